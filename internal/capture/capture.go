@@ -0,0 +1,267 @@
+// Package capture writes the SIP messages and RTP packets of calls to pcap
+// or pcapng files, one per call, for reading in Wireshark when S2
+// misbehaves.
+package capture
+
+import (
+    "bufio"
+    "fmt"
+    "log"
+    "math/rand"
+    "net"
+    "os"
+    "path/filepath"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+)
+
+// Config sets which calls are captured and how long their files are kept.
+type Config struct {
+    Dir          string
+    Format       string        // pcap or pcapng
+    SampleRate   float64       // percent of calls captured
+    MaxFileSize  int64         // bytes per call, later packets are dropped; 0 for no limit
+    MaxTotalSize int64         // bytes of all captures, the oldest are removed beyond it; 0 for no limit
+    MaxAge       time.Duration // captures older are removed; 0 to keep them
+}
+
+// File is a finished capture.
+type File struct {
+    CallID  string    `json:"call_id"`
+    Name    string    `json:"name"`
+    Size    int64     `json:"size"`
+    ModTime time.Time `json:"mod_time"`
+}
+
+// Capturer starts the captures of sampled calls and rotates finished ones
+// out of its directory by total size and age.
+type Capturer struct {
+    config Config
+    writer packetWriter
+    ext    string
+
+    mu       sync.Mutex
+    finished []File // oldest first
+    total    int64
+}
+
+// New creates the capture directory and indexes the captures already in it.
+func New(config Config) (*Capturer, error) {
+    c := &Capturer{config: config}
+    switch config.Format {
+    case "", "pcap":
+        c.writer, c.ext = pcapWriter{}, ".pcap"
+    case "pcapng":
+        c.writer, c.ext = pcapngWriter{}, ".pcapng"
+    default:
+        return nil, fmt.Errorf("capture: unknown format %q", config.Format)
+    }
+    if err := os.MkdirAll(config.Dir, 0o755); err != nil {
+        return nil, fmt.Errorf("capture: %v", err)
+    }
+
+    entries, err := os.ReadDir(config.Dir)
+    if err != nil {
+        return nil, fmt.Errorf("capture: %v", err)
+    }
+    for _, entry := range entries {
+        ext := filepath.Ext(entry.Name())
+        if entry.IsDir() || (ext != ".pcap" && ext != ".pcapng") {
+            continue
+        }
+        info, err := entry.Info()
+        if err != nil {
+            continue
+        }
+        c.finished = append(c.finished, File{
+            CallID:  strings.TrimSuffix(entry.Name(), ext),
+            Name:    entry.Name(),
+            Size:    info.Size(),
+            ModTime: info.ModTime(),
+        })
+        c.total += info.Size()
+    }
+    sort.Slice(c.finished, func(i, j int) bool {
+        return c.finished[i].ModTime.Before(c.finished[j].ModTime)
+    })
+
+    c.mu.Lock()
+    c.rotate(time.Now())
+    c.mu.Unlock()
+    return c, nil
+}
+
+// Start opens the capture of a call, or returns nil when the call is not
+// sampled or the file cannot be created.
+func (c *Capturer) Start(callID string) *Call {
+    if c == nil || rand.Float64()*100 >= c.config.SampleRate {
+        return nil
+    }
+
+    name := fileName(callID) + c.ext
+    f, err := os.Create(filepath.Join(c.config.Dir, name))
+    if err != nil {
+        log.Printf("[CAPTURE] Cannot capture call %s: %v", callID, err)
+        return nil
+    }
+    call := &Call{
+        capturer: c,
+        callID:   callID,
+        name:     name,
+        file:     f,
+        buffer:   bufio.NewWriter(f),
+    }
+    call.writeErr = c.writer.writeHeader(call.buffer)
+    return call
+}
+
+// Find returns the path of the finished capture of a call.
+func (c *Capturer) Find(callID string) (string, bool) {
+    name := fileName(callID)
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    for _, f := range c.finished {
+        if f.CallID == name {
+            return filepath.Join(c.config.Dir, f.Name), true
+        }
+    }
+    return "", false
+}
+
+// Files returns the finished captures, newest first.
+func (c *Capturer) Files() []File {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    files := make([]File, len(c.finished))
+    for i, f := range c.finished {
+        files[len(files)-1-i] = f
+    }
+    return files
+}
+
+// finish adds a closed capture to the index and rotates old ones out.
+func (c *Capturer) finish(f File) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    c.finished = append(c.finished, f)
+    c.total += f.Size
+    c.rotate(f.ModTime)
+}
+
+// rotate removes the oldest captures while they exceed the total size or
+// the age limit. Called with c.mu held.
+func (c *Capturer) rotate(now time.Time) {
+    for len(c.finished) > 0 {
+        oldest := c.finished[0]
+        tooBig := c.config.MaxTotalSize > 0 && c.total > c.config.MaxTotalSize
+        tooOld := c.config.MaxAge > 0 && now.Sub(oldest.ModTime) > c.config.MaxAge
+        if !tooBig && !tooOld {
+            return
+        }
+        if err := os.Remove(filepath.Join(c.config.Dir, oldest.Name)); err != nil && !os.IsNotExist(err) {
+            log.Printf("[CAPTURE] Cannot remove %s: %v", oldest.Name, err)
+        }
+        c.finished = c.finished[1:]
+        c.total -= oldest.Size
+    }
+}
+
+// fileName makes a Call-ID safe to use as a file name.
+func fileName(callID string) string {
+    return strings.Map(func(r rune) rune {
+        switch {
+        case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+            return r
+        case r == '.', r == '-', r == '_', r == '@':
+            return r
+        }
+        return '_'
+    }, callID)
+}
+
+// Call is the capture of one call. Its methods do nothing on a nil Call, so
+// calls that are not sampled need no checks.
+type Call struct {
+    capturer *Capturer
+    callID   string
+    name     string
+
+    mu       sync.Mutex
+    file     *os.File
+    buffer   *bufio.Writer
+    size     int64
+    dropped  int
+    writeErr error
+}
+
+// Packet records a UDP payload sent from src to dst, or a SIP message over
+// TCP or TLS as if it were one.
+func (c *Call) Packet(src, dst net.Addr, payload []byte) {
+    if c == nil {
+        return
+    }
+    packet := udpPacket(udpAddr(src), udpAddr(dst), payload)
+    now := time.Now()
+
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    if c.file == nil || c.writeErr != nil {
+        return
+    }
+    if limit := c.capturer.config.MaxFileSize; limit > 0 && c.size+int64(len(packet)) > limit {
+        c.dropped++
+        return
+    }
+    c.writeErr = c.capturer.writer.writePacket(c.buffer, now, packet)
+    c.size += int64(len(packet))
+}
+
+// Close writes out the capture and hands it to the capturer for download
+// and rotation.
+func (c *Call) Close() {
+    if c == nil {
+        return
+    }
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    if c.file == nil {
+        return
+    }
+
+    err := c.writeErr
+    if flushErr := c.buffer.Flush(); err == nil {
+        err = flushErr
+    }
+    info, statErr := c.file.Stat()
+    c.file.Close()
+    c.file = nil
+    if err == nil {
+        err = statErr
+    }
+    if err != nil {
+        log.Printf("[CAPTURE] Error writing capture of call %s: %v", c.callID, err)
+        os.Remove(filepath.Join(c.capturer.config.Dir, c.name))
+        return
+    }
+    if c.dropped > 0 {
+        log.Printf("[CAPTURE] Call %s: Dropped %d packets over the file size limit", c.callID, c.dropped)
+    }
+    c.capturer.finish(File{CallID: fileName(c.callID), Name: c.name, Size: info.Size(), ModTime: info.ModTime()})
+}
+
+// udpAddr returns the IP and port of a UDP or TCP address.
+func udpAddr(addr net.Addr) *net.UDPAddr {
+    switch a := addr.(type) {
+    case *net.UDPAddr:
+        if a != nil {
+            return a
+        }
+    case *net.TCPAddr:
+        if a != nil {
+            return &net.UDPAddr{IP: a.IP, Port: a.Port}
+        }
+    }
+    return &net.UDPAddr{}
+}
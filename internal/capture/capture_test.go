@@ -0,0 +1,183 @@
+package capture
+
+import (
+    "bytes"
+    "net"
+    "os"
+    "path/filepath"
+    "testing"
+    "time"
+)
+
+var (
+    sipAddr = &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 5060}
+    s2Addr  = &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 5060}
+)
+
+func newCapturer(t *testing.T, config Config) *Capturer {
+    t.Helper()
+    if config.Dir == "" {
+        config.Dir = t.TempDir()
+    }
+    config.SampleRate = 100
+    c, err := New(config)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return c
+}
+
+func TestCapture(t *testing.T) {
+    c := newCapturer(t, Config{Format: "pcapng"})
+    call := c.Start("abc/def@host")
+    if call == nil {
+        t.Fatal("call not captured at a sample rate of 100%")
+    }
+    tcp := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 5061}
+    call.Packet(sipAddr, s2Addr, []byte("INVITE"))
+    call.Packet(tcp, sipAddr, []byte("SIP/2.0 200 OK"))
+    if _, ok := c.Find("abc/def@host"); ok {
+        t.Error("found a capture still being written")
+    }
+    call.Close()
+    call.Close()
+
+    path, ok := c.Find("abc/def@host")
+    if !ok || filepath.Base(path) != "abc_def@host.pcapng" {
+        t.Fatalf("found %q, %v; want abc_def@host.pcapng", path, ok)
+    }
+    data, err := os.ReadFile(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    blocks := readPcapng(t, data)
+    if len(blocks) != 4 {
+        t.Fatalf("%d blocks, want a header, an interface and 2 packets", len(blocks))
+    }
+    for i, want := range []struct {
+        src, dst *net.UDPAddr
+        payload  string
+    }{
+        {sipAddr, s2Addr, "INVITE"},
+        {&net.UDPAddr{IP: tcp.IP, Port: tcp.Port}, sipAddr, "SIP/2.0 200 OK"},
+    } {
+        packet := blocks[2+i].body[20:]
+        if expected := udpPacket(want.src, want.dst, []byte(want.payload)); !bytes.HasPrefix(packet, expected) {
+            t.Errorf("packet %d is %x, want %x", i, packet, expected)
+        }
+    }
+
+    files := c.Files()
+    if len(files) != 1 || files[0].CallID != "abc_def@host" || files[0].Size != int64(len(data)) {
+        t.Errorf("files %+v, want the one of %d bytes", files, len(data))
+    }
+}
+
+func TestCaptureNotSampled(t *testing.T) {
+    c, err := New(Config{Dir: t.TempDir()})
+    if err != nil {
+        t.Fatal(err)
+    }
+    call := c.Start("call")
+    if call != nil {
+        t.Fatal("call captured at a sample rate of 0")
+    }
+    // A nil call and capturer do nothing
+    call.Packet(sipAddr, s2Addr, []byte("INVITE"))
+    call.Close()
+    if (*Capturer)(nil).Start("call") != nil {
+        t.Error("nil capturer started a capture")
+    }
+}
+
+func TestMaxFileSize(t *testing.T) {
+    // One packet of 28 + 100 bytes fits, the second does not; the file
+    // header does not count
+    c := newCapturer(t, Config{MaxFileSize: 200})
+    call := c.Start("call")
+    payload := make([]byte, 100)
+    call.Packet(sipAddr, s2Addr, payload)
+    call.Packet(sipAddr, s2Addr, payload)
+    call.Close()
+
+    files := c.Files()
+    if want := int64(24 + 16 + 128); len(files) != 1 || files[0].Size != want {
+        t.Errorf("files %+v, want one of %d bytes", files, want)
+    }
+}
+
+func TestRotate(t *testing.T) {
+    dir := t.TempDir()
+    now := time.Now()
+    ages := map[string]time.Duration{
+        "new.pcap":     0,
+        "old.pcap":     time.Hour,
+        "older.pcapng": 2 * time.Hour,
+        "notes.txt":    3 * time.Hour,
+    }
+    for name, age := range ages {
+        path := filepath.Join(dir, name)
+        if err := os.WriteFile(path, make([]byte, 100), 0o644); err != nil {
+            t.Fatal(err)
+        }
+        if err := os.Chtimes(path, now.Add(-age), now.Add(-age)); err != nil {
+            t.Fatal(err)
+        }
+    }
+
+    // Existing captures are indexed oldest first, and those past the age
+    // limit removed at once
+    c := newCapturer(t, Config{Dir: dir, MaxAge: 90 * time.Minute, MaxTotalSize: 600})
+    if _, err := os.Stat(filepath.Join(dir, "older.pcapng")); !os.IsNotExist(err) {
+        t.Errorf("capture 2 hours old kept: %v", err)
+    }
+    if _, err := os.Stat(filepath.Join(dir, "notes.txt")); err != nil {
+        t.Errorf("other file removed: %v", err)
+    }
+    names := func() []string {
+        var names []string
+        for _, f := range c.Files() {
+            names = append(names, f.Name)
+        }
+        return names
+    }
+    if got := names(); len(got) != 2 || got[0] != "new.pcap" || got[1] != "old.pcap" {
+        t.Fatalf("files %v, want new.pcap and old.pcap", got)
+    }
+
+    // Each capture is 24 + 16 + 28 + 200 bytes, so the second one takes the
+    // total of 736 bytes over 600 and the two oldest files go
+    for _, id := range []string{"a", "b"} {
+        call := c.Start(id)
+        call.Packet(sipAddr, s2Addr, make([]byte, 200))
+        call.Close()
+    }
+    if got := names(); len(got) != 2 || got[0] != "b.pcap" || got[1] != "a.pcap" {
+        t.Errorf("files %v, want b.pcap and a.pcap", got)
+    }
+    for _, name := range []string{"old.pcap", "new.pcap"} {
+        if _, err := os.Stat(filepath.Join(dir, name)); !os.IsNotExist(err) {
+            t.Errorf("%s kept over the total size: %v", name, err)
+        }
+    }
+}
+
+func TestNewUnknownFormat(t *testing.T) {
+    if _, err := New(Config{Dir: t.TempDir(), Format: "erf"}); err == nil {
+        t.Error("created a capturer writing erf")
+    }
+}
+
+func TestFileName(t *testing.T) {
+    tests := map[string]string{
+        "a84b4c76e66710@pc33.atlanta.com": "a84b4c76e66710@pc33.atlanta.com",
+        "../../etc/passwd":                ".._.._etc_passwd",
+        "id with spaces/and:colons":       "id_with_spaces_and_colons",
+        "ünïcode":                         "_n_code",
+    }
+    for callID, want := range tests {
+        if got := fileName(callID); got != want {
+            t.Errorf("fileName(%q) = %q, want %q", callID, got, want)
+        }
+    }
+}
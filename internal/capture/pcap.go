@@ -0,0 +1,164 @@
+package capture
+
+import (
+    "encoding/binary"
+    "io"
+    "net"
+    "time"
+)
+
+// Packets are written as raw IP datagrams, without a link layer header.
+const (
+    linkTypeRaw = 101
+    snapLength  = 65535
+)
+
+// packetWriter writes packets to a capture file in one of its formats.
+type packetWriter interface {
+    writeHeader(w io.Writer) error
+    writePacket(w io.Writer, at time.Time, packet []byte) error
+}
+
+// pcapWriter writes the classic libpcap format, in little endian with
+// microsecond timestamps.
+type pcapWriter struct{}
+
+func (pcapWriter) writeHeader(w io.Writer) error {
+    b := binary.LittleEndian.AppendUint32(nil, 0xa1b2c3d4)
+    b = binary.LittleEndian.AppendUint16(b, 2)
+    b = binary.LittleEndian.AppendUint16(b, 4)
+    b = binary.LittleEndian.AppendUint32(b, 0) // GMT
+    b = binary.LittleEndian.AppendUint32(b, 0) // timestamp accuracy
+    b = binary.LittleEndian.AppendUint32(b, snapLength)
+    b = binary.LittleEndian.AppendUint32(b, linkTypeRaw)
+    _, err := w.Write(b)
+    return err
+}
+
+func (pcapWriter) writePacket(w io.Writer, at time.Time, packet []byte) error {
+    b := binary.LittleEndian.AppendUint32(make([]byte, 0, 16+len(packet)), uint32(at.Unix()))
+    b = binary.LittleEndian.AppendUint32(b, uint32(at.Nanosecond()/1000))
+    b = binary.LittleEndian.AppendUint32(b, uint32(len(packet)))
+    b = binary.LittleEndian.AppendUint32(b, uint32(len(packet)))
+    b = append(b, packet...)
+    _, err := w.Write(b)
+    return err
+}
+
+// pcapngWriter writes the pcapng format: a section header, one interface and
+// an enhanced packet block per packet, with the default microsecond
+// timestamps.
+type pcapngWriter struct{}
+
+func (pcapngWriter) writeHeader(w io.Writer) error {
+    // Section header block, of unspecified section length
+    b := binary.LittleEndian.AppendUint32(nil, 0x0a0d0d0a)
+    b = binary.LittleEndian.AppendUint32(b, 28)
+    b = binary.LittleEndian.AppendUint32(b, 0x1a2b3c4d)
+    b = binary.LittleEndian.AppendUint16(b, 1)
+    b = binary.LittleEndian.AppendUint16(b, 0)
+    b = binary.LittleEndian.AppendUint64(b, 0xffffffffffffffff)
+    b = binary.LittleEndian.AppendUint32(b, 28)
+
+    // Interface description block
+    b = binary.LittleEndian.AppendUint32(b, 1)
+    b = binary.LittleEndian.AppendUint32(b, 20)
+    b = binary.LittleEndian.AppendUint16(b, linkTypeRaw)
+    b = binary.LittleEndian.AppendUint16(b, 0)
+    b = binary.LittleEndian.AppendUint32(b, snapLength)
+    b = binary.LittleEndian.AppendUint32(b, 20)
+    _, err := w.Write(b)
+    return err
+}
+
+func (pcapngWriter) writePacket(w io.Writer, at time.Time, packet []byte) error {
+    padded := (len(packet) + 3) &^ 3
+    length := uint32(32 + padded)
+    micros := uint64(at.UnixMicro())
+
+    b := binary.LittleEndian.AppendUint32(make([]byte, 0, length), 6)
+    b = binary.LittleEndian.AppendUint32(b, length)
+    b = binary.LittleEndian.AppendUint32(b, 0) // interface
+    b = binary.LittleEndian.AppendUint32(b, uint32(micros>>32))
+    b = binary.LittleEndian.AppendUint32(b, uint32(micros))
+    b = binary.LittleEndian.AppendUint32(b, uint32(len(packet)))
+    b = binary.LittleEndian.AppendUint32(b, uint32(len(packet)))
+    b = append(b, packet...)
+    b = append(b, make([]byte, padded-len(packet))...)
+    b = binary.LittleEndian.AppendUint32(b, length)
+    _, err := w.Write(b)
+    return err
+}
+
+// udpPacket wraps a payload in synthetic IP and UDP headers from src to dst,
+// IPv6 when either address is. Messages S1 sent over TCP or TLS are also
+// captured as UDP, decrypted.
+func udpPacket(src, dst *net.UDPAddr, payload []byte) []byte {
+    srcIP, dstIP := src.IP.To4(), dst.IP.To4()
+    v6 := srcIP == nil || dstIP == nil
+    if v6 {
+        srcIP, dstIP = src.IP.To16(), dst.IP.To16()
+        if srcIP == nil {
+            srcIP = net.IPv6unspecified
+        }
+        if dstIP == nil {
+            dstIP = net.IPv6unspecified
+        }
+    }
+
+    udpLength := 8 + len(payload)
+    var b []byte
+    if v6 {
+        b = make([]byte, 40, 40+udpLength)
+        b[0] = 0x60
+        binary.BigEndian.PutUint16(b[4:], uint16(udpLength))
+        b[6] = 17 // UDP
+        b[7] = 64 // hop limit
+        copy(b[8:], srcIP)
+        copy(b[24:], dstIP)
+    } else {
+        b = make([]byte, 20, 20+udpLength)
+        b[0] = 0x45
+        binary.BigEndian.PutUint16(b[2:], uint16(20+udpLength))
+        binary.BigEndian.PutUint16(b[6:], 0x4000) // don't fragment
+        b[8] = 64                                 // TTL
+        b[9] = 17                                 // UDP
+        copy(b[12:], srcIP)
+        copy(b[16:], dstIP)
+        binary.BigEndian.PutUint16(b[10:], ^uint16(checksum(0, b)))
+    }
+    header := len(b)
+
+    b = binary.BigEndian.AppendUint16(b, uint16(src.Port))
+    b = binary.BigEndian.AppendUint16(b, uint16(dst.Port))
+    b = binary.BigEndian.AppendUint16(b, uint16(udpLength))
+    b = binary.BigEndian.AppendUint16(b, 0)
+    b = append(b, payload...)
+
+    // The UDP checksum covers a pseudo header of the addresses, protocol
+    // and length (RFC 768, RFC 8200 section 8.1)
+    sum := checksum(0, srcIP)
+    sum = checksum(sum, dstIP)
+    sum += 17 + uint32(udpLength)
+    udpSum := ^uint16(checksum(sum, b[header:]))
+    if udpSum == 0 {
+        udpSum = 0xffff
+    }
+    binary.BigEndian.PutUint16(b[header+6:], udpSum)
+    return b
+}
+
+// checksum adds b to a ones' complement sum of 16 bit words, folded to 16
+// bits.
+func checksum(sum uint32, b []byte) uint32 {
+    for i := 0; i+1 < len(b); i += 2 {
+        sum += uint32(b[i])<<8 | uint32(b[i+1])
+    }
+    if len(b)%2 == 1 {
+        sum += uint32(b[len(b)-1]) << 8
+    }
+    for sum > 0xffff {
+        sum = sum&0xffff + sum>>16
+    }
+    return sum
+}
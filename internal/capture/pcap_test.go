@@ -0,0 +1,247 @@
+package capture
+
+import (
+    "bytes"
+    "encoding/binary"
+    "net"
+    "testing"
+    "time"
+)
+
+// onesComplementSum is the Internet checksum (RFC 1071) of the
+// concatenated buffers, not yet complemented.
+func onesComplementSum(buffers ...[]byte) uint16 {
+    var all []byte
+    for _, b := range buffers {
+        all = append(all, b...)
+    }
+    if len(all)%2 == 1 {
+        all = append(all, 0)
+    }
+    sum := 0
+    for i := 0; i < len(all); i += 2 {
+        sum += int(binary.BigEndian.Uint16(all[i:]))
+        sum = sum&0xffff + sum>>16
+    }
+    return uint16(sum)
+}
+
+func TestChecksum(t *testing.T) {
+    // The example of RFC 1071 section 3
+    if got := checksum(0, []byte{0x00, 0x01, 0xf2, 0x03, 0xf4, 0xf5, 0xf6, 0xf7}); got != 0xddf2 {
+        t.Errorf("sum %#x, want 0xddf2", got)
+    }
+    if got := checksum(0, []byte{0xff, 0xff, 0x00, 0x01, 0x80}); got != 0x8001 {
+        t.Errorf("odd length sum %#x, want 0x8001", got)
+    }
+}
+
+func TestUDPPacketIPv4(t *testing.T) {
+    src := &net.UDPAddr{IP: net.ParseIP("192.168.0.1"), Port: 5060}
+    dst := &net.UDPAddr{IP: net.ParseIP("192.168.0.199"), Port: 5080}
+    payload := bytes.Repeat([]byte{'x'}, 87)
+
+    packet := udpPacket(src, dst, payload)
+    if len(packet) != 20+8+87 {
+        t.Fatalf("packet of %d bytes, want %d", len(packet), 20+8+87)
+    }
+
+    // The widely quoted IPv4 header of 115 bytes from 192.168.0.1 to
+    // 192.168.0.199 has the checksum 0xb861
+    ip := packet[:20]
+    want := []byte{0x45, 0, 0, 115, 0, 0, 0x40, 0, 64, 17, 0xb8, 0x61, 192, 168, 0, 1, 192, 168, 0, 199}
+    if !bytes.Equal(ip, want) {
+        t.Errorf("IP header %x, want %x", ip, want)
+    }
+
+    udp := packet[20:]
+    if binary.BigEndian.Uint16(udp[0:]) != 5060 || binary.BigEndian.Uint16(udp[2:]) != 5080 || binary.BigEndian.Uint16(udp[4:]) != 8+87 {
+        t.Errorf("UDP header %x", udp[:8])
+    }
+    pseudo := append(append([]byte(nil), ip[12:20]...), 0, 17, 0, byte(len(udp)))
+    if sum := onesComplementSum(pseudo, udp); sum != 0xffff {
+        t.Errorf("UDP checksum %#x does not verify, sums to %#x", binary.BigEndian.Uint16(udp[6:]), sum)
+    }
+    if !bytes.Equal(udp[8:], payload) {
+        t.Error("payload changed")
+    }
+}
+
+func TestUDPPacketIPv6(t *testing.T) {
+    tests := []struct {
+        name     string
+        src, dst *net.UDPAddr
+        srcIP    net.IP
+        dstIP    net.IP
+    }{
+        {
+            name:  "IPv6",
+            src:   &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 10000},
+            dst:   &net.UDPAddr{IP: net.ParseIP("2001:db8::2"), Port: 20000},
+            srcIP: net.ParseIP("2001:db8::1"),
+            dstIP: net.ParseIP("2001:db8::2"),
+        },
+        {
+            name:  "IPv4 to IPv6 as mapped",
+            src:   &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 10000},
+            dst:   &net.UDPAddr{IP: net.ParseIP("2001:db8::2"), Port: 20000},
+            srcIP: net.ParseIP("::ffff:10.0.0.1"),
+            dstIP: net.ParseIP("2001:db8::2"),
+        },
+        {
+            name:  "unknown source",
+            src:   &net.UDPAddr{},
+            dst:   &net.UDPAddr{IP: net.ParseIP("2001:db8::2"), Port: 20000},
+            srcIP: net.IPv6unspecified,
+            dstIP: net.ParseIP("2001:db8::2"),
+        },
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            payload := []byte("odd length payload")
+            packet := udpPacket(tt.src, tt.dst, payload)
+            if len(packet) != 40+8+len(payload) {
+                t.Fatalf("packet of %d bytes", len(packet))
+            }
+            ip, udp := packet[:40], packet[40:]
+            if ip[0] != 0x60 || binary.BigEndian.Uint16(ip[4:]) != uint16(len(udp)) || ip[6] != 17 {
+                t.Errorf("IPv6 header %x", ip[:8])
+            }
+            if !net.IP(ip[8:24]).Equal(tt.srcIP) || !net.IP(ip[24:40]).Equal(tt.dstIP) {
+                t.Errorf("from %v to %v, want %v to %v", net.IP(ip[8:24]), net.IP(ip[24:40]), tt.srcIP, tt.dstIP)
+            }
+
+            // RFC 8200 section 8.1: addresses, upper-layer length and next
+            // header
+            pseudo := append(append([]byte(nil), ip[8:40]...), 0, 0, 0, byte(len(udp)), 0, 0, 0, 17)
+            if sum := onesComplementSum(pseudo, udp); sum != 0xffff {
+                t.Errorf("UDP checksum %#x does not verify, sums to %#x", binary.BigEndian.Uint16(udp[6:]), sum)
+            }
+            if binary.BigEndian.Uint16(udp[6:]) == 0 {
+                t.Error("UDP checksum 0, which IPv6 forbids")
+            }
+        })
+    }
+}
+
+func TestPcap(t *testing.T) {
+    var buf bytes.Buffer
+    w := pcapWriter{}
+    if err := w.writeHeader(&buf); err != nil {
+        t.Fatal(err)
+    }
+    at := time.Unix(1700000000, 123456789)
+    packets := [][]byte{[]byte("first"), bytes.Repeat([]byte{1}, 1500)}
+    for _, p := range packets {
+        if err := w.writePacket(&buf, at, p); err != nil {
+            t.Fatal(err)
+        }
+    }
+
+    b := buf.Bytes()
+    header := []uint32{0xa1b2c3d4, 4<<16 | 2, 0, 0, snapLength, linkTypeRaw}
+    for i, want := range header {
+        if got := binary.LittleEndian.Uint32(b[4*i:]); got != want {
+            t.Errorf("header word %d is %#x, want %#x", i, got, want)
+        }
+    }
+    b = b[24:]
+    for i, p := range packets {
+        if len(b) < 16 {
+            t.Fatalf("record %d missing", i)
+        }
+        seconds := binary.LittleEndian.Uint32(b)
+        micros := binary.LittleEndian.Uint32(b[4:])
+        captured := binary.LittleEndian.Uint32(b[8:])
+        original := binary.LittleEndian.Uint32(b[12:])
+        if seconds != 1700000000 || micros != 123456 || int(captured) != len(p) || original != captured {
+            t.Errorf("record %d: %d.%06d, %d of %d bytes", i, seconds, micros, captured, original)
+        }
+        if !bytes.Equal(b[16:16+captured], p) {
+            t.Errorf("record %d: data differs", i)
+        }
+        b = b[16+captured:]
+    }
+    if len(b) != 0 {
+        t.Errorf("%d bytes left over", len(b))
+    }
+}
+
+// pcapngBlock is a block of a pcapng file.
+type pcapngBlock struct {
+    typ  uint32
+    body []byte
+}
+
+// readPcapng splits a pcapng file into blocks, checking that every block is
+// a multiple of 4 bytes long and repeats its length at the end.
+func readPcapng(t *testing.T, b []byte) []pcapngBlock {
+    t.Helper()
+    var blocks []pcapngBlock
+    for len(b) > 0 {
+        if len(b) < 12 {
+            t.Fatalf("%d bytes after the last block", len(b))
+        }
+        typ := binary.LittleEndian.Uint32(b)
+        length := binary.LittleEndian.Uint32(b[4:])
+        if length%4 != 0 || int(length) > len(b) || length < 12 {
+            t.Fatalf("block %#x of length %d in %d bytes", typ, length, len(b))
+        }
+        if trailer := binary.LittleEndian.Uint32(b[length-4:]); trailer != length {
+            t.Fatalf("block %#x of length %d ends with %d", typ, length, trailer)
+        }
+        blocks = append(blocks, pcapngBlock{typ, b[8 : length-4]})
+        b = b[length:]
+    }
+    return blocks
+}
+
+func TestPcapng(t *testing.T) {
+    var buf bytes.Buffer
+    w := pcapngWriter{}
+    if err := w.writeHeader(&buf); err != nil {
+        t.Fatal(err)
+    }
+    at := time.Unix(1700000000, 123456789)
+    // Lengths needing 0 to 3 bytes of padding
+    packets := [][]byte{[]byte("1234"), []byte("12345"), []byte("123456"), []byte("1234567")}
+    for _, p := range packets {
+        if err := w.writePacket(&buf, at, p); err != nil {
+            t.Fatal(err)
+        }
+    }
+
+    blocks := readPcapng(t, buf.Bytes())
+    if len(blocks) != 2+len(packets) {
+        t.Fatalf("%d blocks, want %d", len(blocks), 2+len(packets))
+    }
+
+    shb := blocks[0]
+    if shb.typ != 0x0a0d0d0a || binary.LittleEndian.Uint32(shb.body) != 0x1a2b3c4d ||
+        binary.LittleEndian.Uint16(shb.body[4:]) != 1 || binary.LittleEndian.Uint64(shb.body[8:]) != 0xffffffffffffffff {
+        t.Errorf("section header %#x %x", shb.typ, shb.body)
+    }
+    idb := blocks[1]
+    if idb.typ != 1 || binary.LittleEndian.Uint16(idb.body) != linkTypeRaw || binary.LittleEndian.Uint32(idb.body[4:]) != snapLength {
+        t.Errorf("interface description %#x %x", idb.typ, idb.body)
+    }
+
+    for i, p := range packets {
+        epb := blocks[2+i]
+        if epb.typ != 6 {
+            t.Errorf("packet %d in block %#x", i, epb.typ)
+            continue
+        }
+        micros := uint64(binary.LittleEndian.Uint32(epb.body[4:]))<<32 | uint64(binary.LittleEndian.Uint32(epb.body[8:]))
+        captured := binary.LittleEndian.Uint32(epb.body[12:])
+        original := binary.LittleEndian.Uint32(epb.body[16:])
+        if binary.LittleEndian.Uint32(epb.body) != 0 || micros != 1700000000123456 || int(captured) != len(p) || original != captured {
+            t.Errorf("packet %d: interface %d at %d µs, %d of %d bytes", i, binary.LittleEndian.Uint32(epb.body), micros, captured, original)
+        }
+        data := epb.body[20:]
+        if len(data) != (len(p)+3)&^3 || !bytes.Equal(data[:len(p)], p) || !bytes.Equal(data[len(p):], make([]byte, len(data)-len(p))) {
+            t.Errorf("packet %d: data %x, want %x padded with zeros", i, data, p)
+        }
+    }
+}
@@ -2,8 +2,13 @@ package config
 
 import (
    "encoding/json"
+   "fmt"
+   "net"
    "os"
+   "strconv"
+   "strings"
    
+   "github.com/s1-callgen/internal/media"
    "github.com/s1-callgen/internal/models"
 )
 
@@ -20,7 +25,45 @@ func LoadConfig(filename string) (*models.Config, error) {
        return nil, err
    }
    
+   if address := config.Local.Address; address != "" && net.ParseIP(address) == nil {
+       return nil, fmt.Errorf("local address %q is not an IP address", address)
+   }
+   
    // Set defaults
+   if config.Local.Port == 0 {
+       config.Local.Port = 5070
+   }
+   if config.Local.Sockets == 0 {
+       config.Local.Sockets = 1
+   }
+   if len(config.S2Targets) == 0 {
+       config.S2Targets = []models.S2Target{config.S2Server}
+   }
+   for i := range config.S2Targets {
+       target := &config.S2Targets[i]
+       host, err := validateHost(target.Host, config.Local.Address)
+       if err != nil {
+           return nil, fmt.Errorf("s2 target %q: %v", target.Host, err)
+       }
+       target.Host = host
+       if target.Name == "" && target.Port == 0 {
+           target.Name = target.Host
+       } else if target.Name == "" {
+           target.Name = net.JoinHostPort(target.Host, strconv.Itoa(target.Port))
+       }
+       if target.Weight <= 0 {
+           target.Weight = 1
+       }
+   }
+   if config.HealthCheck.Interval == 0 {
+       config.HealthCheck.Interval = 30
+   }
+   if config.HealthCheck.Threshold == 0 {
+       config.HealthCheck.Threshold = 2
+   }
+   if config.HealthCheck.HoldDown == 0 {
+       config.HealthCheck.HoldDown = 30
+   }
    if config.CallParams.ACDMin == 0 {
        config.CallParams.ACDMin = 30
    }
@@ -36,6 +79,129 @@ func LoadConfig(filename string) (*models.Config, error) {
    if config.CallParams.CallsPerSecond == 0 {
        config.CallParams.CallsPerSecond = 1
    }
+   if config.CallParams.PostDialDelay.Distribution == "" {
+       config.CallParams.PostDialDelay.Distribution = "fixed"
+   }
+   if config.CallParams.PostDialDelay.Mean == 0 {
+       config.CallParams.PostDialDelay.Mean = 5
+   }
+   if len(config.CallParams.Codecs) == 0 {
+       config.CallParams.Codecs = []models.CodecProfile{{Preference: []string{"PCMU", "PCMA"}}}
+   }
+   for i := range config.CallParams.Codecs {
+       profile := &config.CallParams.Codecs[i]
+       if len(profile.Preference) == 0 {
+           return nil, fmt.Errorf("codec profile %d: no codecs", i+1)
+       }
+       for _, name := range profile.Preference {
+           if _, err := media.New(name); err != nil {
+               return nil, fmt.Errorf("codec profile %d: %v", i+1, err)
+           }
+       }
+       if profile.Weight <= 0 {
+           profile.Weight = 1
+       }
+   }
+   switch config.Audio.Selection {
+   case "":
+       config.Audio.Selection = "loop"
+   case "loop", "random", "pair":
+   default:
+       return nil, fmt.Errorf("unknown prompt selection %q", config.Audio.Selection)
+   }
+   for _, script := range config.DTMF.Scripts {
+       if _, err := media.ParseDTMFScript(script); err != nil {
+           return nil, err
+       }
+   }
+   switch config.DTMF.Method {
+   case "":
+       config.DTMF.Method = "rfc4733"
+   case "rfc4733", "info":
+   default:
+       return nil, fmt.Errorf("unknown DTMF method %q", config.DTMF.Method)
+   }
+   if config.Capture.Dir == "" {
+       config.Capture.Dir = "captures"
+   }
+   switch config.Capture.Format {
+   case "":
+       config.Capture.Format = "pcap"
+   case "pcap", "pcapng":
+   default:
+       return nil, fmt.Errorf("unknown capture format %q", config.Capture.Format)
+   }
+   if config.Capture.SampleRate == 0 {
+       config.Capture.SampleRate = 100
+   }
+   if config.HEP.Enabled && config.HEP.Address == "" {
+       return nil, fmt.Errorf("HEP enabled without a collector address")
+   }
+   if config.HEP.CaptureID == 0 {
+       config.HEP.CaptureID = 2001
+   }
+   if config.SessionTimers.Expires == 0 {
+       config.SessionTimers.Expires = 1800
+   }
+   if config.SessionTimers.MinSE == 0 {
+       config.SessionTimers.MinSE = 90
+   }
+   if config.SessionTimers.MinSE < 90 || config.SessionTimers.Expires < config.SessionTimers.MinSE {
+       return nil, fmt.Errorf("session timer of %d s below its minimum of %d s, which is at least 90 s",
+           config.SessionTimers.Expires, config.SessionTimers.MinSE)
+   }
+   switch config.SessionTimers.Refresher {
+   case "", "uac", "uas":
+   default:
+       return nil, fmt.Errorf("unknown session refresher %q", config.SessionTimers.Refresher)
+   }
+   switch config.SessionTimers.Method {
+   case "":
+       config.SessionTimers.Method = "update"
+   case "update", "invite":
+   default:
+       return nil, fmt.Errorf("unknown session refresh method %q", config.SessionTimers.Method)
+   }
+   if config.Registration.Expires == 0 {
+       config.Registration.Expires = 3600
+   }
+   for i := range config.Registration.Registrars {
+       registrar := &config.Registration.Registrars[i]
+       host, err := validateHost(registrar.Host, config.Local.Address)
+       if err != nil {
+           return nil, fmt.Errorf("registrar %q: %v", registrar.Host, err)
+       }
+       registrar.Host = host
+   }
+   
+   // Every target has its own sockets
+   if last := config.Local.Port + len(config.S2Targets)*config.Local.Sockets - 1; config.Local.PortRangeEnd < last {
+       config.Local.PortRangeEnd = last
+   }
    
    return config, nil
 }
+
+// validateHost checks the host of an S2 target or registrar: a domain, an
+// IPv4 address, or an IPv6 address, which may be bracketed as in URIs. An IP
+// address must be of the same family as the local address, if one is set.
+// The host is returned without brackets.
+func validateHost(host, localAddress string) (string, error) {
+   if host == "" {
+       return "", fmt.Errorf("missing host")
+   }
+   
+   bracketed := strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]")
+   if bracketed {
+       host = host[1 : len(host)-1]
+   }
+   ip := net.ParseIP(host)
+   if (bracketed || strings.Contains(host, ":")) && (ip == nil || ip.To4() != nil) {
+       return "", fmt.Errorf("invalid IPv6 address")
+   }
+   
+   if local := net.ParseIP(localAddress); ip != nil && local != nil && (ip.To4() == nil) != (local.To4() == nil) {
+       return "", fmt.Errorf("local address %s cannot reach it", localAddress)
+   }
+   return host, nil
+}
@@ -1,55 +1,176 @@
 package generator
 
 import (
+    "context"
     "encoding/csv"
+    "errors"
+    "fmt"
+    "hash/fnv"
+    "io"
     "log"
     "math/rand"
     "net"
     "os"
+    "strings"
     "sync"
+    "sync/atomic"
     "time"
     
+    "github.com/s1-callgen/internal/capture"
+    "github.com/s1-callgen/internal/hep"
+    "github.com/s1-callgen/internal/media"
     "github.com/s1-callgen/internal/models"
     "github.com/s1-callgen/internal/sip"
 )
 
 type Generator struct {
-    config      *models.Config
-    sipClient   *sip.Client
-    numberPairs []models.NumberPair
-    stats       *Statistics
-    mu          sync.RWMutex
-    stopChan    chan bool
-    wg          sync.WaitGroup
+    config       *models.Config
+    targets      *targetPool
+    registration *sip.Registration
+    numberPairs  []models.NumberPair
+    prompts      []*media.Prompt
+    dtmfScripts  []media.DTMFScript
+    capturer     *capture.Capturer // nil when capture is disabled
+    hep          *hep.Sender       // nil when HEP is disabled
+    nextPrompt   atomic.Uint64 // for the loop selection
+    stats        *Statistics
+    mu           sync.RWMutex
+    stopChan     chan bool
+    wg           sync.WaitGroup
 }
 
 type Statistics struct {
     TotalCalls      int64
     SuccessfulCalls int64
     FailedCalls     int64
+    CanceledCalls   int64
+    TimedOutCalls   int64
+    CodecMismatches int64 // calls rejected with 488 or 606, or answered without a common codec
+    RemoteHangups   int64 // answered calls S2 hung up before the chosen duration
     ActiveCalls     int64
+    ResponseCodes   map[int]int64    // final 3xx-6xx responses by status code
+    MediaFailures   map[string]int64 // answered calls failed by the media checks, by reason
+    TotalDuration   int64            // seconds of answered calls
     StartTime       time.Time
-    mu              sync.Mutex
+    
+    // Media quality summed over answered calls S2 sent RTP on, whether or
+    // not they passed the media checks
+    MediaCalls      int64
+    PacketsExpected int64
+    PacketsLost     int64
+    JitterSum       float64 // ms
+    RTTCalls        int64   // calls with a round trip from RTCP
+    RTTSum          float64 // ms
+    MOSSum          float64
+    
+    mu sync.Mutex
 }
 
 func NewGenerator(config *models.Config) (*Generator, error) {
-    // Get local IP
-    localIP := getLocalIP()
-    
-    // Create SIP client
-    sipClient, err := sip.NewClient(localIP, 5070, config.S2Server.Host, config.S2Server.Port)
-    if err != nil {
-        return nil, err
-    }
-    
-    return &Generator{
-        config:    config,
-        sipClient: sipClient,
+    g := &Generator{
+        config: config,
+        targets: &targetPool{
+            holdDown: time.Duration(config.HealthCheck.HoldDown) * time.Second,
+        },
         stats: &Statistics{
-            StartTime: time.Now(),
+            ResponseCodes: make(map[int]int64),
+            MediaFailures: make(map[string]int64),
+            StartTime:     time.Now(),
         },
         stopChan: make(chan bool),
-    }, nil
+    }
+    
+    for _, path := range config.Audio.Prompts {
+        prompt, err := media.LoadWAV(path)
+        if err != nil {
+            return nil, fmt.Errorf("prompt: %v", err)
+        }
+        g.prompts = append(g.prompts, prompt)
+    }
+    if len(g.prompts) > 0 {
+        log.Printf("[GENERATOR] Loaded %d prompts", len(g.prompts))
+    }
+    
+    for _, script := range config.DTMF.Scripts {
+        parsed, err := media.ParseDTMFScript(script)
+        if err != nil {
+            return nil, err
+        }
+        g.dtmfScripts = append(g.dtmfScripts, parsed)
+    }
+    
+    if c := config.Capture; c.Enabled {
+        var err error
+        g.capturer, err = capture.New(capture.Config{
+            Dir:          c.Dir,
+            Format:       c.Format,
+            SampleRate:   c.SampleRate,
+            MaxFileSize:  int64(c.MaxFileSize) << 20,
+            MaxTotalSize: int64(c.MaxTotalSize) << 20,
+            MaxAge:       time.Duration(c.MaxAge) * time.Minute,
+        })
+        if err != nil {
+            return nil, err
+        }
+        log.Printf("[GENERATOR] Capturing %.0f%% of calls to %s", c.SampleRate, c.Dir)
+    }
+    
+    if h := config.HEP; h.Enabled {
+        var err error
+        g.hep, err = hep.Dial(h.Address, h.CaptureID, h.Password)
+        if err != nil {
+            return nil, err
+        }
+        log.Printf("[GENERATOR] Mirroring SIP to HEP collector %s with capture ID %d", h.Address, h.CaptureID)
+    }
+    
+    // Create a SIP client per S2 target. Hosts are located as SIP domains,
+    // sharing one DNS cache.
+    locator := sip.NewLocator(sip.NewDNSResolver())
+    for _, s2 := range config.S2Targets {
+        // Get local IP, of the same family as the target's
+        localIP := config.Local.Address
+        if localIP == "" {
+            localIP = getLocalIP(strings.Contains(s2.Host, ":"))
+        }
+        
+        t, err := newTarget(config, s2, localIP, locator)
+        if err != nil {
+            return nil, err
+        }
+        t.client.SetCapture(g.capturer)
+        t.client.SetHEP(g.hep, config.HEP.RTCP)
+        g.targets.targets = append(g.targets.targets, t)
+    }
+    
+    // The registration goes through the first target
+    if reg := config.Registration; reg.Enabled {
+        primary := config.S2Targets[0]
+        registrars := []sip.Registrar{{Host: primary.Host, Port: primary.Port}}
+        if len(reg.Registrars) > 0 {
+            registrars = registrars[:0]
+            for _, r := range reg.Registrars {
+                registrars = append(registrars, sip.Registrar{Host: r.Host, Port: r.Port})
+            }
+        }
+        
+        var credentials *sip.Credentials
+        if auth := primary.Auth; auth.Username != "" {
+            credentials = &sip.Credentials{
+                Username: auth.Username,
+                Password: auth.Password,
+                Realm:    auth.Realm,
+            }
+        }
+        
+        var err error
+        g.registration, err = g.targets.targets[0].client.NewRegistration(reg.User, reg.Domain, registrars, reg.Expires, credentials)
+        if err != nil {
+            return nil, err
+        }
+    }
+    
+    return g, nil
 }
 
 func (g *Generator) LoadNumbersFromCSV(filename string) error {
@@ -59,7 +180,14 @@ func (g *Generator) LoadNumbersFromCSV(filename string) error {
     }
     defer file.Close()
     
-    reader := csv.NewReader(file)
+    return g.LoadNumbers(file)
+}
+
+// LoadNumbers replaces the number pairs with those read from CSV records of
+// ANI and DNIS.
+func (g *Generator) LoadNumbers(r io.Reader) error {
+    reader := csv.NewReader(r)
+    reader.FieldsPerRecord = -1
     records, err := reader.ReadAll()
     if err != nil {
         return err
@@ -96,8 +224,29 @@ func (g *Generator) LoadTestNumbers() {
 }
 
 func (g *Generator) Start() error {
-    if err := g.sipClient.Connect(); err != nil {
-        return err
+    // A target that cannot be reached yet stays out of rotation until the
+    // health checks, or reconnect when they are off, connect it
+    connected := 0
+    for _, t := range g.targets.targets {
+        if err := t.client.Connect(); err != nil {
+            log.Printf("[GENERATOR] Target %s: %v", t.config.Name, err)
+            g.targets.mu.Lock()
+            t.healthy = false
+            g.targets.mu.Unlock()
+            continue
+        }
+        g.targets.mu.Lock()
+        t.connected = true
+        g.targets.mu.Unlock()
+        connected++
+    }
+    if connected == 0 {
+        return fmt.Errorf("no S2 target reachable")
+    }
+    if g.registration != nil {
+        if err := g.registration.Start(); err != nil {
+            return err
+        }
     }
     
     log.Printf("[GENERATOR] Starting call generation")
@@ -114,6 +263,25 @@ func (g *Generator) Start() error {
     g.wg.Add(1)
     go g.reportStatistics()
     
+    // Start health checks
+    hc := g.config.HealthCheck
+    for _, t := range g.targets.targets {
+        switch {
+        case hc.Enabled:
+            g.wg.Add(1)
+            go func(t *target) {
+                defer g.wg.Done()
+                g.targets.healthCheck(t, time.Duration(hc.Interval)*time.Second, hc.Threshold, g.stopChan)
+            }(t)
+        case !t.connected:
+            g.wg.Add(1)
+            go func(t *target) {
+                defer g.wg.Done()
+                g.targets.reconnect(t, time.Duration(hc.Interval)*time.Second, g.stopChan)
+            }(t)
+        }
+    }
+    
     return nil
 }
 
@@ -133,14 +301,25 @@ func (g *Generator) generateCalls() {
                 continue
             }
             
+            // S2 only accepts calls from a registered PBX
+            if g.registration != nil && !g.registration.Registered() {
+                continue
+            }
+            
             // Check concurrent call limit
-            if g.sipClient.GetActiveCallCount() >= g.config.CallParams.MaxConcurrent {
+            if g.targets.activeCalls() >= g.config.CallParams.MaxConcurrent {
+                continue
+            }
+            
+            // Pick a target with capacity left
+            t := g.targets.acquire(nil)
+            if t == nil {
                 continue
             }
             
             // Make a call
             g.wg.Add(1)
-            go g.makeCall()
+            go g.makeCall(t)
             
         case <-g.stopChan:
             return
@@ -148,50 +327,169 @@ func (g *Generator) generateCalls() {
     }
 }
 
-func (g *Generator) makeCall() {
+func (g *Generator) makeCall(t *target) {
     defer g.wg.Done()
     
     // Get random number pair
     g.mu.RLock()
     if len(g.numberPairs) == 0 {
         g.mu.RUnlock()
+        g.targets.abandon(t)
         return
     }
     pair := g.numberPairs[rand.Intn(len(g.numberPairs))]
     g.mu.RUnlock()
     
-    // Determine if call should be answered based on ASR
-    shouldAnswer := rand.Float64()*100 < g.config.CallParams.ASR
-    
     g.stats.mu.Lock()
     g.stats.TotalCalls++
     g.stats.ActiveCalls++
     g.stats.mu.Unlock()
+
+    // Every call goes on the wire. With the ASR policy enabled the caller
+    // gives up on (100-ASR)% of calls while they ring, so S2 only gets the
+    // chance to answer the rest.
+    ctx := context.Background()
+    if g.config.CallParams.EnforceASR && rand.Float64()*100 >= g.config.CallParams.ASR {
+        var cancel context.CancelFunc
+        ctx, cancel = context.WithTimeout(ctx, g.postDialDelay())
+        defer cancel()
+    }
+
+    // Random duration between ACDMin and ACDMax
+    duration := time.Duration(g.config.CallParams.ACDMin+rand.Intn(g.config.CallParams.ACDMax-g.config.CallParams.ACDMin+1)) * time.Second
+
+    opts := sip.CallOptions{
+        Codecs: g.codecProfile().Preference,
+        Prompt: g.prompt(pair),
+    }
+    if len(g.dtmfScripts) > 0 {
+        opts.DTMF = g.dtmfScripts[rand.Intn(len(g.dtmfScripts))]
+        opts.DTMFInfo = g.config.DTMF.Method == "info"
+    }
+
+    // A call S2 rejects with 503 or never answers moves on to the next
+    // target, as a carrier would route-advance
+    tried := []*target{t}
+    call, err := t.client.MakeCall(ctx, pair.ANI, pair.DNIS, duration, opts)
+    for g.targets.release(t, err) && ctx.Err() == nil {
+        if t = g.targets.acquire(tried); t == nil {
+            break
+        }
+        tried = append(tried, t)
+        call, err = t.client.MakeCall(ctx, pair.ANI, pair.DNIS, duration, opts)
+    }
+
+    g.stats.mu.Lock()
+    defer g.stats.mu.Unlock()
+
+    g.stats.ActiveCalls--
+    if call != nil && call.PacketsReceived > 0 {
+        g.stats.MediaCalls++
+        g.stats.PacketsExpected += int64(call.PacketsReceived) + call.PacketsLost
+        g.stats.PacketsLost += call.PacketsLost
+        g.stats.JitterSum += call.Jitter
+        g.stats.MOSSum += call.MOS
+        if call.RTT > 0 {
+            g.stats.RTTCalls++
+            g.stats.RTTSum += call.RTT
+        }
+    }
+    if err == nil {
+        g.stats.SuccessfulCalls++
+        g.stats.TotalDuration += int64(call.Duration)
+        if call.DisconnectedBy == "remote" {
+            g.stats.RemoteHangups++
+        }
+        return
+    }
+
+    g.stats.FailedCalls++
+    if errors.Is(err, sip.ErrCodecMismatch) {
+        g.stats.CodecMismatches++
+    }
+    var rejected *sip.ResponseError
+    var mediaFailure *sip.MediaError
+    switch {
+    case errors.As(err, &mediaFailure):
+        g.stats.MediaFailures[mediaFailure.Reason]++
+    case errors.As(err, &rejected):
+        g.stats.ResponseCodes[rejected.StatusCode]++
+    case errors.Is(err, sip.ErrCanceled):
+        g.stats.CanceledCalls++
+    case errors.Is(err, sip.ErrTimeout):
+        g.stats.TimedOutCalls++
+        log.Printf("[GENERATOR] Call failed: %v", err)
+    default:
+        log.Printf("[GENERATOR] Call failed: %v", err)
+    }
+}
+
+// codecProfile picks the codecs a call offers among the configured profiles,
+// in proportion to their weight.
+func (g *Generator) codecProfile() models.CodecProfile {
+    profiles := g.config.CallParams.Codecs
+    weights := 0
+    for _, profile := range profiles {
+        weights += profile.Weight
+    }
+    if weights <= 0 {
+        return models.CodecProfile{}
+    }
     
-    if shouldAnswer {
-        // Random duration between ACDMin and ACDMax
-        duration := time.Duration(g.config.CallParams.ACDMin+rand.Intn(g.config.CallParams.ACDMax-g.config.CallParams.ACDMin)) * time.Second
-        
-        err := g.sipClient.MakeCall(pair.ANI, pair.DNIS, duration)
-        
-        g.stats.mu.Lock()
-        if err == nil {
-            g.stats.SuccessfulCalls++
-        } else {
-            g.stats.FailedCalls++
-            log.Printf("[GENERATOR] Call failed: %v", err)
+    pick := rand.Intn(weights)
+    for _, profile := range profiles {
+        if pick < profile.Weight {
+            return profile
         }
-        g.stats.ActiveCalls--
-        g.stats.mu.Unlock()
-    } else {
-        // Simulate rejected call
-        time.Sleep(5 * time.Second)
-        
-        g.stats.mu.Lock()
-        g.stats.FailedCalls++
-        g.stats.ActiveCalls--
-        g.stats.mu.Unlock()
+        pick -= profile.Weight
     }
+    return models.CodecProfile{}
+}
+
+// prompt picks the prompt a call plays by the configured selection, or nil
+// for silence.
+func (g *Generator) prompt(pair models.NumberPair) *media.Prompt {
+    if len(g.prompts) == 0 {
+        return nil
+    }
+    
+    switch g.config.Audio.Selection {
+    case "random":
+        return g.prompts[rand.Intn(len(g.prompts))]
+    case "pair":
+        h := fnv.New32a()
+        h.Write([]byte(pair.ANI + "/" + pair.DNIS))
+        return g.prompts[h.Sum32()%uint32(len(g.prompts))]
+    default:
+        return g.prompts[(g.nextPrompt.Add(1)-1)%uint64(len(g.prompts))]
+    }
+}
+
+// postDialDelay draws how long a caller waits for an answer before hanging up
+// from the configured distribution, clamped to [Min, Max] when Max is set.
+func (g *Generator) postDialDelay() time.Duration {
+    pdd := g.config.CallParams.PostDialDelay
+
+    var seconds float64
+    switch pdd.Distribution {
+    case "uniform":
+        seconds = pdd.Min + rand.Float64()*(pdd.Max-pdd.Min)
+    case "normal":
+        seconds = pdd.Mean + rand.NormFloat64()*pdd.StdDev
+    case "exponential":
+        seconds = rand.ExpFloat64() * pdd.Mean
+    default:
+        seconds = pdd.Mean
+    }
+
+    if pdd.Max > 0 && seconds > pdd.Max {
+        seconds = pdd.Max
+    }
+    if seconds < pdd.Min {
+        seconds = pdd.Min
+    }
+
+    return time.Duration(seconds * float64(time.Second))
 }
 
 func (g *Generator) isWithinSchedule() bool {
@@ -220,18 +518,32 @@ func (g *Generator) reportStatistics() {
     for {
         select {
         case <-ticker.C:
-            g.stats.mu.Lock()
-            elapsed := time.Since(g.stats.StartTime)
-            cps := float64(g.stats.TotalCalls) / elapsed.Seconds()
-            asr := float64(0)
-            if g.stats.TotalCalls > 0 {
-                asr = float64(g.stats.SuccessfulCalls) / float64(g.stats.TotalCalls) * 100
+            stats := g.GetStatistics()
+            log.Printf("[STATS] Total: %d, Success: %d (Remote BYE: %d), Failed: %d (Canceled: %d, Timeout: %d, Codec: %d), Active: %d, CPS: %.2f, ASR: %.1f%%",
+                stats.TotalCalls, stats.SuccessfulCalls, stats.RemoteHangups, stats.FailedCalls,
+                stats.CanceledCalls, stats.TimedOutCalls, stats.CodecMismatches,
+                stats.ActiveCalls, stats.CurrentCPS, stats.CurrentASR)
+            if m := stats.Media; m.Calls > 0 {
+                log.Printf("[STATS] Media: Calls: %d, Loss: %.2f%%, Jitter: %.1f ms, RTT: %.1f ms, MOS: %.2f",
+                    m.Calls, m.PacketLoss, m.Jitter, m.RTT, m.MOS)
+            }
+            if len(stats.MediaFailures) > 0 {
+                log.Printf("[STATS] Media failures: No media: %d, One-way: %d, Dead air: %d, SSRC change: %d",
+                    stats.MediaFailures[sip.MediaNoMedia], stats.MediaFailures[sip.MediaOneWayAudio],
+                    stats.MediaFailures[sip.MediaDeadAir], stats.MediaFailures[sip.MediaSSRCChange])
             }
             
-            log.Printf("[STATS] Total: %d, Success: %d, Failed: %d, Active: %d, CPS: %.2f, ASR: %.1f%%",
-                g.stats.TotalCalls, g.stats.SuccessfulCalls, g.stats.FailedCalls,
-                g.stats.ActiveCalls, cps, asr)
-            g.stats.mu.Unlock()
+            if len(g.targets.targets) > 1 {
+                for _, ts := range stats.Targets {
+                    log.Printf("[STATS] Target %s: Healthy: %v, Active: %d, Total: %d, Success: %d, Failed: %d, Failovers: %d",
+                        ts.Name, ts.Healthy, ts.ActiveCalls, ts.TotalCalls, ts.SuccessfulCalls, ts.FailedCalls, ts.Failovers)
+                }
+            }
+            
+            if g.registration != nil {
+                status := g.registration.Status()
+                log.Printf("[STATS] Registration: %s with %s", status.State, status.Registrar)
+            }
             
         case <-g.stopChan:
             return
@@ -242,14 +554,94 @@ func (g *Generator) reportStatistics() {
 func (g *Generator) Stop() {
     close(g.stopChan)
     g.wg.Wait()
-    g.sipClient.Close()
+    if g.registration != nil {
+        g.registration.Stop()
+    }
+    for _, t := range g.targets.targets {
+        t.client.Close()
+    }
+    if g.hep != nil {
+        g.hep.Close()
+    }
 }
 
-func getLocalIP() string {
+// GetStatistics returns the counters of call generation with the rates and
+// media quality derived from them, and those of each S2 target.
+func (g *Generator) GetStatistics() *models.Statistics {
+    g.stats.mu.Lock()
+    defer g.stats.mu.Unlock()
+    
+    now := time.Now()
+    stats := &models.Statistics{
+        TotalCalls:      g.stats.TotalCalls,
+        SuccessfulCalls: g.stats.SuccessfulCalls,
+        FailedCalls:     g.stats.FailedCalls,
+        CanceledCalls:   g.stats.CanceledCalls,
+        TimedOutCalls:   g.stats.TimedOutCalls,
+        CodecMismatches: g.stats.CodecMismatches,
+        RemoteHangups:   g.stats.RemoteHangups,
+        ActiveCalls:     g.stats.ActiveCalls,
+        ResponseCodes:   make(map[int]int64, len(g.stats.ResponseCodes)),
+        MediaFailures:   make(map[string]int64, len(g.stats.MediaFailures)),
+        CurrentCPS:      float64(g.stats.TotalCalls) / now.Sub(g.stats.StartTime).Seconds(),
+        StartTime:       g.stats.StartTime,
+        LastUpdate:      now,
+        Targets:         g.targets.statistics(),
+    }
+    for code, count := range g.stats.ResponseCodes {
+        stats.ResponseCodes[code] = count
+    }
+    for reason, count := range g.stats.MediaFailures {
+        stats.MediaFailures[reason] = count
+    }
+    if g.stats.TotalCalls > 0 {
+        stats.CurrentASR = float64(g.stats.SuccessfulCalls) / float64(g.stats.TotalCalls) * 100
+    }
+    if g.stats.SuccessfulCalls > 0 {
+        stats.AverageCallDuration = float64(g.stats.TotalDuration) / float64(g.stats.SuccessfulCalls)
+    }
+    
+    if calls := g.stats.MediaCalls; calls > 0 {
+        stats.Media.Calls = calls
+        stats.Media.Jitter = g.stats.JitterSum / float64(calls)
+        stats.Media.MOS = g.stats.MOSSum / float64(calls)
+        if g.stats.PacketsExpected > 0 {
+            stats.Media.PacketLoss = float64(g.stats.PacketsLost) / float64(g.stats.PacketsExpected) * 100
+        }
+        if g.stats.RTTCalls > 0 {
+            stats.Media.RTT = g.stats.RTTSum / float64(g.stats.RTTCalls)
+        }
+    }
+    return stats
+}
+
+// Captures returns the capturer of calls, or nil when capture is disabled.
+func (g *Generator) Captures() *capture.Capturer {
+    return g.capturer
+}
+
+// RegistrationStatus returns the state of the registration with S2, or nil
+// when registration is disabled.
+func (g *Generator) RegistrationStatus() *sip.RegistrationStatus {
+    if g.registration == nil {
+        return nil
+    }
+    status := g.registration.Status()
+    return &status
+}
+
+// getLocalIP returns the address of the primary network interface: a global
+// IPv6 address when ipv6 is set, else an IPv4 one.
+func getLocalIP(ipv6 bool) string {
+    fallback := "10.0.0.1"
+    if ipv6 {
+        fallback = "::1"
+    }
+    
     // Try to get the primary network interface IP
     interfaces, err := net.Interfaces()
     if err != nil {
-        return "10.0.0.1"
+        return fallback
     }
     
     for _, iface := range interfaces {
@@ -263,13 +655,16 @@ func getLocalIP() string {
         }
         
         for _, addr := range addrs {
-            if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.To4() != nil {
-                if ipnet.IP.String() != "127.0.0.1" {
-                    return ipnet.IP.String()
-                }
+            ipnet, ok := addr.(*net.IPNet)
+            if !ok || (ipnet.IP.To4() == nil) != ipv6 {
+                continue
+            }
+            // Link-local IPv6 addresses need a zone and do not route
+            if ipnet.IP.IsGlobalUnicast() {
+                return ipnet.IP.String()
             }
         }
     }
     
-    return "10.0.0.1"
+    return fallback
 }
@@ -0,0 +1,322 @@
+package generator
+
+import (
+    "errors"
+    "log"
+    "math/rand"
+    "sync"
+    "time"
+
+    "github.com/s1-callgen/internal/models"
+    "github.com/s1-callgen/internal/sip"
+    "github.com/s1-callgen/internal/sip/message"
+)
+
+// target is an S2 switch with its own SIP client.
+type target struct {
+    config models.S2Target
+    client *sip.Client
+    probe  prober // the client, which tests replace
+
+    // Guarded by targetPool.mu
+    active    int
+    connected bool // false until Connect succeeds
+    healthy   bool
+    failures  int       // consecutive failed pings
+    downUntil time.Time // set by a 503 or timeout
+    stats     models.TargetStatistics
+}
+
+// prober is what the health checks need of a target's SIP client.
+type prober interface {
+    Connect() error
+    Ping() (*message.Response, error)
+}
+
+// targetPool balances calls over the S2 targets: the lowest priority with a
+// healthy target under its capacity is used, and within it targets are
+// picked at random in proportion to their weight.
+type targetPool struct {
+    mu       sync.Mutex
+    targets  []*target
+    holdDown time.Duration
+    now      func() time.Time // nil means time.Now
+}
+
+// clock returns the current time of the pool.
+func (p *targetPool) clock() time.Time {
+    if p.now != nil {
+        return p.now()
+    }
+    return time.Now()
+}
+
+func newTarget(config *models.Config, s2 models.S2Target, localIP string, locator *sip.Locator) (*target, error) {
+    client, err := sip.NewClient(localIP, config.Local.Port, s2.Host, s2.Port)
+    if err != nil {
+        return nil, err
+    }
+    client.SetListenAddress(config.Local.Address, config.Local.Port, config.Local.PortRangeEnd)
+    client.SetSockets(config.Local.Sockets)
+    client.SetLocator(locator)
+    client.SetMediaChecks(sip.MediaChecks{
+        NoMediaTimeout: time.Duration(config.MediaChecks.NoMediaTimeout) * time.Second,
+        SilenceGap:     time.Duration(config.MediaChecks.SilenceGap) * time.Second,
+        OneWayAudio:    config.MediaChecks.OneWayAudio,
+        SSRCChange:     config.MediaChecks.SSRCChange,
+    })
+    if config.SessionTimers.Enabled {
+        client.SetSessionTimers(sip.SessionTimers{
+            Expires:   config.SessionTimers.Expires,
+            MinSE:     config.SessionTimers.MinSE,
+            Refresher: config.SessionTimers.Refresher,
+            UseUpdate: config.SessionTimers.Method == "update",
+        })
+    }
+
+    err = client.SetTransport(s2.Transport, &sip.TLSConfig{
+        CertFile:           s2.TLS.CertFile,
+        KeyFile:            s2.TLS.KeyFile,
+        CAFile:             s2.TLS.CAFile,
+        ServerName:         s2.TLS.ServerName,
+        InsecureSkipVerify: s2.TLS.InsecureSkipVerify,
+    })
+    if err != nil {
+        return nil, err
+    }
+    if s2.Auth.Username != "" {
+        client.SetCredentials(sip.Credentials{
+            Username: s2.Auth.Username,
+            Password: s2.Auth.Password,
+            Realm:    s2.Auth.Realm,
+        })
+    }
+
+    return &target{
+        config:  s2,
+        client:  client,
+        probe:   client,
+        healthy: true,
+        stats: models.TargetStatistics{
+            Name:     s2.Name,
+            Priority: s2.Priority,
+            Weight:   s2.Weight,
+        },
+    }, nil
+}
+
+// acquire picks a target for a call and counts the call against its
+// capacity. Targets already tried for the call are skipped. It returns nil
+// when no target can take the call.
+func (p *targetPool) acquire(tried []*target) *target {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+
+    now := p.clock()
+    var candidates []*target
+    weights := 0
+    for _, t := range p.targets {
+        if !t.healthy || now.Before(t.downUntil) || containsTarget(tried, t) {
+            continue
+        }
+        if t.config.MaxConcurrent > 0 && t.active >= t.config.MaxConcurrent {
+            continue
+        }
+        if len(candidates) > 0 && t.config.Priority > candidates[0].config.Priority {
+            continue
+        }
+        if len(candidates) > 0 && t.config.Priority < candidates[0].config.Priority {
+            candidates, weights = nil, 0
+        }
+        candidates = append(candidates, t)
+        weights += t.config.Weight
+    }
+    if len(candidates) == 0 {
+        return nil
+    }
+
+    chosen := candidates[len(candidates)-1]
+    pick := rand.Intn(weights)
+    for _, t := range candidates {
+        if pick < t.config.Weight {
+            chosen = t
+            break
+        }
+        pick -= t.config.Weight
+    }
+
+    chosen.active++
+    chosen.stats.TotalCalls++
+    return chosen
+}
+
+// abandon undoes acquire for a call that was never placed.
+func (p *targetPool) abandon(t *target) {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+
+    t.active--
+    t.stats.TotalCalls--
+}
+
+// release records the outcome of a call on a target. It reports whether the
+// call should fail over to another target: S2 answered 503 or never answered,
+// and the target is taken out of rotation.
+func (p *targetPool) release(t *target, err error) bool {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+
+    t.active--
+    if err == nil {
+        t.stats.SuccessfulCalls++
+        return false
+    }
+    t.stats.FailedCalls++
+
+    var rejected *sip.ResponseError
+    unavailable := errors.As(err, &rejected) && rejected.StatusCode == 503
+    if !unavailable && !errors.Is(err, sip.ErrTimeout) {
+        return false
+    }
+
+    t.stats.Failovers++
+    now := p.clock()
+    if !now.Before(t.downUntil) {
+        log.Printf("[GENERATOR] Target %s unavailable (%v), failing over", t.config.Name, err)
+    }
+    t.downUntil = now.Add(p.holdDown)
+    return true
+}
+
+// connect connects the client of a target that could not be reached when
+// the generator started. It reports whether the target is connected.
+func (p *targetPool) connect(t *target) bool {
+    p.mu.Lock()
+    connected := t.connected
+    p.mu.Unlock()
+    if connected {
+        return true
+    }
+
+    if err := t.probe.Connect(); err != nil {
+        log.Printf("[GENERATOR] Target %s still unreachable: %v", t.config.Name, err)
+        return false
+    }
+    log.Printf("[GENERATOR] Target %s connected", t.config.Name)
+    p.mu.Lock()
+    t.connected = true
+    p.mu.Unlock()
+    return true
+}
+
+// healthCheck pings a target with OPTIONS every interval, connecting it
+// first if it could not be reached yet. After threshold failed pings in a
+// row the target is taken out of rotation until one succeeds again; a
+// successful ping also ends a hold-down after a 503.
+func (p *targetPool) healthCheck(t *target, interval time.Duration, threshold int, stop <-chan bool) {
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+
+    for {
+        select {
+        case <-ticker.C:
+        case <-stop:
+            return
+        }
+        p.check(t, threshold)
+    }
+}
+
+// check runs one health check of a target. A target that cannot be
+// connected counts as a failed ping without one being sent.
+func (p *targetPool) check(t *target, threshold int) {
+    if !p.connect(t) {
+        p.mu.Lock()
+        t.failures++
+        p.mu.Unlock()
+        return
+    }
+
+    start := p.clock()
+    resp, err := t.probe.Ping()
+    rtt := p.clock().Sub(start)
+    alive := err == nil && resp.StatusCode != 503
+
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    t.stats.LastPing = start
+    if alive {
+        t.stats.PingRTT = float64(rtt) / float64(time.Millisecond)
+        if !t.healthy {
+            log.Printf("[GENERATOR] Target %s is back up", t.config.Name)
+        }
+        t.healthy = true
+        t.failures = 0
+        t.downUntil = time.Time{}
+        return
+    }
+    t.failures++
+    if t.healthy && t.failures >= threshold {
+        log.Printf("[GENERATOR] Target %s is down after %d failed pings", t.config.Name, t.failures)
+        t.healthy = false
+    }
+}
+
+// reconnect connects a target that could not be reached when the generator
+// started, trying every interval, and puts it in rotation once connected.
+// It stands in for the health checks when they are off.
+func (p *targetPool) reconnect(t *target, interval time.Duration, stop <-chan bool) {
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+
+    for {
+        select {
+        case <-ticker.C:
+        case <-stop:
+            return
+        }
+
+        if p.connect(t) {
+            p.mu.Lock()
+            t.healthy = true
+            p.mu.Unlock()
+            return
+        }
+    }
+}
+
+// activeCalls returns the number of calls in progress on all targets.
+func (p *targetPool) activeCalls() int {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+
+    count := 0
+    for _, t := range p.targets {
+        count += t.active
+    }
+    return count
+}
+
+// statistics returns a snapshot of every target's counters.
+func (p *targetPool) statistics() []models.TargetStatistics {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+
+    now := p.clock()
+    stats := make([]models.TargetStatistics, len(p.targets))
+    for i, t := range p.targets {
+        stats[i] = t.stats
+        stats[i].Healthy = t.healthy && !now.Before(t.downUntil)
+        stats[i].ActiveCalls = t.active
+    }
+    return stats
+}
+
+func containsTarget(targets []*target, t *target) bool {
+    for _, tried := range targets {
+        if tried == t {
+            return true
+        }
+    }
+    return false
+}
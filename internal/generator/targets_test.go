@@ -0,0 +1,288 @@
+package generator
+
+import (
+    "errors"
+    "fmt"
+    "testing"
+    "time"
+
+    "github.com/s1-callgen/internal/models"
+    "github.com/s1-callgen/internal/sip"
+    "github.com/s1-callgen/internal/sip/message"
+)
+
+// fakeClock is the time of a pool under test, moved on by hand.
+type fakeClock struct {
+    now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+    return c.now
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+    c.now = c.now.Add(d)
+}
+
+// fakeS2 stands in for the SIP client of a target in health checks. It
+// answers OPTIONS with status after rtt, or times out when status is 0.
+type fakeS2 struct {
+    clock      *fakeClock
+    connectErr error
+    status     int
+    rtt        time.Duration
+    connects   int
+    pings      int
+}
+
+func (f *fakeS2) Connect() error {
+    f.connects++
+    return f.connectErr
+}
+
+func (f *fakeS2) Ping() (*message.Response, error) {
+    f.pings++
+    f.clock.advance(f.rtt)
+    if f.status == 0 {
+        return nil, sip.ErrTimeout
+    }
+    return &message.Response{StatusCode: f.status, Reason: "Test"}, nil
+}
+
+// testPool returns a pool of connected, healthy targets on a fake clock
+// with a hold-down of a minute.
+func testPool(configs ...models.S2Target) (*targetPool, *fakeClock) {
+    clock := &fakeClock{now: time.Unix(1700000000, 0)}
+    p := &targetPool{holdDown: time.Minute, now: clock.Now}
+    for _, config := range configs {
+        p.targets = append(p.targets, &target{
+            config:    config,
+            probe:     &fakeS2{clock: clock, status: 200},
+            connected: true,
+            healthy:   true,
+            stats:     models.TargetStatistics{Name: config.Name},
+        })
+    }
+    return p, clock
+}
+
+func TestAcquireWeighted(t *testing.T) {
+    p, _ := testPool(
+        models.S2Target{Name: "a", Priority: 1, Weight: 1},
+        models.S2Target{Name: "b", Priority: 1, Weight: 3},
+        models.S2Target{Name: "backup", Priority: 2, Weight: 100},
+    )
+
+    // Within the lowest priority calls go in proportion to the weights; 150
+    // is over five standard deviations of 4000 picks
+    counts := map[string]int64{}
+    for i := 0; i < 4000; i++ {
+        chosen := p.acquire(nil)
+        counts[chosen.config.Name]++
+        p.release(chosen, nil)
+    }
+    if counts["backup"] != 0 || counts["a"] < 850 || counts["a"] > 1150 || counts["b"] < 2850 || counts["b"] > 3150 {
+        t.Errorf("picked %v, want about 1000 a, 3000 b and no backup", counts)
+    }
+    for _, target := range p.targets {
+        if target.active != 0 || target.stats.TotalCalls != counts[target.config.Name] || target.stats.SuccessfulCalls != counts[target.config.Name] {
+            t.Errorf("%s: %d active, %d calls, %d successful; want 0 and %d", target.config.Name, target.active, target.stats.TotalCalls, target.stats.SuccessfulCalls, counts[target.config.Name])
+        }
+    }
+}
+
+func TestAcquireSkips(t *testing.T) {
+    p, _ := testPool(
+        models.S2Target{Name: "a", Priority: 1, Weight: 1, MaxConcurrent: 2},
+        models.S2Target{Name: "b", Priority: 1, Weight: 1},
+        models.S2Target{Name: "backup", Priority: 2, Weight: 1},
+    )
+    a, b, backup := p.targets[0], p.targets[1], p.targets[2]
+
+    // A call that failed on a target fails over to the rest of its priority
+    // first, then to the next priority
+    if got := p.acquire([]*target{a}); got != b {
+        t.Errorf("after a, got %s, want b", got.config.Name)
+    }
+    if got := p.acquire([]*target{a, b}); got != backup {
+        t.Errorf("after a and b, got %s, want backup", got.config.Name)
+    }
+    if got := p.acquire([]*target{a, b, backup}); got != nil {
+        t.Errorf("after every target, got %s, want none", got.config.Name)
+    }
+
+    // A target at its capacity takes no more calls
+    a.active = 2
+    for i := 0; i < 20; i++ {
+        if got := p.acquire(nil); got != b {
+            t.Fatalf("with a full, got %s, want b", got.config.Name)
+        }
+    }
+
+    // Nor does an unhealthy one
+    b.healthy = false
+    if got := p.acquire(nil); got != backup {
+        t.Errorf("with a full and b down, got %s, want backup", got.config.Name)
+    }
+
+    // A call never placed is not counted
+    calls := backup.stats.TotalCalls
+    active := backup.active
+    p.abandon(backup)
+    if backup.stats.TotalCalls != calls-1 || backup.active != active-1 {
+        t.Errorf("abandoned call left %d calls and %d active, want %d and %d", backup.stats.TotalCalls, backup.active, calls-1, active-1)
+    }
+}
+
+func TestReleaseFailover(t *testing.T) {
+    tests := []struct {
+        name     string
+        err      error
+        failover bool
+    }{
+        {"answered", nil, false},
+        {"timed out", sip.ErrTimeout, true},
+        {"timed out, wrapped", fmt.Errorf("call: %w", sip.ErrTimeout), true},
+        {"unavailable", &sip.ResponseError{StatusCode: 503, Reason: "Service Unavailable"}, true},
+        {"busy", &sip.ResponseError{StatusCode: 486, Reason: "Busy Here"}, false},
+        {"canceled", sip.ErrCanceled, false},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            p, clock := testPool(
+                models.S2Target{Name: "a", Priority: 1, Weight: 1},
+                models.S2Target{Name: "b", Priority: 2, Weight: 1},
+            )
+            a, b := p.targets[0], p.targets[1]
+
+            if got := p.acquire(nil); got != a {
+                t.Fatalf("got %s, want a", got.config.Name)
+            }
+            if got := p.release(a, tt.err); got != tt.failover {
+                t.Fatalf("failover %v, want %v", got, tt.failover)
+            }
+            if !tt.failover {
+                if got := p.acquire(nil); got != a {
+                    t.Errorf("got %s, want a still in rotation", got.config.Name)
+                }
+                return
+            }
+
+            // The target is held down, then back in rotation
+            if a.stats.Failovers != 1 || a.stats.FailedCalls != 1 {
+                t.Errorf("%d failovers, %d failed calls; want 1 and 1", a.stats.Failovers, a.stats.FailedCalls)
+            }
+            if stats := p.statistics(); stats[0].Healthy {
+                t.Error("target held down reported healthy")
+            }
+            clock.advance(time.Minute - time.Second)
+            if got := p.acquire(nil); got != b {
+                t.Errorf("during the hold-down, got %s, want b", got.config.Name)
+            }
+            clock.advance(time.Second)
+            if got := p.acquire(nil); got != a {
+                t.Errorf("after the hold-down, got %s, want a", got.config.Name)
+            }
+        })
+    }
+}
+
+func TestHealthCheck(t *testing.T) {
+    p, clock := testPool(
+        models.S2Target{Name: "a", Priority: 1, Weight: 1},
+        models.S2Target{Name: "b", Priority: 2, Weight: 1},
+    )
+    a := p.targets[0]
+    s2 := a.probe.(*fakeS2)
+    s2.rtt = 12 * time.Millisecond
+
+    p.check(a, 2)
+    if !a.healthy || a.stats.PingRTT != 12 || !a.stats.LastPing.Equal(clock.now.Add(-s2.rtt)) {
+        t.Errorf("healthy %v, RTT %.1f ms, last ping at %v; want healthy and 12 ms at %v", a.healthy, a.stats.PingRTT, a.stats.LastPing, clock.now.Add(-s2.rtt))
+    }
+
+    // A call timing out holds the target down, and failed pings take it
+    // down once they reach the threshold; a 503 is a failure too
+    if got := p.acquire(nil); got != a || !p.release(a, sip.ErrTimeout) {
+        t.Fatal("a call timing out on a did not fail over")
+    }
+    s2.status = 0
+    p.check(a, 2)
+    if !a.healthy {
+        t.Error("down after one failed ping, want two")
+    }
+    s2.status = 503
+    p.check(a, 2)
+    if a.healthy {
+        t.Error("up after two failed pings")
+    }
+    if got := p.acquire(nil); got != p.targets[1] {
+        t.Errorf("with a down, got %s, want b", got.config.Name)
+    }
+
+    // Any answer brings it back, and ends the hold-down early
+    p.release(p.targets[1], nil)
+    s2.status = 404
+    p.check(a, 2)
+    if !a.healthy || a.failures != 0 || !a.downUntil.IsZero() {
+        t.Errorf("healthy %v with %d failures down until %v, want healthy", a.healthy, a.failures, a.downUntil)
+    }
+    if got := p.acquire(nil); got != a {
+        t.Errorf("with a back, got %s, want a", got.config.Name)
+    }
+}
+
+func TestHealthCheckConnects(t *testing.T) {
+    p, _ := testPool(models.S2Target{Name: "a", Priority: 1, Weight: 1})
+    a := p.targets[0]
+    a.connected = false
+    s2 := a.probe.(*fakeS2)
+    s2.connectErr = errors.New("no route to host")
+
+    // A target that cannot be reached fails its checks without a ping
+    for i := 0; i < 2; i++ {
+        p.check(a, 2)
+    }
+    if s2.connects != 2 || s2.pings != 0 || a.failures != 2 || a.connected {
+        t.Errorf("%d connects, %d pings, %d failures, connected %v; want 2, 0, 2 and not connected", s2.connects, s2.pings, a.failures, a.connected)
+    }
+
+    // Once it connects it is pinged, and is not connected again
+    s2.connectErr = nil
+    p.check(a, 2)
+    p.check(a, 2)
+    if s2.connects != 3 || s2.pings != 2 || a.failures != 0 || !a.connected {
+        t.Errorf("%d connects, %d pings, %d failures, connected %v; want 3, 2, 0 and connected", s2.connects, s2.pings, a.failures, a.connected)
+    }
+}
+
+func TestHealthCheckRuns(t *testing.T) {
+    p, _ := testPool(models.S2Target{Name: "a", Priority: 1, Weight: 1})
+    a := p.targets[0]
+    s2 := a.probe.(*fakeS2)
+    s2.status = 0
+
+    // The checks run every interval until stopped
+    stop := make(chan bool)
+    done := make(chan struct{})
+    go func() {
+        p.healthCheck(a, time.Millisecond, 3, stop)
+        close(done)
+    }()
+    deadline := time.Now().Add(time.Second)
+    for {
+        p.mu.Lock()
+        healthy := a.healthy
+        p.mu.Unlock()
+        if !healthy {
+            break
+        }
+        if time.Now().After(deadline) {
+            t.Fatal("still healthy a second after its pings started failing")
+        }
+        time.Sleep(time.Millisecond)
+    }
+    close(stop)
+    <-done
+}
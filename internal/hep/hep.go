@@ -0,0 +1,157 @@
+// Package hep mirrors packets to a Homer collector in HEPv3, also known as
+// EEP, so calls S1 places show up next to S2's own captures.
+package hep
+
+import (
+    "encoding/binary"
+    "fmt"
+    "net"
+    "time"
+)
+
+// Protocol types of a mirrored payload
+const (
+    ProtocolSIP  = 1
+    ProtocolRTCP = 5
+)
+
+// Chunk types of the generic vendor (HEPv3 specification section 3)
+const (
+    chunkFamily        = 0x0001
+    chunkProtocol      = 0x0002
+    chunkIPv4Src       = 0x0003
+    chunkIPv4Dst       = 0x0004
+    chunkIPv6Src       = 0x0005
+    chunkIPv6Dst       = 0x0006
+    chunkSrcPort       = 0x0007
+    chunkDstPort       = 0x0008
+    chunkSeconds       = 0x0009
+    chunkMicroseconds  = 0x000a
+    chunkProtocolType  = 0x000b
+    chunkCaptureID     = 0x000c
+    chunkAuthKey       = 0x000e
+    chunkPayload       = 0x000f
+    chunkCorrelationID = 0x0011
+)
+
+// Packet is a payload to mirror, as sent from Src to Dst over UDP or, for
+// TCP addresses, TCP.
+type Packet struct {
+    Protocol      byte // ProtocolSIP or ProtocolRTCP
+    Src, Dst      net.Addr
+    Time          time.Time
+    CorrelationID string // the Call-ID, which Homer groups a call's packets by
+    Payload       []byte
+}
+
+// Sender sends packets to a collector over UDP.
+type Sender struct {
+    conn      *net.UDPConn
+    collector *net.UDPAddr
+    captureID uint32
+    password  string
+}
+
+// Dial resolves the collector's host:port and opens the socket packets are
+// sent from, tagged with the capture agent ID and, if set, the password.
+func Dial(address string, captureID uint32, password string) (*Sender, error) {
+    collector, err := net.ResolveUDPAddr("udp", address)
+    if err != nil {
+        return nil, fmt.Errorf("hep: %v", err)
+    }
+    // Unconnected, so an unreachable collector does not fail later sends
+    conn, err := net.ListenUDP("udp", nil)
+    if err != nil {
+        return nil, fmt.Errorf("hep: %v", err)
+    }
+    return &Sender{conn: conn, collector: collector, captureID: captureID, password: password}, nil
+}
+
+// Send mirrors a packet to the collector.
+func (s *Sender) Send(p Packet) error {
+    b := s.encode(p)
+    if len(b) > 0xffff {
+        return fmt.Errorf("hep: packet of %d bytes too large", len(b))
+    }
+    _, err := s.conn.WriteToUDP(b, s.collector)
+    return err
+}
+
+// Close closes the socket.
+func (s *Sender) Close() error {
+    return s.conn.Close()
+}
+
+// encode builds a HEPv3 packet: the "HEP3" id and total length, then chunks
+// of vendor, type, length and value.
+func (s *Sender) encode(p Packet) []byte {
+    srcIP, srcPort, tcp := addrParts(p.Src)
+    dstIP, dstPort, _ := addrParts(p.Dst)
+
+    b := make([]byte, 6, 128+len(p.Payload))
+    copy(b, "HEP3")
+
+    protocol := byte(17) // UDP
+    if tcp {
+        protocol = 6
+    }
+    if src4, dst4 := srcIP.To4(), dstIP.To4(); src4 != nil && dst4 != nil {
+        b = appendChunk(b, chunkFamily, 2)
+        b = appendChunk(b, chunkProtocol, protocol)
+        b = appendChunk(b, chunkIPv4Src, src4...)
+        b = appendChunk(b, chunkIPv4Dst, dst4...)
+    } else {
+        b = appendChunk(b, chunkFamily, 10)
+        b = appendChunk(b, chunkProtocol, protocol)
+        b = appendChunk(b, chunkIPv6Src, ipv6(srcIP)...)
+        b = appendChunk(b, chunkIPv6Dst, ipv6(dstIP)...)
+    }
+    b = appendChunk(b, chunkSrcPort, binary.BigEndian.AppendUint16(nil, uint16(srcPort))...)
+    b = appendChunk(b, chunkDstPort, binary.BigEndian.AppendUint16(nil, uint16(dstPort))...)
+    b = appendChunk(b, chunkSeconds, binary.BigEndian.AppendUint32(nil, uint32(p.Time.Unix()))...)
+    b = appendChunk(b, chunkMicroseconds, binary.BigEndian.AppendUint32(nil, uint32(p.Time.Nanosecond()/1000))...)
+    b = appendChunk(b, chunkProtocolType, p.Protocol)
+    b = appendChunk(b, chunkCaptureID, binary.BigEndian.AppendUint32(nil, s.captureID)...)
+    if s.password != "" {
+        b = appendChunk(b, chunkAuthKey, []byte(s.password)...)
+    }
+    if p.CorrelationID != "" {
+        b = appendChunk(b, chunkCorrelationID, []byte(p.CorrelationID)...)
+    }
+    b = appendChunk(b, chunkPayload, p.Payload...)
+
+    binary.BigEndian.PutUint16(b[4:], uint16(len(b)))
+    return b
+}
+
+// appendChunk appends a chunk of the generic vendor, whose length counts its
+// 6 byte header.
+func appendChunk(b []byte, chunkType uint16, value ...byte) []byte {
+    b = binary.BigEndian.AppendUint16(b, 0)
+    b = binary.BigEndian.AppendUint16(b, chunkType)
+    b = binary.BigEndian.AppendUint16(b, uint16(6+len(value)))
+    return append(b, value...)
+}
+
+// addrParts returns the IP and port of a UDP or TCP address, and whether it
+// is TCP.
+func addrParts(addr net.Addr) (net.IP, int, bool) {
+    switch a := addr.(type) {
+    case *net.UDPAddr:
+        if a != nil {
+            return a.IP, a.Port, false
+        }
+    case *net.TCPAddr:
+        if a != nil {
+            return a.IP, a.Port, true
+        }
+    }
+    return nil, 0, false
+}
+
+func ipv6(ip net.IP) net.IP {
+    if ip16 := ip.To16(); ip16 != nil {
+        return ip16
+    }
+    return net.IPv6unspecified
+}
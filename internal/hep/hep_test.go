@@ -0,0 +1,212 @@
+package hep
+
+import (
+    "bytes"
+    "encoding/binary"
+    "net"
+    "testing"
+    "time"
+)
+
+// collector listens on 127.0.0.1 as a stand-in for Homer.
+func collector(t *testing.T) *net.UDPConn {
+    conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { conn.Close() })
+    return conn
+}
+
+// receive reads one packet from the collector and decodes its chunks by
+// type, checking the header and every chunk length on the way.
+func receive(t *testing.T, conn *net.UDPConn) map[uint16][]byte {
+    t.Helper()
+    conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+    buffer := make([]byte, 65536)
+    n, _, err := conn.ReadFromUDP(buffer)
+    if err != nil {
+        t.Fatal(err)
+    }
+    b := buffer[:n]
+
+    if len(b) < 6 || string(b[:4]) != "HEP3" {
+        t.Fatalf("packet starts with %q, want HEP3", b[:min(len(b), 4)])
+    }
+    if length := binary.BigEndian.Uint16(b[4:]); int(length) != n {
+        t.Fatalf("total length %d, received %d bytes", length, n)
+    }
+
+    chunks := make(map[uint16][]byte)
+    for off := 6; off < n; {
+        if off+6 > n {
+            t.Fatalf("chunk header at %d runs past the end", off)
+        }
+        vendor := binary.BigEndian.Uint16(b[off:])
+        chunkType := binary.BigEndian.Uint16(b[off+2:])
+        length := int(binary.BigEndian.Uint16(b[off+4:]))
+        if vendor != 0 {
+            t.Errorf("chunk %d of vendor %d, want 0", chunkType, vendor)
+        }
+        if length < 6 || off+length > n {
+            t.Fatalf("chunk %d of length %d at %d does not fit its header or the packet", chunkType, length, off)
+        }
+        if _, dup := chunks[chunkType]; dup {
+            t.Errorf("chunk %d repeated", chunkType)
+        }
+        chunks[chunkType] = b[off+6 : off+length]
+        off += length
+    }
+    return chunks
+}
+
+func TestSend(t *testing.T) {
+    sent := time.Date(2026, 10, 16, 8, 30, 0, 123456789, time.UTC)
+    payload := []byte("INVITE sip:50764137984@s2 SIP/2.0\r\nCall-ID: 1@s1\r\n\r\n")
+
+    tests := []struct {
+        name     string
+        packet   Packet
+        password string
+        family   byte
+        protocol byte
+        src, dst net.IP
+        srcChunk uint16
+        dstChunk uint16
+        ports    [2]uint16
+    }{
+        {
+            name: "SIP over IPv4 UDP",
+            packet: Packet{
+                Protocol:      ProtocolSIP,
+                Src:           &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 5060},
+                Dst:           &net.UDPAddr{IP: net.ParseIP("10.0.0.2"), Port: 5080},
+                Time:          sent,
+                CorrelationID: "1@s1",
+                Payload:       payload,
+            },
+            password: "secret",
+            family:   2,
+            protocol: 17,
+            src:      net.ParseIP("10.0.0.1").To4(),
+            dst:      net.ParseIP("10.0.0.2").To4(),
+            srcChunk: chunkIPv4Src,
+            dstChunk: chunkIPv4Dst,
+            ports:    [2]uint16{5060, 5080},
+        },
+        {
+            name: "RTCP over IPv6",
+            packet: Packet{
+                Protocol: ProtocolRTCP,
+                Src:      &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 10001},
+                Dst:      &net.UDPAddr{IP: net.ParseIP("2001:db8::2"), Port: 20001},
+                Time:     sent,
+                Payload:  []byte{0x80, 201, 0, 1, 0, 0, 0, 1},
+            },
+            family:   10,
+            protocol: 17,
+            src:      net.ParseIP("2001:db8::1"),
+            dst:      net.ParseIP("2001:db8::2"),
+            srcChunk: chunkIPv6Src,
+            dstChunk: chunkIPv6Dst,
+            ports:    [2]uint16{10001, 20001},
+        },
+        {
+            name: "SIP over TCP",
+            packet: Packet{
+                Protocol:      ProtocolSIP,
+                Src:           &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 40000},
+                Dst:           &net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 5060},
+                Time:          sent,
+                CorrelationID: "2@s1",
+                Payload:       payload,
+            },
+            family:   2,
+            protocol: 6,
+            src:      net.ParseIP("10.0.0.1").To4(),
+            dst:      net.ParseIP("10.0.0.2").To4(),
+            srcChunk: chunkIPv4Src,
+            dstChunk: chunkIPv4Dst,
+            ports:    [2]uint16{40000, 5060},
+        },
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            conn := collector(t)
+            sender, err := Dial(conn.LocalAddr().String(), 2001, tt.password)
+            if err != nil {
+                t.Fatal(err)
+            }
+            defer sender.Close()
+            if err := sender.Send(tt.packet); err != nil {
+                t.Fatal(err)
+            }
+            chunks := receive(t, conn)
+
+            checks := []struct {
+                chunk uint16
+                want  []byte
+            }{
+                {chunkFamily, []byte{tt.family}},
+                {chunkProtocol, []byte{tt.protocol}},
+                {tt.srcChunk, tt.src},
+                {tt.dstChunk, tt.dst},
+                {chunkSrcPort, binary.BigEndian.AppendUint16(nil, tt.ports[0])},
+                {chunkDstPort, binary.BigEndian.AppendUint16(nil, tt.ports[1])},
+                {chunkSeconds, binary.BigEndian.AppendUint32(nil, uint32(sent.Unix()))},
+                {chunkMicroseconds, binary.BigEndian.AppendUint32(nil, 123456)},
+                {chunkProtocolType, []byte{tt.packet.Protocol}},
+                {chunkCaptureID, binary.BigEndian.AppendUint32(nil, 2001)},
+                {chunkPayload, tt.packet.Payload},
+            }
+            if tt.password != "" {
+                checks = append(checks, struct {
+                    chunk uint16
+                    want  []byte
+                }{chunkAuthKey, []byte(tt.password)})
+            } else if _, ok := chunks[chunkAuthKey]; ok {
+                t.Error("auth key sent without a password")
+            }
+            if tt.packet.CorrelationID != "" {
+                checks = append(checks, struct {
+                    chunk uint16
+                    want  []byte
+                }{chunkCorrelationID, []byte(tt.packet.CorrelationID)})
+            } else if _, ok := chunks[chunkCorrelationID]; ok {
+                t.Error("correlation ID sent without a Call-ID")
+            }
+
+            for _, check := range checks {
+                got, ok := chunks[check.chunk]
+                if !ok {
+                    t.Errorf("chunk %d missing", check.chunk)
+                    continue
+                }
+                if !bytes.Equal(got, check.want) {
+                    t.Errorf("chunk %d is %x, want %x", check.chunk, got, check.want)
+                }
+            }
+        })
+    }
+}
+
+func TestSendTooLarge(t *testing.T) {
+    conn := collector(t)
+    sender, err := Dial(conn.LocalAddr().String(), 1, "")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer sender.Close()
+
+    err = sender.Send(Packet{
+        Protocol: ProtocolSIP,
+        Src:      &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 5060},
+        Dst:      &net.UDPAddr{IP: net.ParseIP("10.0.0.2"), Port: 5060},
+        Time:     time.Now(),
+        Payload:  make([]byte, 0xffff),
+    })
+    if err == nil {
+        t.Error("packet over 64 KB sent")
+    }
+}
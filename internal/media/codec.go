@@ -0,0 +1,71 @@
+// Package media encodes and decodes the audio carried in RTP by calls.
+package media
+
+import (
+    "fmt"
+    "sort"
+    "strings"
+)
+
+// FrameDuration is the audio carried by one RTP packet, in milliseconds.
+const FrameDuration = 20
+
+// Codec encodes linear PCM into RTP payloads and back. Codecs with state,
+// such as G.722, must not be shared by calls; New returns a fresh one.
+type Codec interface {
+    Name() string       // encoding name, as in SDP rtpmap
+    PayloadType() uint8 // static payload type, or the dynamic one we offer
+    ClockRate() int     // RTP timestamp rate, as in SDP rtpmap
+    Channels() int
+    Fmtp() string
+    SampleRate() int // rate of the PCM Encode takes and Decode returns
+
+    // Encode encodes a frame of FrameDuration of mono PCM samples.
+    Encode(pcm []int16) []byte
+    // Decode decodes a payload to mono PCM samples.
+    Decode(payload []byte) []int16
+}
+
+// codecs are the supported codecs by upper case encoding name.
+var codecs = map[string]func() Codec{
+    "PCMU": func() Codec { return pcmu{} },
+    "PCMA": func() Codec { return pcma{} },
+    "G722": func() Codec { return newG722() },
+    "L16":  func() Codec { return l16{} },
+    "OPUS": func() Codec { return opus{} },
+}
+
+// New returns a codec by encoding name, in any case.
+func New(name string) (Codec, error) {
+    factory, ok := codecs[strings.ToUpper(name)]
+    if !ok {
+        return nil, fmt.Errorf("media: unsupported codec %q", name)
+    }
+    return factory(), nil
+}
+
+// Names returns the names of the supported codecs.
+func Names() []string {
+    names := make([]string, 0, len(codecs))
+    for name := range codecs {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    return names
+}
+
+// FrameSamples returns the number of PCM samples in a frame of the codec.
+func FrameSamples(c Codec) int {
+    return c.SampleRate() * FrameDuration / 1000
+}
+
+// FrameTicks returns how far the RTP timestamp advances per frame of the
+// codec.
+func FrameTicks(c Codec) uint32 {
+    return uint32(c.ClockRate() * FrameDuration / 1000)
+}
+
+// Silence returns a frame of silence encoded by the codec.
+func Silence(c Codec) []byte {
+    return c.Encode(make([]int16, FrameSamples(c)))
+}
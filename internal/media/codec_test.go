@@ -0,0 +1,285 @@
+package media
+
+import (
+    "math"
+    "testing"
+)
+
+// The G.711 vectors are those of the Sun reference implementation, as found
+// in Python's audioop. Its µ-law encoder rounds negative samples away from
+// zero before compressing them; ours compresses the magnitude as the ITU
+// tables do, so negative µ-law samples are checked by symmetry instead.
+
+func TestULaw(t *testing.T) {
+    encode := []struct {
+        sample int16
+        code   byte
+    }{
+        {0, 0xff}, {1, 0xff}, {7, 0xfe}, {8, 0xfe}, {100, 0xf2}, {255, 0xe7}, {256, 0xe7},
+        {1000, 0xce}, {4000, 0xaf}, {8031, 0xa0}, {8032, 0xa0}, {16000, 0x90}, {32124, 0x80}, {32767, 0x80},
+    }
+    for _, tt := range encode {
+        if got := linearToULaw(tt.sample); got != tt.code {
+            t.Errorf("µ-law of %d is %#x, want %#x", tt.sample, got, tt.code)
+        }
+        if got, want := linearToULaw(-tt.sample), tt.code&^0x80; tt.sample != 0 && got != want {
+            t.Errorf("µ-law of %d is %#x, want %#x", -tt.sample, got, want)
+        }
+    }
+
+    decode := []struct {
+        code   byte
+        sample int16
+    }{
+        {0x00, -32124}, {0x0f, -16764}, {0x70, -120}, {0x7e, -8}, {0x7f, 0},
+        {0x80, 32124}, {0x8f, 16764}, {0xf0, 120}, {0xfe, 8}, {0xff, 0},
+    }
+    for _, tt := range decode {
+        if got := uLawToLinear(tt.code); got != tt.sample {
+            t.Errorf("µ-law %#x decodes to %d, want %d", tt.code, got, tt.sample)
+        }
+    }
+
+    // Every code but the negative zero survives decoding and encoding
+    for code := 0; code < 256; code++ {
+        if code == 0x7f {
+            continue
+        }
+        if got := linearToULaw(uLawToLinear(byte(code))); got != byte(code) {
+            t.Errorf("µ-law %#x comes back as %#x", code, got)
+        }
+    }
+}
+
+func TestALaw(t *testing.T) {
+    encode := []struct {
+        sample int16
+        code   byte
+    }{
+        {0, 0xd5}, {1, 0xd5}, {7, 0xd5}, {8, 0xd5}, {100, 0xd3}, {255, 0xda}, {256, 0xc5},
+        {1000, 0xfa}, {4000, 0x9a}, {8031, 0x8a}, {8032, 0x8a}, {16000, 0xba}, {32124, 0xaa}, {32767, 0xaa},
+        {-1, 0x55}, {-8, 0x55}, {-9, 0x55}, {-100, 0x53}, {-1000, 0x7a}, {-16000, 0x3a}, {-32768, 0x2a},
+    }
+    for _, tt := range encode {
+        if got := linearToALaw(tt.sample); got != tt.code {
+            t.Errorf("A-law of %d is %#x, want %#x", tt.sample, got, tt.code)
+        }
+    }
+
+    decode := []struct {
+        code   byte
+        sample int16
+    }{
+        {0x00, -5504}, {0x2a, -32256}, {0x55, -8}, {0x54, -24},
+        {0x80, 5504}, {0xaa, 32256}, {0xd5, 8}, {0xd4, 24}, {0xff, 848},
+    }
+    for _, tt := range decode {
+        if got := aLawToLinear(tt.code); got != tt.sample {
+            t.Errorf("A-law %#x decodes to %d, want %d", tt.code, got, tt.sample)
+        }
+    }
+
+    for code := 0; code < 256; code++ {
+        if got := linearToALaw(aLawToLinear(byte(code))); got != byte(code) {
+            t.Errorf("A-law %#x comes back as %#x", code, got)
+        }
+    }
+}
+
+// TestG711Error checks that the quantization error of every sample stays
+// within half a step of its segment.
+func TestG711Error(t *testing.T) {
+    for _, name := range []string{"PCMU", "PCMA"} {
+        codec, err := New(name)
+        if err != nil {
+            t.Fatal(err)
+        }
+        pcm := make([]int16, 65536)
+        for i := range pcm {
+            pcm[i] = int16(i - 32768)
+        }
+        decoded := codec.Decode(codec.Encode(pcm))
+        for i, sample := range pcm {
+            magnitude := math.Abs(float64(sample))
+            limit := max(16, magnitude/32+8)
+            if magnitude > 32124 {
+                limit = magnitude - 32124 + 512 // clipped
+            }
+            if diff := math.Abs(float64(decoded[i]) - float64(sample)); diff > limit {
+                t.Errorf("%s: %d decodes to %d", name, sample, decoded[i])
+                break
+            }
+        }
+    }
+}
+
+// tone returns n samples of a sine at freq Hz.
+func tone(freq, rate float64, n int) []int16 {
+    pcm := make([]int16, n)
+    for i := range pcm {
+        pcm[i] = int16(8000 * math.Sin(2*math.Pi*freq*float64(i)/rate))
+    }
+    return pcm
+}
+
+// chirp returns n samples of a sine sweeping from low to high Hz, which
+// unlike a tone has a single delay at which it lines up with itself.
+func chirp(low, high, rate float64, n int) []int16 {
+    pcm := make([]int16, n)
+    duration := float64(n) / rate
+    for i := range pcm {
+        at := float64(i) / rate
+        phase := 2 * math.Pi * (low*at + (high-low)*at*at/(2*duration))
+        pcm[i] = int16(8000 * math.Sin(phase))
+    }
+    return pcm
+}
+
+// snr returns the signal to noise ratio in dB of decoded against pcm, with
+// decoded lagging by delay samples.
+func snr(pcm, decoded []int16, delay int) float64 {
+    var signal, noise float64
+    for i := delay; i < len(decoded); i++ {
+        s := float64(pcm[i-delay])
+        d := float64(decoded[i]) - s
+        signal += s * s
+        noise += d * d
+    }
+    return 10 * math.Log10(signal/noise)
+}
+
+func TestG722(t *testing.T) {
+    // From the initial state a pair of zero samples falls in the fourth
+    // interval of the low band quantizer, code 58, and the inner one of the
+    // high band, code 3
+    if got := newG722().Encode(make([]int16, 2)); len(got) != 1 || got[0] != 0xfa {
+        t.Errorf("first silent byte %x, want fa", got)
+    }
+
+    tests := []struct {
+        name  string
+        pcm   []int16
+        delay int // where decoded lines up, 0 to find it
+        snr   float64
+    }{
+        // The QMF filters of the encoder and decoder delay the signal by
+        // 22 samples
+        {"sweep", chirp(100, 7000, 16000, 16000), 0, 20},
+        {"300 Hz", tone(300, 16000, 16000), 22, 30},
+        {"1 kHz", tone(1000, 16000, 16000), 22, 30},
+        {"3 kHz", tone(3000, 16000, 16000), 22, 30},
+        {"6 kHz", tone(6000, 16000, 16000), 22, 20},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            codec, err := New("G722")
+            if err != nil {
+                t.Fatal(err)
+            }
+            var decoded []int16
+            for i := 0; i < len(tt.pcm); i += FrameSamples(codec) {
+                payload := codec.Encode(tt.pcm[i : i+FrameSamples(codec)])
+                if len(payload) != 160 {
+                    t.Fatalf("frame of %d bytes, want 160", len(payload))
+                }
+                decoded = append(decoded, codec.Decode(payload)...)
+            }
+
+            if tt.delay == 0 {
+                best := math.Inf(-1)
+                for delay := 0; delay < 64; delay++ {
+                    if ratio := snr(tt.pcm, decoded, delay); ratio > best {
+                        best, tt.delay = ratio, delay
+                    }
+                }
+                if tt.delay != 22 {
+                    t.Errorf("decoded lags by %d samples, want 22", tt.delay)
+                }
+            }
+            if ratio := snr(tt.pcm, decoded, tt.delay); ratio < tt.snr {
+                t.Errorf("%.1f dB, want over %v dB", ratio, tt.snr)
+            }
+        })
+    }
+}
+
+// TestG722State checks that every call gets its own encoder state.
+func TestG722State(t *testing.T) {
+    a, _ := New("g722")
+    b, _ := New("G722")
+    pcm := tone(1000, 16000, 320)
+    first := a.Encode(pcm)
+    a.Encode(pcm)
+    if got := b.Encode(pcm); string(got) != string(first) {
+        t.Error("a fresh codec encodes like one that already coded a frame")
+    }
+}
+
+func TestSilence(t *testing.T) {
+    for _, name := range Names() {
+        codec, err := New(name)
+        if err != nil {
+            t.Fatal(err)
+        }
+        silence := Silence(codec)
+        for _, sample := range codec.Decode(silence) {
+            if sample > 64 || sample < -64 {
+                t.Errorf("%s: silence decodes to %d", name, sample)
+                break
+            }
+        }
+        if name != "OPUS" && len(codec.Decode(silence)) != FrameSamples(codec) {
+            t.Errorf("%s: silence decodes to %d samples, want %d", name, len(codec.Decode(silence)), FrameSamples(codec))
+        }
+    }
+}
+
+func TestNew(t *testing.T) {
+    tests := []struct {
+        name    string
+        pt      uint8
+        ticks   uint32
+        samples int
+    }{
+        {"pcmu", 0, 160, 160},
+        {"PCMA", 8, 160, 160},
+        {"G722", 9, 160, 320},
+        {"L16", 96, 160, 160},
+        {"opus", 111, 960, 960},
+    }
+    for _, tt := range tests {
+        codec, err := New(tt.name)
+        if err != nil {
+            t.Fatal(err)
+        }
+        if codec.PayloadType() != tt.pt || FrameTicks(codec) != tt.ticks || FrameSamples(codec) != tt.samples {
+            t.Errorf("%s: payload type %d, %d ticks and %d samples a frame; want %d, %d and %d",
+                tt.name, codec.PayloadType(), FrameTicks(codec), FrameSamples(codec), tt.pt, tt.ticks, tt.samples)
+        }
+    }
+    if _, err := New("G729"); err == nil {
+        t.Error("G729 is supported")
+    }
+}
+
+func TestMOS(t *testing.T) {
+    tests := []struct {
+        loss, delay float64
+        min, max    float64
+    }{
+        {0, 0, 4.40, 4.45},
+        {0, 150, 4.30, 4.40},
+        {1, 20, 4.28, 4.36},
+        {5, 20, 3.85, 3.95},
+        {20, 300, 1.0, 2.0},
+    }
+    for _, tt := range tests {
+        mos := MOS(RFactor(tt.loss, tt.delay))
+        if mos < tt.min || mos > tt.max {
+            t.Errorf("%v%% loss, %v ms: MOS %.2f, want %.2f to %.2f", tt.loss, tt.delay, mos, tt.min, tt.max)
+        }
+    }
+    if MOS(-5) != 1 || MOS(120) != 4.5 {
+        t.Error("MOS not clamped to 1 and 4.5")
+    }
+}
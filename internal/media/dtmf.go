@@ -0,0 +1,70 @@
+package media
+
+import (
+    "fmt"
+    "strings"
+    "time"
+)
+
+// DTMFStep waits and then sends digits, one after the other.
+type DTMFStep struct {
+    Wait   time.Duration // from the end of the previous step, or the answer
+    Digits string
+}
+
+// DTMFScript is the DTMF a call sends, such as "3s 1234# 2s 9": wait 3 s,
+// send 1, 2, 3, 4 and #, wait 2 s more and send 9. Waits are Go durations
+// and digits 0-9, *, # and A-D.
+type DTMFScript []DTMFStep
+
+// ParseDTMFScript parses a DTMF script.
+func ParseDTMFScript(s string) (DTMFScript, error) {
+    var script DTMFScript
+    var wait time.Duration
+    for _, field := range strings.Fields(s) {
+        // A lone 0 is a digit, though it also parses as a duration
+        if !isDigits(field) {
+            d, err := time.ParseDuration(field)
+            if err != nil {
+                return nil, fmt.Errorf("media: %q in DTMF script is neither a wait nor digits", field)
+            }
+            if d < 0 {
+                return nil, fmt.Errorf("media: negative wait %q in DTMF script", field)
+            }
+            wait += d
+            continue
+        }
+        script = append(script, DTMFStep{Wait: wait, Digits: strings.ToUpper(field)})
+        wait = 0
+    }
+    if len(script) == 0 {
+        return nil, fmt.Errorf("media: DTMF script %q has no digits", s)
+    }
+    return script, nil
+}
+
+func isDigits(field string) bool {
+    for _, digit := range field {
+        if _, ok := DTMFEvent(digit); !ok {
+            return false
+        }
+    }
+    return true
+}
+
+// DTMFEvent returns the RFC 4733 event code of a digit.
+func DTMFEvent(digit rune) (byte, bool) {
+    switch {
+    case digit >= '0' && digit <= '9':
+        return byte(digit - '0'), true
+    case digit == '*':
+        return 10, true
+    case digit == '#':
+        return 11, true
+    case digit >= 'A' && digit <= 'D':
+        return byte(digit-'A') + 12, true
+    case digit >= 'a' && digit <= 'd':
+        return byte(digit-'a') + 12, true
+    }
+    return 0, false
+}
@@ -0,0 +1,45 @@
+package media
+
+import (
+    "reflect"
+    "testing"
+    "time"
+)
+
+func TestParseDTMFScript(t *testing.T) {
+    tests := []struct {
+        script string
+        want   DTMFScript
+    }{
+        {"1234#", DTMFScript{{Digits: "1234#"}}},
+        {"3s 12a# 500ms 1s *9", DTMFScript{{Wait: 3 * time.Second, Digits: "12A#"}, {Wait: 1500 * time.Millisecond, Digits: "*9"}}},
+        {"  0  D ", DTMFScript{{Digits: "0"}, {Digits: "D"}}},
+    }
+    for _, tt := range tests {
+        got, err := ParseDTMFScript(tt.script)
+        if err != nil {
+            t.Errorf("%q: %v", tt.script, err)
+            continue
+        }
+        if !reflect.DeepEqual(got, tt.want) {
+            t.Errorf("%q: got %+v, want %+v", tt.script, got, tt.want)
+        }
+    }
+
+    for _, bad := range []string{"", "3s", "12E", "-1s 1", "1,2"} {
+        if script, err := ParseDTMFScript(bad); err == nil {
+            t.Errorf("%q parsed as %+v", bad, script)
+        }
+    }
+}
+
+func TestDTMFEvent(t *testing.T) {
+    for digit, want := range map[rune]byte{'0': 0, '9': 9, '*': 10, '#': 11, 'A': 12, 'd': 15} {
+        if got, ok := DTMFEvent(digit); !ok || got != want {
+            t.Errorf("%c is event %d, %v; want %d", digit, got, ok, want)
+        }
+    }
+    if _, ok := DTMFEvent('E'); ok {
+        t.Error("E is an event")
+    }
+}
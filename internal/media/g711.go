@@ -0,0 +1,134 @@
+package media
+
+// pcmu is G.711 µ-law, static payload type 0.
+type pcmu struct{}
+
+func (pcmu) Name() string       { return "PCMU" }
+func (pcmu) PayloadType() uint8 { return 0 }
+func (pcmu) ClockRate() int     { return 8000 }
+func (pcmu) Channels() int      { return 1 }
+func (pcmu) Fmtp() string       { return "" }
+func (pcmu) SampleRate() int    { return 8000 }
+
+func (pcmu) Encode(pcm []int16) []byte {
+    payload := make([]byte, len(pcm))
+    for i, sample := range pcm {
+        payload[i] = linearToULaw(sample)
+    }
+    return payload
+}
+
+func (pcmu) Decode(payload []byte) []int16 {
+    pcm := make([]int16, len(payload))
+    for i, b := range payload {
+        pcm[i] = uLawToLinear(b)
+    }
+    return pcm
+}
+
+// pcma is G.711 A-law, static payload type 8.
+type pcma struct{}
+
+func (pcma) Name() string       { return "PCMA" }
+func (pcma) PayloadType() uint8 { return 8 }
+func (pcma) ClockRate() int     { return 8000 }
+func (pcma) Channels() int      { return 1 }
+func (pcma) Fmtp() string       { return "" }
+func (pcma) SampleRate() int    { return 8000 }
+
+func (pcma) Encode(pcm []int16) []byte {
+    payload := make([]byte, len(pcm))
+    for i, sample := range pcm {
+        payload[i] = linearToALaw(sample)
+    }
+    return payload
+}
+
+func (pcma) Decode(payload []byte) []int16 {
+    pcm := make([]int16, len(payload))
+    for i, b := range payload {
+        pcm[i] = aLawToLinear(b)
+    }
+    return pcm
+}
+
+const (
+    uLawBias = 0x84
+    uLawClip = 32635
+)
+
+// linearToULaw compresses a sample with the segment encoding of G.711.
+func linearToULaw(sample int16) byte {
+    s := int(sample)
+    sign := 0
+    if s < 0 {
+        s = -s
+        sign = 0x80
+    }
+    if s > uLawClip {
+        s = uLawClip
+    }
+    s += uLawBias
+
+    exponent := 7
+    for mask := 0x4000; s&mask == 0 && exponent > 0; mask >>= 1 {
+        exponent--
+    }
+    mantissa := (s >> (exponent + 3)) & 0x0f
+    return ^byte(sign | exponent<<4 | mantissa)
+}
+
+func uLawToLinear(b byte) int16 {
+    b = ^b
+    exponent := int(b>>4) & 0x07
+    mantissa := int(b & 0x0f)
+    s := ((mantissa << 3) + uLawBias) << exponent
+    s -= uLawBias
+    if b&0x80 != 0 {
+        return int16(-s)
+    }
+    return int16(s)
+}
+
+// linearToALaw compresses a sample with the A-law segment encoding of G.711.
+// Even bits are inverted on the wire.
+func linearToALaw(sample int16) byte {
+    s := int(sample) >> 3 // 13 bit
+    mask := 0xd5
+    if s < 0 {
+        mask = 0x55
+        s = -s - 1
+    }
+
+    segment := 0
+    for segment < 8 && s > 0x20<<segment-1 {
+        segment++
+    }
+    if segment >= 8 {
+        return byte(0x7f ^ mask)
+    }
+    b := segment << 4
+    if segment < 2 {
+        b |= (s >> 1) & 0x0f
+    } else {
+        b |= (s >> segment) & 0x0f
+    }
+    return byte(b ^ mask)
+}
+
+func aLawToLinear(b byte) int16 {
+    b ^= 0x55
+    s := int(b&0x0f) << 4
+    switch segment := int(b>>4) & 0x07; segment {
+    case 0:
+        s += 8
+    case 1:
+        s += 0x108
+    default:
+        s = (s + 0x108) << (segment - 1)
+    }
+    if b&0x80 == 0 {
+        return int16(-s)
+    }
+    return int16(s)
+}
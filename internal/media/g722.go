@@ -0,0 +1,283 @@
+package media
+
+// g722 is ITU-T G.722 at 64 kbit/s, static payload type 9: 16 kHz audio
+// split into two sub-bands coded with ADPCM. For historical reasons its RTP
+// clock runs at 8 kHz (RFC 3551 section 4.5.2).
+type g722 struct {
+    encoder g722State
+    decoder g722State
+}
+
+func newG722() *g722 {
+    return &g722{encoder: newG722State(), decoder: newG722State()}
+}
+
+func (*g722) Name() string       { return "G722" }
+func (*g722) PayloadType() uint8 { return 9 }
+func (*g722) ClockRate() int     { return 8000 }
+func (*g722) Channels() int      { return 1 }
+func (*g722) Fmtp() string       { return "" }
+func (*g722) SampleRate() int    { return 16000 }
+
+// g722Band is the adaptive predictor and quantizer state of a sub-band.
+type g722Band struct {
+    s, sp, sz int
+    r         [3]int
+    a, ap     [3]int
+    p         [3]int
+    d         [7]int
+    b, bp     [7]int
+    nb, det   int
+}
+
+type g722State struct {
+    x    [24]int // QMF delay line
+    band [2]g722Band
+}
+
+func newG722State() g722State {
+    var s g722State
+    s.band[0].det = 32
+    s.band[1].det = 8
+    return s
+}
+
+// Tables of the G.722 reference implementation
+var (
+    g722Q6   = [32]int{0, 35, 72, 110, 150, 190, 233, 276, 323, 370, 422, 473, 530, 587, 650, 714, 786, 858, 940, 1023, 1121, 1219, 1339, 1458, 1612, 1765, 1980, 2195, 2557, 2919, 0, 0}
+    g722ILN  = [32]int{0, 63, 62, 31, 30, 29, 28, 27, 26, 25, 24, 23, 22, 21, 20, 19, 18, 17, 16, 15, 14, 13, 12, 11, 10, 9, 8, 7, 6, 5, 4, 0}
+    g722ILP  = [32]int{0, 61, 60, 59, 58, 57, 56, 55, 54, 53, 52, 51, 50, 49, 48, 47, 46, 45, 44, 43, 42, 41, 40, 39, 38, 37, 36, 35, 34, 33, 32, 0}
+    g722WL   = [8]int{-60, -30, 58, 172, 334, 538, 1198, 3042}
+    g722RL42 = [16]int{0, 7, 6, 5, 4, 3, 2, 1, 7, 6, 5, 4, 3, 2, 1, 0}
+    g722ILB  = [32]int{2048, 2093, 2139, 2186, 2233, 2282, 2332, 2383, 2435, 2489, 2543, 2599, 2656, 2714, 2774, 2834, 2896, 2960, 3025, 3091, 3158, 3228, 3298, 3371, 3444, 3520, 3597, 3676, 3756, 3838, 3922, 4008}
+    g722QM4  = [16]int{0, -20456, -12896, -8968, -6288, -4240, -2584, -1200, 20456, 12896, 8968, 6288, 4240, 2584, 1200, 0}
+    g722QM6  = [64]int{
+        -136, -136, -136, -136, -24808, -21904, -19008, -16704,
+        -14984, -13512, -12280, -11192, -10232, -9360, -8576, -7856,
+        -7192, -6576, -6000, -5456, -4944, -4464, -4008, -3576,
+        -3168, -2776, -2400, -2032, -1688, -1360, -1040, -728,
+        24808, 21904, 19008, 16704, 14984, 13512, 12280, 11192,
+        10232, 9360, 8576, 7856, 7192, 6576, 6000, 5456,
+        4944, 4464, 4008, 3576, 3168, 2776, 2400, 2032,
+        1688, 1360, 1040, 728, 432, 136, -432, -136,
+    }
+    g722QM2 = [4]int{-7408, -1616, 7408, 1616}
+    g722QMF = [12]int{3, -11, 12, 32, -210, 951, 3876, -805, 362, -156, 53, -11}
+    g722IHN = [3]int{0, 1, 0}
+    g722IHP = [3]int{0, 3, 2}
+    g722WH  = [3]int{0, -214, 798}
+    g722RH2 = [4]int{2, 1, 2, 1}
+)
+
+func saturate(v int) int {
+    if v > 32767 {
+        return 32767
+    }
+    if v < -32768 {
+        return -32768
+    }
+    return v
+}
+
+// Encode codes pairs of 16 kHz samples into one byte each.
+func (g *g722) Encode(pcm []int16) []byte {
+    s := &g.encoder
+    payload := make([]byte, 0, len(pcm)/2)
+    for j := 0; j+1 < len(pcm); j += 2 {
+        // Transmit QMF, splitting the low and high bands
+        copy(s.x[:22], s.x[2:])
+        s.x[22] = int(pcm[j])
+        s.x[23] = int(pcm[j+1])
+        sumEven, sumOdd := 0, 0
+        for i := 0; i < 12; i++ {
+            sumOdd += s.x[2*i] * g722QMF[i]
+            sumEven += s.x[2*i+1] * g722QMF[11-i]
+        }
+        xLow := (sumEven + sumOdd) >> 14
+        xHigh := (sumEven - sumOdd) >> 14
+
+        // Low band: 6 bit quantizer
+        low := &s.band[0]
+        el := saturate(xLow - low.s)
+        wd := el
+        if el < 0 {
+            wd = -(el + 1)
+        }
+        i := 1
+        for ; i < 30; i++ {
+            if wd < (g722Q6[i]*low.det)>>12 {
+                break
+            }
+        }
+        iLow := g722ILP[i]
+        if el < 0 {
+            iLow = g722ILN[i]
+        }
+        ril := iLow >> 2
+        dLow := (low.det * g722QM4[ril]) >> 15
+        low.nb = scaleFactor(low.nb, g722WL[g722RL42[ril]], 18432)
+        low.det = quantizerScale(low.nb, 8)
+        low.update(dLow)
+
+        // High band: 2 bit quantizer
+        high := &s.band[1]
+        eh := saturate(xHigh - high.s)
+        wd = eh
+        if eh < 0 {
+            wd = -(eh + 1)
+        }
+        mih := 1
+        if wd >= (564*high.det)>>12 {
+            mih = 2
+        }
+        iHigh := g722IHP[mih]
+        if eh < 0 {
+            iHigh = g722IHN[mih]
+        }
+        dHigh := (high.det * g722QM2[iHigh]) >> 15
+        high.nb = scaleFactor(high.nb, g722WH[g722RH2[iHigh]], 22528)
+        high.det = quantizerScale(high.nb, 10)
+        high.update(dHigh)
+
+        payload = append(payload, byte(iHigh<<6|iLow))
+    }
+    return payload
+}
+
+// Decode decodes each byte into two 16 kHz samples.
+func (g *g722) Decode(payload []byte) []int16 {
+    s := &g.decoder
+    pcm := make([]int16, 0, 2*len(payload))
+    for _, code := range payload {
+        iLow := int(code & 0x3f)
+        iHigh := int(code>>6) & 0x03
+
+        low := &s.band[0]
+        rLow := min(max(low.s+(low.det*g722QM6[iLow])>>15, -16384), 16383)
+        ril := iLow >> 2
+        dLow := (low.det * g722QM4[ril]) >> 15
+        low.nb = scaleFactor(low.nb, g722WL[g722RL42[ril]], 18432)
+        low.det = quantizerScale(low.nb, 8)
+        low.update(dLow)
+
+        high := &s.band[1]
+        dHigh := (high.det * g722QM2[iHigh]) >> 15
+        rHigh := min(max(dHigh+high.s, -16384), 16383)
+        high.nb = scaleFactor(high.nb, g722WH[g722RH2[iHigh]], 22528)
+        high.det = quantizerScale(high.nb, 10)
+        high.update(dHigh)
+
+        // Receive QMF, combining the bands
+        copy(s.x[:22], s.x[2:])
+        s.x[22] = rLow + rHigh
+        s.x[23] = rLow - rHigh
+        out1, out2 := 0, 0
+        for i := 0; i < 12; i++ {
+            out2 += s.x[2*i] * g722QMF[i]
+            out1 += s.x[2*i+1] * g722QMF[11-i]
+        }
+        pcm = append(pcm, int16(saturate(out1>>11)), int16(saturate(out2>>11)))
+    }
+    return pcm
+}
+
+// scaleFactor adapts the logarithmic scale factor (blocks 3L and 3H, LOGSCL
+// and LOGSCH).
+func scaleFactor(nb, w, limit int) int {
+    return min(max((nb*127)>>7+w, 0), limit)
+}
+
+// quantizerScale converts the logarithmic scale factor to the linear one
+// (blocks 3L and 3H, SCALEL and SCALEH).
+func quantizerScale(nb, shift int) int {
+    wd1 := (nb >> 6) & 31
+    wd2 := shift - (nb >> 11)
+    if wd2 < 0 {
+        return (g722ILB[wd1] << -wd2) << 2
+    }
+    return (g722ILB[wd1] >> wd2) << 2
+}
+
+// update adapts the pole and zero predictors of a band to a new quantized
+// difference signal (block 4).
+func (b *g722Band) update(d int) {
+    // RECONS and PARREC
+    b.d[0] = d
+    b.r[0] = saturate(b.s + d)
+    b.p[0] = saturate(b.sz + d)
+
+    // UPPOL2
+    var sg [7]int
+    for i := 0; i < 3; i++ {
+        sg[i] = b.p[i] >> 15
+    }
+    wd1 := saturate(b.a[1] << 2)
+    wd2 := wd1
+    if sg[0] == sg[1] {
+        wd2 = -wd1
+    }
+    wd2 = min(wd2, 32767)
+    wd3 := wd2 >> 7
+    if sg[0] == sg[2] {
+        wd3 += 128
+    } else {
+        wd3 -= 128
+    }
+    wd3 += (b.a[2] * 32512) >> 15
+    b.ap[2] = min(max(wd3, -12288), 12288)
+
+    // UPPOL1
+    wd1 = -192
+    if sg[0] == sg[1] {
+        wd1 = 192
+    }
+    wd2 = (b.a[1] * 32640) >> 15
+    b.ap[1] = saturate(wd1 + wd2)
+    wd3 = saturate(15360 - b.ap[2])
+    b.ap[1] = min(max(b.ap[1], -wd3), wd3)
+
+    // UPZERO
+    wd1 = 128
+    if d == 0 {
+        wd1 = 0
+    }
+    sg[0] = d >> 15
+    for i := 1; i < 7; i++ {
+        sg[i] = b.d[i] >> 15
+        wd2 = -wd1
+        if sg[i] == sg[0] {
+            wd2 = wd1
+        }
+        wd3 = (b.b[i] * 32640) >> 15
+        b.bp[i] = saturate(wd2 + wd3)
+    }
+
+    // DELAYA
+    for i := 6; i > 0; i-- {
+        b.d[i] = b.d[i-1]
+        b.b[i] = b.bp[i]
+    }
+    for i := 2; i > 0; i-- {
+        b.r[i] = b.r[i-1]
+        b.p[i] = b.p[i-1]
+        b.a[i] = b.ap[i]
+    }
+
+    // FILTEP
+    wd1 = saturate(b.r[1] + b.r[1])
+    wd1 = (b.a[1] * wd1) >> 15
+    wd2 = saturate(b.r[2] + b.r[2])
+    wd2 = (b.a[2] * wd2) >> 15
+    b.sp = saturate(wd1 + wd2)
+
+    // FILTEZ
+    b.sz = 0
+    for i := 6; i > 0; i-- {
+        wd1 = saturate(b.d[i] + b.d[i])
+        b.sz += (b.b[i] * wd1) >> 15
+    }
+    b.sz = saturate(b.sz)
+
+    // PREDIC
+    b.s = saturate(b.sp + b.sz)
+}
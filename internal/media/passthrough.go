@@ -0,0 +1,53 @@
+package media
+
+import "encoding/binary"
+
+// l16 is uncompressed 16 bit linear PCM at 8 kHz, big-endian (RFC 3551
+// section 4.5.11), on a dynamic payload type.
+type l16 struct{}
+
+func (l16) Name() string       { return "L16" }
+func (l16) PayloadType() uint8 { return 96 }
+func (l16) ClockRate() int     { return 8000 }
+func (l16) Channels() int      { return 1 }
+func (l16) Fmtp() string       { return "" }
+func (l16) SampleRate() int    { return 8000 }
+
+func (l16) Encode(pcm []int16) []byte {
+    payload := make([]byte, 2*len(pcm))
+    for i, sample := range pcm {
+        binary.BigEndian.PutUint16(payload[2*i:], uint16(sample))
+    }
+    return payload
+}
+
+func (l16) Decode(payload []byte) []int16 {
+    pcm := make([]int16, len(payload)/2)
+    for i := range pcm {
+        pcm[i] = int16(binary.BigEndian.Uint16(payload[2*i:]))
+    }
+    return pcm
+}
+
+// opus is a stub of Opus (RFC 7587) for negotiating it with S2 without an
+// encoder: every frame is sent as a 20 ms Opus silence frame and received
+// frames decode to silence, so S2 still has to transcode a valid stream.
+type opus struct{}
+
+// opusSilence is a 20 ms CELT fullband frame of silence.
+var opusSilence = []byte{0xf8, 0xff, 0xfe}
+
+func (opus) Name() string       { return "opus" }
+func (opus) PayloadType() uint8 { return 111 }
+func (opus) ClockRate() int     { return 48000 }
+func (opus) Channels() int      { return 2 }
+func (opus) Fmtp() string       { return "minptime=10;useinbandfec=1" }
+func (opus) SampleRate() int    { return 48000 }
+
+func (opus) Encode(pcm []int16) []byte {
+    return append([]byte(nil), opusSilence...)
+}
+
+func (opus) Decode(payload []byte) []int16 {
+    return make([]int16, 48000*FrameDuration/1000)
+}
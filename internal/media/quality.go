@@ -0,0 +1,41 @@
+package media
+
+// The E-model equipment impairment factor Ie and packet loss robustness Bpl
+// of G.711 with packet loss concealment (ITU-T G.113 appendix I). They rate
+// every codec: G.113 has no narrowband figures for G.722, L16 or Opus, which
+// lose nothing G.711 keeps in the telephone band.
+const (
+    impairment     = 0
+    lossRobustness = 25.1
+)
+
+// RFactor estimates the E-model transmission rating (ITU-T G.107) of a call
+// from the percentage of packets lost and the one-way delay in milliseconds,
+// with default values for the other parameters.
+func RFactor(loss, delay float64) float64 {
+    // Effective equipment impairment, random loss
+    ie := float64(impairment)
+    if loss > 0 {
+        ie += (95 - ie) * loss / (loss + lossRobustness)
+    }
+
+    // Delay impairment, simplified for an echo-free path
+    id := 0.024 * delay
+    if delay > 177.3 {
+        id += 0.11 * (delay - 177.3)
+    }
+
+    return 93.2 - id - ie
+}
+
+// MOS converts an R-factor to an estimated mean opinion score, 1 to 4.5
+// (ITU-T G.107 annex B).
+func MOS(r float64) float64 {
+    switch {
+    case r <= 0:
+        return 1
+    case r >= 100:
+        return 4.5
+    }
+    return 1 + 0.035*r + r*(r-60)*(100-r)*7e-6
+}
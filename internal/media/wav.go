@@ -0,0 +1,159 @@
+package media
+
+import (
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "io"
+    "os"
+    "path/filepath"
+)
+
+// PromptRate is the sample rate of prompts.
+const PromptRate = 8000
+
+// Prompt is a recording calls play to S2, as 8 kHz mono PCM.
+type Prompt struct {
+    Name    string
+    Samples []int16
+}
+
+// Duration returns the length of the prompt in milliseconds.
+func (p *Prompt) Duration() int {
+    return len(p.Samples) * 1000 / PromptRate
+}
+
+// WAV format tags
+const (
+    wavPCM        = 1
+    wavALaw       = 6
+    wavULaw       = 7
+    wavExtensible = 0xfffe
+)
+
+// LoadWAV reads an 8 kHz WAV file of 16 bit linear PCM, or of G.711 A-law or
+// µ-law. Stereo files are mixed down to mono.
+func LoadWAV(path string) (*Prompt, error) {
+    b, err := os.ReadFile(path)
+    if err != nil {
+        return nil, err
+    }
+    samples, err := parseWAV(b)
+    if err != nil {
+        return nil, fmt.Errorf("%s: %v", path, err)
+    }
+    if len(samples) == 0 {
+        return nil, fmt.Errorf("%s: no audio", path)
+    }
+    return &Prompt{Name: filepath.Base(path), Samples: samples}, nil
+}
+
+func parseWAV(b []byte) ([]int16, error) {
+    if len(b) < 12 || string(b[0:4]) != "RIFF" || string(b[8:12]) != "WAVE" {
+        return nil, errors.New("not a WAV file")
+    }
+
+    var format, channels, bits int
+    var rate uint32
+    seenFormat := false
+    for b = b[12:]; len(b) >= 8; {
+        id := string(b[0:4])
+        size := int(binary.LittleEndian.Uint32(b[4:8]))
+        b = b[8:]
+        if size > len(b) {
+            if id != "data" {
+                return nil, io.ErrUnexpectedEOF
+            }
+            // Streamed files may leave the data size unset
+            size = len(b)
+        }
+        chunk := b[:size]
+        // Chunks are padded to an even size
+        b = b[min(size+size%2, len(b)):]
+
+        switch id {
+        case "fmt ":
+            if len(chunk) < 16 {
+                return nil, errors.New("malformed fmt chunk")
+            }
+            format = int(binary.LittleEndian.Uint16(chunk[0:2]))
+            channels = int(binary.LittleEndian.Uint16(chunk[2:4]))
+            rate = binary.LittleEndian.Uint32(chunk[4:8])
+            bits = int(binary.LittleEndian.Uint16(chunk[14:16]))
+            if format == wavExtensible && len(chunk) >= 26 {
+                format = int(binary.LittleEndian.Uint16(chunk[24:26]))
+            }
+            seenFormat = true
+        case "data":
+            if !seenFormat {
+                return nil, errors.New("data before fmt chunk")
+            }
+            if rate != PromptRate {
+                return nil, fmt.Errorf("sample rate is %d Hz, not %d Hz", rate, PromptRate)
+            }
+            if channels < 1 {
+                return nil, errors.New("no channels")
+            }
+            return decodeWAV(chunk, format, bits, channels)
+        }
+    }
+    return nil, errors.New("no data chunk")
+}
+
+// decodeWAV converts interleaved WAV samples to mono linear PCM.
+func decodeWAV(data []byte, format, bits, channels int) ([]int16, error) {
+    var sample func([]byte) int16
+    var width int
+    switch {
+    case format == wavPCM && bits == 16:
+        sample = func(b []byte) int16 { return int16(binary.LittleEndian.Uint16(b)) }
+        width = 2
+    case format == wavULaw && bits == 8:
+        sample = func(b []byte) int16 { return uLawToLinear(b[0]) }
+        width = 1
+    case format == wavALaw && bits == 8:
+        sample = func(b []byte) int16 { return aLawToLinear(b[0]) }
+        width = 1
+    default:
+        return nil, fmt.Errorf("unsupported format %d with %d bit samples", format, bits)
+    }
+
+    frame := width * channels
+    samples := make([]int16, len(data)/frame)
+    for i := range samples {
+        sum := 0
+        for ch := 0; ch < channels; ch++ {
+            sum += int(sample(data[i*frame+ch*width:]))
+        }
+        samples[i] = int16(sum / channels)
+    }
+    return samples, nil
+}
+
+// Player plays a prompt over and over, a frame at a time.
+type Player struct {
+    prompt *Prompt
+    pos    int
+}
+
+func NewPlayer(prompt *Prompt) *Player {
+    return &Player{prompt: prompt}
+}
+
+// Next returns the next frame of FrameDuration at the sample rate, which is
+// upsampled from the prompt's 8 kHz by linear interpolation.
+func (p *Player) Next(sampleRate int) []int16 {
+    samples := p.prompt.Samples
+    n := PromptRate * FrameDuration / 1000
+    frame := make([]int16, sampleRate*FrameDuration/1000)
+    for i := range frame {
+        // Position in the prompt, in 1/sampleRate steps
+        at := i * PromptRate
+        index, fraction := at/sampleRate, at%sampleRate
+        a := int(samples[(p.pos+index)%len(samples)])
+        b := int(samples[(p.pos+index+1)%len(samples)])
+        frame[i] = int16(a + (b-a)*fraction/sampleRate)
+    }
+    p.pos = (p.pos + n) % len(samples)
+    return frame
+}
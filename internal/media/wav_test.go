@@ -0,0 +1,222 @@
+package media
+
+import (
+    "encoding/binary"
+    "os"
+    "path/filepath"
+    "reflect"
+    "strings"
+    "testing"
+)
+
+// wavChunk is a RIFF chunk.
+type wavChunk struct {
+    id   string
+    data []byte
+}
+
+// fmtChunk is a fmt chunk of the given format, and of WAVE_FORMAT_EXTENSIBLE
+// wrapping it when extensible is set.
+func fmtChunk(format, channels int, rate uint32, bits int, extensible bool) wavChunk {
+    width := channels * bits / 8
+    b := binary.LittleEndian.AppendUint16(nil, uint16(format))
+    if extensible {
+        b = binary.LittleEndian.AppendUint16(nil, wavExtensible)
+    }
+    b = binary.LittleEndian.AppendUint16(b, uint16(channels))
+    b = binary.LittleEndian.AppendUint32(b, rate)
+    b = binary.LittleEndian.AppendUint32(b, rate*uint32(width))
+    b = binary.LittleEndian.AppendUint16(b, uint16(width))
+    b = binary.LittleEndian.AppendUint16(b, uint16(bits))
+    if extensible {
+        b = binary.LittleEndian.AppendUint16(b, 22)
+        b = binary.LittleEndian.AppendUint16(b, uint16(bits))
+        b = binary.LittleEndian.AppendUint32(b, 0)
+        b = binary.LittleEndian.AppendUint16(b, uint16(format))
+        b = append(b, 0x00, 0x00, 0x00, 0x00, 0x10, 0x00, 0x80, 0x00, 0x00, 0xaa, 0x00, 0x38, 0x9b, 0x71)
+    }
+    return wavChunk{"fmt ", b}
+}
+
+// pcm16 is 16 bit little-endian samples.
+func pcm16(samples ...int16) []byte {
+    var b []byte
+    for _, s := range samples {
+        b = binary.LittleEndian.AppendUint16(b, uint16(s))
+    }
+    return b
+}
+
+// wavFile builds a RIFF WAVE file of chunks, padding odd sized ones.
+func wavFile(chunks ...wavChunk) []byte {
+    b := []byte("RIFF\x00\x00\x00\x00WAVE")
+    for _, c := range chunks {
+        b = append(b, c.id...)
+        b = binary.LittleEndian.AppendUint32(b, uint32(len(c.data)))
+        b = append(b, c.data...)
+        if len(c.data)%2 == 1 {
+            b = append(b, 0)
+        }
+    }
+    binary.LittleEndian.PutUint32(b[4:], uint32(len(b)-8))
+    return b
+}
+
+func TestParseWAV(t *testing.T) {
+    tests := []struct {
+        name    string
+        file    []byte
+        want    []int16
+        wantErr string
+    }{
+        {
+            name: "16 bit mono",
+            file: wavFile(fmtChunk(wavPCM, 1, 8000, 16, false), wavChunk{"data", pcm16(0, 1000, -1000, 32767)}),
+            want: []int16{0, 1000, -1000, 32767},
+        },
+        {
+            name: "stereo mixed down",
+            file: wavFile(fmtChunk(wavPCM, 2, 8000, 16, false), wavChunk{"data", pcm16(1000, 3000, -32768, -32768)}),
+            want: []int16{2000, -32768},
+        },
+        {
+            name: "µ-law",
+            file: wavFile(fmtChunk(wavULaw, 1, 8000, 8, false), wavChunk{"data", []byte{0xff, 0x80, 0x00}}),
+            want: []int16{0, 32124, -32124},
+        },
+        {
+            name: "A-law",
+            file: wavFile(fmtChunk(wavALaw, 1, 8000, 8, false), wavChunk{"data", []byte{0xd5, 0xaa}}),
+            want: []int16{8, 32256},
+        },
+        {
+            name: "extensible",
+            file: wavFile(fmtChunk(wavPCM, 1, 8000, 16, true), wavChunk{"data", pcm16(7, -7)}),
+            want: []int16{7, -7},
+        },
+        {
+            name: "odd sized chunk before data",
+            file: wavFile(fmtChunk(wavPCM, 1, 8000, 16, false), wavChunk{"LIST", []byte("odd")}, wavChunk{"data", pcm16(5)}),
+            want: []int16{5},
+        },
+        {
+            name: "streamed, data size unset",
+            file: func() []byte {
+                b := wavFile(fmtChunk(wavPCM, 1, 8000, 16, false), wavChunk{"data", pcm16(1, 2, 3)})
+                binary.LittleEndian.PutUint32(b[len(b)-10:], 0xffffffff)
+                return b
+            }(),
+            want: []int16{1, 2, 3},
+        },
+        {
+            name:    "16 kHz",
+            file:    wavFile(fmtChunk(wavPCM, 1, 16000, 16, false), wavChunk{"data", pcm16(1)}),
+            wantErr: "sample rate is 16000 Hz",
+        },
+        {
+            name:    "44.1 kHz",
+            file:    wavFile(fmtChunk(wavPCM, 2, 44100, 16, false), wavChunk{"data", pcm16(1, 1)}),
+            wantErr: "sample rate is 44100 Hz",
+        },
+        {
+            name:    "8 bit linear",
+            file:    wavFile(fmtChunk(wavPCM, 1, 8000, 8, false), wavChunk{"data", []byte{0x80}}),
+            wantErr: "unsupported format",
+        },
+        {
+            name:    "no channels",
+            file:    wavFile(fmtChunk(wavPCM, 0, 8000, 16, false), wavChunk{"data", pcm16(1)}),
+            wantErr: "no channels",
+        },
+        {
+            name:    "data before fmt",
+            file:    wavFile(wavChunk{"data", pcm16(1)}, fmtChunk(wavPCM, 1, 8000, 16, false)),
+            wantErr: "data before fmt",
+        },
+        {
+            name:    "no data",
+            file:    wavFile(fmtChunk(wavPCM, 1, 8000, 16, false)),
+            wantErr: "no data chunk",
+        },
+        {
+            name:    "short fmt",
+            file:    wavFile(wavChunk{"fmt ", []byte{1, 0, 1, 0}}, wavChunk{"data", pcm16(1)}),
+            wantErr: "malformed fmt chunk",
+        },
+        {
+            name:    "truncated chunk",
+            file:    wavFile(fmtChunk(wavPCM, 1, 8000, 16, false), wavChunk{"data", pcm16(1)})[:30],
+            wantErr: "unexpected EOF",
+        },
+        {
+            name:    "not RIFF",
+            file:    []byte("ID3\x04\x00\x00\x00\x00\x00\x00\x00\x00"),
+            wantErr: "not a WAV file",
+        },
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            got, err := parseWAV(tt.file)
+            if tt.wantErr != "" {
+                if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+                    t.Fatalf("got %v, want an error about %q", err, tt.wantErr)
+                }
+                return
+            }
+            if err != nil {
+                t.Fatal(err)
+            }
+            if !reflect.DeepEqual(got, tt.want) {
+                t.Errorf("got %v, want %v", got, tt.want)
+            }
+        })
+    }
+}
+
+func TestLoadWAV(t *testing.T) {
+    dir := t.TempDir()
+    path := filepath.Join(dir, "hello.wav")
+    if err := os.WriteFile(path, wavFile(fmtChunk(wavPCM, 1, 8000, 16, false), wavChunk{"data", pcm16(make([]int16, 4000)...)}), 0o644); err != nil {
+        t.Fatal(err)
+    }
+    prompt, err := LoadWAV(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if prompt.Name != "hello.wav" || prompt.Duration() != 500 {
+        t.Errorf("got %s of %d ms, want hello.wav of 500 ms", prompt.Name, prompt.Duration())
+    }
+
+    empty := filepath.Join(dir, "empty.wav")
+    if err := os.WriteFile(empty, wavFile(fmtChunk(wavPCM, 1, 8000, 16, false), wavChunk{"data", nil}), 0o644); err != nil {
+        t.Fatal(err)
+    }
+    if _, err := LoadWAV(empty); err == nil || !strings.Contains(err.Error(), "empty.wav") {
+        t.Errorf("got %v, want an error naming the file", err)
+    }
+}
+
+func TestPlayer(t *testing.T) {
+    // 25 ms of a ramp, so frames wrap around the end of the prompt
+    samples := make([]int16, 200)
+    for i := range samples {
+        samples[i] = int16(i * 10)
+    }
+    player := NewPlayer(&Prompt{Samples: samples})
+
+    first := player.Next(8000)
+    if len(first) != 160 || first[0] != 0 || first[159] != 1590 {
+        t.Errorf("first frame of %d samples from %d to %d, want 160 from 0 to 1590", len(first), first[0], first[len(first)-1])
+    }
+    second := player.Next(8000)
+    if second[0] != 1600 || second[39] != 1990 || second[40] != 0 {
+        t.Errorf("second frame starts %d and wraps from %d to %d, want 1600, 1990 to 0", second[0], second[39], second[40])
+    }
+
+    // At 16 kHz every other sample is halfway between two of the prompt
+    wide := player.Next(16000)
+    if len(wide) != 320 || wide[0] != 1200 || wide[1] != 1205 || wide[2] != 1210 {
+        t.Errorf("16 kHz frame of %d samples starting %v, want 320 starting 1200 1205 1210", len(wide), wide[:3])
+    }
+}
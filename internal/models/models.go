@@ -3,18 +3,38 @@ package models
 import "time"
 
 type Call struct {
-    ID          string    `json:"id"`
-    ANI         string    `json:"ani"`
-    DNIS        string    `json:"dnis"`
-    StartTime   time.Time `json:"start_time"`
-    EndTime     time.Time `json:"end_time"`
-    Duration    int       `json:"duration"`
-    Status      string    `json:"status"`
-    SIPCallID   string    `json:"sip_call_id"`
-    LocalTag    string    `json:"local_tag"`
-    RemoteTag   string    `json:"remote_tag"`
-    Country     string    `json:"country"`
-    Carrier     string    `json:"carrier"`
+    ID             string    `json:"id"`
+    ANI            string    `json:"ani"`
+    DNIS           string    `json:"dnis"`
+    StartTime      time.Time `json:"start_time"`
+    EndTime        time.Time `json:"end_time"`
+    Duration       int       `json:"duration"`
+    Status         string    `json:"status"`
+    DisconnectedBy string    `json:"disconnected_by"` // "local" or "remote" for answered calls
+    SIPCallID      string    `json:"sip_call_id"`
+    LocalTag       string    `json:"local_tag"`
+    RemoteTag      string    `json:"remote_tag"`
+    Codec          string    `json:"codec"`        // negotiated audio codec, as in PCMU/8000
+    RemoteMedia    string    `json:"remote_media"` // where S2 takes the call's RTP
+    Prompt         string    `json:"prompt"`       // audio file played, empty for silence
+    
+    // Session timer (RFC 4028) as negotiated
+    SessionExpires   int `json:"session_expires"`   // seconds; 0 when the call has none
+    SessionRefreshes int `json:"session_refreshes"` // refreshes S1 sent
+    
+    // Media quality of the RTP S2 sent back, measured when the call ends
+    PacketsSent     uint64  `json:"packets_sent"`
+    PacketsReceived uint64  `json:"packets_received"`
+    PacketsLost     int64   `json:"packets_lost"` // by gaps in sequence numbers
+    Jitter          float64 `json:"jitter"`       // interarrival jitter, ms
+    RTT             float64 `json:"rtt"`          // round trip from RTCP reports, ms; 0 when unknown
+    MOS             float64 `json:"mos"`          // estimated by the E-model; 0 when no RTP came back
+    SSRCChanges     int     `json:"ssrc_changes"`
+    LongestSilence  float64 `json:"longest_silence"` // seconds without audible RTP from S2
+    MediaFailure    string  `json:"media_failure"`   // no_media, one_way_audio, dead_air or ssrc_change
+    
+    Country        string    `json:"country"`
+    Carrier        string    `json:"carrier"`
 }
 
 type NumberPair struct {
@@ -25,15 +45,45 @@ type NumberPair struct {
 }
 
 type Config struct {
-    S2Server struct {
-        Host string `json:"host"`
-        Port int    `json:"port"`
-    } `json:"s2_server"`
+    // Local SIP socket
+    Local struct {
+        Address      string `json:"address"`        // bind and advertise this IP, defaults to all interfaces and the primary IP
+        Port         int    `json:"port"`
+        PortRangeEnd int    `json:"port_range_end"` // try ports up to this one when port is taken
+        Sockets      int    `json:"sockets"`        // calls are spread over this many source ports
+    } `json:"local"`
+    
+    S2Server S2Target `json:"s2_server"`
+    
+    // A cluster of S2 switches calls are balanced over; when empty every call
+    // goes to s2_server
+    S2Targets []S2Target `json:"s2_targets"`
+    
+    // OPTIONS pings that take unresponsive targets out of rotation
+    HealthCheck struct {
+        Enabled   bool `json:"enabled"`
+        Interval  int  `json:"interval"`  // seconds between pings
+        Threshold int  `json:"threshold"` // failed pings before a target is taken out
+        HoldDown  int  `json:"hold_down"` // seconds a target rests after a 503 or timeout, when pings are off
+    } `json:"health_check"`
+    
+    // Register with S2 as a PBX instead of acting as a static IP peer
+    Registration struct {
+        Enabled    bool   `json:"enabled"`
+        User       string `json:"user"`
+        Domain     string `json:"domain"`  // defaults to the registrar host
+        Expires    int    `json:"expires"` // seconds
+        Registrars []struct {
+            Host string `json:"host"`
+            Port int    `json:"port"`
+        } `json:"registrars"` // tried in order, defaults to s2_server
+    } `json:"registration"`
     
     CallParams struct {
         ACDMin           int     `json:"acd_min"`
         ACDMax           int     `json:"acd_max"`
         ASR              float64 `json:"asr"`
+        EnforceASR       bool    `json:"enforce_asr"` // cancel (100-ASR)% of calls before answer
         MaxConcurrent    int     `json:"max_concurrent"`
         MinConcurrent    int     `json:"min_concurrent"`
         CallsPerSecond   float64 `json:"calls_per_second"`
@@ -41,6 +91,20 @@ type Config struct {
         RampDownTime     int     `json:"ramp_down_time"`
         RampUpRate       int     `json:"ramp_up_rate"`    // calls per minute
         RampDownRate     int     `json:"ramp_down_rate"`  // calls per minute
+
+        // How long callers picked by the ASR policy let a call ring before
+        // hanging up, measured from the INVITE
+        PostDialDelay struct {
+            Distribution string  `json:"distribution"` // fixed, uniform, normal or exponential
+            Mean         float64 `json:"mean"`         // seconds
+            StdDev       float64 `json:"std_dev"`      // seconds, normal only
+            Min          float64 `json:"min"`          // seconds
+            Max          float64 `json:"max"`          // seconds
+        } `json:"post_dial_delay"`
+
+        // Codec preference lists; each call offers one of them, picked by
+        // weight
+        Codecs []CodecProfile `json:"codecs"`
     } `json:"call_params"`
     
     Schedule struct {
@@ -62,6 +126,64 @@ type Config struct {
         MaxCPSAdjustment   float64 `json:"max_cps_adjustment"`
     } `json:"autopilot"`
     
+    // Prompts calls play to S2, each looped for the whole call; calls send
+    // silence when none are set. Selection picks a prompt per call: loop
+    // takes them in turn, random at random, and pair always plays the same
+    // one for a number pair.
+    Audio struct {
+        Prompts   []string `json:"prompts"`   // 8 kHz WAV files
+        Selection string   `json:"selection"` // loop, random or pair
+    } `json:"audio"`
+    
+    // Checks on the RTP S2 sends back that fail answered calls; zero values
+    // disable them. The one-way audio check needs S2 to send RTCP reports
+    // on the streams it receives.
+    MediaChecks struct {
+        NoMediaTimeout int  `json:"no_media_timeout"` // seconds after answer without RTP from S2
+        SilenceGap     int  `json:"silence_gap"`      // seconds without audible RTP from S2, dead air
+        OneWayAudio    bool `json:"one_way_audio"`    // S2's RTCP shows it receives none of our RTP
+        SSRCChange     bool `json:"ssrc_change"`      // S2 changes RTP source without a new offer
+    } `json:"media_checks"`
+    
+    // Captures of the SIP and RTP of a sample of calls, a pcap or pcapng
+    // file each. The oldest files are removed once they exceed the total
+    // size or age; zero limits keep them all.
+    Capture struct {
+        Enabled      bool    `json:"enabled"`
+        Dir          string  `json:"dir"`
+        Format       string  `json:"format"`         // pcap or pcapng
+        SampleRate   float64 `json:"sample_rate"`    // percent of calls captured
+        MaxFileSize  int     `json:"max_file_size"`  // MB per call, later packets are dropped
+        MaxTotalSize int     `json:"max_total_size"` // MB of all captures
+        MaxAge       int     `json:"max_age"`        // minutes
+    } `json:"capture"`
+    
+    // Mirroring of SIP, and optionally RTCP, to a Homer collector as HEPv3
+    HEP struct {
+        Enabled   bool   `json:"enabled"`
+        Address   string `json:"address"` // collector host:port, UDP
+        CaptureID uint32 `json:"capture_id"`
+        Password  string `json:"password"`
+        RTCP      bool   `json:"rtcp"`
+    } `json:"hep"`
+    
+    // Session timers (RFC 4028) asked for in INVITEs, so S2 keeps long
+    // calls up as long as they are refreshed
+    SessionTimers struct {
+        Enabled   bool   `json:"enabled"`
+        Expires   int    `json:"expires"`   // seconds, Session-Expires asked for
+        MinSE     int    `json:"min_se"`    // seconds, smallest interval accepted, at least 90
+        Refresher string `json:"refresher"` // uac for S1, uas for S2, or empty to leave it to S2
+        Method    string `json:"method"`    // update or invite, how S1 refreshes
+    } `json:"session_timers"`
+    
+    // DTMF scripts sent once calls are answered, one picked at random per
+    // call; none when empty. "3s 1234#" waits 3 s and sends 1, 2, 3, 4 and #.
+    DTMF struct {
+        Scripts []string `json:"scripts"`
+        Method  string   `json:"method"` // rfc4733 or info
+    } `json:"dtmf"`
+    
     WebInterface struct {
         Enabled bool   `json:"enabled"`
         Port    int    `json:"port"`
@@ -72,17 +194,83 @@ type Config struct {
     } `json:"web_interface"`
 }
 
+// CodecProfile is a list of codecs offered in SDP, in order of preference.
+type CodecProfile struct {
+    Preference []string `json:"preference"` // PCMU, PCMA, G722, L16 or opus
+    Weight     int      `json:"weight"`     // share of calls offering it
+}
+
+// S2Target is an S2 switch calls are sent to.
+type S2Target struct {
+    Name          string `json:"name"` // defaults to host:port
+    Host          string `json:"host"`           // IP or SIP domain, located by NAPTR, SRV and A/AAAA records
+    Port          int    `json:"port"`           // 0 leaves it to SRV records
+    Transport     string `json:"transport"`      // udp, tcp or tls; empty leaves it to NAPTR records
+    Weight        int    `json:"weight"`         // share of calls among targets of equal priority
+    Priority      int    `json:"priority"`       // lower is preferred, higher takes over on failure
+    MaxConcurrent int    `json:"max_concurrent"` // 0 is unlimited
+
+    // Client certificate and trust for the tls transport
+    TLS struct {
+        CertFile           string `json:"cert_file"`
+        KeyFile            string `json:"key_file"`
+        CAFile             string `json:"ca_file"`     // defaults to the system roots
+        ServerName         string `json:"server_name"` // SNI, defaults to host
+        InsecureSkipVerify bool   `json:"insecure_skip_verify"`
+    } `json:"tls"`
+
+    // Digest credentials for INVITEs challenged by the trunk
+    Auth struct {
+        Username string `json:"username"`
+        Password string `json:"password"`
+        Realm    string `json:"realm"` // optional, answer only this realm
+    } `json:"auth"`
+}
+
 type Statistics struct {
-    TotalCalls          int64     `json:"total_calls"`
-    SuccessfulCalls     int64     `json:"successful_calls"`
-    FailedCalls         int64     `json:"failed_calls"`
-    ActiveCalls         int64     `json:"active_calls"`
-    CurrentCPS          float64   `json:"current_cps"`
-    AverageCallDuration float64   `json:"average_call_duration"`
-    CurrentASR          float64   `json:"current_asr"`
-    StartTime           time.Time `json:"start_time"`
-    LastUpdate          time.Time `json:"last_update"`
+    TotalCalls          int64                `json:"total_calls"`
+    SuccessfulCalls     int64                `json:"successful_calls"`
+    FailedCalls         int64                `json:"failed_calls"`
+    CanceledCalls       int64                `json:"canceled_calls"`
+    TimedOutCalls       int64                `json:"timed_out_calls"`
+    CodecMismatches     int64                `json:"codec_mismatches"`
+    RemoteHangups       int64                `json:"remote_hangups"`
+    ActiveCalls         int64                `json:"active_calls"`
+    ResponseCodes       map[int]int64        `json:"response_codes"` // final 3xx-6xx responses by status code
+    MediaFailures       map[string]int64     `json:"media_failures"` // answered calls failed by the media checks, by reason
+    CurrentCPS          float64              `json:"current_cps"`
+    AverageCallDuration float64              `json:"average_call_duration"`
+    CurrentASR          float64              `json:"current_asr"`
+    Media               MediaQuality         `json:"media"`
+    StartTime           time.Time            `json:"start_time"`
+    LastUpdate          time.Time            `json:"last_update"`
     HourlyStats         map[int]*HourlyStats `json:"hourly_stats"`
+    Targets             []TargetStatistics   `json:"targets"`
+}
+
+// TargetStatistics are the health and call counters of one S2 target.
+type TargetStatistics struct {
+    Name            string    `json:"name"`
+    Priority        int       `json:"priority"`
+    Weight          int       `json:"weight"`
+    Healthy         bool      `json:"healthy"`
+    ActiveCalls     int       `json:"active_calls"`
+    TotalCalls      int64     `json:"total_calls"`
+    SuccessfulCalls int64     `json:"successful_calls"`
+    FailedCalls     int64     `json:"failed_calls"`
+    Failovers       int64     `json:"failovers"` // calls moved to another target after a 503 or timeout
+    PingRTT         float64   `json:"ping_rtt"`  // milliseconds
+    LastPing        time.Time `json:"last_ping"`
+}
+
+// MediaQuality is the media quality of answered calls, averaged over those S2
+// sent RTP on, media failures included.
+type MediaQuality struct {
+    Calls      int64   `json:"calls"`
+    PacketLoss float64 `json:"packet_loss"` // percent of all packets
+    Jitter     float64 `json:"jitter"`      // ms
+    RTT        float64 `json:"rtt"`         // ms, over calls with RTCP round trips
+    MOS        float64 `json:"mos"`
 }
 
 type HourlyStats struct {
@@ -0,0 +1,295 @@
+package sip
+
+import (
+    "crypto/md5"
+    "crypto/rand"
+    "crypto/sha256"
+    "encoding/hex"
+    "fmt"
+    "hash"
+    "strings"
+
+    "github.com/s1-callgen/internal/sip/message"
+)
+
+// maxAuthAttempts bounds how often a request is resent with credentials:
+// once for a proxy, once for S2 and once more for a stale nonce.
+const maxAuthAttempts = 3
+
+// Credentials authenticate requests to S2 with HTTP digest (RFC 3261 section
+// 22.4, RFC 8760). When Realm is set only challenges for that realm are
+// answered.
+type Credentials struct {
+    Username string
+    Password string
+    Realm    string
+}
+
+// challenge is a parsed WWW-Authenticate or Proxy-Authenticate header.
+type challenge struct {
+    realm     string
+    nonce     string
+    opaque    string
+    algorithm string
+    qop       []string
+    stale     bool
+}
+
+// parseChallenge parses a Digest challenge.
+func parseChallenge(value string) (*challenge, error) {
+    scheme, rest, _ := strings.Cut(strings.TrimSpace(value), " ")
+    if !strings.EqualFold(scheme, "Digest") {
+        return nil, fmt.Errorf("sip: unsupported authentication scheme %q", scheme)
+    }
+
+    params := parseAuthParams(rest)
+    ch := &challenge{
+        realm:     params["realm"],
+        nonce:     params["nonce"],
+        opaque:    params["opaque"],
+        algorithm: params["algorithm"],
+        stale:     strings.EqualFold(params["stale"], "true"),
+    }
+    if ch.algorithm == "" {
+        ch.algorithm = "MD5"
+    }
+    for _, qop := range strings.Split(params["qop"], ",") {
+        if qop = strings.TrimSpace(qop); qop != "" {
+            ch.qop = append(ch.qop, qop)
+        }
+    }
+    if ch.nonce == "" {
+        return nil, fmt.Errorf("sip: digest challenge without nonce")
+    }
+
+    return ch, nil
+}
+
+// parseAuthParams parses the comma-separated name=value pairs of a digest
+// header, unquoting quoted values.
+func parseAuthParams(s string) map[string]string {
+    params := make(map[string]string)
+    for len(s) > 0 {
+        s = strings.TrimLeft(s, " \t,")
+        name, rest, found := strings.Cut(s, "=")
+        if !found {
+            break
+        }
+        name = strings.ToLower(strings.TrimSpace(name))
+        rest = strings.TrimLeft(rest, " \t")
+
+        var value string
+        if strings.HasPrefix(rest, `"`) {
+            var b strings.Builder
+            i := 1
+            for ; i < len(rest) && rest[i] != '"'; i++ {
+                if rest[i] == '\\' && i+1 < len(rest) {
+                    i++
+                }
+                b.WriteByte(rest[i])
+            }
+            value = b.String()
+            s = rest[min(i+1, len(rest)):]
+        } else {
+            value, s, _ = strings.Cut(rest, ",")
+            value = strings.TrimSpace(value)
+        }
+        params[name] = value
+    }
+    return params
+}
+
+// hashFor returns the hash function of a digest algorithm and whether it is
+// a -sess variant.
+func hashFor(algorithm string) (func() hash.Hash, bool, error) {
+    switch strings.ToUpper(algorithm) {
+    case "MD5":
+        return md5.New, false, nil
+    case "MD5-SESS":
+        return md5.New, true, nil
+    case "SHA-256":
+        return sha256.New, false, nil
+    case "SHA-256-SESS":
+        return sha256.New, true, nil
+    default:
+        return nil, false, fmt.Errorf("sip: unsupported digest algorithm %q", algorithm)
+    }
+}
+
+// authorization computes the Authorization or Proxy-Authorization value that
+// answers ch for a request.
+func (cr Credentials) authorization(ch *challenge, method, uri string, body []byte) (string, error) {
+    return cr.digest(ch, method, uri, body, generateCnonce(), "00000001")
+}
+
+// digest computes the credentials answering ch with the given client nonce
+// and nonce count.
+func (cr Credentials) digest(ch *challenge, method, uri string, body []byte, cnonce, nc string) (string, error) {
+    newHash, sess, err := hashFor(ch.algorithm)
+    if err != nil {
+        return "", err
+    }
+    h := func(s string) string {
+        sum := newHash()
+        sum.Write([]byte(s))
+        return hex.EncodeToString(sum.Sum(nil))
+    }
+
+    ha1 := h(cr.Username + ":" + ch.realm + ":" + cr.Password)
+    if sess {
+        ha1 = h(ha1 + ":" + ch.nonce + ":" + cnonce)
+    }
+
+    // Prefer qop=auth; fall back to auth-int, which also covers the body
+    qop := ""
+    for _, offered := range ch.qop {
+        if offered == "auth" {
+            qop = "auth"
+            break
+        }
+        if offered == "auth-int" {
+            qop = "auth-int"
+        }
+    }
+
+    ha2 := h(method + ":" + uri)
+    if qop == "auth-int" {
+        ha2 = h(method + ":" + uri + ":" + h(string(body)))
+    }
+
+    var response string
+    if qop == "" {
+        response = h(ha1 + ":" + ch.nonce + ":" + ha2)
+    } else {
+        response = h(ha1 + ":" + ch.nonce + ":" + nc + ":" + cnonce + ":" + qop + ":" + ha2)
+    }
+
+    var b strings.Builder
+    fmt.Fprintf(&b, `Digest username="%s", realm="%s", nonce="%s", uri="%s", response="%s", algorithm=%s`,
+        cr.Username, ch.realm, ch.nonce, uri, response, ch.algorithm)
+    if ch.opaque != "" {
+        fmt.Fprintf(&b, `, opaque="%s"`, ch.opaque)
+    }
+    if qop != "" {
+        fmt.Fprintf(&b, `, qop=%s, nc=%s, cnonce="%s"`, qop, nc, cnonce)
+    }
+
+    return b.String(), nil
+}
+
+// digestPreference orders algorithms from strongest to weakest.
+var digestPreference = []string{"SHA-256-SESS", "SHA-256", "MD5-SESS", "MD5"}
+
+// authorize returns a copy of req carrying credentials for the 401 or 407
+// challenge in resp. The copy is a new transaction: it gets the given branch
+// and the next CSeq number (RFC 3261 section 22.2). Credentials from an
+// earlier attempt for the realm answered are replaced; those for other
+// realms, as for a proxy that challenged before S2, are kept.
+func authorize(req *message.Request, resp *message.Response, cr Credentials, branch string) (*message.Request, error) {
+    challengeHeader, authHeader := authHeaders(resp)
+
+    var chosen *challenge
+    rank := len(digestPreference)
+    for _, value := range resp.Header.Values(challengeHeader) {
+        ch, err := parseChallenge(value)
+        if err != nil {
+            continue
+        }
+        if cr.Realm != "" && ch.realm != cr.Realm {
+            continue
+        }
+        for i, algorithm := range digestPreference {
+            if strings.EqualFold(ch.algorithm, algorithm) && i < rank {
+                chosen, rank = ch, i
+            }
+        }
+    }
+    if chosen == nil {
+        return nil, fmt.Errorf("sip: no usable digest challenge in %d response", resp.StatusCode)
+    }
+
+    value, err := cr.authorization(chosen, req.Method, req.URI.String(), req.Body)
+    if err != nil {
+        return nil, err
+    }
+
+    via, err := req.Header.Via()
+    if err != nil {
+        return nil, err
+    }
+    via.Params.Set("branch", branch)
+    seq, method, err := req.Header.CSeq()
+    if err != nil {
+        return nil, err
+    }
+
+    authed := &message.Request{
+        Method: req.Method,
+        URI:    req.URI,
+        Header: req.Header.Clone(),
+        Body:   req.Body,
+    }
+    authed.Header.Set("Via", via.String())
+    authed.Header.Set("CSeq", fmt.Sprintf("%d %s", seq+1, method))
+    authed.Header.Del(authHeader)
+    for _, earlier := range req.Header.Values(authHeader) {
+        if credentialsRealm(earlier) != chosen.realm {
+            authed.Header.Add(authHeader, earlier)
+        }
+    }
+    authed.Header.Add(authHeader, value)
+
+    return authed, nil
+}
+
+// authHeaders returns the header a 401 or 407 challenges in and the one
+// answering it.
+func authHeaders(resp *message.Response) (challenge, credentials string) {
+    if resp.StatusCode == 407 {
+        return "Proxy-Authenticate", "Proxy-Authorization"
+    }
+    return "WWW-Authenticate", "Authorization"
+}
+
+// credentialsRealm returns the realm of an Authorization or
+// Proxy-Authorization value.
+func credentialsRealm(value string) string {
+    _, params, _ := strings.Cut(strings.TrimSpace(value), " ")
+    return parseAuthParams(params)["realm"]
+}
+
+// rechallenged reports whether a 401 or 407 challenges only realms req
+// already carried credentials for, so that it rejects them rather than asks
+// for those of another realm, as S2 does after a proxy.
+func rechallenged(req *message.Request, resp *message.Response) bool {
+    challengeHeader, authHeader := authHeaders(resp)
+    answered := make(map[string]bool)
+    for _, value := range req.Header.Values(authHeader) {
+        answered[credentialsRealm(value)] = true
+    }
+    for _, value := range resp.Header.Values(challengeHeader) {
+        if ch, err := parseChallenge(value); err == nil && !answered[ch.realm] {
+            return false
+        }
+    }
+    return true
+}
+
+// staleChallenge reports whether a 401 or 407 only rejected the nonce of our
+// credentials, not the credentials themselves.
+func staleChallenge(resp *message.Response) bool {
+    for _, name := range []string{"WWW-Authenticate", "Proxy-Authenticate"} {
+        for _, value := range resp.Header.Values(name) {
+            if ch, err := parseChallenge(value); err == nil && ch.stale {
+                return true
+            }
+        }
+    }
+    return false
+}
+
+func generateCnonce() string {
+    b := make([]byte, 8)
+    rand.Read(b)
+    return hex.EncodeToString(b)
+}
@@ -0,0 +1,230 @@
+package sip
+
+import (
+    "strings"
+    "testing"
+
+    "github.com/s1-callgen/internal/sip/message"
+)
+
+func TestDigest(t *testing.T) {
+    // RFC 2617 section 3.5
+    rfc2617 := &challenge{
+        realm:  "testrealm@host.com",
+        nonce:  "dcd98b7102dd2f0e8b11d0f600bfb0c093",
+        opaque: "5ccc069c403ebaf9f0171e9517f40e41",
+        qop:    []string{"auth", "auth-int"},
+    }
+    // RFC 7616 section 3.9.1
+    rfc7616 := &challenge{
+        realm:  "http-auth@example.org",
+        nonce:  "7ypf/xlj9XXwfDPEoM4URrv/xwf94BcCAzFZH4GiTo0v",
+        opaque: "FQhe/qaU925kfnzjCev0ciny7QMkPqMAFRtzCUYo5tdS",
+        qop:    []string{"auth", "auth-int"},
+    }
+    with := func(ch *challenge, algorithm string, qop ...string) *challenge {
+        c := *ch
+        c.algorithm = algorithm
+        if qop != nil {
+            c.qop = qop
+        }
+        return &c
+    }
+
+    tests := []struct {
+        name      string
+        ch        *challenge
+        password  string
+        cnonce    string
+        response  string
+        algorithm string
+    }{
+        {
+            name:     "RFC 2617 MD5",
+            ch:       with(rfc2617, "MD5"),
+            password: "Circle Of Life",
+            cnonce:   "0a4f113b",
+            response: "6629fae49393a05397450978507c4ef1",
+        },
+        {
+            // The RFC has no example of MD5-sess; this is its example
+            // computed by Python's hashlib
+            name:     "RFC 2617 MD5-sess",
+            ch:       with(rfc2617, "MD5-sess"),
+            password: "Circle Of Life",
+            cnonce:   "0a4f113b",
+            response: "8e3825c57e897f5a0dec6c2d4e5059d0",
+        },
+        {
+            name:     "RFC 2617 MD5 without qop",
+            ch:       with(rfc2617, "MD5", []string{}...),
+            password: "Circle Of Life",
+            cnonce:   "0a4f113b",
+            response: "670fd8c2df070c60b045671b8b24ff02",
+        },
+        {
+            name:     "RFC 7616 MD5",
+            ch:       with(rfc7616, "MD5"),
+            password: "Circle of Life",
+            cnonce:   "f2/wE4q74E6zIJEtWaHKaf5wv/H5QzzpXusqGemxURZJ",
+            response: "8ca523f5e9506fed4657c9700eebdbec",
+        },
+        {
+            name:     "RFC 7616 SHA-256",
+            ch:       with(rfc7616, "SHA-256"),
+            password: "Circle of Life",
+            cnonce:   "f2/wE4q74E6zIJEtWaHKaf5wv/H5QzzpXusqGemxURZJ",
+            response: "753927fa0e85d155564e2e272a28d1802ca10daf4496794697cf8db5856cb6c1",
+        },
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            cr := Credentials{Username: "Mufasa", Password: tt.password}
+            value, err := cr.digest(tt.ch, "GET", "/dir/index.html", nil, tt.cnonce, "00000001")
+            if err != nil {
+                t.Fatal(err)
+            }
+            if !strings.HasPrefix(value, "Digest ") {
+                t.Fatalf("got %q, want Digest credentials", value)
+            }
+            params := parseAuthParams(strings.TrimPrefix(value, "Digest "))
+            if params["response"] != tt.response {
+                t.Errorf("response %s, want %s", params["response"], tt.response)
+            }
+            want := map[string]string{
+                "username":  "Mufasa",
+                "realm":     tt.ch.realm,
+                "nonce":     tt.ch.nonce,
+                "uri":       "/dir/index.html",
+                "algorithm": tt.ch.algorithm,
+                "opaque":    tt.ch.opaque,
+            }
+            if len(tt.ch.qop) > 0 {
+                want["qop"], want["nc"], want["cnonce"] = "auth", "00000001", tt.cnonce
+            }
+            for name, value := range want {
+                if params[name] != value {
+                    t.Errorf("%s=%q, want %q", name, params[name], value)
+                }
+            }
+        })
+    }
+
+    if _, err := (Credentials{}).digest(with(rfc2617, "SHA-512-256"), "GET", "/", nil, "x", "00000001"); err == nil {
+        t.Error("answered a challenge of an unknown algorithm")
+    }
+}
+
+func TestParseChallenge(t *testing.T) {
+    ch, err := parseChallenge(`Digest realm="s2, \"east\"", nonce="abc", qop="auth,auth-int", stale=TRUE, opaque="xyz"`)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if ch.realm != `s2, "east"` || ch.nonce != "abc" || ch.opaque != "xyz" || !ch.stale || ch.algorithm != "MD5" ||
+        len(ch.qop) != 2 || ch.qop[0] != "auth" || ch.qop[1] != "auth-int" {
+        t.Errorf("got %+v", ch)
+    }
+
+    for _, value := range []string{`Basic realm="s2"`, `Digest realm="s2"`} {
+        if _, err := parseChallenge(value); err == nil {
+            t.Errorf("parsed %s", value)
+        }
+    }
+}
+
+// parseRequest parses a request for a test.
+func parseRequest(t *testing.T, raw string) *message.Request {
+    t.Helper()
+    msg, err := message.Parse([]byte(strings.ReplaceAll(raw, "\n", "\r\n")))
+    if err != nil {
+        t.Fatal(err)
+    }
+    req, ok := msg.(*message.Request)
+    if !ok {
+        t.Fatalf("%q is not a request", raw)
+    }
+    return req
+}
+
+// challengeResponse is a 401 or 407 to req with the given challenges.
+func challengeResponse(req *message.Request, status int, challenges ...string) *message.Response {
+    header := "WWW-Authenticate"
+    if status == 407 {
+        header = "Proxy-Authenticate"
+    }
+    resp := message.NewResponse(req, status, "Unauthorized")
+    for _, ch := range challenges {
+        resp.Header.Add(header, ch)
+    }
+    return resp
+}
+
+func TestAuthorize(t *testing.T) {
+    invite := parseRequest(t, `INVITE sip:200@s2.example.com SIP/2.0
+Via: SIP/2.0/UDP 10.0.0.1:5060;branch=z9hG4bK1
+From: <sip:100@s1.example.com>;tag=a
+To: <sip:200@s2.example.com>
+Call-ID: auth@s1
+CSeq: 1 INVITE
+Content-Length: 0
+
+`)
+    cr := Credentials{Username: "s1", Password: "secret"}
+
+    // The proxy challenges first, offering its strongest algorithm too
+    proxy := challengeResponse(invite, 407,
+        `Digest realm="proxy", nonce="p1", algorithm=MD5`,
+        `Digest realm="proxy", nonce="p2", algorithm=SHA-256, qop="auth"`)
+    first, err := authorize(invite, proxy, cr, "z9hG4bK2")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if seq, _, _ := first.Header.CSeq(); seq != 2 {
+        t.Errorf("CSeq %d, want 2", seq)
+    }
+    if via, _ := first.Header.Via(); via.Branch() != "z9hG4bK2" {
+        t.Errorf("branch %s, want z9hG4bK2", via.Branch())
+    }
+    if got := first.Header.Values("Proxy-Authorization"); len(got) != 1 || !strings.Contains(got[0], `nonce="p2"`) || !strings.Contains(got[0], "algorithm=SHA-256") {
+        t.Errorf("Proxy-Authorization %q, want SHA-256 for nonce p2", got)
+    }
+    if rechallenged(first, challengeResponse(first, 401, `Digest realm="s2", nonce="s1"`)) {
+        t.Error("a challenge from S2 after the proxy's taken as a rejection")
+    }
+
+    // Then S2: the proxy's credentials stay
+    second, err := authorize(first, challengeResponse(first, 401, `Digest realm="s2", nonce="s1"`), cr, "z9hG4bK3")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if got := second.Header.Values("Proxy-Authorization"); len(got) != 1 || credentialsRealm(got[0]) != "proxy" {
+        t.Errorf("Proxy-Authorization %q, want the proxy's kept", got)
+    }
+    if got := second.Header.Values("Authorization"); len(got) != 1 || credentialsRealm(got[0]) != "s2" {
+        t.Errorf("Authorization %q, want S2's", got)
+    }
+    if seq, _, _ := second.Header.CSeq(); seq != 3 {
+        t.Errorf("CSeq %d, want 3", seq)
+    }
+    if !rechallenged(second, challengeResponse(second, 401, `Digest realm="s2", nonce="s2"`)) {
+        t.Error("a second challenge of S2's realm not taken as a rejection")
+    }
+
+    // A stale nonce of S2 replaces only S2's credentials
+    third, err := authorize(second, challengeResponse(second, 401, `Digest realm="s2", nonce="s3", stale=true`), cr, "z9hG4bK4")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if got := third.Header.Values("Authorization"); len(got) != 1 || !strings.Contains(got[0], `nonce="s3"`) {
+        t.Errorf("Authorization %q, want one for nonce s3", got)
+    }
+    if got := third.Header.Values("Proxy-Authorization"); len(got) != 1 {
+        t.Errorf("Proxy-Authorization %q, want the proxy's kept", got)
+    }
+
+    // Credentials for one realm answer no other
+    if _, err := authorize(invite, challengeResponse(invite, 401, `Digest realm="other", nonce="o"`), Credentials{Username: "s1", Realm: "s2"}, "z9hG4bK5"); err == nil {
+        t.Error("answered the challenge of another realm")
+    }
+}
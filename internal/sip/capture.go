@@ -0,0 +1,113 @@
+package sip
+
+import (
+    "net"
+
+    "github.com/s1-callgen/internal/capture"
+    "github.com/s1-callgen/internal/hep"
+    "github.com/s1-callgen/internal/sip/message"
+)
+
+// SetCapture sets the capturer that records the SIP messages and RTP of
+// sampled calls, or nil for none.
+func (c *Client) SetCapture(capturer *capture.Capturer) {
+    c.capturer = capturer
+}
+
+// tracing reports whether SIP messages are captured or mirrored.
+func (c *Client) tracing() bool {
+    return c.capturer != nil || c.hep != nil
+}
+
+// traceMessage mirrors a SIP message sent or received to the HEP collector,
+// and records it in the capture of its call when the call is captured.
+func (c *Client) traceMessage(msg message.Message, b []byte, from, to net.Addr) {
+    from, to = c.advertised(from), c.advertised(to)
+    callID := msg.Headers().CallID()
+    c.mirror(hep.ProtocolSIP, callID, from, to, b)
+    if c.capturer == nil {
+        return
+    }
+
+    sh := c.shardFor(callID)
+    sh.mu.Lock()
+    sess := sh.sessions[callID]
+    sh.mu.Unlock()
+    if sess != nil {
+        sess.capture.Packet(from, to, b)
+    }
+}
+
+// advertised returns an address with the local IP in place of the
+// unspecified one sockets bound to all interfaces report.
+func (c *Client) advertised(addr net.Addr) net.Addr {
+    switch a := addr.(type) {
+    case *net.UDPAddr:
+        if a != nil && (a.IP == nil || a.IP.IsUnspecified()) {
+            return &net.UDPAddr{IP: net.ParseIP(c.localIP), Port: a.Port}
+        }
+    case *net.TCPAddr:
+        if a != nil && (a.IP == nil || a.IP.IsUnspecified()) {
+            return &net.TCPAddr{IP: net.ParseIP(c.localIP), Port: a.Port}
+        }
+    }
+    return addr
+}
+
+// streamCapture is where a stream records its RTP and RTCP packets, and
+// mirrors its RTCP.
+type streamCapture struct {
+    call   *capture.Call // nil when the call is not captured
+    client *Client       // mirrors RTCP, nil when it is not
+    callID string
+    rtp    net.Addr // local addresses as advertised
+    rtcp   net.Addr
+}
+
+// captureStream records the packets of a call's stream in its capture, and
+// has its RTCP mirrored to the HEP collector when configured.
+func (c *Client) captureStream(s *rtpStream, call *capture.Call, callID string) {
+    mirrorRTCP := c.hep != nil && c.hepRTCP
+    if call == nil && !mirrorRTCP {
+        return
+    }
+    sc := &streamCapture{
+        call:   call,
+        callID: callID,
+        rtp:    c.advertised(s.conn.LocalAddr()),
+        rtcp:   c.advertised(s.rtcp.LocalAddr()),
+    }
+    if mirrorRTCP {
+        sc.client = c
+    }
+    s.capture.Store(sc)
+}
+
+// captureRTP records an RTP packet sent or received, when the stream is
+// captured.
+func (s *rtpStream) captureRTP(packet []byte, remote net.Addr, sent bool) {
+    if sc := s.capture.Load(); sc != nil {
+        if sent {
+            sc.call.Packet(sc.rtp, remote, packet)
+        } else {
+            sc.call.Packet(remote, sc.rtp, packet)
+        }
+    }
+}
+
+// captureRTCP records an RTCP packet sent or received, when the stream is
+// captured, and mirrors it when RTCP is.
+func (s *rtpStream) captureRTCP(packet []byte, remote net.Addr, sent bool) {
+    sc := s.capture.Load()
+    if sc == nil {
+        return
+    }
+    from, to := remote, sc.rtcp
+    if sent {
+        from, to = sc.rtcp, remote
+    }
+    sc.call.Packet(from, to, packet)
+    if sc.client != nil {
+        sc.client.mirror(hep.ProtocolRTCP, sc.callID, from, to, packet)
+    }
+}
@@ -1,63 +1,144 @@
 package sip
 
 import (
+    "context"
+    "crypto/tls"
+    "errors"
     "fmt"
     "log"
     "math/rand"
     "net"
+    "strconv"
     "strings"
     "sync"
+    "sync/atomic"
     "time"
-    
+
+    "github.com/s1-callgen/internal/capture"
+    "github.com/s1-callgen/internal/hep"
+    "github.com/s1-callgen/internal/media"
     "github.com/s1-callgen/internal/models"
+    "github.com/s1-callgen/internal/sip/message"
+    "github.com/s1-callgen/internal/sip/sdp"
 )
 
+const userAgent = "S1-CallGenerator/1.0"
+
 type Client struct {
-    localIP    string
-    localPort  int
-    remoteIP   string
-    remotePort int
-    transport  string
-    conn       net.Conn
-    mu         sync.Mutex
-    activeCalls map[string]*models.Call
-    rtpPorts   chan int
+    localIP      string
+    localPort    int
+    bindIP       string
+    firstPort    int
+    lastPort     int
+    mu           sync.RWMutex
+    remoteIP     string
+    remotePort   int
+    remoteAddr   atomic.Pointer[net.UDPAddr]
+    locator      *Locator
+    located      []Destination // guarded by mu
+    relocation   *time.Timer   // guarded by mu
+    closed       bool          // guarded by mu
+    transport    string
+    transportSet bool // false while DNS may still pick the transport
+    tlsConfig    *tls.Config
+    credentials  *Credentials
+    mediaChecks  MediaChecks
+    timers       SessionTimers
+    timing       transactionTimers
+    capturer     *capture.Capturer
+    hep          *hep.Sender
+    hepRTCP      bool
+    shards       []*shard
+    callSeq      atomic.Uint64
+    rtpPorts     chan int
 }
 
 func NewClient(localIP string, localPort int, remoteIP string, remotePort int) (*Client, error) {
-    // Initialize RTP port pool (even ports from 10000-20000)
-    rtpPorts := make(chan int, 1000)
-    for i := 10000; i < 20000; i += 2 {
-        rtpPorts <- i
-    }
-    
-    return &Client{
-        localIP:     localIP,
-        localPort:   localPort,
-        remoteIP:    remoteIP,
-        remotePort:  remotePort,
-        transport:   "UDP",
-        activeCalls: make(map[string]*models.Call),
-        rtpPorts:    rtpPorts,
-    }, nil
+    c := &Client{
+        localIP:    localIP,
+        localPort:  localPort,
+        firstPort:  localPort,
+        lastPort:   localPort,
+        remoteIP:   strings.Trim(remoteIP, "[]"), // IPv6 literals may come bracketed
+        remotePort: remotePort,
+        transport:  TransportUDP,
+        timing:     defaultTimers,
+        rtpPorts:   rtpPortPool(),
+    }
+    c.SetSockets(1)
+    return c, nil
 }
 
 func (c *Client) Connect() error {
-    addr := fmt.Sprintf("%s:%d", c.remoteIP, c.remotePort)
-    conn, err := net.Dial("udp", addr)
-    if err != nil {
+    if err := c.locate(); err != nil {
         return fmt.Errorf("failed to connect: %v", err)
     }
-    c.conn = conn
-    
-    // Start listening for responses
-    go c.listenResponses()
-    
-    log.Printf("[SIP] Connected to %s", addr)
+    if !c.reliable() {
+        return c.connectUDP()
+    }
+
+    // Each shard keeps its own connection to S2, on which it also listens
+    // for responses and requests
+    for _, sh := range c.shards {
+        if err := sh.connect(); err != nil {
+            return fmt.Errorf("failed to connect: %v", err)
+        }
+    }
+
+    remoteIP, remotePort := c.target()
+    log.Printf("[SIP] Connected to %s over %s", message.HostPort(remoteIP, remotePort), c.transport)
     return nil
 }
 
-func (c *Client) MakeCall(ani, dnis string, duration time.Duration) error {
+// Retarget points the client at another S2 server, as when registration
+// fails over to a backup registrar. Calls already in progress lose their
+// signaling path.
+func (c *Client) Retarget(host string, port int) error {
+    c.mu.Lock()
+    c.remoteIP = strings.Trim(host, "[]")
+    c.remotePort = port
+    c.mu.Unlock()
+
+    // UDP sockets stay bound; only the destination changes. Stream
+    // connections are replaced.
+    return c.Connect()
+}
+
+// target returns the S2 server the client currently talks to.
+func (c *Client) target() (string, int) {
+    c.mu.RLock()
+    defer c.mu.RUnlock()
+    return c.remoteIP, c.remotePort
+}
+
+// CallOptions are the per-call choices of MakeCall.
+type CallOptions struct {
+    // Codecs are offered in this order of preference, by encoding name as
+    // known to the media package. PCMU and PCMA when empty.
+    Codecs []string
+
+    // Prompt is played in a loop for as long as the call lasts. Silence is
+    // sent when nil.
+    Prompt *media.Prompt
+
+    // DTMF is sent once the call is answered, as RFC 4733 telephone events
+    // or, with DTMFInfo, as SIP INFO requests.
+    DTMF     media.DTMFScript
+    DTMFInfo bool
+}
+
+// defaultCodecs are offered when CallOptions leaves the codecs unset.
+var defaultCodecs = []string{"PCMU", "PCMA"}
+
+// MakeCall places a call and holds it for duration once answered, or until S2
+// hangs up. The call record is returned in every case. The error is nil only
+// when a 2xx final response was received with a usable answer and the media
+// passed the checks; a rejected call returns a *ResponseError, an unanswered
+// one ErrTimeout, one answered without a common codec ErrCodecMismatch, one
+// whose media failed a *MediaError and one whose session timer ran out
+// ErrSessionExpired. If ctx is done before the call is answered the INVITE is
+// canceled and ErrCanceled is returned.
+func (c *Client) MakeCall(ctx context.Context, ani, dnis string, duration time.Duration, opts CallOptions) (*models.Call, error) {
     call := &models.Call{
         ID:        fmt.Sprintf("%d", time.Now().UnixNano()),
         ANI:       ani,
@@ -67,207 +148,693 @@ func (c *Client) MakeCall(ani, dnis string, duration time.Duration) error {
         SIPCallID: c.generateCallID(),
         LocalTag:  c.generateTag(),
     }
-    
-    // Get RTP port
-    rtpPort := <-c.rtpPorts
-    defer func() { c.rtpPorts <- rtpPort }()
-    
-    // Send INVITE
-    invite := c.buildINVITE(call, rtpPort)
-    if err := c.sendMessage(invite); err != nil {
-        return err
-    }
-    
-    c.mu.Lock()
-    c.activeCalls[call.SIPCallID] = call
-    c.mu.Unlock()
-    
+
+    names := opts.Codecs
+    if len(names) == 0 {
+        names = defaultCodecs
+    }
+    codecs := make([]media.Codec, len(names))
+    for i, name := range names {
+        codec, err := media.New(name)
+        if err != nil {
+            call.Status = "FAILED"
+            return call, err
+        }
+        codecs[i] = codec
+    }
+
+    // The capture is closed last, once the stream sent its RTCP BYE
+    recording := c.capturer.Start(call.SIPCallID)
+    defer recording.Close()
+
+    // Get RTP port, and bind it before offering it
+    stream, rtpPort, err := c.openStream()
+    if err != nil {
+        call.Status = "FAILED"
+        return call, err
+    }
+    defer func() {
+        stream.close()
+        c.rtpPorts <- rtpPort
+    }()
+    c.captureStream(stream, recording, call.SIPCallID)
+
+    sess := newSession(call, rtpPort)
+    sess.stream = stream
+    sess.codecs = codecs
+    sess.capture = recording
+    sess.timer.minSE = max(c.timers.MinSE, minSessionExpires)
+    if opts.Prompt != nil {
+        call.Prompt = opts.Prompt.Name
+        stream.player = media.NewPlayer(opts.Prompt)
+    }
+
+    sh := c.shardFor(call.SIPCallID)
+    sh.mu.Lock()
+    sh.sessions[call.SIPCallID] = sess
+    sh.mu.Unlock()
+
+    defer func() {
+        call.EndTime = time.Now()
+        sh.mu.Lock()
+        delete(sh.sessions, call.SIPCallID)
+        sh.mu.Unlock()
+    }()
+
+    invite := c.buildINVITE(sess, c.generateBranch())
     log.Printf("[SIP] Call initiated: %s -> %s (CallID: %s)", ani, dnis, call.SIPCallID)
-    
-    // Simulate call duration
-    time.Sleep(duration)
-    
+
+    var tx *inviteTransaction
+    var result transactionResult
+    authAttempts, tooSmallAttempts := 0, 0
+    for {
+        var err error
+        tx, err = c.startINVITE(sess, invite, true)
+        if err != nil {
+            sess.setStatus("FAILED")
+            return call, err
+        }
+
+        select {
+        case result = <-tx.result:
+        case <-ctx.Done():
+            c.CancelCall(call.SIPCallID)
+            result = <-tx.result
+        }
+
+        resp := result.response
+        if resp == nil || ctx.Err() != nil {
+            break
+        }
+
+        // Ask again for the larger session interval S2 requires
+        if resp.StatusCode == 422 && tooSmallAttempts < maxIntervalRetries {
+            retry := retryTooSmall(sess, invite, resp, c.generateBranch())
+            if retry == nil {
+                break
+            }
+            tooSmallAttempts++
+            log.Printf("[SIP] Call %s: Session interval too small, asking for %s", call.SIPCallID, resp.Header.Get("Min-SE"))
+            invite = retry
+            continue
+        }
+
+        // Answer each realm's digest challenge once, or again if only our
+        // nonce was found stale
+        if (resp.StatusCode != 401 && resp.StatusCode != 407) || c.credentials == nil || authAttempts >= maxAuthAttempts {
+            break
+        }
+        if authAttempts > 0 && !staleChallenge(resp) && rechallenged(invite, resp) {
+            break
+        }
+        authAttempts++
+        authed, err := authorize(invite, resp, *c.credentials, c.generateBranch())
+        if err != nil {
+            log.Printf("[SIP] Call %s: Cannot answer %d challenge: %v", call.SIPCallID, resp.StatusCode, err)
+            break
+        }
+        log.Printf("[SIP] Call %s: Authenticating after %d", call.SIPCallID, resp.StatusCode)
+        invite = authed
+    }
+
+    if errors.Is(result.err, ErrCanceled) {
+        sess.setStatus("CANCELED")
+        return call, result.err
+    }
+    if result.err != nil {
+        sess.setStatus("TIMEOUT")
+        return call, result.err
+    }
+
+    resp := result.response
+    if resp.StatusCode == 487 && tx.Canceling() {
+        log.Printf("[SIP] Call %s: Canceled", call.SIPCallID)
+        sess.setStatus("CANCELED")
+        return call, ErrCanceled
+    }
+    if resp.StatusCode >= 300 {
+        log.Printf("[SIP] Call %s: Rejected with %d %s", call.SIPCallID, resp.StatusCode, resp.Reason)
+        sess.setStatus("FAILED")
+        return call, &ResponseError{StatusCode: resp.StatusCode, Reason: resp.Reason}
+    }
+
+    log.Printf("[SIP] Call %s: Answered", call.SIPCallID)
+    sess.setStatus("ANSWERED")
+    answered := time.Now()
+
+    dialog, err := NewDialog(invite, resp)
+    if err != nil {
+        // Without a usable To or CSeq there is no dialog to ACK or BYE
+        log.Printf("[SIP] Call %s: Invalid 2xx: %v", call.SIPCallID, err)
+        sess.setStatus("FAILED")
+        return call, err
+    }
+    call.RemoteTag = dialog.RemoteTag
+    sess.startSessionTimer(resp)
+
+    // The ACK for a 2xx is sent end-to-end by the UA core and must be repeated
+    // for every retransmission of the 2xx until S2 stops sending it.
+    ack := dialog.NewACK(c.newVia(call.SIPCallID, c.generateBranch()))
+    sess.mu.Lock()
+    sess.ack = ack
+    sess.dialog = dialog
+    sess.mu.Unlock()
+    if err := c.sendMessage(ack); err != nil {
+        log.Printf("[SIP] Call %s: ACK failed: %v", call.SIPCallID, err)
+    }
+
+    // The answer to our offer decides the codec and where media goes. One
+    // without any codec of ours fails the call, which is hung up straight
+    // away.
+    sess.mu.Lock()
+    offer := sess.offer
+    sess.offer = nil
+    sess.mu.Unlock()
+    answer, err := sdp.Parse(resp.Body)
+    var negotiated *sdp.Result
+    if err == nil {
+        negotiated, err = sdp.Match(offer, answer)
+    }
+    mismatch := errors.Is(err, sdp.ErrNoCommonCodec)
+    if err != nil {
+        log.Printf("[SIP] Call %s: No media: %v", call.SIPCallID, err)
+    } else {
+        sess.setMedia(negotiated)
+        stream.start(negotiated)
+    }
+
+    // A 2xx that crossed our CANCEL still answers the call; it is hung up
+    // straight away
+    var mediaErr error
+    sessionExpired := false
+    if !tx.Canceling() && !mismatch {
+        stopDTMF := make(chan struct{})
+        dtmfDone := make(chan struct{})
+        go func() {
+            defer close(dtmfDone)
+            if len(opts.DTMF) > 0 && (negotiated != nil || opts.DTMFInfo) {
+                c.playDTMF(sess, dialog, opts.DTMF, opts.DTMFInfo, stopDTMF)
+            }
+        }()
+
+        // A refresh in flight when the call ends is not waited for before
+        // the BYE, only before returning
+        stopTimer := make(chan struct{})
+        expired := make(chan struct{})
+        timerDone := make(chan struct{})
+        go func() {
+            defer close(timerDone)
+            c.runSessionTimer(sess, dialog, stopTimer, expired)
+        }()
+        defer func() { <-timerDone }()
+
+        remoteHangup := false
+        select {
+        case <-time.After(duration):
+        case <-sess.hangup:
+            remoteHangup = true
+        case <-expired:
+            log.Printf("[SIP] Call %s: Session expired", call.SIPCallID)
+            sessionExpired = true
+        }
+
+        // Media, DTMF and the session timer stop with the BYE, whoever
+        // sends it
+        close(stopDTMF)
+        close(stopTimer)
+        <-dtmfDone
+        stream.close()
+        recordQuality(call, stream)
+        log.Printf("[SIP] Call %s: Sent %d RTP packets, received %d, lost %d, jitter %.1f ms, MOS %.2f",
+            call.SIPCallID, call.PacketsSent, call.PacketsReceived, call.PacketsLost, call.Jitter, call.MOS)
+        if call.MediaFailure = stream.mediaFailure(c.mediaChecks); call.MediaFailure != "" {
+            log.Printf("[SIP] Call %s: Media failure: %s", call.SIPCallID, call.MediaFailure)
+            mediaErr = &MediaError{Reason: call.MediaFailure}
+        }
+        if remoteHangup {
+            sess.setStatus("COMPLETED")
+            call.DisconnectedBy = "remote"
+            call.Duration = int(time.Since(answered).Seconds())
+            if mediaErr != nil {
+                sess.setStatus("FAILED")
+            }
+            return call, mediaErr
+        }
+    }
+
     // Send BYE
-    bye := c.buildBYE(call)
-    c.sendMessage(bye)
-    
-    c.mu.Lock()
-    delete(c.activeCalls, call.SIPCallID)
-    c.mu.Unlock()
-    
-    return nil
+    bye := dialog.NewRequest("BYE", c.newVia(call.SIPCallID, c.generateBranch()))
+    if resp, err := c.request(call.SIPCallID, bye); err != nil {
+        log.Printf("[SIP] Call %s: BYE failed: %v", call.SIPCallID, err)
+    } else if resp.StatusCode >= 300 {
+        log.Printf("[SIP] Call %s: BYE answered with %d %s", call.SIPCallID, resp.StatusCode, resp.Reason)
+    }
+    if mismatch {
+        sess.setStatus("FAILED")
+        return call, ErrCodecMismatch
+    }
+    sess.setStatus("COMPLETED")
+    call.DisconnectedBy = "local"
+    call.Duration = int(time.Since(answered).Seconds())
+    if sessionExpired {
+        sess.setStatus("FAILED")
+        return call, ErrSessionExpired
+    }
+    if mediaErr != nil {
+        sess.setStatus("FAILED")
+    }
+
+    return call, mediaErr
+}
+
+// recordQuality stores the media quality measured by a call's stream on the
+// call. The MOS is estimated from the loss, and from the delay of the round
+// trip, a jitter buffer of twice the jitter and one packet.
+func recordQuality(call *models.Call, stream *rtpStream) {
+    q := stream.quality()
+    call.PacketsSent = stream.sent.Load()
+    call.PacketsReceived = q.received
+    call.PacketsLost = q.lost
+    call.Jitter = float64(q.jitter) / float64(time.Millisecond)
+    call.RTT = float64(q.rtt) / float64(time.Millisecond)
+    m := stream.mediaStats()
+    call.SSRCChanges = m.ssrcChanges
+    call.LongestSilence = m.longestSilence.Seconds()
+    if q.expected == 0 {
+        return
+    }
+
+    loss := float64(q.lost) / float64(q.expected) * 100
+    delay := call.RTT/2 + 2*call.Jitter + media.FrameDuration
+    call.MOS = media.MOS(media.RFactor(loss, delay))
 }
 
-func (c *Client) buildINVITE(call *models.Call, rtpPort int) string {
-    branch := c.generateBranch()
-    
-    sdp := fmt.Sprintf(
-        "v=0\r\n" +
-        "o=- %d %d IN IP4 %s\r\n" +
-        "s=S1 Call Generator\r\n" +
-        "c=IN IP4 %s\r\n" +
-        "t=0 0\r\n" +
-        "m=audio %d RTP/AVP 0 8 101\r\n" +
-        "a=rtpmap:0 PCMU/8000\r\n" +
-        "a=rtpmap:8 PCMA/8000\r\n" +
-        "a=rtpmap:101 telephone-event/8000\r\n" +
-        "a=fmtp:101 0-16\r\n" +
-        "a=sendrecv\r\n",
-        time.Now().Unix(), time.Now().Unix(), c.localIP, c.localIP, rtpPort,
-    )
-    
-    invite := fmt.Sprintf(
-        "INVITE sip:%s@%s:%d SIP/2.0\r\n" +
-        "Via: SIP/2.0/%s %s:%d;branch=%s;rport\r\n" +
-        "Max-Forwards: 70\r\n" +
-        "From: <sip:%s@%s>;tag=%s\r\n" +
-        "To: <sip:%s@%s>\r\n" +
-        "Call-ID: %s\r\n" +
-        "CSeq: 1 INVITE\r\n" +
-        "Contact: <sip:%s@%s:%d>\r\n" +
-        "Content-Type: application/sdp\r\n" +
-        "Content-Length: %d\r\n" +
-        "User-Agent: S1-CallGenerator/1.0\r\n" +
-        "\r\n%s",
-        call.DNIS, c.remoteIP, c.remotePort,
-        c.transport, c.localIP, c.localPort, branch,
-        call.ANI, c.localIP, call.LocalTag,
-        call.DNIS, c.remoteIP,
-        call.SIPCallID,
-        call.ANI, c.localIP, c.localPort,
-        len(sdp), sdp,
-    )
-    
+// openStream reserves an RTP port and binds it. Ports held by something else
+// are returned to the pool and another is tried.
+func (c *Client) openStream() (*rtpStream, int, error) {
+    var err error
+    for attempt := 0; attempt < 10; attempt++ {
+        port := <-c.rtpPorts
+        var stream *rtpStream
+        if stream, err = openRTPStream(c.bindIP, port); err == nil {
+            return stream, port, nil
+        }
+        c.rtpPorts <- port
+    }
+    return nil, 0, fmt.Errorf("sip: cannot bind an RTP port: %v", err)
+}
+
+func (c *Client) buildINVITE(sess *session, branch string) *message.Request {
+    call := sess.call
+
+    invite := c.newRequest("INVITE", c.requestURI(call), call, branch, 1)
+    invite.Header.Add("Contact", c.contact(call).String())
+    invite.Header.Add("Allow", allowedMethods)
+    invite.Header.Add("Content-Type", "application/sdp")
+    invite.Header.Add("User-Agent", userAgent)
+    if timers := c.timers; timers.Expires > 0 {
+        addTimerHeaders(invite, timers.Expires, sess.timer.minSE, timers.Refresher)
+    }
+    offer := c.localSDP(sess)
+    sess.mu.Lock()
+    sess.offer = offer
+    sess.mu.Unlock()
+    invite.Body = offer.Bytes()
+
     return invite
 }
 
-func (c *Client) buildBYE(call *models.Call) string {
-    branch := c.generateBranch()
-    
-    bye := fmt.Sprintf(
-        "BYE sip:%s@%s:%d SIP/2.0\r\n" +
-        "Via: SIP/2.0/%s %s:%d;branch=%s;rport\r\n" +
-       "Max-Forwards: 70\r\n" +
-       "From: <sip:%s@%s>;tag=%s\r\n" +
-       "To: <sip:%s@%s>;tag=%s\r\n" +
-       "Call-ID: %s\r\n" +
-       "CSeq: 2 BYE\r\n" +
-       "Content-Length: 0\r\n" +
-       "\r\n",
-       c.transport, c.localIP, c.localPort, branch,
-       call.ANI, c.localIP, call.LocalTag,
-       call.DNIS, c.remoteIP, call.RemoteTag,
-       call.SIPCallID,
-   )
-   
-   return bye
-}
-
-func (c *Client) sendMessage(message string) error {
-   c.mu.Lock()
-   defer c.mu.Unlock()
-   
-   _, err := c.conn.Write([]byte(message))
-   return err
-}
-
-func (c *Client) listenResponses() {
-   buffer := make([]byte, 4096)
-   for {
-       n, err := c.conn.Read(buffer)
-       if err != nil {
-           log.Printf("[SIP] Error reading response: %v", err)
-           continue
-       }
-       
-       response := string(buffer[:n])
-       c.handleResponse(response)
-   }
-}
-
-func (c *Client) handleResponse(response string) {
-   lines := strings.Split(response, "\r\n")
-   if len(lines) < 1 {
-       return
-   }
-   
-   // Parse status line
-   parts := strings.Split(lines[0], " ")
-   if len(parts) < 3 {
-       return
-   }
-   
-   if parts[0] != "SIP/2.0" {
-       return
-   }
-   
-   statusCode := parts[1]
-   
-   // Extract Call-ID
-   var callID string
-   for _, line := range lines {
-       if strings.HasPrefix(line, "Call-ID:") {
-           callID = strings.TrimSpace(strings.TrimPrefix(line, "Call-ID:"))
-           break
-       }
-   }
-   
-   c.mu.Lock()
-   call, exists := c.activeCalls[callID]
-   c.mu.Unlock()
-   
-   if !exists {
-       return
-   }
-   
-   switch statusCode {
-   case "100":
-       log.Printf("[SIP] Call %s: Trying", callID)
-       call.Status = "TRYING"
-   case "180":
-       log.Printf("[SIP] Call %s: Ringing", callID)
-       call.Status = "RINGING"
-   case "200":
-       log.Printf("[SIP] Call %s: Answered", callID)
-       call.Status = "ANSWERED"
-       // Extract remote tag
-       for _, line := range lines {
-           if strings.HasPrefix(line, "To:") && strings.Contains(line, "tag=") {
-               tagStart := strings.Index(line, "tag=") + 4
-               tagEnd := strings.IndexAny(line[tagStart:], ";>")
-               if tagEnd == -1 {
-                   call.RemoteTag = line[tagStart:]
-               } else {
-                   call.RemoteTag = line[tagStart:tagStart+tagEnd]
-               }
-               break
-           }
-       }
-   default:
-       log.Printf("[SIP] Call %s: Status %s", callID, statusCode)
-   }
+// startINVITE starts an INVITE client transaction for a call. The one
+// setting up the call is recorded on the session for CancelCall; a
+// re-INVITE within the dialog is not, so a CancelCall during a refresh does
+// not cancel the refresh instead.
+func (c *Client) startINVITE(sess *session, invite *message.Request, initial bool) (*inviteTransaction, error) {
+    via, err := invite.Header.Via()
+    if err != nil {
+        return nil, err
+    }
+
+    tx := newInviteTransaction(c, sess, via.Branch(), invite)
+    if initial {
+        sess.setInvite(tx)
+    }
+
+    sh := c.shardFor(sess.call.SIPCallID)
+    sh.mu.Lock()
+    sh.transactions[transactionKey(via.Branch(), "INVITE")] = tx
+    sh.mu.Unlock()
+
+    if err := tx.start(); err != nil {
+        c.removeTransaction(sess.call.SIPCallID, transactionKey(via.Branch(), "INVITE"))
+        return nil, err
+    }
+    return tx, nil
+}
+
+// SetCredentials enables digest authentication of INVITEs challenged by S2.
+func (c *Client) SetCredentials(credentials Credentials) {
+    c.credentials = &credentials
+}
+
+// CancelCall abandons a call that has not been answered yet. The CANCEL is
+// sent as soon as S2 has sent a provisional response; S2's 487 to the INVITE
+// is acknowledged by the INVITE transaction and MakeCall returns ErrCanceled.
+func (c *Client) CancelCall(sipCallID string) error {
+    sh := c.shardFor(sipCallID)
+    sh.mu.Lock()
+    sess, exists := sh.sessions[sipCallID]
+    sh.mu.Unlock()
+
+    if !exists {
+        return ErrNoTransaction
+    }
+    tx := sess.Invite()
+    if tx == nil {
+        return ErrNoTransaction
+    }
+    if state := tx.State(); state != stateCalling && state != stateProceeding {
+        return ErrNoTransaction
+    }
+
+    tx.requestCancel()
+    return nil
+}
+
+// sendCANCEL runs the CANCEL transaction for an INVITE and logs its outcome.
+// Whether the call ends is decided by the INVITE's final response, not by the
+// response to the CANCEL.
+func (c *Client) sendCANCEL(call *models.Call, invite *message.Request) {
+    log.Printf("[SIP] Call %s: Canceling", call.SIPCallID)
+
+    resp, err := c.request(call.SIPCallID, buildCANCEL(invite))
+    switch {
+    case err != nil:
+        log.Printf("[SIP] Call %s: CANCEL failed: %v", call.SIPCallID, err)
+    case resp.StatusCode == 200:
+        log.Printf("[SIP] Call %s: CANCEL accepted", call.SIPCallID)
+    default:
+        // 481: the INVITE already completed, its final response decides
+        log.Printf("[SIP] Call %s: CANCEL answered with %d %s", call.SIPCallID, resp.StatusCode, resp.Reason)
+    }
+}
+
+// request runs a non-INVITE client transaction and waits for its final
+// response.
+func (c *Client) request(callID string, req *message.Request) (*message.Response, error) {
+    via, err := req.Header.Via()
+    if err != nil {
+        return nil, err
+    }
+
+    key := transactionKey(via.Branch(), req.Method)
+    tx := newNonInviteTransaction(c, key, callID, req)
+
+    sh := c.shardFor(callID)
+    sh.mu.Lock()
+    sh.transactions[key] = tx
+    sh.mu.Unlock()
+
+    if err := tx.start(); err != nil {
+        c.removeTransaction(callID, key)
+        return nil, err
+    }
+
+    result := <-tx.result
+    return result.response, result.err
+}
+
+// Ping sends an out-of-dialog OPTIONS to S2 and returns its response, as a
+// health check of the switch (RFC 3261 section 11).
+func (c *Client) Ping() (*message.Response, error) {
+    callID := c.generateCallID()
+    remoteIP, remotePort := c.target()
+
+    from := &message.Address{
+        URI:    &message.URI{Scheme: "sip", User: "ping", Host: c.localIP},
+        Params: message.Params{{Name: "tag", Value: c.generateTag()}},
+    }
+    host, port := c.contactAddress(callID)
+    contact := &message.Address{
+        URI: c.withTransport(&message.URI{Scheme: "sip", User: "ping", Host: host, Port: port}),
+    }
+
+    req := message.NewRequest("OPTIONS", c.withTransport(&message.URI{Scheme: "sip", Host: remoteIP, Port: remotePort}))
+    req.Header.Add("Via", c.newVia(callID, c.generateBranch()).String())
+    req.Header.Add("Max-Forwards", "70")
+    req.Header.Add("From", from.String())
+    req.Header.Add("To", (&message.Address{URI: &message.URI{Scheme: "sip", Host: remoteIP}}).String())
+    req.Header.Add("Call-ID", callID)
+    req.Header.Add("CSeq", "1 OPTIONS")
+    req.Header.Add("Contact", contact.String())
+    req.Header.Add("Accept", "application/sdp")
+    req.Header.Add("User-Agent", userAgent)
+
+    return c.request(callID, req)
+}
+
+// buildACK builds the ACK for a non-2xx final response. It is part of the
+// INVITE transaction, so it reuses the INVITE's Request-URI, top Via, From,
+// Call-ID, CSeq number and Route, and takes the To header, including the
+// remote tag, from the response (RFC 3261 section 17.1.1.3).
+func buildACK(invite *message.Request, resp *message.Response) *message.Request {
+    seq, _, _ := invite.Header.CSeq()
+
+    ack := message.NewRequest("ACK", invite.URI)
+    ack.Header.Add("Via", invite.Header.Get("Via"))
+    for _, route := range invite.Header.Values("Route") {
+        ack.Header.Add("Route", route)
+    }
+    ack.Header.Add("Max-Forwards", "70")
+    ack.Header.Add("From", invite.Header.Get("From"))
+    ack.Header.Add("To", resp.Header.Get("To"))
+    ack.Header.Add("Call-ID", invite.Header.CallID())
+    ack.Header.Add("CSeq", fmt.Sprintf("%d ACK", seq))
+
+    return ack
+}
+
+// buildCANCEL builds a CANCEL for an outstanding INVITE. It matches the
+// INVITE's Request-URI, top Via, Call-ID, From, To, CSeq number and Route
+// (RFC 3261 section 9.1).
+func buildCANCEL(invite *message.Request) *message.Request {
+    seq, _, _ := invite.Header.CSeq()
+
+    cancel := message.NewRequest("CANCEL", invite.URI)
+    cancel.Header.Add("Via", invite.Header.Get("Via"))
+    for _, route := range invite.Header.Values("Route") {
+        cancel.Header.Add("Route", route)
+    }
+    cancel.Header.Add("Max-Forwards", "70")
+    cancel.Header.Add("From", invite.Header.Get("From"))
+    cancel.Header.Add("To", invite.Header.Get("To"))
+    cancel.Header.Add("Call-ID", invite.Header.CallID())
+    cancel.Header.Add("CSeq", fmt.Sprintf("%d CANCEL", seq))
+
+    return cancel
+}
+
+// newRequest builds an out-of-dialog request with the headers every request
+// carries: Via, Max-Forwards, From, To, Call-ID and CSeq.
+func (c *Client) newRequest(method string, uri *message.URI, call *models.Call, branch string, seq uint32) *message.Request {
+    via := c.newVia(call.SIPCallID, branch)
+
+    from := &message.Address{
+        URI:    &message.URI{Scheme: "sip", User: call.ANI, Host: c.localIP},
+        Params: message.Params{{Name: "tag", Value: call.LocalTag}},
+    }
+
+    remoteIP, _ := c.target()
+    to := &message.Address{
+        URI: &message.URI{Scheme: "sip", User: call.DNIS, Host: remoteIP},
+    }
+
+    req := message.NewRequest(method, uri)
+    req.Header.Add("Via", via.String())
+    req.Header.Add("Max-Forwards", "70")
+    req.Header.Add("From", from.String())
+    req.Header.Add("To", to.String())
+    req.Header.Add("Call-ID", call.SIPCallID)
+    req.Header.Add("CSeq", fmt.Sprintf("%d %s", seq, method))
+
+    return req
+}
+
+// newVia returns the Via header for a new client transaction of a call; it
+// names the call's socket by the same address as Contact, the public one once
+// learned. Over a stream the alias parameter asks S2 to send its requests
+// back over our connection (RFC 5923).
+func (c *Client) newVia(callID, branch string) *message.Via {
+    host, port := c.contactAddress(callID)
+    via := &message.Via{
+        Transport: c.transport,
+        Host:      host,
+        Port:      port,
+        Params:    message.Params{{Name: "branch", Value: branch}, {Name: "rport"}},
+    }
+    if c.reliable() {
+        via.Params.Set("alias", "")
+    }
+    return via
+}
+
+// requestURI is the URI a call's INVITE is addressed to.
+func (c *Client) requestURI(call *models.Call) *message.URI {
+    remoteIP, remotePort := c.target()
+    return c.withTransport(&message.URI{Scheme: "sip", User: call.DNIS, Host: remoteIP, Port: remotePort})
+}
+
+// contact is the address S2 reaches this client on for the call.
+func (c *Client) contact(call *models.Call) *message.Address {
+    host, port := c.contactAddress(call.SIPCallID)
+    return &message.Address{
+        URI: c.withTransport(&message.URI{Scheme: "sip", User: call.ANI, Host: host, Port: port}),
+    }
+}
+
+// contactAddress is the address put in Contact and Via headers for a call:
+// the public address of its socket once S2 reported it in Via, else the local
+// one.
+func (c *Client) contactAddress(callID string) (string, int) {
+    sh := c.shardFor(callID)
+    sh.mu.Lock()
+    defer sh.mu.Unlock()
+    if sh.publicIP != "" {
+        return sh.publicIP, sh.publicPort
+    }
+    return c.localIP, sh.localPort
+}
+
+// learnAddress records the source address S2 saw our request come from, as
+// reported in the received and rport parameters of our Via (RFC 3581).
+// Behind a NAT it differs from the local address and is where S2 must send
+// its requests. Each socket is mapped separately. Our Via names either the
+// local address or the one learned before.
+func (c *Client) learnAddress(sh *shard, via *message.Via) {
+    sh.mu.Lock()
+    learned := sh.publicIP != "" && sameHost(via.Host, sh.publicIP) && via.Port == sh.publicPort
+    sh.mu.Unlock()
+    if !learned && (!sameHost(via.Host, c.localIP) || via.Port != sh.localPort) {
+        return
+    }
+
+    // Without either parameter S2 reported nothing, as when it does not
+    // support rport; without one, the sent-by part is what S2 saw
+    received, _ := via.Params.Get("received")
+    rport, _ := via.Params.Get("rport")
+    n, err := strconv.Atoi(rport)
+    if received == "" && (err != nil || n <= 0) {
+        return
+    }
+    host, port := via.Host, via.Port
+    if received != "" {
+        // Some servers bracket IPv6 addresses here (RFC 5118 section 4.5)
+        host = strings.Trim(received, "[]")
+    }
+    if err == nil && n > 0 {
+        port = n
+    }
+
+    sh.mu.Lock()
+    changed := host != sh.publicIP || port != sh.publicPort
+    sh.publicIP, sh.publicPort = host, port
+    sh.mu.Unlock()
+
+    if changed && (!sameHost(host, c.localIP) || port != sh.localPort) {
+        log.Printf("[SIP] Learned public address %s from S2", message.HostPort(host, port))
+    }
+}
+
+// sameHost reports whether two hosts are the same, comparing IP addresses by
+// value as IPv6 ones have several textual forms.
+func sameHost(a, b string) bool {
+    if ipA, ipB := net.ParseIP(a), net.ParseIP(b); ipA != nil && ipB != nil {
+        return ipA.Equal(ipB)
+    }
+    return strings.EqualFold(a, b)
+}
+
+// withTransport adds the transport parameter to a URI when S2 is not reached
+// over UDP, the default for sip URIs.
+func (c *Client) withTransport(uri *message.URI) *message.URI {
+    if c.transport != TransportUDP {
+        uri.Params.Set("transport", strings.ToLower(c.transport))
+    }
+    return uri
+}
+
+func (c *Client) handleResponse(resp *message.Response) {
+    via, err := resp.Header.Via()
+    if err != nil {
+        return
+    }
+    _, method, err := resp.Header.CSeq()
+    if err != nil {
+        return
+    }
+    callID := resp.Header.CallID()
+    sh := c.shardFor(callID)
+    c.learnAddress(sh, via)
+
+    // Responses are matched to client transactions by the branch of the top
+    // Via and the CSeq method (RFC 3261 section 17.1.3).
+    sh.mu.Lock()
+    tx, exists := sh.transactions[transactionKey(via.Branch(), method)]
+    sess := sh.sessions[callID]
+    sh.mu.Unlock()
+
+    if exists {
+        tx.deliver(resp)
+        return
+    }
+    if sess == nil {
+        return
+    }
+
+    // The transaction ends on the first 2xx, so retransmissions of it are
+    // answered here with the ACK already sent for the call.
+    sess.mu.Lock()
+    ack := sess.ack
+    sess.mu.Unlock()
+    if ack != nil && method == "INVITE" && resp.StatusCode >= 200 && resp.StatusCode < 300 {
+        if err := c.sendMessage(ack); err != nil {
+            log.Printf("[SIP] Call %s: ACK retransmission failed: %v", callID, err)
+        }
+    }
 }
 
 func (c *Client) generateCallID() string {
-   return fmt.Sprintf("%d@%s", time.Now().UnixNano(), c.localIP)
+    // The sequence number keeps Call-IDs unique when calls start within the
+    // same clock tick
+    return fmt.Sprintf("%d.%d@%s", time.Now().UnixNano(), c.callSeq.Add(1), c.localIP)
 }
 
 func (c *Client) generateTag() string {
-   return fmt.Sprintf("%d", rand.Int63())
+    return fmt.Sprintf("%d", rand.Int63())
 }
 
 func (c *Client) generateBranch() string {
-   return fmt.Sprintf("z9hG4bK%d", rand.Int63())
+    return fmt.Sprintf("z9hG4bK%d", rand.Int63())
 }
 
 func (c *Client) GetActiveCallCount() int {
-   c.mu.Lock()
-   defer c.mu.Unlock()
-   return len(c.activeCalls)
+    count := 0
+    for _, sh := range c.shards {
+        sh.mu.Lock()
+        count += len(sh.sessions)
+        sh.mu.Unlock()
+    }
+    return count
 }
 
 func (c *Client) Close() {
-   if c.conn != nil {
-       c.conn.Close()
-   }
+    c.mu.Lock()
+    c.closed = true
+    if c.relocation != nil {
+        c.relocation.Stop()
+    }
+    c.mu.Unlock()
+
+    for _, sh := range c.shards {
+        sh.close()
+    }
 }
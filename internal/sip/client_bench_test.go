@@ -0,0 +1,152 @@
+package sip
+
+import (
+    "context"
+    "fmt"
+    "io"
+    "log"
+    "net"
+    "os"
+    "testing"
+
+    "github.com/s1-callgen/internal/sip/message"
+)
+
+// fakeS2 answers every INVITE and BYE with 200 OK, reading its socket from
+// several goroutines so it keeps up with the client under test.
+func fakeS2(b *testing.B) *net.UDPConn {
+    conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+    if err != nil {
+        b.Fatal(err)
+    }
+
+    for i := 0; i < 8; i++ {
+        go func() {
+            buffer := make([]byte, message.MaxMessageSize)
+            for {
+                n, addr, err := conn.ReadFromUDP(buffer)
+                if err != nil {
+                    return
+                }
+                msg, err := message.Parse(buffer[:n])
+                if err != nil {
+                    continue
+                }
+                req, ok := msg.(*message.Request)
+                if !ok || req.Method == "ACK" {
+                    continue
+                }
+
+                resp := message.NewResponse(req, 200, "OK")
+                if to, err := req.Header.To(); err == nil && to.Tag() == "" {
+                    to.Params.Set("tag", "s2")
+                    resp.Header.Set("To", to.String())
+                }
+                conn.WriteToUDP(resp.Bytes(), addr)
+            }
+        }()
+    }
+    return conn
+}
+
+// BenchmarkMakeCall runs complete calls, INVITE to BYE, against a local S2
+// with the client spread over an increasing number of sockets. All sockets
+// talk to the one socket of the fake S2, so this measures the whole call path
+// rather than how it scales with sockets; BenchmarkShards measures that.
+func BenchmarkMakeCall(b *testing.B) {
+    log.SetOutput(io.Discard)
+    defer log.SetOutput(os.Stderr)
+
+    for _, sockets := range []int{1, 2, 4, 8} {
+        b.Run(fmt.Sprintf("sockets=%d", sockets), func(b *testing.B) {
+            s2 := fakeS2(b)
+            defer s2.Close()
+
+            c, err := NewClient("127.0.0.1", 0, "127.0.0.1", s2.LocalAddr().(*net.UDPAddr).Port)
+            if err != nil {
+                b.Fatal(err)
+            }
+            c.SetListenAddress("127.0.0.1", 0, 0)
+            c.SetSockets(sockets)
+            if err := c.Connect(); err != nil {
+                b.Fatal(err)
+            }
+            defer c.Close()
+
+            b.SetParallelism(32)
+            b.ResetTimer()
+            b.RunParallel(func(pb *testing.PB) {
+                for pb.Next() {
+                    if _, err := c.MakeCall(context.Background(), "100", "200", 0, CallOptions{}); err != nil {
+                        b.Error(err)
+                        return
+                    }
+                }
+            })
+            b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "calls/s")
+        })
+    }
+}
+
+// BenchmarkShards measures what sockets are meant to spread: the work each
+// message of a call does on the shared state of the client, which is adding
+// its transaction to the table, sending it and finding the transaction again
+// for the response. Nothing answers, so no responder limits the rate. Run it
+// with -cpu=1,2,4,8: with one core the rate cannot depend on the number of
+// sockets, with more it grows with them as far as the table locks and the
+// socket writes were what calls waited on.
+func BenchmarkShards(b *testing.B) {
+    log.SetOutput(io.Discard)
+    defer log.SetOutput(os.Stderr)
+
+    for _, sockets := range []int{1, 2, 4, 8} {
+        b.Run(fmt.Sprintf("sockets=%d", sockets), func(b *testing.B) {
+            // A sink nobody reads, whose full buffer drops what is sent
+            sink, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+            if err != nil {
+                b.Fatal(err)
+            }
+            defer sink.Close()
+
+            c, err := NewClient("127.0.0.1", 0, "127.0.0.1", sink.LocalAddr().(*net.UDPAddr).Port)
+            if err != nil {
+                b.Fatal(err)
+            }
+            c.SetListenAddress("127.0.0.1", 0, 0)
+            c.SetSockets(sockets)
+            if err := c.Connect(); err != nil {
+                b.Fatal(err)
+            }
+            defer c.Close()
+
+            b.SetParallelism(8)
+            b.ResetTimer()
+            b.RunParallel(func(pb *testing.PB) {
+                tx := &nonInviteTransaction{}
+                packet := make([]byte, 800) // a typical INVITE
+                for pb.Next() {
+                    callID := c.generateCallID()
+                    key := transactionKey(callID, "INVITE")
+                    sh := c.shardFor(callID)
+
+                    sh.mu.Lock()
+                    sh.transactions[key] = tx
+                    sh.mu.Unlock()
+                    if err := sh.send(packet); err != nil {
+                        b.Error(err)
+                        return
+                    }
+                    sh.mu.Lock()
+                    _, found := sh.transactions[key]
+                    sh.mu.Unlock()
+                    if !found {
+                        b.Error("transaction not found")
+                        return
+                    }
+                    c.removeTransaction(callID, key)
+                }
+            })
+            b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "messages/s")
+        })
+    }
+}
@@ -0,0 +1,105 @@
+package sip
+
+import (
+    "strconv"
+    "testing"
+    "time"
+
+    "github.com/s1-callgen/internal/sip/message"
+)
+
+// pingWithVia pings S2 and answers the OPTIONS with a 200 whose Via has the
+// given parameters set, returning the request.
+func pingWithVia(c *Client, peer *udpPeer, params ...string) *message.Request {
+    peer.t.Helper()
+    done := ping(c)
+    req := peer.expect("OPTIONS", "")
+    resp := message.NewResponse(req, 200, "OK")
+    via, _ := resp.Header.Via()
+    for i := 0; i+1 < len(params); i += 2 {
+        via.Params.Set(params[i], params[i+1])
+    }
+    resp.Header.Set("Via", via.String())
+    peer.send(resp)
+    select {
+    case result := <-done:
+        if result.err != nil {
+            peer.t.Fatal(result.err)
+        }
+    case <-time.After(time.Second):
+        peer.t.Fatal("ping not answered")
+    }
+    return req
+}
+
+// sentFrom returns the addresses in the Via and Contact of a request.
+func sentFrom(t *testing.T, req *message.Request) (string, string) {
+    t.Helper()
+    via, err := req.Header.Via()
+    if err != nil {
+        t.Fatal(err)
+    }
+    contact, err := message.ParseAddress(req.Header.Get("Contact"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    return message.HostPort(via.Host, via.Port), message.HostPort(contact.URI.Host, contact.URI.Port)
+}
+
+func TestLearnAddress(t *testing.T) {
+    tests := []struct {
+        name   string
+        params []string
+        want   string // the address, or "" for the local one
+    }{
+        {"received and rport", []string{"received", "203.0.113.7", "rport", "40000"}, "203.0.113.7:40000"},
+        {"rport only", []string{"rport", "40000"}, "127.0.0.1:40000"},
+        {"received only", []string{"received", "203.0.113.7"}, "203.0.113.7:"},
+        {"bracketed IPv6", []string{"received", "[2001:db8::7]", "rport", "40000"}, "[2001:db8::7]:40000"},
+        {"neither", nil, ""},
+        {"rport not a port", []string{"rport", "x"}, ""},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            c, peer := newUDPPeer(t)
+            local := message.HostPort("127.0.0.1", c.shards[0].localPort)
+            first := pingWithVia(c, peer, tt.params...)
+            if via, contact := sentFrom(t, first); via != local || contact != local {
+                t.Fatalf("first OPTIONS from %s with Contact %s, want %s", via, contact, local)
+            }
+
+            want := tt.want
+            switch {
+            case want == "":
+                want = local
+            case want[len(want)-1] == ':':
+                want += strconv.Itoa(c.shards[0].localPort)
+            }
+            later := pingWithVia(c, peer)
+            if via, contact := sentFrom(t, later); via != want || contact != want {
+                t.Errorf("later OPTIONS from %s with Contact %s, want %s", via, contact, want)
+            }
+        })
+    }
+}
+
+func TestLearnAddressKept(t *testing.T) {
+    c, peer := newUDPPeer(t)
+    pingWithVia(c, peer, "received", "203.0.113.7", "rport", "40000")
+
+    // S2 leaves received out when our Via names the address it saw, and
+    // responses without either parameter tell nothing
+    pingWithVia(c, peer, "rport", "40000")
+    pingWithVia(c, peer)
+    if via, contact := sentFrom(t, pingWithVia(c, peer)); via != "203.0.113.7:40000" || contact != "203.0.113.7:40000" {
+        t.Errorf("OPTIONS from %s with Contact %s, want the learned 203.0.113.7:40000", via, contact)
+    }
+
+    // Nor does a response to a Via not ours
+    sh := c.shards[0]
+    c.learnAddress(sh, &message.Via{Transport: TransportUDP, Host: "10.9.9.9", Port: 5060, Params: message.Params{{Name: "received", Value: "198.51.100.1"}, {Name: "rport", Value: "50000"}}})
+    if host, port := c.contactAddress("any"); host != "203.0.113.7" || port != 40000 {
+        t.Errorf("learned %s from another Via, want 203.0.113.7:40000 kept", message.HostPort(host, port))
+    }
+}
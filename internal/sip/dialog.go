@@ -0,0 +1,176 @@
+package sip
+
+import (
+    "fmt"
+    "sync"
+
+    "github.com/s1-callgen/internal/sip/message"
+)
+
+// Dialog is the UAC side of a dialog established by a 2xx response to an
+// INVITE (RFC 3261 section 12.1.2). Every in-dialog request is built from it
+// so it follows the remote target and route set S2 gave us.
+type Dialog struct {
+    CallID       string
+    LocalTag     string
+    RemoteTag    string
+    LocalURI     *message.Address
+    RemoteURI    *message.Address
+    RemoteTarget *message.URI // guarded by mu
+    RouteSet     []*message.Address
+    Secure       bool
+
+    mu        sync.Mutex
+    localSeq  uint32
+    inviteSeq uint32
+    remoteSeq uint32
+}
+
+// NewDialog creates the dialog for a 2xx response to invite. The remote
+// target is the Contact of the response and the route set is its
+// Record-Route in reverse order. Some switches leave the Contact out of the
+// 2xx; the dialog then targets the INVITE's Request-URI.
+func NewDialog(invite *message.Request, resp *message.Response) (*Dialog, error) {
+    if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+        return nil, fmt.Errorf("sip: dialog needs a 2xx response, got %d", resp.StatusCode)
+    }
+
+    from, err := invite.Header.From()
+    if err != nil {
+        return nil, err
+    }
+    to, err := resp.Header.To()
+    if err != nil {
+        return nil, err
+    }
+    seq, _, err := invite.Header.CSeq()
+    if err != nil {
+        return nil, err
+    }
+
+    contacts, err := resp.Header.Addresses("Contact")
+    if err != nil {
+        return nil, err
+    }
+    target := invite.URI
+    if len(contacts) > 0 && contacts[0].URI != nil {
+        target = contacts[0].URI
+    }
+
+    records, err := resp.Header.Addresses("Record-Route")
+    if err != nil {
+        return nil, err
+    }
+    routes := make([]*message.Address, 0, len(records))
+    for i := len(records) - 1; i >= 0; i-- {
+        routes = append(routes, records[i])
+    }
+
+    return &Dialog{
+        CallID:       invite.Header.CallID(),
+        LocalTag:     from.Tag(),
+        RemoteTag:    to.Tag(),
+        LocalURI:     from,
+        RemoteURI:    to,
+        RemoteTarget: target,
+        RouteSet:     routes,
+        Secure:       invite.URI.Scheme == "sips",
+        localSeq:     seq,
+        inviteSeq:    seq,
+    }, nil
+}
+
+// NewRequest builds an in-dialog request with the next local CSeq. via is
+// the Via header of the new transaction.
+func (d *Dialog) NewRequest(method string, via *message.Via) *message.Request {
+    d.mu.Lock()
+    d.localSeq++
+    seq := d.localSeq
+    if method == "INVITE" {
+        d.inviteSeq = seq
+    }
+    target := d.RemoteTarget
+    d.mu.Unlock()
+
+    return d.newRequest(method, seq, target, via)
+}
+
+// NewACK builds the ACK for the 2xx to the dialog's latest INVITE. It reuses
+// the INVITE's CSeq number rather than taking a new one.
+func (d *Dialog) NewACK(via *message.Via) *message.Request {
+    d.mu.Lock()
+    seq := d.inviteSeq
+    target := d.RemoteTarget
+    d.mu.Unlock()
+
+    return d.newRequest("ACK", seq, target, via)
+}
+
+// refreshTarget replaces the remote target with the Contact of a target
+// refresh: a re-INVITE or UPDATE from S2 we accept, or the 2xx to ours (RFC
+// 3261 sections 12.2.1.2 and 12.2.2). Without a Contact the target stays.
+func (d *Dialog) refreshTarget(header message.Header) {
+    contacts, err := header.Addresses("Contact")
+    if err != nil || len(contacts) == 0 || contacts[0].URI == nil {
+        return
+    }
+    d.mu.Lock()
+    d.RemoteTarget = contacts[0].URI
+    d.mu.Unlock()
+}
+
+// matches reports whether a request from S2 belongs to the dialog: its From
+// tag is the remote tag and its To tag ours (RFC 3261 section 12.2.2).
+func (d *Dialog) matches(req *message.Request) bool {
+    from, err := req.Header.From()
+    if err != nil {
+        return false
+    }
+    to, err := req.Header.To()
+    if err != nil {
+        return false
+    }
+    return req.Header.CallID() == d.CallID && from.Tag() == d.RemoteTag && to.Tag() == d.LocalTag
+}
+
+// acceptRemoteSeq records the CSeq of a request from S2. Requests must arrive
+// with increasing sequence numbers; an older one is rejected.
+func (d *Dialog) acceptRemoteSeq(seq uint32) bool {
+    d.mu.Lock()
+    defer d.mu.Unlock()
+
+    if d.remoteSeq != 0 && seq <= d.remoteSeq {
+        return false
+    }
+    d.remoteSeq = seq
+    return true
+}
+
+// newRequest applies the routing rules of RFC 3261 section 12.2.1.1: with a
+// loose-routing first hop the request goes to the remote target through the
+// route set; a strict router instead becomes the Request-URI and the remote
+// target moves to the end of the Route header.
+func (d *Dialog) newRequest(method string, seq uint32, remoteTarget *message.URI, via *message.Via) *message.Request {
+    target := remoteTarget.Clone()
+    routes := d.RouteSet
+
+    if len(routes) > 0 && !routes[0].URI.Params.Has("lr") {
+        target = routes[0].URI.Clone()
+        target.Params.Del("method")
+        target.Headers = ""
+        routes = append(append([]*message.Address(nil), routes[1:]...), &message.Address{URI: remoteTarget})
+    }
+
+    req := message.NewRequest(method, target)
+    req.Header.Add("Via", via.String())
+    for _, route := range routes {
+        req.Header.Add("Route", route.String())
+    }
+    req.Header.Add("Max-Forwards", "70")
+    req.Header.Add("From", d.LocalURI.String())
+    req.Header.Add("To", d.RemoteURI.String())
+    req.Header.Add("Call-ID", d.CallID)
+    req.Header.Add("CSeq", fmt.Sprintf("%d %s", seq, method))
+
+    return req
+}
@@ -0,0 +1,184 @@
+package sip
+
+import (
+    "testing"
+
+    "github.com/s1-callgen/internal/sip/message"
+)
+
+// testDialog is the dialog of a 2xx to an INVITE with the given Contact, if
+// any, and Record-Route headers.
+func testDialog(t *testing.T, contact string, recordRoutes ...string) *Dialog {
+    t.Helper()
+    invite := parseRequest(t, `INVITE sip:200@s2.example.com SIP/2.0
+Via: SIP/2.0/UDP 10.0.0.1:5060;branch=z9hG4bK1
+From: <sip:100@s1.example.com>;tag=a
+To: <sip:200@s2.example.com>
+Call-ID: dialog@s1
+CSeq: 1 INVITE
+Content-Length: 0
+
+`)
+    resp := message.NewResponse(invite, 200, "OK")
+    resp.Header.Set("To", "<sip:200@s2.example.com>;tag=b")
+    if contact != "" {
+        resp.Header.Add("Contact", contact)
+    }
+    for _, route := range recordRoutes {
+        resp.Header.Add("Record-Route", route)
+    }
+    d, err := NewDialog(invite, resp)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return d
+}
+
+func TestDialogRequest(t *testing.T) {
+    via := &message.Via{Transport: "UDP", Host: "10.0.0.1", Port: 5060, Params: message.Params{{Name: "branch", Value: "z9hG4bK2"}}}
+    tests := []struct {
+        name         string
+        contact      string
+        recordRoutes []string
+        uri          string
+        routes       []string
+    }{
+        {
+            name:    "no route set",
+            contact: "<sip:200@10.0.0.2:5080>",
+            uri:     "sip:200@10.0.0.2:5080",
+        },
+        {
+            name: "no Contact",
+            uri:  "sip:200@s2.example.com",
+        },
+        {
+            // Record-Route lists the proxies from S2's end, the route set
+            // from ours
+            name:         "loose routers",
+            contact:      "<sip:200@10.0.0.2:5080>",
+            recordRoutes: []string{"<sip:p2.example.com;lr>", "<sip:p1.example.com;lr>"},
+            uri:          "sip:200@10.0.0.2:5080",
+            routes:       []string{"<sip:p1.example.com;lr>", "<sip:p2.example.com;lr>"},
+        },
+        {
+            name:         "strict router first",
+            contact:      "<sip:200@10.0.0.2:5080>",
+            recordRoutes: []string{"<sip:p2.example.com;lr>", "<sip:p1.example.com;method=INVITE?Priority=urgent>"},
+            uri:          "sip:p1.example.com",
+            routes:       []string{"<sip:p2.example.com;lr>", "<sip:200@10.0.0.2:5080>"},
+        },
+        {
+            name:         "strict router only",
+            contact:      "<sip:200@10.0.0.2:5080>",
+            recordRoutes: []string{"<sip:p1.example.com>"},
+            uri:          "sip:p1.example.com",
+            routes:       []string{"<sip:200@10.0.0.2:5080>"},
+        },
+        {
+            // Only the first hop decides; a later strict router is the
+            // loose one's business
+            name:         "strict router second",
+            contact:      "<sip:200@10.0.0.2:5080>",
+            recordRoutes: []string{"<sip:p2.example.com>", "<sip:p1.example.com;lr>"},
+            uri:          "sip:200@10.0.0.2:5080",
+            routes:       []string{"<sip:p1.example.com;lr>", "<sip:p2.example.com>"},
+        },
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            d := testDialog(t, tt.contact, tt.recordRoutes...)
+            for i, req := range []*message.Request{d.NewRequest("BYE", via), d.NewACK(via)} {
+                if req.URI.String() != tt.uri {
+                    t.Errorf("%s to %s, want %s", req.Method, req.URI, tt.uri)
+                }
+                routes := req.Header.Values("Route")
+                if len(routes) != len(tt.routes) {
+                    t.Fatalf("%s routed %q, want %q", req.Method, routes, tt.routes)
+                }
+                for j := range routes {
+                    if routes[j] != tt.routes[j] {
+                        t.Errorf("%s routed %q, want %q", req.Method, routes, tt.routes)
+                        break
+                    }
+                }
+                wantSeq := []uint32{2, 1}[i]
+                if seq, method, _ := req.Header.CSeq(); seq != wantSeq || method != req.Method {
+                    t.Errorf("CSeq %d %s, want %d %s", seq, method, wantSeq, req.Method)
+                }
+                if req.Header.Get("From") != "<sip:100@s1.example.com>;tag=a" || req.Header.Get("To") != "<sip:200@s2.example.com>;tag=b" || req.Header.CallID() != "dialog@s1" {
+                    t.Errorf("%s from %s to %s in %s", req.Method, req.Header.Get("From"), req.Header.Get("To"), req.Header.CallID())
+                }
+            }
+        })
+    }
+}
+
+func TestDialogTargetRefresh(t *testing.T) {
+    via := &message.Via{Transport: "UDP", Host: "10.0.0.1", Port: 5060, Params: message.Params{{Name: "branch", Value: "z9hG4bK2"}}}
+    contact := func(value string) message.Header {
+        var h message.Header
+        if value != "" {
+            h.Add("Contact", value)
+        }
+        return h
+    }
+
+    tests := []struct {
+        name         string
+        recordRoutes []string
+        refreshes    []string
+        uri          string
+        routes       []string
+    }{
+        {
+            name:      "new target",
+            refreshes: []string{"<sip:200@10.0.0.3:5080>"},
+            uri:       "sip:200@10.0.0.3:5080",
+        },
+        {
+            name:      "refresh without Contact",
+            refreshes: []string{"<sip:200@10.0.0.3:5080>", ""},
+            uri:       "sip:200@10.0.0.3:5080",
+        },
+        {
+            name:      "latest refresh",
+            refreshes: []string{"<sip:200@10.0.0.3:5080>", `"S2" <sip:200@10.0.0.4;transport=tcp>;expires=60`},
+            uri:       "sip:200@10.0.0.4;transport=tcp",
+        },
+        {
+            name:         "through a loose router",
+            recordRoutes: []string{"<sip:p1.example.com;lr>"},
+            refreshes:    []string{"<sip:200@10.0.0.3:5080>"},
+            uri:          "sip:200@10.0.0.3:5080",
+            routes:       []string{"<sip:p1.example.com;lr>"},
+        },
+        {
+            // The route set is fixed when the dialog is created; only the
+            // target at the end of the Route moves
+            name:         "through a strict router",
+            recordRoutes: []string{"<sip:p1.example.com>"},
+            refreshes:    []string{"<sip:200@10.0.0.3:5080>"},
+            uri:          "sip:p1.example.com",
+            routes:       []string{"<sip:200@10.0.0.3:5080>"},
+        },
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            d := testDialog(t, "<sip:200@10.0.0.2:5080>", tt.recordRoutes...)
+            for _, refresh := range tt.refreshes {
+                d.refreshTarget(contact(refresh))
+            }
+            for _, req := range []*message.Request{d.NewRequest("BYE", via), d.NewACK(via)} {
+                if req.URI.String() != tt.uri {
+                    t.Errorf("%s to %s, want %s", req.Method, req.URI, tt.uri)
+                }
+                if routes := req.Header.Values("Route"); len(routes) != len(tt.routes) || (len(routes) > 0 && routes[len(routes)-1] != tt.routes[len(tt.routes)-1]) {
+                    t.Errorf("%s routed %q, want %q", req.Method, routes, tt.routes)
+                }
+            }
+        })
+    }
+}
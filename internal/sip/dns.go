@@ -0,0 +1,400 @@
+package sip
+
+import (
+    "bufio"
+    "context"
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "io"
+    "math/rand"
+    "net"
+    "os"
+    "strings"
+    "time"
+)
+
+// DNS record types queried directly for RFC 3263 location
+const (
+    dnsTypeSRV   = 33
+    dnsTypeNAPTR = 35
+)
+
+// negativeTTL is how long a name without records of a type is cached.
+const negativeTTL = time.Minute
+
+// addressTTL is how long the addresses of a host are cached. The system
+// resolver they come from reports no TTL.
+const addressTTL = time.Minute
+
+// DNSResolver is a Resolver that queries DNS servers directly for NAPTR and
+// SRV records, which the standard library resolver can neither look up nor
+// report TTLs of. Addresses are looked up as the system does, so that names
+// in /etc/hosts and short names completed by the search domains of
+// /etc/resolv.conf are found.
+type DNSResolver struct {
+    Servers []string      // host:port, tried in order
+    System  *net.Resolver // looks up addresses; nil for net.DefaultResolver
+    Timeout time.Duration
+}
+
+// NewDNSResolver returns a resolver using the nameservers of
+// /etc/resolv.conf, or a local one if there are none.
+func NewDNSResolver() *DNSResolver {
+    r := &DNSResolver{Timeout: 5 * time.Second}
+
+    if file, err := os.Open("/etc/resolv.conf"); err == nil {
+        defer file.Close()
+        scanner := bufio.NewScanner(file)
+        for scanner.Scan() {
+            fields := strings.Fields(scanner.Text())
+            if len(fields) >= 2 && fields[0] == "nameserver" {
+                r.Servers = append(r.Servers, net.JoinHostPort(fields[1], "53"))
+            }
+        }
+    }
+    if len(r.Servers) == 0 {
+        r.Servers = []string{"127.0.0.1:53"}
+    }
+    return r
+}
+
+func (r *DNSResolver) LookupNAPTR(ctx context.Context, name string) ([]NAPTR, time.Duration, error) {
+    answers, ttl, err := r.query(ctx, name, dnsTypeNAPTR)
+    if err != nil {
+        return nil, 0, err
+    }
+
+    var records []NAPTR
+    for _, rr := range answers {
+        if rr.typ != dnsTypeNAPTR {
+            continue
+        }
+        p := &dnsParser{msg: rr.msg, off: rr.rdata}
+        var record NAPTR
+        record.Order = p.uint16()
+        record.Preference = p.uint16()
+        record.Flags = p.characterString()
+        record.Service = p.characterString()
+        record.Regexp = p.characterString()
+        record.Replacement = p.name()
+        if p.err != nil {
+            return nil, 0, p.err
+        }
+        records = append(records, record)
+    }
+    return records, ttl, nil
+}
+
+func (r *DNSResolver) LookupSRV(ctx context.Context, name string) ([]SRV, time.Duration, error) {
+    answers, ttl, err := r.query(ctx, name, dnsTypeSRV)
+    if err != nil {
+        return nil, 0, err
+    }
+
+    var records []SRV
+    for _, rr := range answers {
+        if rr.typ != dnsTypeSRV {
+            continue
+        }
+        p := &dnsParser{msg: rr.msg, off: rr.rdata}
+        var record SRV
+        record.Priority = p.uint16()
+        record.Weight = p.uint16()
+        record.Port = p.uint16()
+        record.Target = p.name()
+        if p.err != nil {
+            return nil, 0, p.err
+        }
+        records = append(records, record)
+    }
+    return records, ttl, nil
+}
+
+// LookupIP returns the IPv4 and IPv6 addresses of host, IPv4 first.
+func (r *DNSResolver) LookupIP(ctx context.Context, host string) ([]net.IP, time.Duration, error) {
+    resolver := r.System
+    if resolver == nil {
+        resolver = net.DefaultResolver
+    }
+    addrs, err := resolver.LookupIPAddr(ctx, host)
+    var dnsErr *net.DNSError
+    if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+        return nil, negativeTTL, nil
+    }
+    if err != nil {
+        return nil, 0, fmt.Errorf("sip: address lookup for %s failed: %v", host, err)
+    }
+
+    var ips []net.IP
+    for _, addr := range addrs {
+        if addr.IP.To4() != nil {
+            ips = append(ips, addr.IP)
+        }
+    }
+    for _, addr := range addrs {
+        if addr.IP.To4() == nil {
+            ips = append(ips, addr.IP)
+        }
+    }
+    return ips, addressTTL, nil
+}
+
+// dnsRecord is a resource record of an answer section. Its data is left in
+// the message so that compressed names in it can be followed.
+type dnsRecord struct {
+    typ      uint16
+    ttl      uint32
+    msg      []byte
+    rdata    int
+    rdlength int
+}
+
+// query asks each server in turn for the records of a type, over UDP and
+// again over TCP if the answer was truncated. It returns the answer section
+// and its lowest TTL. A name without such records is not an error.
+func (r *DNSResolver) query(ctx context.Context, name string, typ uint16) ([]dnsRecord, time.Duration, error) {
+    query, id, err := buildDNSQuery(name, typ)
+    if err != nil {
+        return nil, 0, err
+    }
+
+    var lastErr error
+    for _, server := range r.Servers {
+        resp, err := r.exchange(ctx, "udp", server, query, id)
+        if err == nil && resp[2]&0x02 != 0 {
+            // Truncated
+            resp, err = r.exchange(ctx, "tcp", server, query, id)
+        }
+        if err != nil {
+            lastErr = err
+            continue
+        }
+        return parseDNSAnswers(resp)
+    }
+    return nil, 0, fmt.Errorf("sip: DNS query for %s failed: %v", name, lastErr)
+}
+
+func (r *DNSResolver) exchange(ctx context.Context, network, server string, query []byte, id uint16) ([]byte, error) {
+    dialer := net.Dialer{Timeout: r.Timeout}
+    conn, err := dialer.DialContext(ctx, network, server)
+    if err != nil {
+        return nil, err
+    }
+    defer conn.Close()
+
+    deadline := time.Now().Add(r.Timeout)
+    if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+        deadline = d
+    }
+    conn.SetDeadline(deadline)
+
+    if network == "tcp" {
+        // Messages over TCP are prefixed with their length
+        framed := binary.BigEndian.AppendUint16(nil, uint16(len(query)))
+        if _, err := conn.Write(append(framed, query...)); err != nil {
+            return nil, err
+        }
+        var length [2]byte
+        if _, err := io.ReadFull(conn, length[:]); err != nil {
+            return nil, err
+        }
+        resp := make([]byte, binary.BigEndian.Uint16(length[:]))
+        if _, err := io.ReadFull(conn, resp); err != nil {
+            return nil, err
+        }
+        return checkDNSResponse(resp, id)
+    }
+
+    if _, err := conn.Write(query); err != nil {
+        return nil, err
+    }
+    buffer := make([]byte, 4096)
+    for {
+        n, err := conn.Read(buffer)
+        if err != nil {
+            return nil, err
+        }
+        // Ignore stray answers to other queries
+        if resp, err := checkDNSResponse(buffer[:n], id); err == nil || !errors.Is(err, errDNSMismatch) {
+            return resp, err
+        }
+    }
+}
+
+var errDNSMismatch = errors.New("sip: DNS response does not match query")
+
+func checkDNSResponse(resp []byte, id uint16) ([]byte, error) {
+    if len(resp) < 12 || binary.BigEndian.Uint16(resp) != id || resp[2]&0x80 == 0 {
+        return nil, errDNSMismatch
+    }
+    switch rcode := resp[3] & 0x0f; rcode {
+    case 0, 3: // NOERROR, NXDOMAIN
+        return resp, nil
+    default:
+        return nil, fmt.Errorf("sip: DNS server answered with rcode %d", rcode)
+    }
+}
+
+// buildDNSQuery builds a recursive query with an EDNS0 record advertising a
+// 4096 byte UDP payload.
+func buildDNSQuery(name string, typ uint16) ([]byte, uint16, error) {
+    id := uint16(rand.Uint32())
+    msg := binary.BigEndian.AppendUint16(nil, id)
+    msg = append(msg, 0x01, 0x00) // RD
+    msg = append(msg, 0, 1, 0, 0, 0, 0, 0, 1)
+
+    for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+        if len(label) == 0 || len(label) > 63 {
+            return nil, 0, fmt.Errorf("sip: invalid DNS name %q", name)
+        }
+        msg = append(msg, byte(len(label)))
+        msg = append(msg, label...)
+    }
+    msg = append(msg, 0)
+    msg = binary.BigEndian.AppendUint16(msg, typ)
+    msg = binary.BigEndian.AppendUint16(msg, 1) // IN
+
+    // OPT pseudo-record
+    msg = append(msg, 0)
+    msg = binary.BigEndian.AppendUint16(msg, 41)
+    msg = binary.BigEndian.AppendUint16(msg, 4096)
+    msg = append(msg, 0, 0, 0, 0, 0, 0)
+
+    return msg, id, nil
+}
+
+// parseDNSAnswers returns the answer section of a response and the lowest TTL
+// in it, or negativeTTL if it is empty.
+func parseDNSAnswers(msg []byte) ([]dnsRecord, time.Duration, error) {
+    if len(msg) < 12 {
+        return nil, 0, errors.New("sip: truncated DNS message")
+    }
+    p := &dnsParser{msg: msg, off: 12}
+    questions := binary.BigEndian.Uint16(msg[4:])
+    answers := binary.BigEndian.Uint16(msg[6:])
+
+    for i := 0; i < int(questions); i++ {
+        p.name()
+        p.skip(4)
+    }
+    if p.err != nil {
+        return nil, 0, p.err
+    }
+
+    var records []dnsRecord
+    ttl := uint32(0)
+    for i := 0; i < int(answers); i++ {
+        p.name()
+        rr := dnsRecord{msg: msg}
+        rr.typ = p.uint16()
+        p.uint16() // class
+        rr.ttl = p.uint32()
+        rr.rdlength = int(p.uint16())
+        rr.rdata = p.off
+        p.skip(rr.rdlength)
+        if p.err != nil {
+            return nil, 0, p.err
+        }
+        if len(records) == 0 || rr.ttl < ttl {
+            ttl = rr.ttl
+        }
+        records = append(records, rr)
+    }
+
+    if len(records) == 0 {
+        return nil, negativeTTL, nil
+    }
+    return records, time.Duration(ttl) * time.Second, nil
+}
+
+// dnsParser reads fields of a DNS message, remembering the first error.
+type dnsParser struct {
+    msg []byte
+    off int
+    err error
+}
+
+func (p *dnsParser) need(n int) bool {
+    if p.err == nil && p.off+n > len(p.msg) {
+        p.err = errors.New("sip: truncated DNS message")
+    }
+    return p.err == nil
+}
+
+func (p *dnsParser) skip(n int) {
+    if p.need(n) {
+        p.off += n
+    }
+}
+
+func (p *dnsParser) uint16() uint16 {
+    if !p.need(2) {
+        return 0
+    }
+    v := binary.BigEndian.Uint16(p.msg[p.off:])
+    p.off += 2
+    return v
+}
+
+func (p *dnsParser) uint32() uint32 {
+    if !p.need(4) {
+        return 0
+    }
+    v := binary.BigEndian.Uint32(p.msg[p.off:])
+    p.off += 4
+    return v
+}
+
+func (p *dnsParser) characterString() string {
+    if !p.need(1) {
+        return ""
+    }
+    n := int(p.msg[p.off])
+    p.off++
+    if !p.need(n) {
+        return ""
+    }
+    s := string(p.msg[p.off : p.off+n])
+    p.off += n
+    return s
+}
+
+// name reads a domain name, following compression pointers.
+func (p *dnsParser) name() string {
+    var labels []string
+    off := p.off
+    jumped := false
+    for hops := 0; p.err == nil; hops++ {
+        if off >= len(p.msg) || hops > 64 {
+            p.err = errors.New("sip: invalid DNS name")
+            break
+        }
+        n := int(p.msg[off])
+        switch {
+        case n == 0:
+            if !jumped {
+                p.off = off + 1
+            }
+            return strings.Join(labels, ".")
+        case n&0xc0 == 0xc0:
+            if off+1 >= len(p.msg) {
+                p.err = errors.New("sip: invalid DNS name")
+                break
+            }
+            if !jumped {
+                p.off = off + 2
+            }
+            off = int(binary.BigEndian.Uint16(p.msg[off:]) & 0x3fff)
+            jumped = true
+        default:
+            if off+1+n > len(p.msg) {
+                p.err = errors.New("sip: invalid DNS name")
+                break
+            }
+            labels = append(labels, string(p.msg[off+1:off+1+n]))
+            off += 1 + n
+        }
+    }
+    return ""
+}
@@ -0,0 +1,341 @@
+package sip
+
+import (
+    "context"
+    "encoding/binary"
+    "net"
+    "reflect"
+    "strings"
+    "testing"
+    "time"
+)
+
+// Address record types, which only the system resolver queries
+const (
+    dnsTypeA    = 1
+    dnsTypeAAAA = 28
+)
+
+// dnsName encodes a domain name as uncompressed labels, optionally ending in
+// a compression pointer to offset instead of the root label.
+func dnsName(name string, pointer int) []byte {
+    var b []byte
+    for _, label := range strings.Split(name, ".") {
+        if label != "" {
+            b = append(b, byte(len(label)))
+            b = append(b, label...)
+        }
+    }
+    if pointer > 0 {
+        return binary.BigEndian.AppendUint16(b, 0xc000|uint16(pointer))
+    }
+    return append(b, 0)
+}
+
+// testRecord is an answer of a DNS response built by dnsResponse.
+type testRecord struct {
+    typ   uint16
+    ttl   uint32
+    rdata []byte
+}
+
+// dnsResponse builds the response to a query for name, with the answers
+// named by a compression pointer to the question.
+func dnsResponse(id uint16, name string, typ uint16, answers ...testRecord) []byte {
+    msg := binary.BigEndian.AppendUint16(nil, id)
+    msg = append(msg, 0x81, 0x80) // QR, RD, RA
+    msg = binary.BigEndian.AppendUint16(msg, 1)
+    msg = binary.BigEndian.AppendUint16(msg, uint16(len(answers)))
+    msg = append(msg, 0, 0, 0, 0)
+    msg = append(msg, dnsName(name, 0)...)
+    msg = binary.BigEndian.AppendUint16(msg, typ)
+    msg = binary.BigEndian.AppendUint16(msg, 1)
+
+    for _, rr := range answers {
+        msg = binary.BigEndian.AppendUint16(msg, 0xc00c)
+        msg = binary.BigEndian.AppendUint16(msg, rr.typ)
+        msg = binary.BigEndian.AppendUint16(msg, 1)
+        msg = binary.BigEndian.AppendUint32(msg, rr.ttl)
+        msg = binary.BigEndian.AppendUint16(msg, uint16(len(rr.rdata)))
+        msg = append(msg, rr.rdata...)
+    }
+    return msg
+}
+
+// srvData is the data of an SRV record whose target is label followed by a
+// pointer to the question name at offset 12.
+func srvData(priority, weight, port uint16, label string) []byte {
+    b := binary.BigEndian.AppendUint16(nil, priority)
+    b = binary.BigEndian.AppendUint16(b, weight)
+    b = binary.BigEndian.AppendUint16(b, port)
+    return append(b, dnsName(label, 12)...)
+}
+
+func naptrData(order, preference uint16, flags, service, replacement string) []byte {
+    b := binary.BigEndian.AppendUint16(nil, order)
+    b = binary.BigEndian.AppendUint16(b, preference)
+    for _, s := range []string{flags, service, ""} {
+        b = append(b, byte(len(s)))
+        b = append(b, s...)
+    }
+    return append(b, dnsName(replacement, 0)...)
+}
+
+func TestParseDNSAnswers(t *testing.T) {
+    msg := dnsResponse(1, "_sip._udp.example.com", dnsTypeSRV,
+        testRecord{dnsTypeSRV, 300, srvData(10, 60, 5060, "sip1")},
+        testRecord{dnsTypeSRV, 120, srvData(20, 0, 5062, "sip2")},
+    )
+
+    answers, ttl, err := parseDNSAnswers(msg)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if ttl != 120*time.Second {
+        t.Errorf("TTL %v, want the lowest, 2m0s", ttl)
+    }
+
+    var got []SRV
+    for _, rr := range answers {
+        p := &dnsParser{msg: rr.msg, off: rr.rdata}
+        got = append(got, SRV{Priority: p.uint16(), Weight: p.uint16(), Port: p.uint16(), Target: p.name()})
+        if p.err != nil {
+            t.Fatal(p.err)
+        }
+        if p.off != rr.rdata+rr.rdlength {
+            t.Errorf("record data read to %d, want %d", p.off, rr.rdata+rr.rdlength)
+        }
+    }
+    want := []SRV{
+        {Target: "sip1._sip._udp.example.com", Port: 5060, Priority: 10, Weight: 60},
+        {Target: "sip2._sip._udp.example.com", Port: 5062, Priority: 20, Weight: 0},
+    }
+    if !reflect.DeepEqual(got, want) {
+        t.Errorf("got %+v, want %+v", got, want)
+    }
+}
+
+func TestParseDNSAnswersEmpty(t *testing.T) {
+    answers, ttl, err := parseDNSAnswers(dnsResponse(1, "example.com", dnsTypeNAPTR))
+    if err != nil || len(answers) != 0 || ttl != negativeTTL {
+        t.Errorf("got %d answers, TTL %v, %v; want none cached for %v", len(answers), ttl, err, negativeTTL)
+    }
+}
+
+func TestParseDNSAnswersTruncated(t *testing.T) {
+    msg := dnsResponse(1, "example.com", dnsTypeA, testRecord{dnsTypeA, 60, []byte{192, 0, 2, 1}})
+    for n := 0; n < len(msg); n++ {
+        if _, _, err := parseDNSAnswers(msg[:n]); err == nil {
+            t.Errorf("message truncated to %d of %d bytes parsed", n, len(msg))
+        }
+    }
+}
+
+func TestDNSParserName(t *testing.T) {
+    // "example.com" at 0, "sip" pointing to it at 13, and a pointer to
+    // "sip" at 19
+    msg := dnsName("example.com", 0)
+    msg = append(msg, dnsName("sip", 0)...)
+    msg = msg[:len(msg)-1]
+    msg = binary.BigEndian.AppendUint16(msg, 0xc000)
+    msg = binary.BigEndian.AppendUint16(msg, 0xc00d)
+
+    tests := []struct {
+        name    string
+        msg     []byte
+        off     int
+        want    string
+        wantOff int
+        wantErr bool
+    }{
+        {name: "labels", msg: msg, off: 0, want: "example.com", wantOff: 13},
+        {name: "labels then pointer", msg: msg, off: 13, want: "sip.example.com", wantOff: 19},
+        {name: "pointer to pointer", msg: msg, off: 19, want: "sip.example.com", wantOff: 21},
+        {name: "root", msg: []byte{0}, want: "", wantOff: 1},
+        {name: "pointer loop", msg: []byte{0xc0, 0x00}, wantErr: true},
+        {name: "pointer out of range", msg: []byte{0xc0, 0x10}, wantErr: true},
+        {name: "truncated pointer", msg: []byte{0xc0}, wantErr: true},
+        {name: "truncated label", msg: []byte{7, 'e', 'x', 'a'}, wantErr: true},
+        {name: "missing root", msg: []byte{3, 'c', 'o', 'm'}, wantErr: true},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            p := &dnsParser{msg: tt.msg, off: tt.off}
+            got := p.name()
+            if tt.wantErr {
+                if p.err == nil {
+                    t.Errorf("parsed %q, want an error", got)
+                }
+                return
+            }
+            if p.err != nil {
+                t.Fatal(p.err)
+            }
+            if got != tt.want || p.off != tt.wantOff {
+                t.Errorf("got %q ending at %d, want %q ending at %d", got, p.off, tt.want, tt.wantOff)
+            }
+        })
+    }
+}
+
+// fakeDNS answers queries over UDP from a table of responses by type, and
+// sets the truncation bit on those whose type is in truncate so they are
+// asked again over TCP on the same port.
+func fakeDNS(t *testing.T, answers map[uint16][]testRecord, truncate map[uint16]bool) string {
+    udp, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { udp.Close() })
+    tcp, err := net.ListenTCP("tcp", net.TCPAddrFromAddrPort(udp.LocalAddr().(*net.UDPAddr).AddrPort()))
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { tcp.Close() })
+
+    respond := func(query []byte, stream bool) []byte {
+        p := &dnsParser{msg: query, off: 12}
+        name := p.name()
+        typ := p.uint16()
+        resp := dnsResponse(binary.BigEndian.Uint16(query), name, typ, answers[typ]...)
+        if truncate[typ] && !stream {
+            resp[2] |= 0x02
+            resp[7] = 0 // no answers
+            resp = resp[:12+len(name)+2+4]
+        }
+        return resp
+    }
+
+    go func() {
+        buffer := make([]byte, 512)
+        for {
+            n, addr, err := udp.ReadFromUDP(buffer)
+            if err != nil {
+                return
+            }
+            udp.WriteToUDP(respond(buffer[:n], false), addr)
+        }
+    }()
+    go func() {
+        for {
+            conn, err := tcp.Accept()
+            if err != nil {
+                return
+            }
+            var length [2]byte
+            if _, err := conn.Read(length[:]); err == nil {
+                query := make([]byte, binary.BigEndian.Uint16(length[:]))
+                if _, err := conn.Read(query); err == nil {
+                    resp := respond(query, true)
+                    conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(resp))), resp...))
+                }
+            }
+            conn.Close()
+        }
+    }()
+    return udp.LocalAddr().String()
+}
+
+func TestDNSResolver(t *testing.T) {
+    server := fakeDNS(t, map[uint16][]testRecord{
+        dnsTypeNAPTR: {{dnsTypeNAPTR, 3600, naptrData(10, 20, "S", "SIP+D2T", "_sip._tcp.example.com")}},
+        dnsTypeSRV:   {{dnsTypeSRV, 600, srvData(1, 2, 5070, "sip")}},
+        dnsTypeA:     {{dnsTypeA, 60, []byte{192, 0, 2, 1}}},
+        dnsTypeAAAA:  {{dnsTypeAAAA, 30, net.ParseIP("2001:db8::1")}},
+    }, map[uint16]bool{dnsTypeSRV: true})
+    r := &DNSResolver{Servers: []string{server}, System: systemResolver(server), Timeout: time.Second}
+    ctx := context.Background()
+
+    naptrs, ttl, err := r.LookupNAPTR(ctx, "example.com")
+    if err != nil {
+        t.Fatal(err)
+    }
+    wantNAPTR := []NAPTR{{Order: 10, Preference: 20, Flags: "S", Service: "SIP+D2T", Replacement: "_sip._tcp.example.com"}}
+    if !reflect.DeepEqual(naptrs, wantNAPTR) || ttl != time.Hour {
+        t.Errorf("NAPTR got %+v for %v, want %+v for 1h", naptrs, ttl, wantNAPTR)
+    }
+
+    // Truncated over UDP, answered over TCP
+    srvs, ttl, err := r.LookupSRV(ctx, "_sip._tcp.example.com")
+    if err != nil {
+        t.Fatal(err)
+    }
+    wantSRV := []SRV{{Target: "sip._sip._tcp.example.com", Port: 5070, Priority: 1, Weight: 2}}
+    if !reflect.DeepEqual(srvs, wantSRV) || ttl != 10*time.Minute {
+        t.Errorf("SRV got %+v for %v, want %+v for 10m", srvs, ttl, wantSRV)
+    }
+
+    ips, ttl, err := r.LookupIP(ctx, "sip.example.com")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(ips) != 2 || !ips[0].Equal(net.ParseIP("192.0.2.1")) || !ips[1].Equal(net.ParseIP("2001:db8::1")) || ttl != addressTTL {
+        t.Errorf("IP got %v for %v, want 192.0.2.1 and 2001:db8::1 for %v", ips, ttl, addressTTL)
+    }
+}
+
+// systemResolver is a resolver reading /etc/hosts as the system one does, but
+// asking server instead of the nameservers of /etc/resolv.conf.
+func systemResolver(server string) *net.Resolver {
+    return &net.Resolver{
+        PreferGo: true,
+        Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+            var d net.Dialer
+            return d.DialContext(ctx, network, server)
+        },
+    }
+}
+
+// TestDNSResolverHosts checks that names only the system knows, from
+// /etc/hosts, are found although DNS has no addresses for them.
+func TestDNSResolverHosts(t *testing.T) {
+    server := fakeDNS(t, nil, nil)
+    r := &DNSResolver{Servers: []string{server}, System: systemResolver(server), Timeout: time.Second}
+    ctx := context.Background()
+
+    ips, _, err := r.LookupIP(ctx, "localhost")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(ips) == 0 || !ips[0].IsLoopback() {
+        t.Errorf("localhost is at %v, want a loopback address", ips)
+    }
+
+    // Nor is an explicit port a reason to skip the hosts file
+    destinations, _, err := NewLocator(r).Locate(ctx, "localhost", 5070, "")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(destinations) == 0 || !destinations[0].IP.IsLoopback() || destinations[0].Port != 5070 || destinations[0].Transport != TransportUDP {
+        t.Errorf("located localhost:5070 at %v, want a loopback address over UDP", destinations)
+    }
+
+    // Nor a DNS server that does not answer, when the port is left to
+    // NAPTR and SRV
+    closed, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+    if err != nil {
+        t.Fatal(err)
+    }
+    closed.Close()
+    down := &DNSResolver{Servers: []string{closed.LocalAddr().String()}, System: systemResolver(server), Timeout: time.Second}
+    destinations, expires, err := NewLocator(down).Locate(ctx, "localhost", 0, "")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(destinations) == 0 || !destinations[0].IP.IsLoopback() || destinations[0].Port != 5060 {
+        t.Errorf("located localhost at %v, want a loopback address on port 5060", destinations)
+    }
+    if time.Until(expires) > negativeTTL {
+        t.Errorf("located until %v, want again within %v as DNS failed", expires, negativeTTL)
+    }
+    if _, _, err := NewLocator(down).Locate(ctx, "nowhere.example.com", 0, ""); err == nil {
+        t.Error("located a name DNS could not be asked about")
+    }
+
+    // A name without addresses anywhere is empty, and cached as such
+    ips, ttl, err := r.LookupIP(ctx, "nowhere.example.com")
+    if err != nil || len(ips) != 0 || ttl != negativeTTL {
+        t.Errorf("got %v for %v, %v; want none for %v", ips, ttl, err, negativeTTL)
+    }
+}
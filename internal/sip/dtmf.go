@@ -0,0 +1,134 @@
+package sip
+
+import (
+    "encoding/binary"
+    "fmt"
+    "log"
+    "time"
+
+    "github.com/s1-callgen/internal/media"
+    "github.com/s1-callgen/internal/sip/sdp"
+)
+
+// Digits are 100 ms tones 100 ms apart, counted in packets. The end of an
+// event is sent three times so a lost packet does not lose the event's
+// duration (RFC 4733 section 2.5.1.4).
+const (
+    digitPackets = 5
+    gapPackets   = 5
+    endRepeats   = 3
+    digitVolume  = 10 // -10 dBm0
+)
+
+// dtmfTone is a digit being sent as an RFC 4733 event.
+type dtmfTone struct {
+    event   byte
+    start   uint32 // RTP timestamp of every packet of the event
+    packets int    // sent so far
+}
+
+// sendDigits queues digits to be sent as telephone events in place of audio.
+func (s *rtpStream) sendDigits(digits string) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    for _, digit := range digits {
+        if event, ok := media.DTMFEvent(digit); ok {
+            s.tones = append(s.tones, event)
+        }
+    }
+}
+
+// eventPacket returns the next telephone event packet, or nil when audio is
+// due. Called with s.mu held.
+func (s *rtpStream) eventPacket(remote *sdp.Result) []byte {
+    if s.tone == nil {
+        if s.pause > 0 {
+            s.pause--
+            return nil
+        }
+        if len(s.tones) == 0 {
+            return nil
+        }
+        if remote.Events == nil {
+            log.Printf("[SIP] Dropping %d DTMF digits: S2 takes no telephone events at the codec's clock rate", len(s.tones))
+            s.tones = nil
+            return nil
+        }
+        s.tone = &dtmfTone{event: s.tones[0], start: s.timestamp}
+        s.tones = s.tones[1:]
+    }
+
+    // Every packet carries the duration so far, the last ones with the end
+    // bit set and the full duration
+    t := s.tone
+    t.packets++
+    ticks := remote.Events.ClockRate * media.FrameDuration / 1000
+    payload := make([]byte, 4)
+    payload[0] = t.event
+    payload[1] = digitVolume
+    if t.packets >= digitPackets {
+        payload[1] |= 0x80
+    }
+    binary.BigEndian.PutUint16(payload[2:], uint16(min(t.packets, digitPackets)*ticks))
+
+    packet := createRTPPacket(remote.Events.PayloadType, s.sequence, t.start, s.ssrc, payload)
+    if t.packets == 1 {
+        packet[1] |= 0x80 // marker on the first packet of an event
+    }
+    if t.packets == digitPackets+endRepeats-1 {
+        s.tone = nil
+        s.pause = gapPackets
+    }
+    return packet
+}
+
+// playDTMF runs a call's DTMF script from the answer until it is done or
+// stop is closed. Digits go as RFC 4733 events on the stream, or as SIP INFO
+// requests in the dialog when info is set.
+func (c *Client) playDTMF(sess *session, dialog *Dialog, script media.DTMFScript, info bool, stop <-chan struct{}) {
+    callID := sess.call.SIPCallID
+    for _, step := range script {
+        select {
+        case <-time.After(step.Wait):
+        case <-stop:
+            return
+        }
+
+        log.Printf("[SIP] Call %s: Sending DTMF %s", callID, step.Digits)
+        if !info {
+            sess.stream.sendDigits(step.Digits)
+            sending := len(step.Digits) * (digitPackets + endRepeats - 1 + gapPackets)
+            select {
+            case <-time.After(time.Duration(sending) * packetInterval):
+            case <-stop:
+                return
+            }
+            continue
+        }
+
+        for _, digit := range step.Digits {
+            c.sendINFO(dialog, callID, digit)
+            select {
+            case <-time.After((digitPackets + gapPackets) * packetInterval):
+            case <-stop:
+                return
+            }
+        }
+    }
+}
+
+// sendINFO sends a digit in an INFO request, with the application/dtmf-relay
+// body most switches understand.
+func (c *Client) sendINFO(dialog *Dialog, callID string, digit rune) {
+    info := dialog.NewRequest("INFO", c.newVia(callID, c.generateBranch()))
+    info.Header.Add("Content-Type", "application/dtmf-relay")
+    info.Header.Add("User-Agent", userAgent)
+    info.Body = []byte(fmt.Sprintf("Signal=%c\r\nDuration=%d\r\n", digit, digitPackets*media.FrameDuration))
+
+    resp, err := c.request(callID, info)
+    if err != nil {
+        log.Printf("[SIP] Call %s: INFO failed: %v", callID, err)
+    } else if resp.StatusCode >= 300 {
+        log.Printf("[SIP] Call %s: INFO answered with %d %s", callID, resp.StatusCode, resp.Reason)
+    }
+}
@@ -0,0 +1,199 @@
+package sip
+
+import (
+    "encoding/binary"
+    "net"
+    "testing"
+
+    "github.com/s1-callgen/internal/media"
+    "github.com/s1-callgen/internal/sip/sdp"
+)
+
+// testStream is a stream sending PCMU to S2, with telephone events on
+// payload type 101 unless noEvents is set. Its packets are taken with
+// nextPacket instead of being sent.
+func testStream(t *testing.T, noEvents bool) *rtpStream {
+    remote := &sdp.Result{
+        Codec:     sdp.Codec{PayloadType: 0, Name: "PCMU", ClockRate: 8000, Channels: 1},
+        Events:    &sdp.Codec{PayloadType: 101, Name: sdp.TelephoneEvent, ClockRate: 8000, Channels: 1},
+        Addr:      &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 4000},
+        Direction: sdp.SendRecv,
+    }
+    if noEvents {
+        remote.Events = nil
+    }
+    s := &rtpStream{sequence: 65530, timestamp: 1000, ssrc: 0x1234}
+    s.setRemote(remote)
+    if s.codec == nil {
+        t.Fatal("no PCMU encoder")
+    }
+    return s
+}
+
+// rtpHeader is the fixed header of an RTP packet.
+type rtpHeader struct {
+    marker      bool
+    payloadType uint8
+    sequence    uint16
+    timestamp   uint32
+    ssrc        uint32
+}
+
+func parseRTPHeader(t *testing.T, packet []byte) rtpHeader {
+    t.Helper()
+    if len(packet) < 12 || packet[0] != 0x80 {
+        t.Fatalf("not an RTP packet without CSRCs: %x", packet)
+    }
+    return rtpHeader{
+        marker:      packet[1]&0x80 != 0,
+        payloadType: packet[1] & 0x7f,
+        sequence:    binary.BigEndian.Uint16(packet[2:]),
+        timestamp:   binary.BigEndian.Uint32(packet[4:]),
+        ssrc:        binary.BigEndian.Uint32(packet[8:]),
+    }
+}
+
+func TestDTMFPackets(t *testing.T) {
+    s := testStream(t, false)
+    s.sendDigits("1x#") // x is not a digit and dropped
+
+    type event struct {
+        audio    bool
+        code     byte
+        end      bool
+        duration uint16
+        marker   bool
+    }
+    digit := func(code byte) []event {
+        return []event{
+            {code: code, duration: 160, marker: true},
+            {code: code, duration: 320},
+            {code: code, duration: 480},
+            {code: code, duration: 640},
+            {code: code, end: true, duration: 800},
+            {code: code, end: true, duration: 800},
+            {code: code, end: true, duration: 800},
+        }
+    }
+    gap := []event{{audio: true}, {audio: true}, {audio: true}, {audio: true}, {audio: true}}
+    var want []event
+    want = append(want, digit(1)...)
+    want = append(want, gap...)
+    want = append(want, digit(11)...)
+    want = append(want, gap...)
+    want = append(want, event{audio: true})
+
+    var eventStart uint32
+    for i, w := range want {
+        s.mu.Lock()
+        packet := s.nextPacket()
+        s.mu.Unlock()
+        h := parseRTPHeader(t, packet)
+
+        // Every packet takes the next sequence number, wrapping, whatever
+        // it carries
+        if h.sequence != uint16(65530+i) || h.ssrc != 0x1234 {
+            t.Errorf("packet %d: sequence %d of SSRC %#x, want %d of 0x1234", i, h.sequence, h.ssrc, uint16(65530+i))
+        }
+        timestamp := uint32(1000 + 160*i)
+
+        if w.audio {
+            if h.payloadType != 0 || h.marker || h.timestamp != timestamp || len(packet) != 12+160 {
+                t.Errorf("packet %d: %+v of %d bytes, want audio at %d", i, h, len(packet), timestamp)
+            }
+            continue
+        }
+
+        // All packets of an event carry the timestamp of its start
+        if w.marker {
+            eventStart = timestamp
+        }
+        payload := packet[12:]
+        if h.payloadType != 101 || h.marker != w.marker || h.timestamp != eventStart || len(payload) != 4 {
+            t.Errorf("packet %d: %+v with %x, want event %d at %d, marker %v", i, h, payload, w.code, eventStart, w.marker)
+            continue
+        }
+        end := payload[1]&0x80 != 0
+        volume := payload[1] & 0x3f
+        duration := binary.BigEndian.Uint16(payload[2:])
+        if payload[0] != w.code || end != w.end || volume != digitVolume || duration != w.duration {
+            t.Errorf("packet %d: event %d, end %v, volume %d, duration %d; want %d, %v, %d, %d",
+                i, payload[0], end, volume, duration, w.code, w.end, digitVolume, w.duration)
+        }
+    }
+}
+
+func TestDTMFWithoutTelephoneEvents(t *testing.T) {
+    s := testStream(t, true)
+    s.sendDigits("123")
+    for i := 0; i < 10; i++ {
+        s.mu.Lock()
+        packet := s.nextPacket()
+        s.mu.Unlock()
+        if h := parseRTPHeader(t, packet); h.payloadType != 0 {
+            t.Fatalf("packet %d has payload type %d, want only audio", i, h.payloadType)
+        }
+    }
+    if len(s.tones) != 0 {
+        t.Errorf("%d digits still queued", len(s.tones))
+    }
+}
+
+func TestDTMFOnHold(t *testing.T) {
+    s := testStream(t, false)
+    s.remote.Direction = sdp.RecvOnly
+    s.sendDigits("5")
+
+    s.mu.Lock()
+    packet := s.nextPacket()
+    s.mu.Unlock()
+    if packet != nil {
+        t.Fatalf("sent %x on hold", packet)
+    }
+    if s.timestamp != 1160 || s.sequence != 65530 {
+        t.Errorf("timestamp %d and sequence %d on hold, want the clock at 1160 and the sequence at 65530", s.timestamp, s.sequence)
+    }
+    if len(s.tones) != 1 {
+        t.Errorf("%d digits queued, want the digit kept until the call is resumed", len(s.tones))
+    }
+}
+
+func TestTelephoneEvents(t *testing.T) {
+    var codecs []media.Codec
+    for _, name := range []string{"OPUS", "PCMU", "G722", "PCMA"} {
+        codec, err := media.New(name)
+        if err != nil {
+            t.Fatal(err)
+        }
+        codecs = append(codecs, codec)
+    }
+
+    // One telephone-event per clock rate, in the order of the codecs
+    events := telephoneEvents(codecs)
+    if len(events) != 2 || events[0].String() != "telephone-event/48000" || events[0].PayloadType != 101 ||
+        events[1].String() != "telephone-event/8000" || events[1].PayloadType != 102 {
+        t.Errorf("got %+v, want telephone-event/48000 on 101 and telephone-event/8000 on 102", events)
+    }
+}
+
+func TestDTMFOnOpus(t *testing.T) {
+    s := &rtpStream{timestamp: 1000, ssrc: 0x1234}
+    s.setRemote(&sdp.Result{
+        Codec:     sdp.Codec{PayloadType: 111, Name: "opus", ClockRate: 48000, Channels: 2},
+        Events:    &sdp.Codec{PayloadType: 102, Name: sdp.TelephoneEvent, ClockRate: 48000, Channels: 1},
+        Addr:      &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 4000},
+        Direction: sdp.SendRecv,
+    })
+    s.sendDigits("5")
+
+    // The durations count ticks of the 48 kHz clock the timestamps run on
+    for i := 1; i <= digitPackets; i++ {
+        s.mu.Lock()
+        packet := s.nextPacket()
+        s.mu.Unlock()
+        h := parseRTPHeader(t, packet)
+        if duration := binary.BigEndian.Uint16(packet[12+2:]); h.payloadType != 102 || h.timestamp != 1000 || duration != uint16(960*i) {
+            t.Errorf("packet %d: %+v lasting %d, want an event on 102 at 1000 lasting %d", i, h, duration, 960*i)
+        }
+    }
+}
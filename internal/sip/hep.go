@@ -0,0 +1,32 @@
+package sip
+
+import (
+    "net"
+    "time"
+
+    "github.com/s1-callgen/internal/hep"
+)
+
+// SetHEP mirrors every SIP message the client sends and receives to a HEP
+// collector, and the RTCP of calls when rtcp is set. A nil sender mirrors
+// nothing.
+func (c *Client) SetHEP(sender *hep.Sender, rtcp bool) {
+    c.hep = sender
+    c.hepRTCP = rtcp
+}
+
+// mirror sends a packet to the HEP collector, correlated to its call by
+// Call-ID. The collector is best effort: errors are not reported.
+func (c *Client) mirror(protocol byte, callID string, from, to net.Addr, payload []byte) {
+    if c.hep == nil {
+        return
+    }
+    c.hep.Send(hep.Packet{
+        Protocol:      protocol,
+        Src:           from,
+        Dst:           to,
+        Time:          time.Now(),
+        CorrelationID: callID,
+        Payload:       payload,
+    })
+}
@@ -0,0 +1,155 @@
+package sip
+
+import (
+    "errors"
+    "time"
+)
+
+// MediaChecks are the checks on the media S2 sends back that fail an answered
+// call. Zero values disable them.
+//
+// The one-way audio check relies on S2's RTCP: it fails a call only when S2
+// sent at least two reports and none had a report block on our stream. A
+// switch that sends no RTCP is never caught by it, and one whose reports
+// leave out the streams it receives fails every call.
+type MediaChecks struct {
+    NoMediaTimeout time.Duration // no RTP from S2 this long after the answer
+    SilenceGap     time.Duration // dead air: no audible RTP from S2 this long
+    OneWayAudio    bool          // S2's RTCP reports show it receives none of our RTP
+    SSRCChange     bool          // S2's RTP changes source without a new offer or answer
+}
+
+// Media failure reasons, in order of precedence
+const (
+    MediaNoMedia     = "no_media"
+    MediaOneWayAudio = "one_way_audio"
+    MediaDeadAir     = "dead_air"
+    MediaSSRCChange  = "ssrc_change"
+)
+
+// ErrMediaFailure is matched by the *MediaError of a call that was answered
+// but failed the media checks.
+var ErrMediaFailure = errors.New("sip: media failure")
+
+// MediaError is returned for an answered call whose media failed a check.
+type MediaError struct {
+    Reason string
+}
+
+func (e *MediaError) Error() string {
+    return "sip: media failure: " + e.Reason
+}
+
+func (e *MediaError) Is(target error) bool {
+    return target == ErrMediaFailure
+}
+
+// SetMediaChecks sets the checks answered calls must pass.
+func (c *Client) SetMediaChecks(checks MediaChecks) {
+    c.mediaChecks = checks
+}
+
+// audibleLevel is the mean amplitude of a received frame above which it is
+// not silence, about -50 dBov.
+const audibleLevel = 100
+
+// observe tracks the liveness of S2's media for a received RTP packet.
+// Called with s.mu held.
+func (s *rtpStream) observe(ssrc uint32, payloadType uint8, payload []byte, now time.Time) {
+    // A new source is expected after S2 sent a new offer or answer, up to
+    // the first packet from S2 once the call is answered
+    switch {
+    case s.reception.started && ssrc != s.reception.ssrc:
+        s.ssrcChanges++
+        if !s.newSource {
+            s.unexpectedSSRC++
+        }
+        s.newSource = false
+    case s.firstArrival.IsZero():
+        s.newSource = false
+    }
+    if s.firstArrival.IsZero() {
+        s.firstArrival = now
+    }
+
+    if !s.audible(payloadType, payload) {
+        return
+    }
+    if gap := now.Sub(s.audibleAt); gap > s.longestSilence {
+        s.longestSilence = gap
+    }
+    s.audibleAt = now
+}
+
+// audible reports whether a packet carries sound: audio above the silence
+// level or a telephone event. Comfort noise and unknown payloads are not.
+func (s *rtpStream) audible(payloadType uint8, payload []byte) bool {
+    remote := s.remote
+    switch {
+    case remote == nil:
+        return false
+    case remote.Events != nil && payloadType == remote.Events.PayloadType:
+        return true
+    case payloadType != remote.Codec.PayloadType || s.decoder == nil:
+        return false
+    }
+
+    pcm := s.decoder.Decode(payload)
+    if len(pcm) == 0 {
+        return false
+    }
+    sum := 0
+    for _, sample := range pcm {
+        sum += max(int(sample), -int(sample))
+    }
+    return sum/len(pcm) >= audibleLevel
+}
+
+// mediaStats is what a stream observed of the liveness of S2's media.
+type mediaStats struct {
+    ssrcChanges    int
+    longestSilence time.Duration
+}
+
+func (s *rtpStream) mediaStats() mediaStats {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    return mediaStats{ssrcChanges: s.ssrcChanges, longestSilence: s.silence()}
+}
+
+// silence returns the longest time without audible media from S2, up to
+// the end of the stream. Called with s.mu held.
+func (s *rtpStream) silence() time.Duration {
+    return max(s.longestSilence, s.closedAt.Sub(s.audibleAt))
+}
+
+// mediaFailure returns the reason the media of a closed stream fails the
+// checks, or "". Checks of media from S2 are skipped when the call ended
+// with S2 not meant to send, as when holding.
+func (s *rtpStream) mediaFailure(checks MediaChecks) string {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if !s.started {
+        return ""
+    }
+
+    inbound := s.remote.Direction.Receives()
+    if inbound && checks.NoMediaTimeout > 0 && s.closedAt.Sub(s.startedAt) >= checks.NoMediaTimeout {
+        if s.firstArrival.IsZero() || s.firstArrival.Sub(s.startedAt) > checks.NoMediaTimeout {
+            return MediaNoMedia
+        }
+    }
+
+    // S2 reports on its reception, but never on our stream
+    if checks.OneWayAudio && s.sent.Load() > 0 && s.remoteReports >= 2 && s.reportsOnUs == 0 {
+        return MediaOneWayAudio
+    }
+
+    if inbound && checks.SilenceGap > 0 && s.silence() >= checks.SilenceGap {
+        return MediaDeadAir
+    }
+    if checks.SSRCChange && s.unexpectedSSRC > 0 {
+        return MediaSSRCChange
+    }
+    return ""
+}
@@ -0,0 +1,244 @@
+package sip
+
+import (
+    "bytes"
+    "testing"
+    "time"
+
+    "github.com/s1-callgen/internal/media"
+    "github.com/s1-callgen/internal/sip/sdp"
+)
+
+// Kinds of packet S2 sends in the media check tests
+const (
+    loud    = iota // a 2 kHz tone
+    quiet          // silence
+    noise          // comfort noise
+    dtmf           // a telephone event
+    reoffer        // not a packet: a re-INVITE from S2
+)
+
+// burst is packets every 20 ms from S2 over a span of a call.
+type burst struct {
+    from, to time.Duration
+    kind     int
+    ssrc     uint32
+}
+
+// mediaCall plays packets from S2 into an answered stream, ending the call at
+// end, and returns the stream.
+func mediaCall(t *testing.T, direction sdp.Direction, early uint32, bursts []burst, end time.Duration) *rtpStream {
+    t.Helper()
+    pcmu, err := media.New("PCMU")
+    if err != nil {
+        t.Fatal(err)
+    }
+    tone := make([]int16, 160)
+    for i := range tone {
+        tone[i] = []int16{0, 5000, 0, -5000}[i%4]
+    }
+    payloads := map[int][]byte{
+        loud:  pcmu.Encode(tone),
+        quiet: bytes.Repeat([]byte{0xff}, 160),
+        noise: {40},
+        dtmf:  {5, 10, 0, 160},
+    }
+    payloadTypes := map[int]uint8{loud: 0, quiet: 0, noise: 13, dtmf: 101}
+
+    s := testStream(t, false)
+    start := time.Unix(1700000000, 0)
+    var seq uint16
+    if early != 0 {
+        // Early media before the answer only counts towards the statistics
+        for i := 0; i < 10; i++ {
+            seq++
+            s.reception.update(early, seq, uint32(i*160), int64(i*160))
+        }
+    }
+
+    remote := *s.remote
+    remote.Direction = direction
+    s.answered(&remote, start)
+    for _, b := range bursts {
+        if b.kind == reoffer {
+            s.newSource = true
+            continue
+        }
+        for at := b.from; at < b.to; at += packetInterval {
+            seq++
+            s.observe(b.ssrc, payloadTypes[b.kind], payloads[b.kind], start.Add(at))
+            s.reception.update(b.ssrc, seq, uint32(at/time.Millisecond*8), int64(at/time.Millisecond*8))
+        }
+    }
+    s.closedAt = start.Add(end)
+    return s
+}
+
+func TestMediaFailure(t *testing.T) {
+    checks := MediaChecks{
+        NoMediaTimeout: 2 * time.Second,
+        SilenceGap:     3 * time.Second,
+        OneWayAudio:    true,
+        SSRCChange:     true,
+    }
+    second := time.Second
+
+    tests := []struct {
+        name      string
+        direction sdp.Direction
+        early     uint32 // SSRC of early media, or 0
+        bursts    []burst
+        end       time.Duration
+        want      string
+    }{
+        {
+            name:   "talking throughout",
+            bursts: []burst{{0, 10 * second, loud, 1}},
+            end:    10 * second,
+        },
+        {
+            name: "no media",
+            end:  10 * second,
+            want: MediaNoMedia,
+        },
+        {
+            name:   "media after the timeout",
+            bursts: []burst{{3 * second, 10 * second, loud, 1}},
+            end:    10 * second,
+            want:   MediaNoMedia,
+        },
+        {
+            name: "call shorter than the timeout",
+            end:  1500 * time.Millisecond,
+        },
+        {
+            name:      "on hold by us",
+            direction: sdp.SendOnly,
+            end:       10 * second,
+        },
+        {
+            name:   "dead air mid call",
+            bursts: []burst{{0, 2 * second, loud, 1}, {2 * second, 6 * second, quiet, 1}, {6 * second, 10 * second, loud, 1}},
+            end:    10 * second,
+            want:   MediaDeadAir,
+        },
+        {
+            name:   "short pauses",
+            bursts: []burst{{0, 2 * second, loud, 1}, {2 * second, 4 * second, quiet, 1}, {4 * second, 6 * second, loud, 1}, {6 * second, 8 * second, quiet, 1}, {8 * second, 10 * second, loud, 1}},
+            end:    10 * second,
+        },
+        {
+            name:   "silent to the end",
+            bursts: []burst{{0, 5 * second, loud, 1}, {5 * second, 10 * second, quiet, 1}},
+            end:    10 * second,
+            want:   MediaDeadAir,
+        },
+        {
+            name:   "stream stops",
+            bursts: []burst{{0, 5 * second, loud, 1}},
+            end:    10 * second,
+            want:   MediaDeadAir,
+        },
+        {
+            name:   "comfort noise only",
+            bursts: []burst{{0, 10 * second, noise, 1}},
+            end:    10 * second,
+            want:   MediaDeadAir,
+        },
+        {
+            name:   "telephone events are audible",
+            bursts: []burst{{0, 2 * second, loud, 1}, {2 * second, 6 * second, dtmf, 1}, {6 * second, 10 * second, loud, 1}},
+            end:    10 * second,
+        },
+        {
+            name:   "new source unannounced",
+            bursts: []burst{{0, 5 * second, loud, 1}, {5 * second, 10 * second, loud, 2}},
+            end:    10 * second,
+            want:   MediaSSRCChange,
+        },
+        {
+            name:   "new source after a re-INVITE",
+            bursts: []burst{{0, 5 * second, loud, 1}, {kind: reoffer}, {5 * second, 10 * second, loud, 2}},
+            end:    10 * second,
+        },
+        {
+            name:   "second new source after a re-INVITE",
+            bursts: []burst{{0, 5 * second, loud, 1}, {kind: reoffer}, {5 * second, 7 * second, loud, 2}, {7 * second, 10 * second, loud, 3}},
+            end:    10 * second,
+            want:   MediaSSRCChange,
+        },
+        {
+            name:   "new source on the answer after early media",
+            early:  7,
+            bursts: []burst{{0, 10 * second, loud, 1}},
+            end:    10 * second,
+        },
+        {
+            name:   "new source after the answer and early media",
+            early:  7,
+            bursts: []burst{{0, 5 * second, loud, 7}, {5 * second, 10 * second, loud, 1}},
+            end:    10 * second,
+            want:   MediaSSRCChange,
+        },
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            direction := tt.direction
+            if direction == "" {
+                direction = sdp.SendRecv
+            }
+            s := mediaCall(t, direction, tt.early, tt.bursts, tt.end)
+            if got := s.mediaFailure(checks); got != tt.want {
+                t.Errorf("got %q, want %q", got, tt.want)
+            }
+            if got := s.mediaFailure(MediaChecks{}); got != "" {
+                t.Errorf("got %q with the checks off, want none", got)
+            }
+        })
+    }
+}
+
+func TestOneWayAudio(t *testing.T) {
+    checks := MediaChecks{OneWayAudio: true}
+    tests := []struct {
+        name        string
+        sent        uint64
+        reports     int
+        reportsOnUs int
+        want        string
+    }{
+        {"S2 reports on our stream", 500, 4, 4, ""},
+        {"S2 reports on nothing", 500, 4, 0, MediaOneWayAudio},
+        {"a single report", 500, 1, 0, ""},
+        {"nothing sent", 0, 4, 0, ""},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            s := mediaCall(t, sdp.SendRecv, 0, []burst{{0, 10 * time.Second, loud, 1}}, 10*time.Second)
+            s.sent.Store(tt.sent)
+            s.remoteReports = tt.reports
+            s.reportsOnUs = tt.reportsOnUs
+            if got := s.mediaFailure(checks); got != tt.want {
+                t.Errorf("got %q, want %q", got, tt.want)
+            }
+        })
+    }
+}
+
+func TestMediaStats(t *testing.T) {
+    s := mediaCall(t, sdp.SendRecv, 0, []burst{
+        {0, 2 * time.Second, loud, 1},
+        {2 * time.Second, 6 * time.Second, quiet, 1},
+        {6 * time.Second, 8 * time.Second, loud, 2},
+    }, 9*time.Second)
+    stats := s.mediaStats()
+    // From the last loud packet at 1.98 s to the next at 6 s
+    if stats.ssrcChanges != 1 || stats.longestSilence != 4020*time.Millisecond {
+        t.Errorf("got %+v, want 1 change of source and 4.02 s of silence", stats)
+    }
+
+    if got := (&rtpStream{}).mediaFailure(MediaChecks{NoMediaTimeout: time.Second}); got != "" {
+        t.Errorf("got %q for a call never answered, want none", got)
+    }
+}
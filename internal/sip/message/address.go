@@ -0,0 +1,211 @@
+package message
+
+import (
+    "fmt"
+    "strings"
+)
+
+// Address is a name-addr or addr-spec as used in From, To, Contact, Route
+// and Record-Route, together with its header parameters such as tag.
+type Address struct {
+    DisplayName string
+    URI         *URI
+    Params      Params
+    Wildcard    bool // Contact: *
+}
+
+// ParseAddress parses `"Alice" <sip:alice@example.com>;tag=1` and the
+// bracketless addr-spec form `sip:alice@example.com;tag=1`. In the
+// bracketless form parameters belong to the header, not to the URI.
+func ParseAddress(s string) (*Address, error) {
+    s = strings.TrimSpace(s)
+    if s == "*" {
+        return &Address{Wildcard: true}, nil
+    }
+
+    addr := &Address{}
+    var uri, params string
+
+    open, err := nameAddrStart(s)
+    if err != nil {
+        return nil, err
+    }
+    if open != -1 {
+        end := strings.IndexByte(s[open:], '>')
+        if end == -1 {
+            return nil, fmt.Errorf("sip: unterminated name-addr %q", s)
+        }
+        addr.DisplayName = unquote(strings.TrimSpace(s[:open]))
+        uri = s[open+1 : open+end]
+        params = s[open+end+1:]
+    } else {
+        uri = s
+        if i := strings.IndexByte(s, ';'); i != -1 {
+            uri = s[:i]
+            params = s[i:]
+        }
+    }
+
+    parsed, err := ParseURI(uri)
+    if err != nil {
+        return nil, err
+    }
+    addr.URI = parsed
+    addr.Params = parseParams(params)
+
+    return addr, nil
+}
+
+// nameAddrStart returns the index of the '<' opening the URI of a
+// name-addr, or -1 for an addr-spec. A '<' inside the quoted display name
+// does not count.
+func nameAddrStart(s string) (int, error) {
+    inQuotes := false
+    for i := 0; i < len(s); i++ {
+        switch s[i] {
+        case '\\':
+            if inQuotes {
+                i++
+            }
+        case '"':
+            inQuotes = !inQuotes
+        case '<':
+            if !inQuotes {
+                return i, nil
+            }
+        }
+    }
+    if inQuotes {
+        return -1, fmt.Errorf("sip: unterminated quoted string in %q", s)
+    }
+    return -1, nil
+}
+
+// unquote returns the content of a quoted-string with its quoted-pairs
+// resolved (RFC 3261 section 25.1). A display name given as tokens is
+// returned as is.
+func unquote(s string) string {
+    if len(s) < 2 || s[0] != '"' || s[len(s)-1] != '"' {
+        return s
+    }
+    s = s[1 : len(s)-1]
+    var b strings.Builder
+    for i := 0; i < len(s); i++ {
+        if s[i] == '\\' && i+1 < len(s) {
+            i++
+        }
+        b.WriteByte(s[i])
+    }
+    return b.String()
+}
+
+// quote formats s as a quoted-string, escaping only '"' and '\\' as RFC
+// 3261 section 25.1 allows. Other characters, UTF-8 included, are written
+// as they are.
+func quote(s string) string {
+    var b strings.Builder
+    b.WriteByte('"')
+    for i := 0; i < len(s); i++ {
+        if s[i] == '"' || s[i] == '\\' {
+            b.WriteByte('\\')
+        }
+        b.WriteByte(s[i])
+    }
+    b.WriteByte('"')
+    return b.String()
+}
+
+// Tag returns the tag parameter, or "" if there is none.
+func (a *Address) Tag() string {
+    tag, _ := a.Params.Get("tag")
+    return tag
+}
+
+// String formats the address in name-addr form, which is always safe
+// whatever parameters the URI carries.
+func (a *Address) String() string {
+    if a.Wildcard {
+        return "*"
+    }
+    var b strings.Builder
+    if a.DisplayName != "" {
+        b.WriteString(quote(a.DisplayName))
+        b.WriteByte(' ')
+    }
+    b.WriteByte('<')
+    b.WriteString(a.URI.String())
+    b.WriteByte('>')
+    b.WriteString(a.Params.String())
+    return b.String()
+}
+
+// Clone returns a deep copy of a.
+func (a *Address) Clone() *Address {
+    clone := *a
+    if a.URI != nil {
+        clone.URI = a.URI.Clone()
+    }
+    clone.Params = append(Params(nil), a.Params...)
+    return &clone
+}
+
+// Via is a single Via header element.
+type Via struct {
+    Transport string
+    Host      string
+    Port      int
+    Params    Params
+}
+
+// ParseVia parses a Via element such as
+// "SIP/2.0/UDP 10.0.0.1:5070;branch=z9hG4bK1;rport".
+func ParseVia(s string) (*Via, error) {
+    s = strings.TrimSpace(s)
+    protocol, rest, found := strings.Cut(s, " ")
+    if !found {
+        return nil, fmt.Errorf("sip: malformed Via %q", s)
+    }
+
+    // Linear whitespace is allowed around the slashes of the protocol
+    for strings.HasSuffix(protocol, "/") || strings.HasPrefix(strings.TrimSpace(rest), "/") {
+        rest = strings.TrimSpace(rest)
+        if rest == "" {
+            break
+        }
+        next, remainder, _ := strings.Cut(rest, " ")
+        protocol += next
+        rest = remainder
+    }
+
+    parts := strings.Split(protocol, "/")
+    if len(parts) != 3 || !strings.EqualFold(parts[0], "SIP") {
+        return nil, fmt.Errorf("sip: malformed Via protocol %q", protocol)
+    }
+
+    via := &Via{Transport: strings.ToUpper(strings.TrimSpace(parts[2]))}
+
+    sentBy := strings.TrimSpace(rest)
+    if i := strings.IndexByte(sentBy, ';'); i != -1 {
+        via.Params = parseParams(sentBy[i:])
+        sentBy = strings.TrimSpace(sentBy[:i])
+    }
+
+    host, port, err := splitHostPort(sentBy)
+    if err != nil {
+        return nil, fmt.Errorf("sip: malformed Via %q: %v", s, err)
+    }
+    via.Host = host
+    via.Port = port
+
+    return via, nil
+}
+
+// Branch returns the branch parameter.
+func (v *Via) Branch() string {
+    branch, _ := v.Params.Get("branch")
+    return branch
+}
+
+func (v *Via) String() string {
+    return "SIP/2.0/" + v.Transport + " " + HostPort(v.Host, v.Port) + v.Params.String()
+}
@@ -0,0 +1,110 @@
+package message
+
+import "testing"
+
+func TestParseAddress(t *testing.T) {
+    tests := []struct {
+        name    string
+        in      string
+        display string
+        uri     string
+        tag     string
+        wantErr bool
+    }{
+        {name: "name-addr", in: `"Alice" <sip:alice@example.com>;tag=1`, display: "Alice", uri: "sip:alice@example.com", tag: "1"},
+        {name: "token display name", in: `Alice Smith <sip:alice@example.com>`, display: "Alice Smith", uri: "sip:alice@example.com"},
+        {name: "no display name", in: `<sip:alice@example.com;transport=tcp>;tag=2`, uri: "sip:alice@example.com;transport=tcp", tag: "2"},
+        {name: "addr-spec parameters belong to the header", in: `sip:alice@example.com;tag=3`, uri: "sip:alice@example.com", tag: "3"},
+        {name: "quoted <", in: `"a<b" <sip:x@y>;tag=4`, display: "a<b", uri: "sip:x@y", tag: "4"},
+        {name: "quoted < and >", in: `"<sip:evil@z>" <sip:x@y>`, display: "<sip:evil@z>", uri: "sip:x@y"},
+        {name: "escaped quote", in: `"say \"hi\" \\ bye" <sip:x@y>`, display: `say "hi" \ bye`, uri: "sip:x@y"},
+        {name: "quoted-pair of other character", in: `"\a" <sip:x@y>`, display: "a", uri: "sip:x@y"},
+        {name: "UTF-8", in: `"Zoë" <sip:zoe@example.com>`, display: "Zoë", uri: "sip:zoe@example.com"},
+        {name: "unterminated name-addr", in: `"Alice" <sip:alice@example.com`, wantErr: true},
+        {name: "unterminated quoted string", in: `"Alice <sip:alice@example.com>`, wantErr: true},
+        {name: "malformed URI", in: `<alice>`, wantErr: true},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            addr, err := ParseAddress(tt.in)
+            if tt.wantErr {
+                if err == nil {
+                    t.Errorf("parsed %q, want an error", addr)
+                }
+                return
+            }
+            if err != nil {
+                t.Fatal(err)
+            }
+            if addr.DisplayName != tt.display || addr.URI.String() != tt.uri || addr.Tag() != tt.tag {
+                t.Errorf("got display %q, URI %q, tag %q; want %q, %q, %q",
+                    addr.DisplayName, addr.URI, addr.Tag(), tt.display, tt.uri, tt.tag)
+            }
+        })
+    }
+}
+
+func TestAddressString(t *testing.T) {
+    tests := []struct {
+        display string
+        want    string
+    }{
+        {"", `<sip:x@y>;tag=1`},
+        {"Alice", `"Alice" <sip:x@y>;tag=1`},
+        {`say "hi"`, `"say \"hi\"" <sip:x@y>;tag=1`},
+        {`a\b`, `"a\\b" <sip:x@y>;tag=1`},
+        {"Zoë", `"Zoë" <sip:x@y>;tag=1`},
+        {"tab\there", "\"tab\there\" <sip:x@y>;tag=1"},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.want, func(t *testing.T) {
+            addr := &Address{DisplayName: tt.display, URI: &URI{Scheme: "sip", User: "x", Host: "y"}, Params: Params{{Name: "tag", Value: "1"}}}
+            got := addr.String()
+            if got != tt.want {
+                t.Errorf("got %s, want %s", got, tt.want)
+            }
+
+            parsed, err := ParseAddress(got)
+            if err != nil {
+                t.Fatal(err)
+            }
+            if parsed.DisplayName != tt.display {
+                t.Errorf("display name %q after a round trip, want %q", parsed.DisplayName, tt.display)
+            }
+        })
+    }
+}
+
+func TestParseVia(t *testing.T) {
+    tests := []struct {
+        in      string
+        want    string
+        branch  string
+        wantErr bool
+    }{
+        {in: "SIP/2.0/UDP 10.0.0.1:5070;branch=z9hG4bK1;rport", want: "SIP/2.0/UDP 10.0.0.1:5070;branch=z9hG4bK1;rport", branch: "z9hG4bK1"},
+        {in: "SIP / 2.0 / tcp [2001:db8::1];branch=z9hG4bK2", want: "SIP/2.0/TCP [2001:db8::1];branch=z9hG4bK2", branch: "z9hG4bK2"},
+        {in: "SIP/2.0/UDP", wantErr: true},
+        {in: "HTTP/1.1/TCP host", wantErr: true},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.in, func(t *testing.T) {
+            via, err := ParseVia(tt.in)
+            if tt.wantErr {
+                if err == nil {
+                    t.Errorf("parsed %q, want an error", via)
+                }
+                return
+            }
+            if err != nil {
+                t.Fatal(err)
+            }
+            if via.String() != tt.want || via.Branch() != tt.branch {
+                t.Errorf("got %q with branch %q, want %q with branch %q", via, via.Branch(), tt.want, tt.branch)
+            }
+        })
+    }
+}
@@ -0,0 +1,207 @@
+package message
+
+import (
+    "net/textproto"
+    "strings"
+)
+
+// compactForms maps the single-letter header names of RFC 3261 section 7.3.3
+// and later extensions to their long form.
+var compactForms = map[string]string{
+    "a": "Accept-Contact",
+    "b": "Referred-By",
+    "c": "Content-Type",
+    "d": "Request-Disposition",
+    "e": "Content-Encoding",
+    "f": "From",
+    "i": "Call-ID",
+    "j": "Reject-Contact",
+    "k": "Supported",
+    "l": "Content-Length",
+    "m": "Contact",
+    "n": "Identity-Info",
+    "o": "Event",
+    "r": "Refer-To",
+    "s": "Subject",
+    "t": "To",
+    "u": "Allow-Events",
+    "v": "Via",
+    "x": "Session-Expires",
+    "y": "Identity",
+}
+
+// irregularNames are header names whose canonical spelling is not the MIME
+// canonical form.
+var irregularNames = map[string]string{
+    "call-id":             "Call-ID",
+    "cseq":                "CSeq",
+    "mime-version":        "MIME-Version",
+    "min-se":              "Min-SE",
+    "rack":                "RAck",
+    "rseq":                "RSeq",
+    "sip-etag":            "SIP-ETag",
+    "sip-if-match":        "SIP-If-Match",
+    "www-authenticate":    "WWW-Authenticate",
+    "p-asserted-identity": "P-Asserted-Identity",
+}
+
+// singleValued are headers whose values may contain commas that do not
+// separate list elements, so they are never split.
+var singleValued = map[string]bool{
+    "Authorization":       true,
+    "Proxy-Authenticate":  true,
+    "Proxy-Authorization": true,
+    "WWW-Authenticate":    true,
+    "Authentication-Info": true,
+    "Date":                true,
+    "Subject":             true,
+    "User-Agent":          true,
+    "Server":              true,
+    "Organization":        true,
+    "Call-ID":             true,
+    "CSeq":                true,
+    "From":                true,
+    "To":                  true,
+}
+
+// CanonicalName returns the long, canonically capitalised form of a header
+// name, expanding compact forms: "i", "call-id" and "CALL-ID" all become
+// "Call-ID".
+func CanonicalName(name string) string {
+    name = strings.TrimSpace(name)
+    lower := strings.ToLower(name)
+    if long, ok := compactForms[lower]; ok {
+        return long
+    }
+    if irregular, ok := irregularNames[lower]; ok {
+        return irregular
+    }
+    return textproto.CanonicalMIMEHeaderKey(name)
+}
+
+// Field is a single header line.
+type Field struct {
+    Name  string
+    Value string
+}
+
+// Header is the ordered list of header fields of a message. Names are stored
+// in canonical form, so lookups are case-insensitive and accept compact forms.
+type Header []Field
+
+// Add appends a header field.
+func (h *Header) Add(name, value string) {
+    *h = append(*h, Field{Name: CanonicalName(name), Value: value})
+}
+
+// Set replaces every field called name with a single field. The new field
+// takes the position of the first one it replaces.
+func (h *Header) Set(name, value string) {
+    name = CanonicalName(name)
+    fields := (*h)[:0]
+    set := false
+    for _, f := range *h {
+        if f.Name != name {
+            fields = append(fields, f)
+            continue
+        }
+        if !set {
+            fields = append(fields, Field{Name: name, Value: value})
+            set = true
+        }
+    }
+    if !set {
+        fields = append(fields, Field{Name: name, Value: value})
+    }
+    *h = fields
+}
+
+// Del removes every field called name.
+func (h *Header) Del(name string) {
+    name = CanonicalName(name)
+    fields := (*h)[:0]
+    for _, f := range *h {
+        if f.Name != name {
+            fields = append(fields, f)
+        }
+    }
+    *h = fields
+}
+
+// Has reports whether a field called name is present.
+func (h Header) Has(name string) bool {
+    name = CanonicalName(name)
+    for _, f := range h {
+        if f.Name == name {
+            return true
+        }
+    }
+    return false
+}
+
+// Get returns the first value of name, or "" if it is not present. For list
+// headers such as Via this is the first element of the list.
+func (h Header) Get(name string) string {
+    values := h.Values(name)
+    if len(values) == 0 {
+        return ""
+    }
+    return values[0]
+}
+
+// Values returns every value of name in order. Fields of list headers are
+// split on the commas separating their elements, so a Via field carrying two
+// hops yields two values.
+func (h Header) Values(name string) []string {
+    name = CanonicalName(name)
+    var values []string
+    for _, f := range h {
+        if f.Name != name {
+            continue
+        }
+        if singleValued[name] {
+            values = append(values, f.Value)
+            continue
+        }
+        values = append(values, SplitList(f.Value)...)
+    }
+    return values
+}
+
+// Clone returns a copy of h that can be modified independently.
+func (h Header) Clone() Header {
+    return append(Header(nil), h...)
+}
+
+// SplitList splits a header value on commas that are not inside angle
+// brackets or quoted strings.
+func SplitList(value string) []string {
+    var list []string
+    var inQuotes, inBrackets bool
+    start := 0
+    for i := 0; i < len(value); i++ {
+        switch value[i] {
+        case '\\':
+            if inQuotes {
+                i++
+            }
+        case '"':
+            inQuotes = !inQuotes
+        case '<':
+            inBrackets = !inQuotes
+        case '>':
+            inBrackets = false
+        case ',':
+            if !inQuotes && !inBrackets {
+                if elem := strings.TrimSpace(value[start:i]); elem != "" {
+                    list = append(list, elem)
+                }
+                start = i + 1
+            }
+        }
+    }
+    if rest := strings.TrimSpace(value[start:]); rest != "" {
+        list = append(list, rest)
+    }
+    return list
+}
@@ -0,0 +1,313 @@
+// Package message parses and builds SIP requests and responses (RFC 3261
+// sections 7 and 25).
+package message
+
+import (
+    "bufio"
+    "bytes"
+    "errors"
+    "fmt"
+    "io"
+    "strconv"
+    "strings"
+)
+
+// MaxMessageSize bounds the size of a message read from a stream.
+const MaxMessageSize = 65535
+
+// Message is a SIP request or response.
+type Message interface {
+    // Headers returns the message header.
+    Headers() *Header
+    // Bytes serialises the message, setting Content-Length from the body.
+    Bytes() []byte
+    String() string
+}
+
+// Request is a SIP request.
+type Request struct {
+    Method string
+    URI    *URI
+    Header Header
+    Body   []byte
+}
+
+// NewRequest returns a request with an empty header.
+func NewRequest(method string, uri *URI) *Request {
+    return &Request{Method: method, URI: uri}
+}
+
+func (r *Request) Headers() *Header { return &r.Header }
+
+func (r *Request) Bytes() []byte {
+    return serialize(r.Method+" "+r.URI.String()+" SIP/2.0", r.Header, r.Body)
+}
+
+func (r *Request) String() string { return string(r.Bytes()) }
+
+// Response is a SIP response.
+type Response struct {
+    StatusCode int
+    Reason     string
+    Header     Header
+    Body       []byte
+}
+
+// NewResponse builds a response to req, copying the headers RFC 3261 section
+// 8.2.6.2 requires: Via, From, To, Call-ID and CSeq.
+func NewResponse(req *Request, code int, reason string) *Response {
+    resp := &Response{StatusCode: code, Reason: reason}
+    for _, f := range req.Header {
+        switch f.Name {
+        case "Via", "From", "To", "Call-ID", "CSeq", "Record-Route":
+            resp.Header = append(resp.Header, f)
+        }
+    }
+    return resp
+}
+
+func (r *Response) Headers() *Header { return &r.Header }
+
+func (r *Response) Bytes() []byte {
+    return serialize("SIP/2.0 "+strconv.Itoa(r.StatusCode)+" "+r.Reason, r.Header, r.Body)
+}
+
+func (r *Response) String() string { return string(r.Bytes()) }
+
+func serialize(startLine string, header Header, body []byte) []byte {
+    var b bytes.Buffer
+    b.WriteString(startLine)
+    b.WriteString("\r\n")
+
+    length := strconv.Itoa(len(body))
+    wroteLength := false
+    for _, f := range header {
+        if f.Name == "Content-Length" {
+            if wroteLength {
+                continue
+            }
+            f.Value = length
+            wroteLength = true
+        }
+        b.WriteString(f.Name)
+        b.WriteString(": ")
+        b.WriteString(f.Value)
+        b.WriteString("\r\n")
+    }
+    if !wroteLength {
+        b.WriteString("Content-Length: " + length + "\r\n")
+    }
+
+    b.WriteString("\r\n")
+    b.Write(body)
+    return b.Bytes()
+}
+
+// ErrIncomplete is returned by Parse when the body is shorter than the
+// Content-Length header says.
+var ErrIncomplete = errors.New("sip: message body shorter than Content-Length")
+
+// Parse parses a single message from a datagram. A body longer than
+// Content-Length is truncated to it (RFC 3261 section 18.3).
+func Parse(data []byte) (Message, error) {
+    head, body, found := bytes.Cut(data, []byte("\r\n\r\n"))
+    if !found {
+        // Tolerate bare LF line endings
+        head, body, found = bytes.Cut(data, []byte("\n\n"))
+        if !found {
+            head, body = data, nil
+        }
+    }
+
+    msg, err := parseHead(string(head))
+    if err != nil {
+        return nil, err
+    }
+
+    header := msg.Headers()
+    if value := header.Get("Content-Length"); value != "" {
+        length, err := strconv.Atoi(strings.TrimSpace(value))
+        if err != nil || length < 0 {
+            return nil, fmt.Errorf("sip: invalid Content-Length %q", value)
+        }
+        if length > len(body) {
+            return nil, ErrIncomplete
+        }
+        body = body[:length]
+    }
+    setBody(msg, body)
+
+    return msg, nil
+}
+
+// ReadMessage reads one message from a stream transport, using Content-Length
+// to find where it ends (RFC 3261 section 18.3). Keep-alive CRLFs between
+// messages are skipped.
+func ReadMessage(r *bufio.Reader) (Message, error) {
+    var head strings.Builder
+    for {
+        line, err := r.ReadString('\n')
+        if err != nil {
+            return nil, err
+        }
+        trimmed := strings.TrimRight(line, "\r\n")
+        if trimmed == "" {
+            if head.Len() == 0 {
+                continue
+            }
+            break
+        }
+        head.WriteString(trimmed)
+        head.WriteString("\r\n")
+        if head.Len() > MaxMessageSize {
+            return nil, fmt.Errorf("sip: message header exceeds %d bytes", MaxMessageSize)
+        }
+    }
+
+    msg, err := parseHead(strings.TrimSuffix(head.String(), "\r\n"))
+    if err != nil {
+        return nil, err
+    }
+
+    value := msg.Headers().Get("Content-Length")
+    if value == "" {
+        return nil, fmt.Errorf("sip: stream message without Content-Length")
+    }
+    length, err := strconv.Atoi(strings.TrimSpace(value))
+    if err != nil || length < 0 || length > MaxMessageSize {
+        return nil, fmt.Errorf("sip: invalid Content-Length %q", value)
+    }
+
+    body := make([]byte, length)
+    if _, err := io.ReadFull(r, body); err != nil {
+        return nil, err
+    }
+    setBody(msg, body)
+
+    return msg, nil
+}
+
+func setBody(msg Message, body []byte) {
+    if len(body) == 0 {
+        return
+    }
+    body = append([]byte(nil), body...)
+    switch m := msg.(type) {
+    case *Request:
+        m.Body = body
+    case *Response:
+        m.Body = body
+    }
+}
+
+// parseHead parses the start line and header fields, unfolding continuation
+// lines.
+func parseHead(head string) (Message, error) {
+    head = strings.ReplaceAll(head, "\r\n", "\n")
+    lines := strings.Split(head, "\n")
+    for len(lines) > 0 && strings.TrimSpace(lines[0]) == "" {
+        lines = lines[1:]
+    }
+    if len(lines) == 0 {
+        return nil, fmt.Errorf("sip: empty message")
+    }
+
+    var header Header
+    for _, line := range lines[1:] {
+        if line == "" {
+            continue
+        }
+        if line[0] == ' ' || line[0] == '\t' {
+            if len(header) == 0 {
+                return nil, fmt.Errorf("sip: continuation line before first header")
+            }
+            last := &header[len(header)-1]
+            last.Value += " " + strings.TrimSpace(line)
+            continue
+        }
+        name, value, found := strings.Cut(line, ":")
+        if !found {
+            return nil, fmt.Errorf("sip: malformed header line %q", line)
+        }
+        header.Add(name, strings.TrimSpace(value))
+    }
+
+    startLine := strings.TrimSpace(lines[0])
+    if strings.HasPrefix(startLine, "SIP/") {
+        parts := strings.SplitN(startLine, " ", 3)
+        if len(parts) < 2 || parts[0] != "SIP/2.0" {
+            return nil, fmt.Errorf("sip: malformed status line %q", startLine)
+        }
+        code, err := strconv.Atoi(parts[1])
+        if err != nil || code < 100 || code > 699 {
+            return nil, fmt.Errorf("sip: invalid status code %q", parts[1])
+        }
+        resp := &Response{StatusCode: code, Header: header}
+        if len(parts) == 3 {
+            resp.Reason = parts[2]
+        }
+        return resp, nil
+    }
+
+    parts := strings.Split(startLine, " ")
+    if len(parts) != 3 || parts[2] != "SIP/2.0" {
+        return nil, fmt.Errorf("sip: malformed request line %q", startLine)
+    }
+    uri, err := ParseURI(parts[1])
+    if err != nil {
+        return nil, err
+    }
+    return &Request{Method: strings.ToUpper(parts[0]), URI: uri, Header: header}, nil
+}
+
+// CSeq returns the sequence number and method of the CSeq header.
+func (h Header) CSeq() (uint32, string, error) {
+    value := h.Get("CSeq")
+    fields := strings.Fields(value)
+    if len(fields) != 2 {
+        return 0, "", fmt.Errorf("sip: malformed CSeq %q", value)
+    }
+    seq, err := strconv.ParseUint(fields[0], 10, 32)
+    if err != nil {
+        return 0, "", fmt.Errorf("sip: malformed CSeq %q", value)
+    }
+    return uint32(seq), strings.ToUpper(fields[1]), nil
+}
+
+// CallID returns the Call-ID header.
+func (h Header) CallID() string {
+    return h.Get("Call-ID")
+}
+
+// Via returns the topmost Via element.
+func (h Header) Via() (*Via, error) {
+    value := h.Get("Via")
+    if value == "" {
+        return nil, fmt.Errorf("sip: missing Via")
+    }
+    return ParseVia(value)
+}
+
+// From returns the parsed From header.
+func (h Header) From() (*Address, error) {
+    return ParseAddress(h.Get("From"))
+}
+
+// To returns the parsed To header.
+func (h Header) To() (*Address, error) {
+    return ParseAddress(h.Get("To"))
+}
+
+// Addresses returns every element of an address list header such as Contact,
+// Route or Record-Route.
+func (h Header) Addresses(name string) ([]*Address, error) {
+    var addrs []*Address
+    for _, value := range h.Values(name) {
+        addr, err := ParseAddress(value)
+        if err != nil {
+            return nil, err
+        }
+        addrs = append(addrs, addr)
+    }
+    return addrs, nil
+}
@@ -0,0 +1,242 @@
+package message
+
+import (
+    "bufio"
+    "errors"
+    "io"
+    "reflect"
+    "strings"
+    "testing"
+)
+
+const invite = "INVITE sip:bob@example.com SIP/2.0\r\n" +
+    "v: SIP/2.0/UDP 10.0.0.1:5060;branch=z9hG4bK1, SIP/2.0/UDP 10.0.0.2:5060;branch=z9hG4bK2\r\n" +
+    "Via: SIP/2.0/TCP 10.0.0.3:5060;branch=z9hG4bK3\r\n" +
+    "f: \"Alice, A.\" <sip:alice@example.com>;tag=1\r\n" +
+    "t: <sip:bob@example.com>\r\n" +
+    "i: abc@10.0.0.1\r\n" +
+    "CSeq: 1 invite\r\n" +
+    "m: <sip:alice@10.0.0.1;transport=udp>\r\n" +
+    "Subject: lunch,\r\n" +
+    " today\r\n" +
+    "\tor tomorrow\r\n" +
+    "k: timer, 100rel\r\n" +
+    "c: application/sdp\r\n" +
+    "l: 4\r\n" +
+    "\r\n" +
+    "v=0\r\n"
+
+func TestParseRequest(t *testing.T) {
+    msg, err := Parse([]byte(invite))
+    if err != nil {
+        t.Fatal(err)
+    }
+    req, ok := msg.(*Request)
+    if !ok {
+        t.Fatalf("parsed a %T, want a request", msg)
+    }
+
+    if req.Method != "INVITE" || req.URI.String() != "sip:bob@example.com" {
+        t.Errorf("request line %s %s", req.Method, req.URI)
+    }
+    // Content-Length truncates the body
+    if string(req.Body) != "v=0\r" {
+        t.Errorf("body %q, want the 4 bytes of Content-Length", req.Body)
+    }
+
+    tests := []struct {
+        name string
+        want []string
+    }{
+        {"Via", []string{
+            "SIP/2.0/UDP 10.0.0.1:5060;branch=z9hG4bK1",
+            "SIP/2.0/UDP 10.0.0.2:5060;branch=z9hG4bK2",
+            "SIP/2.0/TCP 10.0.0.3:5060;branch=z9hG4bK3",
+        }},
+        {"from", []string{`"Alice, A." <sip:alice@example.com>;tag=1`}},
+        {"Call-ID", []string{"abc@10.0.0.1"}},
+        {"CALL-ID", []string{"abc@10.0.0.1"}},
+        {"Contact", []string{"<sip:alice@10.0.0.1;transport=udp>"}},
+        {"Subject", []string{"lunch, today or tomorrow"}},
+        {"Supported", []string{"timer", "100rel"}},
+        {"Content-Type", []string{"application/sdp"}},
+        {"Allow", nil},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            if got := req.Header.Values(tt.name); !reflect.DeepEqual(got, tt.want) {
+                t.Errorf("got %q, want %q", got, tt.want)
+            }
+        })
+    }
+
+    seq, method, err := req.Header.CSeq()
+    if err != nil || seq != 1 || method != "INVITE" {
+        t.Errorf("CSeq %d %s, %v", seq, method, err)
+    }
+    from, err := req.Header.From()
+    if err != nil || from.DisplayName != "Alice, A." || from.Tag() != "1" {
+        t.Errorf("From %v, %v", from, err)
+    }
+}
+
+func TestRoundTrip(t *testing.T) {
+    msg, err := Parse([]byte(invite))
+    if err != nil {
+        t.Fatal(err)
+    }
+    out := msg.Bytes()
+
+    // Compact names are written in long form and Content-Length follows the
+    // body actually kept
+    for _, line := range []string{"Via: SIP/2.0/UDP 10.0.0.1", "From: ", "Call-ID: abc@10.0.0.1", "Content-Length: 4\r\n", "Subject: lunch, today or tomorrow\r\n"} {
+        if !strings.Contains(string(out), line) {
+            t.Errorf("serialised message lacks %q:\n%s", line, out)
+        }
+    }
+
+    again, err := Parse(out)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !reflect.DeepEqual(again, msg) {
+        t.Errorf("got %#v after a second round trip, want %#v", again, msg)
+    }
+}
+
+func TestParseResponse(t *testing.T) {
+    data := "SIP/2.0 180 Ringing Now\r\nVia: SIP/2.0/UDP 10.0.0.1;branch=z9hG4bK1\r\nContent-Length: 0\r\n\r\n"
+    msg, err := Parse([]byte(data))
+    if err != nil {
+        t.Fatal(err)
+    }
+    resp, ok := msg.(*Response)
+    if !ok || resp.StatusCode != 180 || resp.Reason != "Ringing Now" || resp.Body != nil {
+        t.Errorf("got %#v", msg)
+    }
+    if string(resp.Bytes()) != data {
+        t.Errorf("got %q after a round trip, want %q", resp.Bytes(), data)
+    }
+}
+
+func TestParseMalformed(t *testing.T) {
+    tests := []struct {
+        name string
+        data string
+        err  error
+    }{
+        {name: "empty", data: "\r\n\r\n"},
+        {name: "bad request line", data: "INVITE sip:bob@example.com\r\n\r\n"},
+        {name: "bad version", data: "INVITE sip:bob@example.com SIP/3.0\r\n\r\n"},
+        {name: "bad request URI", data: "INVITE bob SIP/2.0\r\n\r\n"},
+        {name: "bad status code", data: "SIP/2.0 1000 Odd\r\n\r\n"},
+        {name: "non-numeric status code", data: "SIP/2.0 OK\r\n\r\n"},
+        {name: "header without colon", data: "OPTIONS sip:x SIP/2.0\r\nVia\r\n\r\n"},
+        {name: "continuation before first header", data: "OPTIONS sip:x SIP/2.0\r\n folded\r\n\r\n"},
+        {name: "bad Content-Length", data: "OPTIONS sip:x SIP/2.0\r\nContent-Length: -1\r\n\r\n"},
+        {name: "short body", data: "OPTIONS sip:x SIP/2.0\r\nContent-Length: 10\r\n\r\nabc", err: ErrIncomplete},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            msg, err := Parse([]byte(tt.data))
+            if err == nil {
+                t.Fatalf("parsed %q, want an error", msg)
+            }
+            if tt.err != nil && !errors.Is(err, tt.err) {
+                t.Errorf("got %v, want %v", err, tt.err)
+            }
+        })
+    }
+}
+
+func TestReadMessage(t *testing.T) {
+    first := "OPTIONS sip:x@y SIP/2.0\r\nCall-ID: 1\r\nContent-Length: 5\r\n\r\nhello"
+    second := "SIP/2.0 200 OK\r\nCall-ID: 1\r\nl: 0\r\n\r\n"
+    third := "MESSAGE sip:x@y SIP/2.0\r\nCall-ID: 2\r\nContent-Length: 7\r\n\r\nINVITE "
+
+    // Keep-alive CRLFs between messages, and a body that looks like the
+    // start of another message
+    stream := "\r\n\r\n" + first + "\r\n" + second + third
+    r := bufio.NewReaderSize(strings.NewReader(stream), 16)
+
+    want := []struct {
+        callID string
+        body   string
+    }{{"1", "hello"}, {"1", ""}, {"2", "INVITE "}}
+    for i, w := range want {
+        msg, err := ReadMessage(r)
+        if err != nil {
+            t.Fatalf("message %d: %v", i, err)
+        }
+        var body []byte
+        switch m := msg.(type) {
+        case *Request:
+            body = m.Body
+        case *Response:
+            body = m.Body
+        }
+        if msg.Headers().CallID() != w.callID || string(body) != w.body {
+            t.Errorf("message %d has Call-ID %q and body %q, want %q and %q", i, msg.Headers().CallID(), body, w.callID, w.body)
+        }
+    }
+    if _, err := ReadMessage(r); err != io.EOF {
+        t.Errorf("got %v at the end of the stream, want EOF", err)
+    }
+}
+
+func TestReadMessageMalformed(t *testing.T) {
+    tests := []struct {
+        name   string
+        stream string
+    }{
+        {"no Content-Length", "OPTIONS sip:x@y SIP/2.0\r\nCall-ID: 1\r\n\r\n"},
+        {"Content-Length too large", "OPTIONS sip:x@y SIP/2.0\r\nContent-Length: 70000\r\n\r\n"},
+        {"body cut short", "OPTIONS sip:x@y SIP/2.0\r\nContent-Length: 10\r\n\r\nabc"},
+        {"header cut short", "OPTIONS sip:x@y SIP/2.0\r\nCall-ID: 1"},
+        {"header too large", "OPTIONS sip:x@y SIP/2.0\r\nSubject: " + strings.Repeat("x", MaxMessageSize) + "\r\n\r\n"},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            msg, err := ReadMessage(bufio.NewReader(strings.NewReader(tt.stream)))
+            if err == nil {
+                t.Errorf("read %q, want an error", msg)
+            }
+        })
+    }
+}
+
+func TestCanonicalName(t *testing.T) {
+    tests := map[string]string{
+        "i":                "Call-ID",
+        "call-id":          "Call-ID",
+        "CSEQ":             "CSeq",
+        "x":                "Session-Expires",
+        "www-authenticate": "WWW-Authenticate",
+        "content-type":     "Content-Type",
+        " max-forwards ":   "Max-Forwards",
+    }
+    for in, want := range tests {
+        if got := CanonicalName(in); got != want {
+            t.Errorf("CanonicalName(%q) = %q, want %q", in, got, want)
+        }
+    }
+}
+
+func TestSplitList(t *testing.T) {
+    tests := []struct {
+        in   string
+        want []string
+    }{
+        {"a, b,c", []string{"a", "b", "c"}},
+        {`"Bob, B." <sip:bob@x>, <sip:carol@y;a=b,c>`, []string{`"Bob, B." <sip:bob@x>`, "<sip:carol@y;a=b,c>"}},
+        {`"a\", <" <sip:x@y>, <sip:z@w>`, []string{`"a\", <" <sip:x@y>`, "<sip:z@w>"}},
+        {" , ,", nil},
+    }
+    for _, tt := range tests {
+        if got := SplitList(tt.in); !reflect.DeepEqual(got, tt.want) {
+            t.Errorf("SplitList(%q) = %q, want %q", tt.in, got, tt.want)
+        }
+    }
+}
@@ -0,0 +1,238 @@
+package message
+
+import (
+    "fmt"
+    "net"
+    "strconv"
+    "strings"
+)
+
+// Param is a ;name=value parameter. Flag parameters such as lr or rport have
+// an empty value.
+type Param struct {
+    Name  string
+    Value string
+}
+
+// Params is an ordered parameter list.
+type Params []Param
+
+// Get returns the value of the parameter called name, and whether it exists.
+// Parameter names are case-insensitive.
+func (p Params) Get(name string) (string, bool) {
+    for _, param := range p {
+        if strings.EqualFold(param.Name, name) {
+            return param.Value, true
+        }
+    }
+    return "", false
+}
+
+// Has reports whether the parameter called name exists.
+func (p Params) Has(name string) bool {
+    _, ok := p.Get(name)
+    return ok
+}
+
+// Set sets the value of name, appending it if it does not exist.
+func (p *Params) Set(name, value string) {
+    for i, param := range *p {
+        if strings.EqualFold(param.Name, name) {
+            (*p)[i].Value = value
+            return
+        }
+    }
+    *p = append(*p, Param{Name: name, Value: value})
+}
+
+// Del removes the parameter called name.
+func (p *Params) Del(name string) {
+    params := (*p)[:0]
+    for _, param := range *p {
+        if !strings.EqualFold(param.Name, name) {
+            params = append(params, param)
+        }
+    }
+    *p = params
+}
+
+func (p Params) String() string {
+    var b strings.Builder
+    for _, param := range p {
+        b.WriteByte(';')
+        b.WriteString(param.Name)
+        if param.Value != "" {
+            b.WriteByte('=')
+            b.WriteString(param.Value)
+        }
+    }
+    return b.String()
+}
+
+// parseParams parses a ";a=b;c" parameter list. The leading semicolon is
+// optional.
+func parseParams(s string) Params {
+    var params Params
+    for _, part := range strings.Split(strings.TrimPrefix(s, ";"), ";") {
+        part = strings.TrimSpace(part)
+        if part == "" {
+            continue
+        }
+        name, value, _ := strings.Cut(part, "=")
+        params = append(params, Param{
+            Name:  strings.TrimSpace(name),
+            Value: strings.TrimSpace(value),
+        })
+    }
+    return params
+}
+
+// URI is a sip, sips or tel URI. Host holds IPv6 literals without brackets.
+type URI struct {
+    Scheme   string
+    User     string
+    Password string
+    Host     string
+    Port     int
+    Params   Params
+    Headers  string
+}
+
+// ParseURI parses a URI such as sip:alice:secret@[2001:db8::1]:5060;lr?subject=x.
+func ParseURI(s string) (*URI, error) {
+    s = strings.TrimSpace(s)
+    scheme, rest, found := strings.Cut(s, ":")
+    if !found || scheme == "" {
+        return nil, fmt.Errorf("sip: malformed URI %q", s)
+    }
+
+    uri := &URI{Scheme: strings.ToLower(scheme)}
+
+    if i := strings.IndexByte(rest, '?'); i != -1 {
+        uri.Headers = rest[i+1:]
+        rest = rest[:i]
+    }
+
+    if uri.Scheme == "tel" {
+        number, params, _ := strings.Cut(rest, ";")
+        uri.User = number
+        uri.Params = parseParams(params)
+        return uri, nil
+    }
+
+    if i := strings.LastIndexByte(rest, '@'); i != -1 {
+        userinfo := rest[:i]
+        rest = rest[i+1:]
+        uri.User, uri.Password, _ = strings.Cut(userinfo, ":")
+    }
+
+    hostport := rest
+    if i := strings.IndexByte(rest, ';'); i != -1 {
+        hostport = rest[:i]
+        uri.Params = parseParams(rest[i:])
+    }
+
+    host, port, err := splitHostPort(hostport)
+    if err != nil {
+        return nil, fmt.Errorf("sip: malformed URI %q: %v", s, err)
+    }
+    uri.Host = host
+    uri.Port = port
+
+    return uri, nil
+}
+
+// splitHostPort splits host[:port], where host may be a bracketed IPv6
+// literal. A missing port is returned as 0.
+func splitHostPort(hostport string) (string, int, error) {
+    if hostport == "" {
+        return "", 0, fmt.Errorf("missing host")
+    }
+
+    if strings.HasPrefix(hostport, "[") {
+        end := strings.IndexByte(hostport, ']')
+        if end == -1 {
+            return "", 0, fmt.Errorf("unterminated IPv6 literal")
+        }
+        host := hostport[1:end]
+        rest := hostport[end+1:]
+        if rest == "" {
+            return host, 0, nil
+        }
+        if rest[0] != ':' {
+            return "", 0, fmt.Errorf("unexpected %q after IPv6 literal", rest)
+        }
+        port, err := strconv.Atoi(rest[1:])
+        if err != nil {
+            return "", 0, fmt.Errorf("invalid port %q", rest[1:])
+        }
+        return host, port, nil
+    }
+
+    host, portStr, found := strings.Cut(hostport, ":")
+    if !found {
+        return host, 0, nil
+    }
+    port, err := strconv.Atoi(portStr)
+    if err != nil {
+        return "", 0, fmt.Errorf("invalid port %q", portStr)
+    }
+    return host, port, nil
+}
+
+// HostPort returns host[:port] with IPv6 literals bracketed. The port is
+// omitted when it is 0.
+func HostPort(host string, port int) string {
+    if strings.Contains(host, ":") {
+        host = "[" + host + "]"
+    }
+    if port == 0 {
+        return host
+    }
+    return host + ":" + strconv.Itoa(port)
+}
+
+func (u *URI) String() string {
+    var b strings.Builder
+    b.WriteString(u.Scheme)
+    b.WriteByte(':')
+    if u.Scheme == "tel" {
+        b.WriteString(u.User)
+    } else {
+        if u.User != "" {
+            b.WriteString(u.User)
+            if u.Password != "" {
+                b.WriteByte(':')
+                b.WriteString(u.Password)
+            }
+            b.WriteByte('@')
+        }
+        b.WriteString(HostPort(u.Host, u.Port))
+    }
+    b.WriteString(u.Params.String())
+    if u.Headers != "" {
+        b.WriteByte('?')
+        b.WriteString(u.Headers)
+    }
+    return b.String()
+}
+
+// Clone returns a deep copy of u.
+func (u *URI) Clone() *URI {
+    clone := *u
+    clone.Params = append(Params(nil), u.Params...)
+    return &clone
+}
+
+// Addr returns the host:port the URI resolves to without DNS, defaulting the
+// port to 5060, or 5061 for sips.
+func (u *URI) Addr() string {
+    port := u.Port
+    if port == 0 {
+        port = 5060
+        if u.Scheme == "sips" {
+            port = 5061
+        }
+    }
+    return net.JoinHostPort(u.Host, strconv.Itoa(port))
+}
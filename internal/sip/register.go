@@ -0,0 +1,377 @@
+package sip
+
+import (
+    "errors"
+    "fmt"
+    "log"
+    "strconv"
+    "sync"
+    "time"
+
+    "github.com/s1-callgen/internal/sip/message"
+)
+
+// Registration states
+const (
+    RegistrationUnregistered = "UNREGISTERED"
+    RegistrationRegistering  = "REGISTERING"
+    RegistrationRegistered   = "REGISTERED"
+    RegistrationFailed       = "FAILED"
+)
+
+// Retry backoff after a failed registration
+const (
+    registrationBaseBackoff = 2 * time.Second
+    registrationMaxBackoff  = time.Minute
+)
+
+// Registrar is a server REGISTER requests can be sent to.
+type Registrar struct {
+    Host string
+    Port int
+}
+
+func (r Registrar) String() string {
+    return message.HostPort(r.Host, r.Port)
+}
+
+// RegistrationStatus is a snapshot of a Registration for the dashboard.
+type RegistrationStatus struct {
+    State      string    `json:"state"`
+    Registrar  string    `json:"registrar"`
+    Expires    int       `json:"expires"`
+    Registered time.Time `json:"registered_at"`
+    LastError  string    `json:"last_error,omitempty"`
+}
+
+// Registration keeps S1 registered with S2 as a PBX would (RFC 3261 section
+// 10). It refreshes the binding before it expires and fails over to the next
+// registrar when one stops answering or rejects us. A failed refresh is
+// retried while the binding lasts, which stays registered until it expires.
+type Registration struct {
+    client      *Client
+    user        string
+    domain      string
+    registrars  []Registrar
+    expires     int
+    credentials *Credentials
+    backoff     time.Duration // before the first retry, doubling after
+
+    callID string
+    tag    string
+
+    mu      sync.Mutex
+    cseq    uint32
+    current int
+    status  RegistrationStatus
+
+    stop chan struct{}
+    done chan struct{}
+}
+
+// NewRegistration creates a registration of sip:user@domain through the
+// client, trying registrars in order. An empty domain uses the registrar's
+// host.
+func (c *Client) NewRegistration(user, domain string, registrars []Registrar, expires int, credentials *Credentials) (*Registration, error) {
+    if len(registrars) == 0 {
+        return nil, errors.New("sip: registration needs at least one registrar")
+    }
+    if expires <= 0 {
+        expires = 3600
+    }
+
+    return &Registration{
+        client:      c,
+        user:        user,
+        domain:      domain,
+        registrars:  registrars,
+        expires:     expires,
+        credentials: credentials,
+        backoff:     registrationBaseBackoff,
+        callID:      c.generateCallID(),
+        tag:         c.generateTag(),
+        status:      RegistrationStatus{State: RegistrationUnregistered},
+        stop:        make(chan struct{}),
+        done:        make(chan struct{}),
+    }, nil
+}
+
+// Start registers in the background and keeps the binding refreshed until
+// Stop is called. The client is pointed at the first registrar.
+func (r *Registration) Start() error {
+    first := r.registrars[0]
+    if host, port := r.client.target(); host != first.Host || port != first.Port {
+        if err := r.client.Retarget(first.Host, first.Port); err != nil {
+            return err
+        }
+    }
+    go r.run()
+    return nil
+}
+
+// Stop removes the binding and stops refreshing it.
+func (r *Registration) Stop() {
+    close(r.stop)
+    <-r.done
+
+    if r.Status().State == RegistrationRegistered {
+        if _, err := r.register(0); err != nil {
+            log.Printf("[SIP] Unregister failed: %v", err)
+        }
+    }
+    r.setState(RegistrationUnregistered, 0, nil)
+}
+
+// Status returns the current registration state. A binding whose refreshes
+// failed is reported FAILED from the moment it expires.
+func (r *Registration) Status() RegistrationStatus {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    status := r.status
+    if status.State == RegistrationRegistered && !time.Now().Before(status.expiresAt()) {
+        status.State = RegistrationFailed
+    }
+    return status
+}
+
+// expiresAt is when the binding registered at Registered expires.
+func (s RegistrationStatus) expiresAt() time.Time {
+    return s.Registered.Add(time.Duration(s.Expires) * time.Second)
+}
+
+// Registered reports whether the binding is currently active.
+func (r *Registration) Registered() bool {
+    return r.Status().State == RegistrationRegistered
+}
+
+func (r *Registration) run() {
+    defer close(r.done)
+
+    failures := 0
+    for {
+        expires, err := r.register(r.expires)
+
+        var wait time.Duration
+        switch {
+        case err == nil:
+            failures = 0
+            r.setState(RegistrationRegistered, expires, nil)
+            log.Printf("[SIP] Registered with %s for %ds", r.registrar(), expires)
+
+            // Refresh ahead of expiry so the binding never lapses
+            wait = time.Duration(expires) * time.Second * 9 / 10
+            wait = max(wait, time.Second)
+
+        case r.Registered():
+            // The binding still holds: keep it, and retry with the same
+            // registrar until it expires
+            failures++
+            r.setError(err)
+            log.Printf("[SIP] Refreshing registration with %s failed: %v", r.registrar(), err)
+            wait = min(r.backoff<<min(failures-1, 5), time.Until(r.Status().expiresAt()))
+
+        default:
+            failures++
+            r.setState(RegistrationFailed, 0, err)
+            log.Printf("[SIP] Registration with %s failed: %v", r.registrar(), err)
+
+            // Back off exponentially, and after each failure move on to
+            // the next registrar
+            wait = min(r.backoff<<min(failures-1, 5), registrationMaxBackoff)
+            r.failover()
+        }
+
+        select {
+        case <-time.After(wait):
+        case <-r.stop:
+            return
+        }
+    }
+}
+
+// register sends a REGISTER asking for the given expiry, answering digest
+// challenges and 423 Interval Too Brief, and returns the expiry S2 granted.
+func (r *Registration) register(expires int) (int, error) {
+    if r.Status().State != RegistrationRegistered {
+        r.setState(RegistrationRegistering, 0, nil)
+    }
+
+    req := r.buildREGISTER(expires)
+    for attempt := 0; ; attempt++ {
+        resp, err := r.client.request(r.callID, req)
+        if err != nil {
+            return 0, err
+        }
+
+        switch {
+        case resp.StatusCode >= 200 && resp.StatusCode < 300 && expires > 0 &&
+            req.Header.Get("Contact") != r.contact().String() && attempt < maxAuthAttempts:
+            // The response taught us our public address; bind that instead
+            log.Printf("[SIP] Re-registering with contact %s", r.contact())
+            req = r.buildREGISTER(expires)
+
+        case resp.StatusCode >= 200 && resp.StatusCode < 300:
+            return r.grantedExpires(resp, req, expires), nil
+
+        case (resp.StatusCode == 401 || resp.StatusCode == 407) && r.credentials != nil && attempt < maxAuthAttempts:
+            if attempt > 0 && !staleChallenge(resp) && rechallenged(req, resp) {
+                return 0, &ResponseError{StatusCode: resp.StatusCode, Reason: resp.Reason}
+            }
+            req, err = authorize(req, resp, *r.credentials, r.client.generateBranch())
+            if err != nil {
+                return 0, err
+            }
+            r.syncCSeq(req)
+
+        case resp.StatusCode == 423 && attempt < maxIntervalRetries:
+            minExpires, err := strconv.Atoi(resp.Header.Get("Min-Expires"))
+            if err != nil || minExpires <= expires {
+                return 0, &ResponseError{StatusCode: resp.StatusCode, Reason: resp.Reason}
+            }
+            expires = minExpires
+            r.mu.Lock()
+            r.expires = minExpires
+            r.mu.Unlock()
+            req = r.buildREGISTER(expires)
+
+        default:
+            return 0, &ResponseError{StatusCode: resp.StatusCode, Reason: resp.Reason}
+        }
+    }
+}
+
+// buildREGISTER builds a REGISTER with the next CSeq. Every REGISTER of the
+// registration shares one Call-ID (RFC 3261 section 10.2).
+func (r *Registration) buildREGISTER(expires int) *message.Request {
+    c := r.client
+    registrar := r.registrars[r.currentIndex()]
+    domain := r.domain
+    if domain == "" {
+        domain = registrar.Host
+    }
+
+    r.mu.Lock()
+    r.cseq++
+    seq := r.cseq
+    r.mu.Unlock()
+
+    aor := &message.URI{Scheme: "sip", User: r.user, Host: domain}
+    uri := &message.URI{Scheme: "sip", Host: domain}
+    if r.domain == "" {
+        uri.Port = registrar.Port
+    }
+
+    from := &message.Address{URI: aor, Params: message.Params{{Name: "tag", Value: r.tag}}}
+    contact := r.contact()
+
+    req := message.NewRequest("REGISTER", uri)
+    req.Header.Add("Via", c.newVia(r.callID, c.generateBranch()).String())
+    req.Header.Add("Max-Forwards", "70")
+    req.Header.Add("From", from.String())
+    req.Header.Add("To", (&message.Address{URI: aor}).String())
+    req.Header.Add("Call-ID", r.callID)
+    req.Header.Add("CSeq", fmt.Sprintf("%d REGISTER", seq))
+    req.Header.Add("Contact", contact.String())
+    req.Header.Add("Expires", strconv.Itoa(expires))
+    req.Header.Add("Allow", allowedMethods)
+    req.Header.Add("User-Agent", userAgent)
+
+    return req
+}
+
+// syncCSeq keeps the registration's CSeq counter in step with a request
+// resent with credentials.
+func (r *Registration) syncCSeq(req *message.Request) {
+    seq, _, err := req.Header.CSeq()
+    if err != nil {
+        return
+    }
+    r.mu.Lock()
+    r.cseq = max(r.cseq, seq)
+    r.mu.Unlock()
+}
+
+// contact is the address bound to our AOR.
+func (r *Registration) contact() *message.Address {
+    host, port := r.client.contactAddress(r.callID)
+    return &message.Address{
+        URI: r.client.withTransport(&message.URI{Scheme: "sip", User: r.user, Host: host, Port: port}),
+    }
+}
+
+// grantedExpires returns the expiry the registrar granted the binding req
+// asked for: the expires parameter of its Contact in the 2xx, else the
+// Expires header, else what we asked for.
+func (r *Registration) grantedExpires(resp *message.Response, req *message.Request, requested int) int {
+    sent, err := req.Header.Addresses("Contact")
+    if err != nil || len(sent) == 0 {
+        return requested
+    }
+    if contacts, err := resp.Header.Addresses("Contact"); err == nil {
+        for _, contact := range contacts {
+            if contact.URI == nil || !sameHost(contact.URI.Host, sent[0].URI.Host) || contact.URI.Port != sent[0].URI.Port {
+                continue
+            }
+            if value, ok := contact.Params.Get("expires"); ok {
+                if expires, err := strconv.Atoi(value); err == nil {
+                    return expires
+                }
+            }
+        }
+    }
+    if expires, err := strconv.Atoi(resp.Header.Get("Expires")); err == nil {
+        return expires
+    }
+    return requested
+}
+
+// failover moves to the next registrar and points the client at it, so
+// calls follow the registration.
+func (r *Registration) failover() {
+    if len(r.registrars) < 2 {
+        return
+    }
+
+    r.mu.Lock()
+    r.current = (r.current + 1) % len(r.registrars)
+    next := r.registrars[r.current]
+    r.mu.Unlock()
+
+    log.Printf("[SIP] Failing over to registrar %s", next)
+    if err := r.client.Retarget(next.Host, next.Port); err != nil {
+        log.Printf("[SIP] Failover to %s failed: %v", next, err)
+    }
+}
+
+func (r *Registration) currentIndex() int {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    return r.current
+}
+
+func (r *Registration) registrar() Registrar {
+    return r.registrars[r.currentIndex()]
+}
+
+func (r *Registration) setState(state string, expires int, err error) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+
+    r.status.State = state
+    r.status.Registrar = r.registrars[r.current].String()
+    r.status.Expires = expires
+    r.status.LastError = ""
+    if err != nil {
+        r.status.LastError = err.Error()
+    }
+    if state == RegistrationRegistered {
+        r.status.Registered = time.Now()
+    }
+}
+
+// setError records why a refresh failed, leaving the state as it is.
+func (r *Registration) setError(err error) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    r.status.LastError = err.Error()
+}
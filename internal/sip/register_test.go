@@ -0,0 +1,271 @@
+package sip
+
+import (
+    "errors"
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/s1-callgen/internal/sip/message"
+)
+
+// newTestRegistration returns a registration of s1 with the peer as its
+// registrar, retrying after 50 ms.
+func newTestRegistration(t *testing.T, expires int, credentials *Credentials) (*Registration, *udpPeer) {
+    t.Helper()
+    c, peer := newUDPPeer(t)
+    host, port := c.target()
+    r, err := c.NewRegistration("s1", "", []Registrar{{Host: host, Port: port}}, expires, credentials)
+    if err != nil {
+        t.Fatal(err)
+    }
+    r.backoff = 50 * time.Millisecond
+    return r, peer
+}
+
+// nextREGISTER returns the next REGISTER from the client past retransmissions
+// of previous, which may be nil.
+func nextREGISTER(peer *udpPeer, previous *message.Request) *message.Request {
+    peer.t.Helper()
+    for {
+        req := peer.expect("REGISTER", "")
+        if previous == nil {
+            return req
+        }
+        if seq, _, _ := req.Header.CSeq(); seq != cseqOf(previous) {
+            return req
+        }
+    }
+}
+
+func cseqOf(req *message.Request) uint32 {
+    seq, _, _ := req.Header.CSeq()
+    return seq
+}
+
+// registerResult is what a register call returned.
+type registerResult struct {
+    expires int
+    err     error
+}
+
+func register(r *Registration, expires int) <-chan registerResult {
+    done := make(chan registerResult, 1)
+    go func() {
+        granted, err := r.register(expires)
+        done <- registerResult{granted, err}
+    }()
+    return done
+}
+
+func registered(t *testing.T, done <-chan registerResult) registerResult {
+    t.Helper()
+    select {
+    case result := <-done:
+        return result
+    case <-time.After(3 * time.Second):
+        t.Fatal("register did not return")
+    }
+    return registerResult{}
+}
+
+func TestRegister(t *testing.T) {
+    r, peer := newTestRegistration(t, 3600, nil)
+    host, port := r.client.target()
+    contact := message.HostPort("127.0.0.1", r.client.shards[0].localPort)
+
+    done := register(r, 3600)
+    first := nextREGISTER(peer, nil)
+    aor := "sip:s1@" + host
+    if first.URI.String() != "sip:"+message.HostPort(host, port) || !strings.Contains(first.Header.Get("To"), aor) || !strings.Contains(first.Header.Get("From"), aor) {
+        t.Errorf("REGISTER %s from %s to %s, want %s to the registrar", first.URI, first.Header.Get("From"), first.Header.Get("To"), aor)
+    }
+    if got := first.Header.Get("Contact"); got != "<sip:s1@"+contact+">" || first.Header.Get("Expires") != "3600" {
+        t.Errorf("Contact %s for %s s, want sip:s1@%s for 3600 s", got, first.Header.Get("Expires"), contact)
+    }
+
+    // The expires parameter of our Contact wins over the Expires header
+    ok := message.NewResponse(first, 200, "OK")
+    ok.Header.Add("Contact", "<sip:s1@"+contact+">;expires=1800, <sip:other@10.9.9.9>;expires=60")
+    ok.Header.Add("Expires", "900")
+    peer.send(ok)
+    if result := registered(t, done); result.err != nil || result.expires != 1800 {
+        t.Fatalf("got %d s, %v; want 1800 s", result.expires, result.err)
+    }
+
+    // A refresh is in the same Call-ID, with the next CSeq; without a
+    // Contact expires the header counts
+    done = register(r, 3600)
+    refresh := nextREGISTER(peer, first)
+    if refresh.Header.CallID() != first.Header.CallID() || cseqOf(refresh) != cseqOf(first)+1 {
+        t.Errorf("refresh in %s with CSeq %d, want %s with %d", refresh.Header.CallID(), cseqOf(refresh), first.Header.CallID(), cseqOf(first)+1)
+    }
+    ok = message.NewResponse(refresh, 200, "OK")
+    ok.Header.Add("Expires", "600")
+    peer.send(ok)
+    if result := registered(t, done); result.err != nil || result.expires != 600 {
+        t.Errorf("got %d s, %v; want 600 s", result.expires, result.err)
+    }
+}
+
+func TestRegisterAuth(t *testing.T) {
+    r, peer := newTestRegistration(t, 3600, &Credentials{Username: "s1", Password: "secret"})
+
+    done := register(r, 3600)
+    first := nextREGISTER(peer, nil)
+    peer.send(challengeResponse(first, 401, `Digest realm="s2", nonce="n1"`))
+    second := nextREGISTER(peer, first)
+    if got := second.Header.Get("Authorization"); !strings.Contains(got, `realm="s2"`) || !strings.Contains(got, `nonce="n1"`) {
+        t.Errorf("Authorization %q, want credentials for nonce n1", got)
+    }
+    if second.Header.CallID() != first.Header.CallID() || cseqOf(second) != cseqOf(first)+1 {
+        t.Errorf("resent in %s with CSeq %d, want %s with %d", second.Header.CallID(), cseqOf(second), first.Header.CallID(), cseqOf(first)+1)
+    }
+    peer.respond(second, 200, "OK")
+    if result := registered(t, done); result.err != nil || result.expires != 3600 {
+        t.Fatalf("got %d s, %v; want 3600 s", result.expires, result.err)
+    }
+
+    // The next REGISTER follows the CSeq of the one resent; a second
+    // challenge of the realm answered is a rejection
+    done = register(r, 3600)
+    third := nextREGISTER(peer, second)
+    if cseqOf(third) != cseqOf(second)+1 {
+        t.Errorf("CSeq %d, want %d", cseqOf(third), cseqOf(second)+1)
+    }
+    peer.send(challengeResponse(third, 401, `Digest realm="s2", nonce="n2"`))
+    fourth := nextREGISTER(peer, third)
+    peer.send(challengeResponse(fourth, 401, `Digest realm="s2", nonce="n3"`))
+    var responseErr *ResponseError
+    if result := registered(t, done); !errors.As(result.err, &responseErr) || responseErr.StatusCode != 401 {
+        t.Errorf("got %v, want the 401", result.err)
+    }
+}
+
+func TestRegisterWithoutCredentials(t *testing.T) {
+    r, peer := newTestRegistration(t, 3600, nil)
+    done := register(r, 3600)
+    peer.send(challengeResponse(nextREGISTER(peer, nil), 401, `Digest realm="s2", nonce="n1"`))
+    var responseErr *ResponseError
+    if result := registered(t, done); !errors.As(result.err, &responseErr) || responseErr.StatusCode != 401 {
+        t.Errorf("got %v, want the 401", result.err)
+    }
+}
+
+func TestRegisterIntervalTooBrief(t *testing.T) {
+    r, peer := newTestRegistration(t, 60, nil)
+    done := register(r, 60)
+    first := nextREGISTER(peer, nil)
+    tooBrief := message.NewResponse(first, 423, "Interval Too Brief")
+    tooBrief.Header.Add("Min-Expires", "300")
+    peer.send(tooBrief)
+
+    second := nextREGISTER(peer, first)
+    if got := second.Header.Get("Expires"); got != "300" {
+        t.Errorf("Expires %s after 423, want 300", got)
+    }
+    peer.respond(second, 200, "OK")
+    if result := registered(t, done); result.err != nil || result.expires != 300 || r.expires != 300 {
+        t.Errorf("got %d s, %v, refreshing for %d s; want 300 s", result.expires, result.err, r.expires)
+    }
+}
+
+// waitStatus polls the registration until ready reports true of its status,
+// failing the test after a second.
+func waitStatus(t *testing.T, r *Registration, ready func(RegistrationStatus) bool) RegistrationStatus {
+    t.Helper()
+    deadline := time.Now().Add(time.Second)
+    for {
+        status := r.Status()
+        if ready(status) {
+            return status
+        }
+        if time.Now().After(deadline) {
+            t.Fatalf("registration %+v", status)
+        }
+        time.Sleep(time.Millisecond)
+    }
+}
+
+// grant answers a REGISTER with a 200 granting expires seconds.
+func grant(peer *udpPeer, req *message.Request, expires string) {
+    ok := message.NewResponse(req, 200, "OK")
+    ok.Header.Add("Expires", expires)
+    peer.send(ok)
+}
+
+func TestRegistrationRefreshFails(t *testing.T) {
+    r, peer := newTestRegistration(t, 2, nil)
+    if err := r.Start(); err != nil {
+        t.Fatal(err)
+    }
+
+    first := nextREGISTER(peer, nil)
+    grant(peer, first, "2")
+    answered := time.Now()
+    waitStatus(t, r, func(s RegistrationStatus) bool { return s.State == RegistrationRegistered })
+
+    // A failed refresh keeps us registered while the binding lasts, and is
+    // retried before it expires
+    refresh := nextREGISTER(peer, first)
+    peer.respond(refresh, 503, "Service Unavailable")
+    status := waitStatus(t, r, func(s RegistrationStatus) bool { return s.LastError != "" })
+    if status.State != RegistrationRegistered {
+        t.Errorf("state %s after a failed refresh, want REGISTERED until the binding expires", status.State)
+    }
+    retry := nextREGISTER(peer, refresh)
+    if since := time.Since(answered); since > 1900*time.Millisecond || !r.Registered() {
+        t.Errorf("retried after %v in state %s, want within the binding of 2 s and registered", since, r.Status().State)
+    }
+
+    // A refresh that succeeds renews the binding
+    grant(peer, retry, "2")
+    waitStatus(t, r, func(s RegistrationStatus) bool { return s.LastError == "" })
+    if !r.Registered() {
+        t.Errorf("state %s after the retry succeeded, want REGISTERED", r.Status().State)
+    }
+
+    // Stopping removes the binding
+    stopped := make(chan struct{})
+    go func() {
+        r.Stop()
+        close(stopped)
+    }()
+    remove := nextREGISTER(peer, retry)
+    if got := remove.Header.Get("Expires"); got != "0" {
+        t.Errorf("Expires %s on stopping, want 0", got)
+    }
+    peer.respond(remove, 200, "OK")
+    <-stopped
+    if state := r.Status().State; state != RegistrationUnregistered {
+        t.Errorf("state %s after Stop, want UNREGISTERED", state)
+    }
+}
+
+func TestRegistrationExpires(t *testing.T) {
+    r, peer := newTestRegistration(t, 2, nil)
+    if err := r.Start(); err != nil {
+        t.Fatal(err)
+    }
+    defer r.Stop()
+
+    first := nextREGISTER(peer, nil)
+    grant(peer, first, "2")
+    answered := time.Now()
+
+    // Every refresh fails: we stay registered, retrying, until the binding
+    // expires
+    last := first
+    for time.Since(answered) < 2*time.Second {
+        req := nextREGISTER(peer, last)
+        if time.Since(answered) < 1900*time.Millisecond && !r.Registered() {
+            t.Errorf("state %s %v into a binding of 2 s, want REGISTERED", r.Status().State, time.Since(answered))
+        }
+        peer.respond(req, 503, "Service Unavailable")
+        last = req
+    }
+    status := waitStatus(t, r, func(s RegistrationStatus) bool { return s.State == RegistrationFailed && s.Expires == 0 })
+    if !strings.Contains(status.LastError, "503") {
+        t.Errorf("last error %q, want the 503", status.LastError)
+    }
+}
@@ -0,0 +1,348 @@
+package sip
+
+import (
+    "context"
+    "math/rand"
+    "net"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+// NAPTR is a naming authority pointer record (RFC 3403).
+type NAPTR struct {
+    Order       uint16
+    Preference  uint16
+    Flags       string
+    Service     string
+    Regexp      string
+    Replacement string
+}
+
+// SRV is a service location record (RFC 2782).
+type SRV struct {
+    Target   string
+    Port     uint16
+    Priority uint16
+    Weight   uint16
+}
+
+// Resolver looks up the DNS records used to locate a SIP server. Each lookup
+// also returns how long its answer may be cached. A name without records of
+// the type is not an error; the result is then empty.
+type Resolver interface {
+    LookupNAPTR(ctx context.Context, name string) ([]NAPTR, time.Duration, error)
+    LookupSRV(ctx context.Context, name string) ([]SRV, time.Duration, error)
+    LookupIP(ctx context.Context, host string) ([]net.IP, time.Duration, error)
+}
+
+// Zone is a Resolver answering from records held in memory, keyed by domain
+// name. Every answer has the same TTL.
+type Zone struct {
+    TTL   time.Duration
+    NAPTR map[string][]NAPTR
+    SRV   map[string][]SRV
+    Hosts map[string][]net.IP
+}
+
+func (z *Zone) LookupNAPTR(ctx context.Context, name string) ([]NAPTR, time.Duration, error) {
+    return z.NAPTR[normalizeName(name)], z.TTL, nil
+}
+
+func (z *Zone) LookupSRV(ctx context.Context, name string) ([]SRV, time.Duration, error) {
+    return z.SRV[normalizeName(name)], z.TTL, nil
+}
+
+func (z *Zone) LookupIP(ctx context.Context, host string) ([]net.IP, time.Duration, error) {
+    return z.Hosts[normalizeName(host)], z.TTL, nil
+}
+
+// Destination is an address and transport a SIP server was located at.
+type Destination struct {
+    Transport string
+    IP        net.IP
+    Port      int
+}
+
+func (d Destination) String() string {
+    return net.JoinHostPort(d.IP.String(), strconv.Itoa(d.Port)) + "/" + d.Transport
+}
+
+func (d Destination) equal(other Destination) bool {
+    return d.Transport == other.Transport && d.IP.Equal(other.IP) && d.Port == other.Port
+}
+
+// NAPTR services of SIP over each transport (RFC 3263 section 4.1), and the
+// SRV names tried when a domain has no NAPTR records, in order of preference.
+var sipServices = []struct {
+    transport string
+    service   string
+    srvPrefix string
+}{
+    {TransportUDP, "SIP+D2U", "_sip._udp."},
+    {TransportTCP, "SIP+D2T", "_sip._tcp."},
+    {TransportTLS, "SIPS+D2T", "_sips._tcp."},
+}
+
+// Locator finds the servers of a SIP domain as RFC 3263 describes: NAPTR
+// records select the transport, SRV records the servers, and A and AAAA
+// records their addresses. Answers are cached for their TTL, so a Locator is
+// best shared by clients reaching the same domains.
+type Locator struct {
+    resolver Resolver
+
+    mu    sync.Mutex
+    cache map[string]cacheEntry
+}
+
+type cacheEntry struct {
+    records any
+    expires time.Time
+}
+
+func NewLocator(resolver Resolver) *Locator {
+    return &Locator{
+        resolver: resolver,
+        cache:    make(map[string]cacheEntry),
+    }
+}
+
+// Locate returns the destinations to try, in order, for a SIP server given
+// by host, port and transport, and when the DNS answers they are based on
+// expire; the zero time when they never do. port 0 and an empty transport
+// are left to DNS.
+func (l *Locator) Locate(ctx context.Context, host string, port int, transport string) ([]Destination, time.Time, error) {
+    host = normalizeName(strings.Trim(host, "[]"))
+    transport = strings.ToUpper(transport)
+
+    // A numeric host is used as is, and so is an explicit port, which only
+    // needs the host's addresses (RFC 3263 section 4.2)
+    if ip := net.ParseIP(host); ip != nil {
+        if transport == "" {
+            transport = TransportUDP
+        }
+        return []Destination{{Transport: transport, IP: ip, Port: defaultPort(port, transport)}}, time.Time{}, nil
+    }
+    if port != 0 {
+        if transport == "" {
+            transport = TransportUDP
+        }
+        return l.addresses(ctx, host, port, transport)
+    }
+
+    // NAPTR and SRV lookups that fail leave the host itself to try, as a
+    // name the system knows from /etc/hosts or its search domains may have
+    // no DNS server answering for it. The result is then located again soon.
+    var destinations []Destination
+    var expires time.Time
+    var failed error
+    if transport == "" {
+        naptrs, naptrExpires, err := lookupCached(l, "NAPTR "+host, func() ([]NAPTR, time.Duration, error) {
+            return l.resolver.LookupNAPTR(ctx, host)
+        })
+        if err != nil {
+            failed = err
+        }
+        expires = earliest(expires, naptrExpires)
+
+        sort.SliceStable(naptrs, func(i, j int) bool {
+            if naptrs[i].Order != naptrs[j].Order {
+                return naptrs[i].Order < naptrs[j].Order
+            }
+            return naptrs[i].Preference < naptrs[j].Preference
+        })
+        for _, naptr := range naptrs {
+            if !strings.EqualFold(naptr.Flags, "s") {
+                continue
+            }
+            for _, service := range sipServices {
+                if !strings.EqualFold(naptr.Service, service.service) {
+                    continue
+                }
+                found, srvExpires, err := l.servers(ctx, naptr.Replacement, service.transport)
+                if err != nil {
+                    failed = err
+                    continue
+                }
+                destinations = append(destinations, found...)
+                expires = earliest(expires, srvExpires)
+            }
+        }
+    }
+
+    // Without usable NAPTR records the SRV records of each transport are
+    // tried, or only those of the transport asked for
+    if len(destinations) == 0 {
+        for _, service := range sipServices {
+            if transport != "" && transport != service.transport {
+                continue
+            }
+            found, srvExpires, err := l.servers(ctx, service.srvPrefix+host, service.transport)
+            if err != nil {
+                failed = err
+                continue
+            }
+            destinations = append(destinations, found...)
+            expires = earliest(expires, srvExpires)
+        }
+    }
+
+    // Nor any SRV records: the domain is the server
+    if len(destinations) == 0 {
+        if transport == "" {
+            transport = TransportUDP
+        }
+        found, ipExpires, err := l.addresses(ctx, host, defaultPort(0, transport), transport)
+        if err != nil {
+            return nil, time.Time{}, err
+        }
+        if len(found) == 0 && failed != nil {
+            return nil, time.Time{}, failed
+        }
+        destinations = found
+        expires = earliest(expires, ipExpires)
+    }
+    if failed != nil {
+        expires = earliest(expires, time.Now().Add(negativeTTL))
+    }
+
+    return destinations, expires, nil
+}
+
+// servers returns the addresses of the targets of an SRV name, ordered by
+// priority and weight.
+func (l *Locator) servers(ctx context.Context, name, transport string) ([]Destination, time.Time, error) {
+    name = normalizeName(name)
+    srvs, expires, err := lookupCached(l, "SRV "+name, func() ([]SRV, time.Duration, error) {
+        return l.resolver.LookupSRV(ctx, name)
+    })
+    if err != nil {
+        return nil, time.Time{}, err
+    }
+
+    var destinations []Destination
+    for _, srv := range orderSRV(srvs) {
+        // A target of "." means the service is not offered
+        target := normalizeName(srv.Target)
+        if target == "" {
+            continue
+        }
+        found, ipExpires, err := l.addresses(ctx, target, int(srv.Port), transport)
+        if err != nil {
+            return nil, time.Time{}, err
+        }
+        destinations = append(destinations, found...)
+        expires = earliest(expires, ipExpires)
+    }
+    return destinations, expires, nil
+}
+
+// addresses returns a destination for each address of host.
+func (l *Locator) addresses(ctx context.Context, host string, port int, transport string) ([]Destination, time.Time, error) {
+    ips, expires, err := lookupCached(l, "IP "+host, func() ([]net.IP, time.Duration, error) {
+        return l.resolver.LookupIP(ctx, host)
+    })
+    if err != nil {
+        return nil, time.Time{}, err
+    }
+
+    destinations := make([]Destination, len(ips))
+    for i, ip := range ips {
+        destinations[i] = Destination{Transport: transport, IP: ip, Port: port}
+    }
+    return destinations, expires, nil
+}
+
+// lookupCached returns the cached records under key, or looks them up and
+// caches them for their TTL. It also returns when they expire.
+func lookupCached[T any](l *Locator, key string, lookup func() ([]T, time.Duration, error)) ([]T, time.Time, error) {
+    l.mu.Lock()
+    entry, ok := l.cache[key]
+    l.mu.Unlock()
+    if ok && time.Now().Before(entry.expires) {
+        return append([]T(nil), entry.records.([]T)...), entry.expires, nil
+    }
+
+    records, ttl, err := lookup()
+    if err != nil {
+        return nil, time.Time{}, err
+    }
+    expires := time.Now().Add(ttl)
+
+    l.mu.Lock()
+    l.cache[key] = cacheEntry{records: records, expires: expires}
+    l.mu.Unlock()
+    return append([]T(nil), records...), expires, nil
+}
+
+// orderSRV sorts SRV records into the order they are tried (RFC 2782): by
+// priority, and within a priority at random in proportion to their weight.
+func orderSRV(records []SRV) []SRV {
+    sorted := append([]SRV(nil), records...)
+    sort.SliceStable(sorted, func(i, j int) bool {
+        return sorted[i].Priority < sorted[j].Priority
+    })
+
+    ordered := make([]SRV, 0, len(sorted))
+    for len(sorted) > 0 {
+        n := 1
+        for n < len(sorted) && sorted[n].Priority == sorted[0].Priority {
+            n++
+        }
+        group := sorted[:n]
+        sorted = sorted[n:]
+
+        // Records of weight 0 are left until no other remains, then picked
+        // at random among themselves
+        for len(group) > 0 {
+            total := 0
+            for _, srv := range group {
+                total += int(srv.Weight)
+            }
+
+            i := rand.Intn(len(group))
+            if total > 0 {
+                pick := rand.Intn(total) + 1
+                sum := 0
+                for i = 0; i < len(group)-1; i++ {
+                    sum += int(group[i].Weight)
+                    if sum >= pick {
+                        break
+                    }
+                }
+            }
+            ordered = append(ordered, group[i])
+            group = append(group[:i], group[i+1:]...)
+        }
+    }
+    return ordered
+}
+
+// defaultPort returns port, or the default port of the transport when it is
+// 0.
+func defaultPort(port int, transport string) int {
+    switch {
+    case port != 0:
+        return port
+    case transport == TransportTLS:
+        return 5061
+    default:
+        return 5060
+    }
+}
+
+// earliest returns the earlier of two expiry times, where the zero time is
+// never.
+func earliest(a, b time.Time) time.Time {
+    if a.IsZero() || (!b.IsZero() && b.Before(a)) {
+        return b
+    }
+    return a
+}
+
+// normalizeName lowercases a domain name and drops its trailing dot.
+func normalizeName(name string) string {
+    return strings.TrimSuffix(strings.ToLower(name), ".")
+}
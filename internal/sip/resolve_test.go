@@ -0,0 +1,240 @@
+package sip
+
+import (
+    "context"
+    "net"
+    "reflect"
+    "testing"
+    "time"
+)
+
+// exampleZone is example.com with NAPTR records preferring TCP over UDP, SRV
+// records for both and a third, lower priority UDP server.
+func exampleZone() *Zone {
+    return &Zone{
+        TTL: time.Hour,
+        NAPTR: map[string][]NAPTR{
+            "example.com": {
+                {Order: 20, Preference: 10, Flags: "s", Service: "SIP+D2U", Replacement: "_sip._udp.example.com."},
+                {Order: 10, Preference: 10, Flags: "s", Service: "SIP+D2T", Replacement: "_sip._tcp.example.com."},
+                {Order: 5, Preference: 10, Flags: "u", Service: "E2U+sip", Regexp: "!^.*$!sip:info@example.com!"},
+            },
+        },
+        SRV: map[string][]SRV{
+            "_sip._tcp.example.com": {{Target: "tcp.example.com.", Port: 5070, Priority: 10, Weight: 1}},
+            "_sip._udp.example.com": {
+                {Target: "backup.example.com.", Port: 5060, Priority: 20, Weight: 1},
+                {Target: "udp.example.com.", Port: 5062, Priority: 10, Weight: 1},
+            },
+        },
+        Hosts: map[string][]net.IP{
+            "tcp.example.com":    {net.ParseIP("192.0.2.1")},
+            "udp.example.com":    {net.ParseIP("192.0.2.2"), net.ParseIP("2001:db8::2")},
+            "backup.example.com": {net.ParseIP("192.0.2.3")},
+        },
+    }
+}
+
+func TestLocate(t *testing.T) {
+    tests := []struct {
+        name      string
+        zone      *Zone
+        host      string
+        port      int
+        transport string
+        want      []string
+    }{
+        {
+            name: "NAPTR picks the transports in order",
+            zone: exampleZone(),
+            host: "example.com",
+            want: []string{
+                "192.0.2.1:5070/TCP",
+                "192.0.2.2:5062/UDP",
+                "[2001:db8::2]:5062/UDP",
+                "192.0.2.3:5060/UDP",
+            },
+        },
+        {
+            name:      "transport asked for skips NAPTR",
+            zone:      exampleZone(),
+            host:      "EXAMPLE.com.",
+            transport: "udp",
+            want: []string{
+                "192.0.2.2:5062/UDP",
+                "[2001:db8::2]:5062/UDP",
+                "192.0.2.3:5060/UDP",
+            },
+        },
+        {
+            name: "SRV without NAPTR",
+            zone: &Zone{
+                SRV:   map[string][]SRV{"_sips._tcp.example.net": {{Target: "tls.example.net", Port: 5061, Weight: 1}}},
+                Hosts: map[string][]net.IP{"tls.example.net": {net.ParseIP("198.51.100.1")}},
+            },
+            host: "example.net",
+            want: []string{"198.51.100.1:5061/TLS"},
+        },
+        {
+            name: "NAPTR of other services falls back to SRV",
+            zone: &Zone{
+                NAPTR: map[string][]NAPTR{"example.net": {{Order: 1, Flags: "s", Service: "SIP+D2W", Replacement: "_sip._ws.example.net"}}},
+                SRV:   map[string][]SRV{"_sip._tcp.example.net": {{Target: "tcp.example.net", Port: 5060, Weight: 1}}},
+                Hosts: map[string][]net.IP{"tcp.example.net": {net.ParseIP("198.51.100.2")}},
+            },
+            host: "example.net",
+            want: []string{"198.51.100.2:5060/TCP"},
+        },
+        {
+            name: "A and AAAA without SRV",
+            zone: &Zone{Hosts: map[string][]net.IP{"example.org": {net.ParseIP("203.0.113.1"), net.ParseIP("2001:db8::1")}}},
+            host: "example.org",
+            want: []string{"203.0.113.1:5060/UDP", "[2001:db8::1]:5060/UDP"},
+        },
+        {
+            name:      "default port of TLS",
+            zone:      &Zone{Hosts: map[string][]net.IP{"example.org": {net.ParseIP("203.0.113.1")}}},
+            host:      "example.org",
+            transport: "TLS",
+            want:      []string{"203.0.113.1:5061/TLS"},
+        },
+        {
+            name: "explicit port skips NAPTR and SRV",
+            zone: exampleZone(),
+            host: "udp.example.com",
+            port: 5080,
+            want: []string{"192.0.2.2:5080/UDP", "[2001:db8::2]:5080/UDP"},
+        },
+        {
+            name: "SRV target of . is skipped",
+            zone: &Zone{
+                SRV:   map[string][]SRV{"_sip._udp.example.org": {{Target: ".", Port: 5060}}},
+                Hosts: map[string][]net.IP{"example.org": {net.ParseIP("203.0.113.1")}},
+            },
+            host: "example.org",
+            want: []string{"203.0.113.1:5060/UDP"},
+        },
+        {
+            name: "numeric host",
+            zone: &Zone{},
+            host: "[2001:db8::9]",
+            port: 5070,
+            want: []string{"[2001:db8::9]:5070/UDP"},
+        },
+        {
+            name: "unknown domain",
+            zone: &Zone{},
+            host: "nowhere.invalid",
+        },
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            destinations, _, err := NewLocator(tt.zone).Locate(context.Background(), tt.host, tt.port, tt.transport)
+            if err != nil {
+                t.Fatal(err)
+            }
+            var got []string
+            for _, d := range destinations {
+                got = append(got, d.String())
+            }
+            if !reflect.DeepEqual(got, tt.want) {
+                t.Errorf("got %v, want %v", got, tt.want)
+            }
+        })
+    }
+}
+
+func TestLocateCachesForTTL(t *testing.T) {
+    zone := &Zone{
+        TTL:   100 * time.Millisecond,
+        Hosts: map[string][]net.IP{"example.org": {net.ParseIP("203.0.113.1")}},
+    }
+    locator := NewLocator(zone)
+
+    start := time.Now()
+    first, expires, err := locator.Locate(context.Background(), "example.org", 0, "")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if expires.Before(start.Add(zone.TTL)) || expires.After(time.Now().Add(zone.TTL)) {
+        t.Errorf("answers expire at %v, want %v after the lookup", expires.Sub(start), zone.TTL)
+    }
+
+    zone.Hosts["example.org"] = []net.IP{net.ParseIP("203.0.113.2")}
+    cached, _, err := locator.Locate(context.Background(), "example.org", 0, "")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !cached[0].equal(first[0]) {
+        t.Errorf("got %v before the TTL expired, want the cached %v", cached[0], first[0])
+    }
+
+    time.Sleep(time.Until(expires) + 10*time.Millisecond)
+    fresh, _, err := locator.Locate(context.Background(), "example.org", 0, "")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if want := "203.0.113.2:5060/UDP"; fresh[0].String() != want {
+        t.Errorf("got %v after the TTL expired, want %v", fresh[0], want)
+    }
+}
+
+func TestOrderSRV(t *testing.T) {
+    tests := []struct {
+        name    string
+        records []SRV
+        first   map[string]float64 // share of orderings starting with each target
+    }{
+        {
+            name:    "single record",
+            records: []SRV{{Target: "a", Weight: 5}},
+            first:   map[string]float64{"a": 1},
+        },
+        {
+            name:    "lowest priority first",
+            records: []SRV{{Target: "b", Priority: 20, Weight: 100}, {Target: "a", Priority: 10, Weight: 1}},
+            first:   map[string]float64{"a": 1},
+        },
+        {
+            name:    "in proportion to weight",
+            records: []SRV{{Target: "a", Priority: 10, Weight: 1}, {Target: "b", Priority: 10, Weight: 3}},
+            first:   map[string]float64{"a": 0.25, "b": 0.75},
+        },
+        {
+            name:    "weight 0 goes last",
+            records: []SRV{{Target: "a", Priority: 10, Weight: 0}, {Target: "b", Priority: 10, Weight: 9}},
+            first:   map[string]float64{"a": 0, "b": 1},
+        },
+        {
+            name:    "all weights 0",
+            records: []SRV{{Target: "a", Priority: 10}, {Target: "b", Priority: 10}},
+            first:   map[string]float64{"a": 0.5, "b": 0.5},
+        },
+    }
+
+    const rounds = 20000
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            counts := make(map[string]int)
+            for i := 0; i < rounds; i++ {
+                ordered := orderSRV(tt.records)
+                if len(ordered) != len(tt.records) {
+                    t.Fatalf("got %d records, want %d", len(ordered), len(tt.records))
+                }
+                for j := 1; j < len(ordered); j++ {
+                    if ordered[j].Priority < ordered[j-1].Priority {
+                        t.Fatalf("priority %d after %d", ordered[j].Priority, ordered[j-1].Priority)
+                    }
+                }
+                counts[ordered[0].Target]++
+            }
+            for target, want := range tt.first {
+                got := float64(counts[target]) / rounds
+                if got < want-0.02 || got > want+0.02 {
+                    t.Errorf("%s first in %.3f of orderings, want %.3f", target, got, want)
+                }
+            }
+        })
+    }
+}
@@ -0,0 +1,267 @@
+package sip
+
+import (
+    "encoding/binary"
+    "errors"
+    "log"
+    "math"
+    "math/rand"
+    "net"
+    "time"
+)
+
+// RTCP packet types (RFC 3550 section 12.1)
+const (
+    rtcpSR   = 200
+    rtcpRR   = 201
+    rtcpSDES = 202
+    rtcpBYE  = 203
+)
+
+// rtcpInterval is the average time between our reports. Each interval is
+// randomized over [0.5, 1.5] times it (RFC 3550 section 6.3.1).
+const rtcpInterval = 5 * time.Second
+
+func nextReportInterval() time.Duration {
+    return time.Duration((0.5 + rand.Float64()) * float64(rtcpInterval))
+}
+
+// reception keeps the statistics of the RTP stream received from S2 that
+// go into our report blocks and the call's quality metrics, as in RFC 3550
+// appendix A.1, A.3 and A.8.
+type reception struct {
+    ssrc          uint32
+    started       bool
+    baseSeq       uint32
+    maxSeq        uint16
+    cycles        uint32
+    received      uint64
+    expectedPrior uint64
+    receivedPrior uint64
+    transit       int64
+    jitter        float64 // in timestamp units
+
+    // From the last sender report of S2, for our report blocks
+    lastSR   uint32 // middle 32 bits of its NTP timestamp
+    lastSRAt time.Time
+
+    // From S2's last report block about our stream
+    rtt time.Duration
+}
+
+// update accounts for a packet. arrival is the arrival time in units of the
+// packet's RTP clock, from any fixed origin.
+func (r *reception) update(ssrc uint32, seq uint16, timestamp uint32, arrival int64) {
+    if !r.started || ssrc != r.ssrc {
+        // A new source, as after a re-INVITE to another media server,
+        // starts the statistics over
+        *r = reception{ssrc: ssrc, started: true, baseSeq: uint32(seq), maxSeq: seq, lastSR: r.lastSR, lastSRAt: r.lastSRAt, rtt: r.rtt}
+        r.transit = arrival - int64(timestamp)
+        r.received = 1
+        return
+    }
+
+    // Sequence numbers behind the highest are reordered or duplicated
+    // packets, and only counted
+    if delta := seq - r.maxSeq; delta != 0 && delta < 0x8000 {
+        if seq < r.maxSeq {
+            r.cycles += 1 << 16
+        }
+        r.maxSeq = seq
+    }
+    r.received++
+
+    transit := arrival - int64(timestamp)
+    d := math.Abs(float64(transit - r.transit))
+    r.transit = transit
+    r.jitter += (d - r.jitter) / 16
+}
+
+func (r *reception) extendedMax() uint32 {
+    return r.cycles + uint32(r.maxSeq)
+}
+
+func (r *reception) expected() uint64 {
+    if !r.started {
+        return 0
+    }
+    return uint64(r.extendedMax()-r.baseSeq) + 1
+}
+
+// lost returns the packets lost, which is negative when duplicates
+// arrived.
+func (r *reception) lost() int64 {
+    return int64(r.expected()) - int64(r.received)
+}
+
+// reportBlock appends the report block about the received stream, and starts
+// a new reporting interval.
+func (r *reception) reportBlock(b []byte, now time.Time) []byte {
+    expected := r.expected()
+    expectedInterval := expected - r.expectedPrior
+    receivedInterval := r.received - r.receivedPrior
+    r.expectedPrior = expected
+    r.receivedPrior = r.received
+
+    fraction := uint32(0)
+    if lostInterval := int64(expectedInterval) - int64(receivedInterval); expectedInterval > 0 && lostInterval > 0 {
+        fraction = uint32(lostInterval<<8) / uint32(expectedInterval)
+    }
+    lost := min(max(r.lost(), -1<<23), 1<<23-1)
+
+    var dlsr uint32
+    if r.lastSR != 0 {
+        dlsr = uint32(now.Sub(r.lastSRAt).Seconds() * 65536)
+    }
+
+    b = binary.BigEndian.AppendUint32(b, r.ssrc)
+    b = binary.BigEndian.AppendUint32(b, fraction<<24|uint32(lost)&0xffffff)
+    b = binary.BigEndian.AppendUint32(b, r.extendedMax())
+    b = binary.BigEndian.AppendUint32(b, uint32(r.jitter))
+    b = binary.BigEndian.AppendUint32(b, r.lastSR)
+    return binary.BigEndian.AppendUint32(b, dlsr)
+}
+
+// ntpTime converts a time to a 64 bit NTP timestamp.
+func ntpTime(t time.Time) uint64 {
+    const epoch = 2208988800 // 1900 to 1970, in seconds
+    seconds := uint64(t.Unix() + epoch)
+    fraction := uint64(t.Nanosecond()) << 32 / uint64(time.Second)
+    return seconds<<32 | fraction
+}
+
+// sendReport sends a compound RTCP packet to port+1 of S2's media address: a
+// sender report while we send, a receiver report otherwise, then our CNAME
+// and, when leaving, a BYE.
+func (s *rtpStream) sendReport(bye bool) {
+    s.mu.Lock()
+    remote := s.remote
+    if remote == nil || remote.Addr == nil {
+        s.mu.Unlock()
+        return
+    }
+
+    now := time.Now()
+    blocks := 0
+    if s.reception.started {
+        blocks = 1
+    }
+
+    var b []byte
+    if s.sent.Load() > 0 && remote.Sends() {
+        b = appendRTCPHeader(b, blocks, rtcpSR, 6+6*blocks)
+        b = binary.BigEndian.AppendUint32(b, s.ssrc)
+        b = binary.BigEndian.AppendUint64(b, ntpTime(now))
+        b = binary.BigEndian.AppendUint32(b, s.timestamp)
+        b = binary.BigEndian.AppendUint32(b, uint32(s.sent.Load()))
+        b = binary.BigEndian.AppendUint32(b, uint32(s.octets))
+    } else {
+        b = appendRTCPHeader(b, blocks, rtcpRR, 1+6*blocks)
+        b = binary.BigEndian.AppendUint32(b, s.ssrc)
+    }
+    if blocks > 0 {
+        b = s.reception.reportBlock(b, now)
+    }
+    ssrc := s.ssrc
+    s.mu.Unlock()
+
+    // SDES with the CNAME item, null terminated and padded to 32 bits
+    chunk := binary.BigEndian.AppendUint32(nil, ssrc)
+    chunk = append(chunk, 1, byte(len(s.cname)))
+    chunk = append(chunk, s.cname...)
+    chunk = append(chunk, 0)
+    for len(chunk)%4 != 0 {
+        chunk = append(chunk, 0)
+    }
+    b = appendRTCPHeader(b, 1, rtcpSDES, len(chunk)/4)
+    b = append(b, chunk...)
+
+    if bye {
+        b = appendRTCPHeader(b, 1, rtcpBYE, 1)
+        b = binary.BigEndian.AppendUint32(b, ssrc)
+    }
+
+    addr := &net.UDPAddr{IP: remote.Addr.IP, Port: remote.Addr.Port + 1, Zone: remote.Addr.Zone}
+    if _, err := s.rtcp.WriteToUDP(b, addr); err != nil {
+        log.Printf("[SIP] Error sending RTCP: %v", err)
+        return
+    }
+    s.captureRTCP(b, addr, true)
+}
+
+// appendRTCPHeader appends the common header of an RTCP packet of length
+// 32 bit words after the header.
+func appendRTCPHeader(b []byte, count, packetType, length int) []byte {
+    return append(b, 0x80|byte(count), byte(packetType), byte(length>>8), byte(length))
+}
+
+// receiveRTCP reads the reports S2 sends until the socket is closed, for
+// the timestamps of its sender reports and the round-trip time from its
+// report blocks about our stream.
+func (s *rtpStream) receiveRTCP() {
+    buffer := make([]byte, 1500)
+    for {
+        n, from, err := s.rtcp.ReadFromUDP(buffer)
+        if err != nil {
+            if errors.Is(err, net.ErrClosed) {
+                return
+            }
+            log.Printf("[SIP] Error reading RTCP: %v", err)
+            continue
+        }
+        s.captureRTCP(buffer[:n], from, false)
+        s.handleRTCP(buffer[:n], time.Now())
+    }
+}
+
+func (s *rtpStream) handleRTCP(b []byte, now time.Time) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    // A compound packet is a series of RTCP packets
+    for len(b) >= 8 && b[0]>>6 == 2 {
+        count := int(b[0] & 0x1f)
+        length := (int(binary.BigEndian.Uint16(b[2:4])) + 1) * 4
+        if length > len(b) {
+            return
+        }
+        packet := b[:length]
+        b = b[length:]
+
+        var blocks []byte
+        switch packet[1] {
+        case rtcpSR:
+            if len(packet) < 28 {
+                continue
+            }
+            s.reception.lastSR = binary.BigEndian.Uint32(packet[10:14])
+            s.reception.lastSRAt = now
+            blocks = packet[28:]
+        case rtcpRR:
+            blocks = packet[8:]
+        default:
+            continue
+        }
+        s.remoteReports++
+
+        for i := 0; i < count && len(blocks) >= 24; i++ {
+            block := blocks[:24]
+            blocks = blocks[24:]
+            if binary.BigEndian.Uint32(block[0:4]) != s.ssrc {
+                continue
+            }
+            s.reportsOnUs++
+
+            // Round trip: now less the time our report was sent and the
+            // delay S2 held it, in 1/65536 s (RFC 3550 section 6.4.1)
+            lsr := binary.BigEndian.Uint32(block[16:20])
+            dlsr := binary.BigEndian.Uint32(block[20:24])
+            if lsr == 0 {
+                continue
+            }
+            if rtt := uint32(ntpTime(now)>>16) - lsr - dlsr; rtt < 1<<31 {
+                s.reception.rtt = time.Duration(rtt) * time.Second / 65536
+            }
+        }
+    }
+}
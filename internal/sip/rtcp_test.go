@@ -0,0 +1,189 @@
+package sip
+
+import (
+    "bytes"
+    "encoding/binary"
+    "net"
+    "testing"
+    "time"
+
+    "github.com/s1-callgen/internal/sip/sdp"
+)
+
+// rtcpPacket is one packet of a compound RTCP packet.
+type rtcpPacket struct {
+    count      int
+    packetType byte
+    body       []byte // after the common header
+}
+
+// splitRTCP splits a compound RTCP packet, checking the version and that
+// the lengths add up.
+func splitRTCP(t *testing.T, b []byte) []rtcpPacket {
+    t.Helper()
+    var packets []rtcpPacket
+    for len(b) > 0 {
+        if len(b) < 4 || b[0]>>6 != 2 {
+            t.Fatalf("not an RTCP packet: %x", b)
+        }
+        length := (int(binary.BigEndian.Uint16(b[2:])) + 1) * 4
+        if length > len(b) {
+            t.Fatalf("packet of %d bytes in %d", length, len(b))
+        }
+        packets = append(packets, rtcpPacket{int(b[0] & 0x1f), b[1], b[4:length]})
+        b = b[length:]
+    }
+    return packets
+}
+
+// reportingStream is a stream sending to a peer, which has received 10
+// packets of the 12 from 0xb0b, and the peer's RTCP socket.
+func reportingStream(t *testing.T) (*rtpStream, *net.UDPConn) {
+    t.Helper()
+    _, peerRTCP := listenPeer(t)
+    s := openTestStream(t)
+    s.setRemote(&sdp.Result{
+        Codec:     sdp.Codec{PayloadType: 0, Name: "PCMU", ClockRate: 8000, Channels: 1},
+        Addr:      &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: peerRTCP.LocalAddr().(*net.UDPAddr).Port - 1},
+        Direction: sdp.SendRecv,
+    })
+    for seq := uint16(100); seq < 112; seq++ {
+        if seq != 103 && seq != 107 {
+            s.reception.update(0xb0b, seq, uint32(seq)*160, int64(seq)*160)
+        }
+    }
+    return s, peerRTCP
+}
+
+func TestSenderReport(t *testing.T) {
+    s, peer := reportingStream(t)
+    s.sent.Store(50)
+    s.octets = 8000
+    s.timestamp = 123456
+
+    before := time.Now()
+    s.sendReport(false)
+    packet := readPacket(t, peer)
+    packets := splitRTCP(t, packet)
+    if len(packets) != 2 || packets[0].packetType != rtcpSR || packets[0].count != 1 || len(packets[0].body) != 48 || packets[1].packetType != rtcpSDES {
+        t.Fatalf("got %x, want a sender report with one block and an SDES", packet)
+    }
+
+    sr := packets[0].body
+    sent := binary.BigEndian.Uint64(sr[4:])
+    if binary.BigEndian.Uint32(sr) != s.ssrc || sent < ntpTime(before) || sent > ntpTime(time.Now()) {
+        t.Errorf("report from %#x at %#x, want %#x between %#x and %#x", binary.BigEndian.Uint32(sr), sent, s.ssrc, ntpTime(before), ntpTime(time.Now()))
+    }
+    if ts, count, octets := binary.BigEndian.Uint32(sr[12:]), binary.BigEndian.Uint32(sr[16:]), binary.BigEndian.Uint32(sr[20:]); ts != 123456 || count != 50 || octets != 8000 {
+        t.Errorf("timestamp %d, %d packets, %d octets; want 123456, 50 and 8000", ts, count, octets)
+    }
+
+    // 2 of 12 lost is a fraction of 42/256
+    block := sr[24:]
+    if ssrc, lost, highest := binary.BigEndian.Uint32(block), binary.BigEndian.Uint32(block[4:]), binary.BigEndian.Uint32(block[8:]); ssrc != 0xb0b || lost != 42<<24|2 || highest != 111 {
+        t.Errorf("block on %#x, lost %#x, highest %d; want 0xb0b, 0x2a000002 and 111", ssrc, lost, highest)
+    }
+    if lsr, dlsr := binary.BigEndian.Uint32(block[16:]), binary.BigEndian.Uint32(block[20:]); lsr != 0 || dlsr != 0 {
+        t.Errorf("LSR %#x and DLSR %#x without a report from the peer, want 0", lsr, dlsr)
+    }
+    if sdes := packets[1].body; binary.BigEndian.Uint32(sdes) != s.ssrc || sdes[4] != 1 || !bytes.Equal(sdes[6:6+int(sdes[5])], []byte(s.cname)) {
+        t.Errorf("SDES %x, want the CNAME %s", sdes, s.cname)
+    }
+
+    // The peer takes it as a report on its stream, and keeps the middle of
+    // its NTP timestamp for its own reports
+    peerStream := &rtpStream{ssrc: 0xb0b}
+    at := time.Now()
+    peerStream.handleRTCP(packet, at)
+    if peerStream.remoteReports != 1 || peerStream.reportsOnUs != 1 {
+        t.Errorf("%d reports, %d on the peer's stream; want 1 and 1", peerStream.remoteReports, peerStream.reportsOnUs)
+    }
+    if lsr := uint32(sent >> 16); peerStream.reception.lastSR != lsr || !peerStream.reception.lastSRAt.Equal(at) {
+        t.Errorf("last SR %#x at %v, want %#x at %v", peerStream.reception.lastSR, peerStream.reception.lastSRAt, lsr, at)
+    }
+}
+
+func TestReceiverReport(t *testing.T) {
+    s, peer := reportingStream(t)
+
+    // Nothing sent, so a receiver report, here with a BYE as the stream
+    // closes
+    s.sendReport(true)
+    packet := readPacket(t, peer)
+    packets := splitRTCP(t, packet)
+    if len(packets) != 3 || packets[0].packetType != rtcpRR || packets[0].count != 1 || len(packets[0].body) != 28 || packets[2].packetType != rtcpBYE {
+        t.Fatalf("got %x, want a receiver report with one block, an SDES and a BYE", packet)
+    }
+    rr := packets[0].body
+    if binary.BigEndian.Uint32(rr) != s.ssrc || binary.BigEndian.Uint32(rr[4:]) != 0xb0b {
+        t.Errorf("report %x, want one from %#x on 0xb0b", rr, s.ssrc)
+    }
+    if bye := packets[2].body; packets[2].count != 1 || binary.BigEndian.Uint32(bye) != s.ssrc {
+        t.Errorf("BYE %x, want one of %#x", bye, s.ssrc)
+    }
+
+    // Reports on other streams count as reports, not as reports on ours
+    other := &rtpStream{ssrc: 0xc0c}
+    other.handleRTCP(packet, time.Now())
+    if other.remoteReports != 1 || other.reportsOnUs != 0 {
+        t.Errorf("%d reports, %d on the stream; want 1 and 0", other.remoteReports, other.reportsOnUs)
+    }
+
+    // A second report interval starts from the first: nothing more lost
+    block := s.reception.reportBlock(nil, time.Now())
+    if lost := binary.BigEndian.Uint32(block[4:]); lost != 2 {
+        t.Errorf("lost %#x in the second interval, want no fraction and 2 in all", lost)
+    }
+}
+
+func TestRoundTripTime(t *testing.T) {
+    // We send a sender report at t0; S2 receives it 20 ms later and reports
+    // on our stream 100 ms after that, which reaches us 30 ms later
+    t0 := time.Unix(1700000000, 0)
+    var sr []byte
+    sr = appendRTCPHeader(sr, 0, rtcpSR, 6)
+    sr = binary.BigEndian.AppendUint32(sr, 0xa0a)
+    sr = binary.BigEndian.AppendUint64(sr, ntpTime(t0))
+    sr = append(sr, make([]byte, 12)...)
+
+    s2 := &rtpStream{ssrc: 0xb0b}
+    s2.reception.update(0xa0a, 1, 160, 160)
+    s2.handleRTCP(sr, t0.Add(20*time.Millisecond))
+    rr := appendRTCPHeader(nil, 1, rtcpRR, 7)
+    rr = binary.BigEndian.AppendUint32(rr, s2.ssrc)
+    rr = s2.reception.reportBlock(rr, t0.Add(120*time.Millisecond))
+
+    us := &rtpStream{ssrc: 0xa0a}
+    us.handleRTCP(rr, t0.Add(150*time.Millisecond))
+    if rtt := us.reception.rtt; rtt < 49*time.Millisecond || rtt > 51*time.Millisecond {
+        t.Errorf("round trip %v, want 50 ms", rtt)
+    }
+
+    tests := []struct {
+        name      string
+        lsr, dlsr uint32
+        at        time.Duration
+    }{
+        // Without a sender report from us S2 has no LSR to give
+        {"no LSR", 0, 0, 150 * time.Millisecond},
+        // A DLSR longer than the time since our report would be negative
+        {"DLSR too long", uint32(ntpTime(t0) >> 16), 65536, 150 * time.Millisecond},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            rr := appendRTCPHeader(nil, 1, rtcpRR, 7)
+            rr = binary.BigEndian.AppendUint32(rr, 0xb0b)
+            rr = binary.BigEndian.AppendUint32(rr, 0xa0a)
+            rr = append(rr, make([]byte, 12)...)
+            rr = binary.BigEndian.AppendUint32(rr, tt.lsr)
+            rr = binary.BigEndian.AppendUint32(rr, tt.dlsr)
+
+            s := &rtpStream{ssrc: 0xa0a}
+            s.reception.rtt = time.Second
+            s.handleRTCP(rr, t0.Add(tt.at))
+            if s.reportsOnUs != 1 || s.reception.rtt != time.Second {
+                t.Errorf("%d reports on us, round trip %v; want 1 and unchanged", s.reportsOnUs, s.reception.rtt)
+            }
+        })
+    }
+}
@@ -2,10 +2,11 @@ package sip
 
 import (
     "encoding/binary"
-    "fmt"
-    "math/rand"
     "net"
+    "strconv"
     "time"
+    
+    "github.com/s1-callgen/internal/sip/sdp"
 )
 
 type RTPPacket struct {
@@ -21,52 +22,41 @@ type RTPPacket struct {
     Payload        []byte
 }
 
+// SendRTPStream sends PCMU silence from localIP:localPort to the remote
+// address for duration.
 func SendRTPStream(localIP string, localPort int, remoteIP string, remotePort int, duration time.Duration) error {
-    conn, err := net.Dial("udp", fmt.Sprintf("%s:%d", remoteIP, remotePort))
+    remoteAddr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(remoteIP, strconv.Itoa(remotePort)))
     if err != nil {
         return err
     }
-    defer conn.Close()
-    
-    // RTP parameters
-    ssrc := uint32(rand.Int31())
-    sequenceNumber := uint16(rand.Intn(65535))
-    timestamp := uint32(rand.Int31())
-    
-    // Send RTP packets (50 packets per second for 20ms intervals)
-    ticker := time.NewTicker(20 * time.Millisecond)
-    defer ticker.Stop()
-    
-    timeout := time.After(duration)
     
-    for {
-        select {
-        case <-ticker.C:
-            packet := createRTPPacket(sequenceNumber, timestamp, ssrc)
-            conn.Write(packet)
-            sequenceNumber++
-            timestamp += 160 // 160 samples at 8kHz for 20ms
-        case <-timeout:
-            return nil
-        }
+    stream, err := openRTPStream(localIP, localPort)
+    if err != nil {
+        return err
     }
+    defer stream.close()
+    
+    stream.start(&sdp.Result{
+        Codec:     sdp.Codec{PayloadType: 0, Name: "PCMU", ClockRate: 8000, Channels: 1},
+        Addr:      remoteAddr,
+        Direction: sdp.SendRecv,
+    })
+    time.Sleep(duration)
+    return nil
 }
 
-func createRTPPacket(seq uint16, ts uint32, ssrc uint32) []byte {
-    packet := make([]byte, 12+160) // RTP header + 160 bytes of audio
+func createRTPPacket(payloadType uint8, seq uint16, ts uint32, ssrc uint32, payload []byte) []byte {
+    packet := make([]byte, 12+len(payload)) // RTP header + encoded audio
     
     // RTP header
     packet[0] = 0x80 // Version 2, no padding, no extension, no CSRC
-    packet[1] = 0    // Marker = 0, Payload type = 0 (PCMU)
+    packet[1] = payloadType & 0x7f // Marker = 0
     
     binary.BigEndian.PutUint16(packet[2:4], seq)
     binary.BigEndian.PutUint32(packet[4:8], ts)
     binary.BigEndian.PutUint32(packet[8:12], ssrc)
     
-    // Fill with silence (0xFF for PCMU)
-    for i := 12; i < len(packet); i++ {
-        packet[i] = 0xFF
-    }
+    copy(packet[12:], payload)
     
     return packet
 }
@@ -0,0 +1,100 @@
+package sdp
+
+import (
+    "fmt"
+    "strconv"
+    "strings"
+)
+
+// Codec is a payload format of a media stream, from its rtpmap and fmtp
+// attributes or the static payload types of RFC 3551.
+type Codec struct {
+    PayloadType uint8
+    Name        string // encoding name, as in PCMU or telephone-event
+    ClockRate   int
+    Channels    int // 1 when not given
+    Fmtp        string
+}
+
+// staticCodecs are the RFC 3551 payload types that need no rtpmap.
+var staticCodecs = map[uint8]Codec{
+    0:  {PayloadType: 0, Name: "PCMU", ClockRate: 8000, Channels: 1},
+    3:  {PayloadType: 3, Name: "GSM", ClockRate: 8000, Channels: 1},
+    4:  {PayloadType: 4, Name: "G723", ClockRate: 8000, Channels: 1},
+    8:  {PayloadType: 8, Name: "PCMA", ClockRate: 8000, Channels: 1},
+    9:  {PayloadType: 9, Name: "G722", ClockRate: 8000, Channels: 1},
+    18: {PayloadType: 18, Name: "G729", ClockRate: 8000, Channels: 1},
+}
+
+// TelephoneEvent is the encoding name of RFC 4733 DTMF events.
+const TelephoneEvent = "telephone-event"
+
+func (c Codec) String() string {
+    if c.Channels > 1 {
+        return fmt.Sprintf("%s/%d/%d", c.Name, c.ClockRate, c.Channels)
+    }
+    return fmt.Sprintf("%s/%d", c.Name, c.ClockRate)
+}
+
+// Same reports whether two codecs are the same encoding, whatever their
+// payload type numbers.
+func (c Codec) Same(other Codec) bool {
+    return strings.EqualFold(c.Name, other.Name) && c.ClockRate == other.ClockRate && max(c.Channels, 1) == max(other.Channels, 1)
+}
+
+// Codecs returns the payload formats of a stream in the order listed.
+// Dynamic payload types without an rtpmap are skipped.
+func (m *Media) Codecs() []Codec {
+    var codecs []Codec
+    for _, format := range m.Formats {
+        pt, err := strconv.Atoi(format)
+        if err != nil || pt < 0 || pt > 127 {
+            continue
+        }
+
+        codec, ok := staticCodecs[uint8(pt)]
+        for _, a := range m.Attributes {
+            fields := strings.Fields(a.Value)
+            if len(fields) < 2 || fields[0] != format {
+                continue
+            }
+            switch a.Key {
+            case "rtpmap":
+                // a=rtpmap:<pt> <name>/<clock rate>[/<channels>]
+                parts := strings.Split(fields[1], "/")
+                if len(parts) < 2 {
+                    continue
+                }
+                rate, err := strconv.Atoi(parts[1])
+                if err != nil {
+                    continue
+                }
+                channels := 1
+                if len(parts) > 2 {
+                    if n, err := strconv.Atoi(parts[2]); err == nil {
+                        channels = n
+                    }
+                }
+                codec = Codec{PayloadType: uint8(pt), Name: parts[0], ClockRate: rate, Channels: channels, Fmtp: codec.Fmtp}
+                ok = true
+            case "fmtp":
+                codec.Fmtp = strings.TrimSpace(strings.TrimPrefix(a.Value, format))
+            }
+        }
+        if ok {
+            codecs = append(codecs, codec)
+        }
+    }
+    return codecs
+}
+
+// AddCodec lists a codec in a stream with its rtpmap and, if it has
+// parameters, fmtp attributes.
+func (m *Media) AddCodec(c Codec) {
+    format := strconv.Itoa(int(c.PayloadType))
+    m.Formats = append(m.Formats, format)
+    m.Attributes = append(m.Attributes, Attribute{Key: "rtpmap", Value: format + " " + c.String()})
+    if c.Fmtp != "" {
+        m.Attributes = append(m.Attributes, Attribute{Key: "fmtp", Value: format + " " + c.Fmtp})
+    }
+}
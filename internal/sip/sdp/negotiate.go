@@ -0,0 +1,166 @@
+package sdp
+
+import (
+    "errors"
+    "net"
+    "strconv"
+    "strings"
+)
+
+// ErrNoCommonCodec is returned when the two sides of an offer/answer exchange
+// share no audio codec.
+var ErrNoCommonCodec = errors.New("sdp: no common audio codec")
+
+// ErrNoAudio is returned when a session description has no audio stream.
+var ErrNoAudio = errors.New("sdp: no audio stream")
+
+// Result is the outcome of an offer/answer exchange for the audio stream,
+// from our point of view.
+type Result struct {
+    Codec     Codec        // the codec we send, the first common one
+    Events    *Codec       // telephone-event at the codec's clock rate, if both sides support it
+    Addr      *net.UDPAddr // where the other side receives, nil if nowhere
+    Direction Direction    // our direction
+    Ptime     int          // milliseconds the other side asked for, or 0
+}
+
+// Sends reports whether we send media to the other side.
+func (r *Result) Sends() bool {
+    return r.Direction.Sends() && r.Addr != nil && !r.Addr.IP.IsUnspecified()
+}
+
+// Answer answers an offer from the other side (RFC 3264 section 6). local is
+// the description we would offer ourselves: its audio stream lists the codecs
+// we support in order of preference, our address, port and direction. The
+// answer keeps the offer's payload type numbers and rejects every stream but
+// the first audio one with port 0, and of the telephone-events only the one
+// at the clock rate of the codec chosen. It fails with ErrNoCommonCodec when
+// no codec matches.
+func Answer(offer, local *Session) (*Session, *Result, error) {
+    ours := local.Audio()
+    theirs := offer.Audio()
+    if ours == nil || theirs == nil {
+        return nil, nil, ErrNoAudio
+    }
+
+    answer := &Session{
+        Origin:     local.Origin,
+        Name:       local.Name,
+        Connection: local.Connection,
+    }
+    var result *Result
+    for _, m := range offer.Media {
+        if m != theirs || m.Port == 0 {
+            // Declined, keeping the offer's formats as the m= line needs one
+            answer.Media = append(answer.Media, &Media{Type: m.Type, Port: 0, Proto: m.Proto, Formats: m.Formats})
+            continue
+        }
+
+        media := &Media{Type: m.Type, Port: ours.Port, Proto: m.Proto, Connection: ours.Connection}
+        offered := m.Codecs()
+        var common []Codec
+        for _, codec := range ours.Codecs() {
+            for _, o := range offered {
+                if !codec.Same(o) {
+                    continue
+                }
+                o.Fmtp = firstNonEmpty(o.Fmtp, codec.Fmtp)
+                if !strings.EqualFold(o.Name, TelephoneEvent) {
+                    media.AddCodec(o)
+                }
+                common = append(common, o)
+                break
+            }
+        }
+        if len(media.Formats) == 0 {
+            return nil, nil, ErrNoCommonCodec
+        }
+        events := eventsAt(common, media.Codecs()[0].ClockRate)
+        if events != nil {
+            media.AddCodec(*events)
+        }
+
+        direction := offer.Direction(m).Reverse().intersect(local.Direction(ours))
+        media.Attributes = append(media.Attributes, Attribute{Key: string(direction)})
+        if ptime := ours.Ptime(); ptime > 0 {
+            media.Attributes = append(media.Attributes, Attribute{Key: "ptime", Value: strconv.Itoa(ptime)})
+        }
+        answer.Media = append(answer.Media, media)
+
+        result = &Result{
+            Codec:     media.Codecs()[0],
+            Events:    events,
+            Addr:      offer.Addr(m),
+            Direction: direction,
+            Ptime:     m.Ptime(),
+        }
+    }
+    return answer, result, nil
+}
+
+// Match reads the other side's answer to our offer (RFC 3264 section 7). The
+// codec we send is the first of the answer that we offered, and the events
+// the answer's first telephone-event at its clock rate. It fails with
+// ErrNoCommonCodec when the answer rejects audio or lists none of our codecs.
+func Match(offer, answer *Session) (*Result, error) {
+    ours := offer.Audio()
+    theirs := answer.Audio()
+    if ours == nil || theirs == nil {
+        return nil, ErrNoAudio
+    }
+    if theirs.Port == 0 {
+        return nil, ErrNoCommonCodec
+    }
+
+    offered := ours.Codecs()
+    result := &Result{
+        Addr:      answer.Addr(theirs),
+        Direction: answer.Direction(theirs).Reverse().intersect(offer.Direction(ours)),
+        Ptime:     theirs.Ptime(),
+    }
+    var common []Codec
+    found := false
+    for _, codec := range theirs.Codecs() {
+        if !containsCodec(offered, codec) {
+            continue
+        }
+        common = append(common, codec)
+        if !found && !strings.EqualFold(codec.Name, TelephoneEvent) {
+            result.Codec = codec
+            found = true
+        }
+    }
+    if !found {
+        return nil, ErrNoCommonCodec
+    }
+    result.Events = eventsAt(common, result.Codec.ClockRate)
+    return result, nil
+}
+
+// eventsAt returns the first telephone-event of codecs at the given clock
+// rate, or nil. Events share the timestamps of the audio stream, so they
+// must run on the same clock (RFC 4733 section 2.1).
+func eventsAt(codecs []Codec, clockRate int) *Codec {
+    for _, codec := range codecs {
+        if strings.EqualFold(codec.Name, TelephoneEvent) && codec.ClockRate == clockRate {
+            return &codec
+        }
+    }
+    return nil
+}
+
+func containsCodec(codecs []Codec, codec Codec) bool {
+    for _, c := range codecs {
+        if c.Same(codec) {
+            return true
+        }
+    }
+    return false
+}
+
+func firstNonEmpty(a, b string) string {
+    if a != "" {
+        return a
+    }
+    return b
+}
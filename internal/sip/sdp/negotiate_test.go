@@ -0,0 +1,349 @@
+package sdp
+
+import (
+    "errors"
+    "strings"
+    "testing"
+)
+
+// session builds a description with one audio stream on port 4000, the given
+// rtpmap lines and an optional direction attribute.
+func session(ip string, direction Direction, rtpmaps ...string) *Session {
+    m := &Media{Type: "audio", Port: 4000, Proto: "RTP/AVP"}
+    for _, rtpmap := range rtpmaps {
+        format, _, _ := strings.Cut(rtpmap, " ")
+        m.Formats = append(m.Formats, format)
+        m.Attributes = append(m.Attributes, Attribute{Key: "rtpmap", Value: rtpmap})
+    }
+    if direction != "" {
+        m.Attributes = append(m.Attributes, Attribute{Key: string(direction)})
+    }
+    return &Session{
+        Origin:     Origin{Username: "-", SessionID: 1, SessionVersion: 1, Connection: *NewConnection(ip)},
+        Connection: NewConnection(ip),
+        Media:      []*Media{m},
+    }
+}
+
+// local is what we offer: PCMA then PCMU, and DTMF on 101.
+func local(direction Direction) *Session {
+    return session("10.0.0.1", direction, "8 PCMA/8000", "0 PCMU/8000", "101 telephone-event/8000")
+}
+
+// wideband is what we offer with Opus first: DTMF at both clock rates.
+func wideband() *Session {
+    return session("10.0.0.1", "", "111 opus/48000/2", "0 PCMU/8000", "101 telephone-event/8000", "102 telephone-event/48000")
+}
+
+func TestAnswer(t *testing.T) {
+    tests := []struct {
+        name      string
+        offer     *Session
+        local     *Session
+        formats   string
+        codec     string
+        events    uint8 // payload type, 0 for none
+        direction Direction
+        wantErr   error
+    }{
+        {
+            name:      "our preference, their payload types",
+            offer:     session("10.0.0.2", "", "0 PCMU/8000", "8 PCMA/8000", "96 telephone-event/8000"),
+            local:     local(""),
+            formats:   "8 0 96",
+            codec:     "PCMA/8000",
+            events:    96,
+            direction: SendRecv,
+        },
+        {
+            name:      "dynamic payload type kept",
+            offer:     session("10.0.0.2", "", "110 pcmu/8000"),
+            local:     local(""),
+            formats:   "110",
+            codec:     "pcmu/8000",
+            direction: SendRecv,
+        },
+        {
+            name:      "sendonly offer is received only",
+            offer:     session("10.0.0.2", SendOnly, "0 PCMU/8000"),
+            local:     local(""),
+            formats:   "0",
+            codec:     "PCMU/8000",
+            direction: RecvOnly,
+        },
+        {
+            name:      "recvonly offer, sendonly us",
+            offer:     session("10.0.0.2", RecvOnly, "0 PCMU/8000"),
+            local:     local(SendOnly),
+            formats:   "0",
+            codec:     "PCMU/8000",
+            direction: SendOnly,
+        },
+        {
+            name:      "sendonly offer, sendonly us",
+            offer:     session("10.0.0.2", SendOnly, "0 PCMU/8000"),
+            local:     local(SendOnly),
+            formats:   "0",
+            codec:     "PCMU/8000",
+            direction: Inactive,
+        },
+        {
+            name:      "inactive offer",
+            offer:     session("10.0.0.2", Inactive, "0 PCMU/8000"),
+            local:     local(""),
+            formats:   "0",
+            codec:     "PCMU/8000",
+            direction: Inactive,
+        },
+        {
+            name:      "events at the codec's clock rate",
+            offer:     session("10.0.0.2", "", "96 opus/48000/2", "0 PCMU/8000", "97 telephone-event/8000", "98 telephone-event/48000"),
+            local:     wideband(),
+            formats:   "96 0 98",
+            codec:     "opus/48000/2",
+            events:    98,
+            direction: SendRecv,
+        },
+        {
+            name:      "no events at the codec's clock rate",
+            offer:     session("10.0.0.2", "", "96 opus/48000/2", "97 telephone-event/8000"),
+            local:     wideband(),
+            formats:   "96",
+            codec:     "opus/48000/2",
+            direction: SendRecv,
+        },
+        {
+            name:    "no common codec",
+            offer:   session("10.0.0.2", "", "18 G729/8000", "101 telephone-event/8000"),
+            local:   local(""),
+            wantErr: ErrNoCommonCodec,
+        },
+        {
+            name:    "clock rate differs",
+            offer:   session("10.0.0.2", "", "97 PCMU/16000"),
+            local:   local(""),
+            wantErr: ErrNoCommonCodec,
+        },
+        {
+            name:    "no audio",
+            offer:   &Session{Media: []*Media{{Type: "video", Port: 5000, Proto: "RTP/AVP", Formats: []string{"31"}}}},
+            local:   local(""),
+            wantErr: ErrNoAudio,
+        },
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            answer, result, err := Answer(tt.offer, tt.local)
+            if tt.wantErr != nil {
+                if !errors.Is(err, tt.wantErr) {
+                    t.Fatalf("got %v, want %v", err, tt.wantErr)
+                }
+                return
+            }
+            if err != nil {
+                t.Fatal(err)
+            }
+
+            audio := answer.Audio()
+            if got := strings.Join(audio.Formats, " "); got != tt.formats {
+                t.Errorf("answer lists %q, want %q", got, tt.formats)
+            }
+            if answer.Direction(audio) != tt.direction || result.Direction != tt.direction {
+                t.Errorf("answer direction %s, result %s, want %s", answer.Direction(audio), result.Direction, tt.direction)
+            }
+            if result.Codec.String() != tt.codec {
+                t.Errorf("codec %s, want %s", result.Codec, tt.codec)
+            }
+            switch {
+            case tt.events == 0 && result.Events != nil:
+                t.Errorf("events on %d, want none", result.Events.PayloadType)
+            case tt.events != 0 && (result.Events == nil || result.Events.PayloadType != tt.events):
+                t.Errorf("events %+v, want payload type %d", result.Events, tt.events)
+            }
+            if result.Addr.String() != "10.0.0.2:4000" {
+                t.Errorf("sending to %v, want the offer's 10.0.0.2:4000", result.Addr)
+            }
+
+            // The answer must parse and, read back against the offer,
+            // agree on the codec
+            parsed, err := Parse(answer.Bytes())
+            if err != nil {
+                t.Fatal(err)
+            }
+            matched, err := Match(tt.offer, parsed)
+            if err != nil {
+                t.Fatal(err)
+            }
+            if matched.Codec.PayloadType != result.Codec.PayloadType {
+                t.Errorf("offerer would send %d, we %d", matched.Codec.PayloadType, result.Codec.PayloadType)
+            }
+        })
+    }
+}
+
+func TestAnswerDeclinesOtherStreams(t *testing.T) {
+    offer := session("10.0.0.2", "", "0 PCMU/8000")
+    offer.Media = append([]*Media{{Type: "video", Port: 5000, Proto: "RTP/AVP", Formats: []string{"31"}}}, offer.Media...)
+    offer.Media = append(offer.Media, &Media{Type: "audio", Port: 6000, Proto: "RTP/AVP", Formats: []string{"0"}})
+
+    answer, _, err := Answer(offer, local(""))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(answer.Media) != 3 {
+        t.Fatalf("answer has %d streams, want one per offered stream", len(answer.Media))
+    }
+    for i, want := range []int{0, 4000, 0} {
+        if answer.Media[i].Port != want {
+            t.Errorf("stream %d on port %d, want %d", i, answer.Media[i].Port, want)
+        }
+    }
+}
+
+func TestMatch(t *testing.T) {
+    tests := []struct {
+        name      string
+        offer     *Session
+        answer    *Session
+        codec     string
+        payload   uint8
+        events    uint8 // payload type, 0 for none
+        direction Direction
+        addr      string
+        wantErr   error
+    }{
+        {
+            name:      "first codec of the answer",
+            offer:     local(""),
+            answer:    session("10.0.0.2", "", "0 PCMU/8000", "8 PCMA/8000", "101 telephone-event/8000"),
+            codec:     "PCMU/8000",
+            payload:   0,
+            events:    101,
+            direction: SendRecv,
+            addr:      "10.0.0.2:4000",
+        },
+        {
+            name:      "events at the codec's clock rate",
+            offer:     wideband(),
+            answer:    session("10.0.0.2", "", "111 opus/48000/2", "101 telephone-event/8000", "102 telephone-event/48000"),
+            codec:     "opus/48000/2",
+            payload:   111,
+            events:    102,
+            direction: SendRecv,
+            addr:      "10.0.0.2:4000",
+        },
+        {
+            name:      "no events at the codec's clock rate",
+            offer:     wideband(),
+            answer:    session("10.0.0.2", "", "111 opus/48000/2", "101 telephone-event/8000"),
+            codec:     "opus/48000/2",
+            payload:   111,
+            direction: SendRecv,
+            addr:      "10.0.0.2:4000",
+        },
+        {
+            name:      "answer's payload type",
+            offer:     local(""),
+            answer:    session("10.0.0.2", "", "97 PCMA/8000"),
+            codec:     "PCMA/8000",
+            payload:   97,
+            direction: SendRecv,
+            addr:      "10.0.0.2:4000",
+        },
+        {
+            name:      "codecs we did not offer are skipped",
+            offer:     local(""),
+            answer:    session("10.0.0.2", "", "18 G729/8000", "0 PCMU/8000"),
+            codec:     "PCMU/8000",
+            direction: SendRecv,
+            addr:      "10.0.0.2:4000",
+        },
+        {
+            name:      "hold",
+            offer:     local(SendOnly),
+            answer:    session("10.0.0.2", RecvOnly, "8 PCMA/8000"),
+            codec:     "PCMA/8000",
+            payload:   8,
+            direction: SendOnly,
+            addr:      "10.0.0.2:4000",
+        },
+        {
+            name:      "answerer sends only",
+            offer:     local(""),
+            answer:    session("10.0.0.2", SendOnly, "8 PCMA/8000"),
+            codec:     "PCMA/8000",
+            payload:   8,
+            direction: RecvOnly,
+            addr:      "10.0.0.2:4000",
+        },
+        {
+            name:    "codec mismatch",
+            offer:   local(""),
+            answer:  session("10.0.0.2", "", "18 G729/8000", "101 telephone-event/8000"),
+            wantErr: ErrNoCommonCodec,
+        },
+        {
+            name:  "audio rejected",
+            offer: local(""),
+            answer: &Session{Media: []*Media{
+                {Type: "audio", Port: 0, Proto: "RTP/AVP", Formats: []string{"8"}},
+            }},
+            wantErr: ErrNoCommonCodec,
+        },
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            result, err := Match(tt.offer, tt.answer)
+            if tt.wantErr != nil {
+                if !errors.Is(err, tt.wantErr) {
+                    t.Fatalf("got %v, want %v", err, tt.wantErr)
+                }
+                return
+            }
+            if err != nil {
+                t.Fatal(err)
+            }
+            if result.Codec.String() != tt.codec || result.Codec.PayloadType != tt.payload {
+                t.Errorf("codec %s on %d, want %s on %d", result.Codec, result.Codec.PayloadType, tt.codec, tt.payload)
+            }
+            switch {
+            case tt.events == 0 && result.Events != nil:
+                t.Errorf("events on %d, want none", result.Events.PayloadType)
+            case tt.events != 0 && (result.Events == nil || result.Events.PayloadType != tt.events):
+                t.Errorf("events %+v, want payload type %d", result.Events, tt.events)
+            }
+            if result.Direction != tt.direction {
+                t.Errorf("direction %s, want %s", result.Direction, tt.direction)
+            }
+            if result.Addr.String() != tt.addr {
+                t.Errorf("sending to %v, want %s", result.Addr, tt.addr)
+            }
+        })
+    }
+}
+
+func TestResultSends(t *testing.T) {
+    on := session("10.0.0.2", "", "0 PCMU/8000")
+    held := session("0.0.0.0", "", "0 PCMU/8000")
+
+    for _, tt := range []struct {
+        name   string
+        answer *Session
+        offer  *Session
+        want   bool
+    }{
+        {"sendrecv", on, local(""), true},
+        {"recvonly us", on, local(RecvOnly), false},
+        {"held with 0.0.0.0", held, local(""), false},
+    } {
+        result, err := Match(tt.offer, tt.answer)
+        if err != nil {
+            t.Fatal(err)
+        }
+        if result.Sends() != tt.want {
+            t.Errorf("%s: Sends() = %v, want %v", tt.name, result.Sends(), tt.want)
+        }
+    }
+}
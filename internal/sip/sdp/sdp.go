@@ -0,0 +1,334 @@
+// Package sdp parses and builds session descriptions (RFC 4566) and
+// negotiates media streams with the offer/answer model (RFC 3264).
+package sdp
+
+import (
+    "errors"
+    "fmt"
+    "net"
+    "strconv"
+    "strings"
+)
+
+// Session is a session description. Lines other than those modeled here,
+// such as b= and i=, are dropped when parsing.
+type Session struct {
+    Origin     Origin
+    Name       string
+    Connection *Connection // default for media without their own
+    Attributes []Attribute
+    Media      []*Media
+}
+
+// Origin is the o= line identifying a session and its version.
+type Origin struct {
+    Username       string
+    SessionID      uint64
+    SessionVersion uint64
+    Connection
+}
+
+// Connection is a c= line, or the address part of the o= line.
+type Connection struct {
+    NetType  string // IN
+    AddrType string // IP4 or IP6
+    Address  string
+}
+
+// NewConnection returns the Internet connection for an IPv4 or IPv6 address.
+func NewConnection(ip string) *Connection {
+    addrType := "IP4"
+    if strings.Contains(ip, ":") {
+        addrType = "IP6"
+    }
+    return &Connection{NetType: "IN", AddrType: addrType, Address: ip}
+}
+
+func (c *Connection) String() string {
+    return c.NetType + " " + c.AddrType + " " + c.Address
+}
+
+// Attribute is an a= line. Property attributes such as a=sendrecv have an
+// empty value.
+type Attribute struct {
+    Key   string
+    Value string
+}
+
+// Media is an m= line and the lines following it.
+type Media struct {
+    Type       string // audio, video, ...
+    Port       int    // 0 rejects or disables the stream
+    Proto      string // RTP/AVP
+    Formats    []string
+    Connection *Connection
+    Attributes []Attribute
+}
+
+// Parse parses a session description. Both CRLF and bare LF line endings are
+// accepted.
+func Parse(b []byte) (*Session, error) {
+    s := &Session{}
+    var media *Media
+    seenVersion, seenOrigin := false, false
+
+    for _, line := range strings.Split(string(b), "\n") {
+        line = strings.TrimRight(line, "\r")
+        if line == "" {
+            continue
+        }
+        if len(line) < 2 || line[1] != '=' {
+            return nil, fmt.Errorf("sdp: malformed line %q", line)
+        }
+        value := line[2:]
+
+        switch line[0] {
+        case 'v':
+            if value != "0" {
+                return nil, fmt.Errorf("sdp: unsupported version %q", value)
+            }
+            seenVersion = true
+        case 'o':
+            origin, err := parseOrigin(value)
+            if err != nil {
+                return nil, err
+            }
+            s.Origin = origin
+            seenOrigin = true
+        case 's':
+            s.Name = value
+        case 'c':
+            connection, err := parseConnection(value)
+            if err != nil {
+                return nil, err
+            }
+            if media != nil {
+                media.Connection = connection
+            } else {
+                s.Connection = connection
+            }
+        case 'm':
+            m, err := parseMedia(value)
+            if err != nil {
+                return nil, err
+            }
+            s.Media = append(s.Media, m)
+            media = m
+        case 'a':
+            attribute := parseAttribute(value)
+            if media != nil {
+                media.Attributes = append(media.Attributes, attribute)
+            } else {
+                s.Attributes = append(s.Attributes, attribute)
+            }
+        }
+    }
+
+    if !seenVersion || !seenOrigin {
+        return nil, errors.New("sdp: missing v= or o= line")
+    }
+    return s, nil
+}
+
+func parseOrigin(value string) (Origin, error) {
+    fields := strings.Fields(value)
+    if len(fields) != 6 {
+        return Origin{}, fmt.Errorf("sdp: malformed origin %q", value)
+    }
+    id, err1 := strconv.ParseUint(fields[1], 10, 64)
+    version, err2 := strconv.ParseUint(fields[2], 10, 64)
+    if err1 != nil || err2 != nil {
+        return Origin{}, fmt.Errorf("sdp: malformed origin %q", value)
+    }
+    return Origin{
+        Username:       fields[0],
+        SessionID:      id,
+        SessionVersion: version,
+        Connection:     Connection{NetType: fields[3], AddrType: fields[4], Address: fields[5]},
+    }, nil
+}
+
+func parseConnection(value string) (*Connection, error) {
+    fields := strings.Fields(value)
+    if len(fields) != 3 {
+        return nil, fmt.Errorf("sdp: malformed connection %q", value)
+    }
+    // A multicast TTL or address count after a slash is dropped
+    address, _, _ := strings.Cut(fields[2], "/")
+    return &Connection{NetType: fields[0], AddrType: fields[1], Address: address}, nil
+}
+
+func parseMedia(value string) (*Media, error) {
+    fields := strings.Fields(value)
+    if len(fields) < 4 {
+        return nil, fmt.Errorf("sdp: malformed media %q", value)
+    }
+    // A port count after a slash is dropped
+    portField, _, _ := strings.Cut(fields[1], "/")
+    port, err := strconv.Atoi(portField)
+    if err != nil || port < 0 || port > 65535 {
+        return nil, fmt.Errorf("sdp: malformed media port %q", fields[1])
+    }
+    return &Media{Type: fields[0], Port: port, Proto: fields[2], Formats: fields[3:]}, nil
+}
+
+func parseAttribute(value string) Attribute {
+    key, value, _ := strings.Cut(value, ":")
+    return Attribute{Key: key, Value: value}
+}
+
+// Bytes serialises the session description with CRLF line endings.
+func (s *Session) Bytes() []byte {
+    var b strings.Builder
+    b.WriteString("v=0\r\n")
+    fmt.Fprintf(&b, "o=%s %d %d %s\r\n", s.Origin.Username, s.Origin.SessionID, s.Origin.SessionVersion, s.Origin.Connection.String())
+    name := s.Name
+    if name == "" {
+        name = "-"
+    }
+    fmt.Fprintf(&b, "s=%s\r\n", name)
+    if s.Connection != nil {
+        fmt.Fprintf(&b, "c=%s\r\n", s.Connection)
+    }
+    b.WriteString("t=0 0\r\n")
+    writeAttributes(&b, s.Attributes)
+
+    for _, m := range s.Media {
+        fmt.Fprintf(&b, "m=%s %d %s %s\r\n", m.Type, m.Port, m.Proto, strings.Join(m.Formats, " "))
+        if m.Connection != nil {
+            fmt.Fprintf(&b, "c=%s\r\n", m.Connection)
+        }
+        writeAttributes(&b, m.Attributes)
+    }
+    return []byte(b.String())
+}
+
+func (s *Session) String() string {
+    return string(s.Bytes())
+}
+
+func writeAttributes(b *strings.Builder, attributes []Attribute) {
+    for _, a := range attributes {
+        if a.Value == "" {
+            fmt.Fprintf(b, "a=%s\r\n", a.Key)
+        } else {
+            fmt.Fprintf(b, "a=%s:%s\r\n", a.Key, a.Value)
+        }
+    }
+}
+
+// Audio returns the first audio stream, or nil.
+func (s *Session) Audio() *Media {
+    for _, m := range s.Media {
+        if m.Type == "audio" {
+            return m
+        }
+    }
+    return nil
+}
+
+// Addr returns where a stream of the session is received: the media or
+// session connection address and the media port. It is nil when the stream is
+// disabled or the address is not an IP.
+func (s *Session) Addr(m *Media) *net.UDPAddr {
+    connection := m.Connection
+    if connection == nil {
+        connection = s.Connection
+    }
+    if connection == nil || m.Port == 0 {
+        return nil
+    }
+    ip := net.ParseIP(connection.Address)
+    if ip == nil {
+        return nil
+    }
+    return &net.UDPAddr{IP: ip, Port: m.Port}
+}
+
+// Direction returns the direction of a stream, from its own attributes or
+// else the session's, sendrecv by default.
+func (s *Session) Direction(m *Media) Direction {
+    if d, ok := findDirection(m.Attributes); ok {
+        return d
+    }
+    if d, ok := findDirection(s.Attributes); ok {
+        return d
+    }
+    return SendRecv
+}
+
+func findDirection(attributes []Attribute) (Direction, bool) {
+    for _, a := range attributes {
+        switch d := Direction(a.Key); d {
+        case SendRecv, SendOnly, RecvOnly, Inactive:
+            return d, true
+        }
+    }
+    return "", false
+}
+
+// Attribute returns the value of the first attribute with the key.
+func (m *Media) Attribute(key string) (string, bool) {
+    for _, a := range m.Attributes {
+        if a.Key == key {
+            return a.Value, true
+        }
+    }
+    return "", false
+}
+
+// Ptime returns the packetization time in milliseconds, or 0 when not given.
+func (m *Media) Ptime() int {
+    value, _ := m.Attribute("ptime")
+    ptime, _ := strconv.Atoi(value)
+    return ptime
+}
+
+// Direction is the direction attribute of a stream, from the point of view of
+// the side describing it.
+type Direction string
+
+const (
+    SendRecv Direction = "sendrecv"
+    SendOnly Direction = "sendonly"
+    RecvOnly Direction = "recvonly"
+    Inactive Direction = "inactive"
+)
+
+// Reverse returns the direction seen from the other side.
+func (d Direction) Reverse() Direction {
+    switch d {
+    case SendOnly:
+        return RecvOnly
+    case RecvOnly:
+        return SendOnly
+    default:
+        return d
+    }
+}
+
+// Sends reports whether the side with this direction sends media.
+func (d Direction) Sends() bool {
+    return d == SendRecv || d == SendOnly
+}
+
+// Receives reports whether the side with this direction receives media.
+func (d Direction) Receives() bool {
+    return d == SendRecv || d == RecvOnly
+}
+
+// intersect returns the direction allowed by both.
+func (d Direction) intersect(other Direction) Direction {
+    sends := d.Sends() && other.Sends()
+    receives := d.Receives() && other.Receives()
+    switch {
+    case sends && receives:
+        return SendRecv
+    case sends:
+        return SendOnly
+    case receives:
+        return RecvOnly
+    default:
+        return Inactive
+    }
+}
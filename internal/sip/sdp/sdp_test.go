@@ -0,0 +1,100 @@
+package sdp
+
+import (
+    "reflect"
+    "testing"
+)
+
+const offer = "v=0\r\n" +
+    "o=s2 1234 5678 IN IP4 10.0.0.2\r\n" +
+    "s=call\r\n" +
+    "c=IN IP4 10.0.0.2\r\n" +
+    "b=AS:64\r\n" +
+    "t=0 0\r\n" +
+    "a=sendrecv\r\n" +
+    "m=audio 30000 RTP/AVP 0 8 9 101 96\r\n" +
+    "c=IN IP4 10.0.0.3/127\r\n" +
+    "a=rtpmap:101 telephone-event/8000\r\n" +
+    "a=fmtp:101 0-15\r\n" +
+    "a=rtpmap:96 opus/48000/2\r\n" +
+    "a=ptime:30\r\n" +
+    "a=recvonly\r\n" +
+    "m=video 0 RTP/AVP 31\r\n"
+
+func TestParse(t *testing.T) {
+    s, err := Parse([]byte(offer))
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if s.Origin.SessionID != 1234 || s.Origin.SessionVersion != 5678 || s.Origin.Address != "10.0.0.2" {
+        t.Errorf("origin %+v", s.Origin)
+    }
+    audio := s.Audio()
+    if audio == nil || len(s.Media) != 2 {
+        t.Fatalf("got %d streams, audio %v", len(s.Media), audio)
+    }
+
+    var codecs []string
+    for _, c := range audio.Codecs() {
+        codecs = append(codecs, c.String())
+    }
+    want := []string{"PCMU/8000", "PCMA/8000", "G722/8000", "telephone-event/8000", "opus/48000/2"}
+    if !reflect.DeepEqual(codecs, want) {
+        t.Errorf("codecs %v, want %v", codecs, want)
+    }
+    if events := audio.Codecs()[3]; events.Fmtp != "0-15" || events.PayloadType != 101 {
+        t.Errorf("telephone-event %+v", events)
+    }
+
+    // The stream's own c= and direction override the session's
+    if addr := s.Addr(audio); addr.String() != "10.0.0.3:30000" {
+        t.Errorf("audio at %v, want 10.0.0.3:30000", addr)
+    }
+    if d := s.Direction(audio); d != RecvOnly {
+        t.Errorf("audio %s, want recvonly", d)
+    }
+    if d := s.Direction(s.Media[1]); d != SendRecv {
+        t.Errorf("video %s, want the session's sendrecv", d)
+    }
+    if s.Addr(s.Media[1]) != nil {
+        t.Error("disabled video has an address")
+    }
+    if audio.Ptime() != 30 {
+        t.Errorf("ptime %d, want 30", audio.Ptime())
+    }
+}
+
+func TestRoundTrip(t *testing.T) {
+    s, err := Parse([]byte(offer))
+    if err != nil {
+        t.Fatal(err)
+    }
+    again, err := Parse(s.Bytes())
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !reflect.DeepEqual(again, s) {
+        t.Errorf("got %+v after a round trip, want %+v", again, s)
+    }
+}
+
+func TestParseMalformed(t *testing.T) {
+    tests := map[string]string{
+        "no version":     "o=- 1 1 IN IP4 10.0.0.1\r\n",
+        "no origin":      "v=0\r\n",
+        "version 1":      "v=1\r\no=- 1 1 IN IP4 10.0.0.1\r\n",
+        "bad line":       "v=0\r\no=- 1 1 IN IP4 10.0.0.1\r\nbogus\r\n",
+        "short origin":   "v=0\r\no=- 1 1 IN IP4\r\n",
+        "bad media":      "v=0\r\no=- 1 1 IN IP4 10.0.0.1\r\nm=audio x RTP/AVP 0\r\n",
+        "no formats":     "v=0\r\no=- 1 1 IN IP4 10.0.0.1\r\nm=audio 4000 RTP/AVP\r\n",
+        "bad connection": "v=0\r\no=- 1 1 IN IP4 10.0.0.1\r\nc=IN IP4\r\n",
+    }
+    for name, data := range tests {
+        t.Run(name, func(t *testing.T) {
+            if s, err := Parse([]byte(data)); err == nil {
+                t.Errorf("parsed %+v, want an error", s)
+            }
+        })
+    }
+}
@@ -0,0 +1,240 @@
+package sip
+
+import (
+    "log"
+    "time"
+
+    "github.com/s1-callgen/internal/sip/message"
+    "github.com/s1-callgen/internal/sip/sdp"
+)
+
+// allowedMethods is sent in Allow headers.
+const allowedMethods = "INVITE, ACK, CANCEL, BYE, OPTIONS, INFO, UPDATE"
+
+// handleRequest answers requests sent by S2. Within a call S2 can hang up
+// with BYE or modify the session with re-INVITE or UPDATE; outside of one
+// it sends OPTIONS keep-alives.
+func (c *Client) handleRequest(req *message.Request) {
+    via, err := req.Header.Via()
+    if err != nil {
+        return
+    }
+    seq, method, err := req.Header.CSeq()
+    if err != nil {
+        return
+    }
+
+    // A retransmitted request gets the response we already sent; ACKs are
+    // never answered (RFC 3261 section 17.2)
+    key := transactionKey(via.Branch(), method)
+    sh := c.shardFor(req.Header.CallID())
+    sh.mu.Lock()
+    cached, retransmitted := sh.responses[key]
+    sess := sh.sessions[req.Header.CallID()]
+    sh.mu.Unlock()
+
+    if req.Method == "ACK" {
+        if sess != nil {
+            c.handleACK(sess, req, seq)
+        }
+        return
+    }
+    if retransmitted {
+        c.sendMessage(cached)
+        return
+    }
+
+    var dialog *Dialog
+    if sess != nil {
+        dialog = sess.Dialog()
+    }
+    if dialog != nil && !dialog.matches(req) {
+        dialog = nil
+    }
+
+    switch req.Method {
+    case "OPTIONS":
+        resp := c.newResponse(req, 200, "OK")
+        resp.Header.Add("Accept", "application/sdp")
+        c.respond(key, resp)
+        return
+    case "CANCEL":
+        // We never have an INVITE server transaction to cancel
+        c.respond(key, c.newResponse(req, 481, "Call/Transaction Does Not Exist"))
+        return
+    }
+
+    if dialog == nil {
+        c.respond(key, c.newResponse(req, 481, "Call/Transaction Does Not Exist"))
+        return
+    }
+    if !dialog.acceptRemoteSeq(seq) {
+        c.respond(key, c.newResponse(req, 500, "Server Internal Error"))
+        return
+    }
+
+    switch req.Method {
+    case "BYE":
+        log.Printf("[SIP] Call %s: BYE from S2", sess.call.SIPCallID)
+        c.respond(key, c.newResponse(req, 200, "OK"))
+        sess.remoteHangup()
+
+    case "INVITE", "UPDATE":
+        c.handleOffer(sess, req, key, seq)
+
+    case "INFO":
+        c.respond(key, c.newResponse(req, 200, "OK"))
+
+    default:
+        resp := c.newResponse(req, 405, "Method Not Allowed")
+        resp.Header.Add("Allow", allowedMethods)
+        c.respond(key, resp)
+    }
+}
+
+// handleOffer answers a re-INVITE or UPDATE. A request carrying an SDP offer
+// gets our answer; a re-INVITE without one gets a fresh offer in the 2xx,
+// which S2 answers in its ACK. Either refreshes the session timer.
+func (c *Client) handleOffer(sess *session, req *message.Request, key string, seq uint32) {
+    // A session interval we cannot keep is refused before the offer is
+    // looked at
+    if tooSmall := c.sessionIntervalTooSmall(sess, req); tooSmall != nil {
+        log.Printf("[SIP] Call %s: %s from S2 asks for too small a session interval", sess.call.SIPCallID, req.Method)
+        c.respond(key, tooSmall)
+        return
+    }
+
+    var body []byte
+    if len(req.Body) > 0 {
+        offer, err := sdp.Parse(req.Body)
+        var answer *sdp.Session
+        var negotiated *sdp.Result
+        if err == nil {
+            answer, negotiated, err = sdp.Answer(offer, c.localSDP(sess))
+        }
+        if err != nil {
+            log.Printf("[SIP] Call %s: Cannot answer %s from S2: %v", sess.call.SIPCallID, req.Method, err)
+            c.respond(key, c.newResponse(req, 488, "Not Acceptable Here"))
+            return
+        }
+        body = answer.Bytes()
+
+        // The stream follows S2's new address, codec or hold state
+        sess.setMedia(negotiated)
+    } else if req.Method == "INVITE" {
+        offer := c.localSDP(sess)
+        sess.mu.Lock()
+        sess.offer = offer
+        sess.mu.Unlock()
+        body = offer.Bytes()
+    }
+
+    if dialog := sess.Dialog(); dialog != nil {
+        dialog.refreshTarget(req.Header)
+    }
+
+    resp := c.newResponse(req, 200, "OK")
+    resp.Header.Add("Contact", c.contact(sess.call).String())
+    resp.Header.Add("Allow", allowedMethods)
+    if body != nil {
+        resp.Header.Add("Content-Type", "application/sdp")
+        resp.Body = body
+    }
+    c.answerSessionTimer(sess, req, resp)
+
+    log.Printf("[SIP] Call %s: %s from S2 answered", sess.call.SIPCallID, req.Method)
+    c.respond(key, resp)
+
+    if req.Method == "INVITE" {
+        go c.retransmitAnswer(sess, resp, seq)
+    }
+}
+
+// retransmitAnswer resends the 2xx to a re-INVITE with the Timer G schedule
+// until S2's ACK arrives or 64*T1 passes (RFC 3261 section 13.3.1.4).
+func (c *Client) retransmitAnswer(sess *session, resp *message.Response, seq uint32) {
+    acked := make(chan struct{})
+    sess.mu.Lock()
+    sess.answer = resp
+    sess.answerSeq = seq
+    sess.answerAck = acked
+    sess.mu.Unlock()
+
+    interval := c.timing.t1
+    timeout := time.After(c.timing.b())
+    for {
+        select {
+        case <-acked:
+            return
+        case <-sess.hangup:
+            return
+        case <-timeout:
+            log.Printf("[SIP] Call %s: no ACK for re-INVITE answer", sess.call.SIPCallID)
+            return
+        case <-time.After(interval):
+            c.sendMessage(resp)
+            interval = min(interval*2, c.timing.t2)
+        }
+    }
+}
+
+// handleACK stops the retransmissions of our 2xx to a re-INVITE. When the
+// 2xx carried our offer, the ACK carries S2's answer.
+func (c *Client) handleACK(sess *session, req *message.Request, seq uint32) {
+    sess.mu.Lock()
+    if sess.answerAck != nil && sess.answerSeq == seq {
+        close(sess.answerAck)
+        sess.answerAck = nil
+    }
+    offer := sess.offer
+    if len(req.Body) > 0 {
+        sess.offer = nil
+    }
+    sess.mu.Unlock()
+
+    if offer == nil || len(req.Body) == 0 {
+        return
+    }
+    answer, err := sdp.Parse(req.Body)
+    if err != nil {
+        log.Printf("[SIP] Call %s: Invalid SDP in ACK: %v", sess.call.SIPCallID, err)
+        return
+    }
+    negotiated, err := sdp.Match(offer, answer)
+    if err != nil {
+        log.Printf("[SIP] Call %s: Cannot use answer in ACK: %v", sess.call.SIPCallID, err)
+        return
+    }
+    sess.setMedia(negotiated)
+}
+
+// newResponse builds a response to a request from S2. Responses that create
+// or confirm a dialog carry our tag in To.
+func (c *Client) newResponse(req *message.Request, code int, reason string) *message.Response {
+    resp := message.NewResponse(req, code, reason)
+    if to, err := req.Header.To(); err == nil && to.Tag() == "" {
+        to.Params.Set("tag", c.generateTag())
+        resp.Header.Set("To", to.String())
+    }
+    resp.Header.Add("Server", userAgent)
+    return resp
+}
+
+// respond sends a response and keeps it for 64*T1 to answer retransmissions
+// of the request (Timer J).
+func (c *Client) respond(key string, resp *message.Response) {
+    sh := c.shardFor(resp.Header.CallID())
+    sh.mu.Lock()
+    sh.responses[key] = resp
+    sh.mu.Unlock()
+
+    time.AfterFunc(c.timing.b(), func() {
+        sh.mu.Lock()
+        delete(sh.responses, key)
+        sh.mu.Unlock()
+    })
+
+    if err := c.sendMessage(resp); err != nil {
+        log.Printf("[SIP] Failed to send %d response: %v", resp.StatusCode, err)
+    }
+}
@@ -0,0 +1,157 @@
+package sip
+
+import (
+    "sync"
+    "time"
+
+    "github.com/s1-callgen/internal/capture"
+    "github.com/s1-callgen/internal/media"
+    "github.com/s1-callgen/internal/models"
+    "github.com/s1-callgen/internal/sip/message"
+    "github.com/s1-callgen/internal/sip/sdp"
+)
+
+// session is the client's state for one call, from the INVITE until the
+// call is torn down.
+type session struct {
+    call    *models.Call
+    rtpPort int
+    stream  *rtpStream
+    codecs  []media.Codec // offered, in order of preference
+    sdpID   int64
+    capture *capture.Call // nil when the call is not captured
+
+    mu         sync.Mutex
+    invite     *inviteTransaction
+    sdpVersion int64
+    offer      *sdp.Session // our last offer, awaiting an answer
+    dialog     *Dialog
+    ack        *message.Request
+
+    // answer is our 2xx to a re-INVITE from S2, retransmitted until S2
+    // acknowledges it
+    answer    *message.Response
+    answerSeq uint32
+    answerAck chan struct{}
+
+    timer      sessionTimer
+    timerReset chan struct{} // wakes the session timer loop when restarted
+
+    hangup chan struct{} // closed when S2 sends BYE
+    hungUp sync.Once
+}
+
+func newSession(call *models.Call, rtpPort int) *session {
+    now := time.Now().Unix()
+    return &session{
+        call:       call,
+        rtpPort:    rtpPort,
+        sdpID:      now,
+        sdpVersion: now,
+        timer:      sessionTimer{minSE: minSessionExpires},
+        timerReset: make(chan struct{}, 1),
+        hangup:     make(chan struct{}),
+    }
+}
+
+func (s *session) Invite() *inviteTransaction {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    return s.invite
+}
+
+func (s *session) setInvite(tx *inviteTransaction) {
+    s.mu.Lock()
+    s.invite = tx
+    s.mu.Unlock()
+}
+
+// setStatus records the status of the call. The INVITE transaction reports
+// the progress of the call from its own goroutine, so the status is guarded
+// by the session's lock.
+func (s *session) setStatus(status string) {
+    s.mu.Lock()
+    s.call.Status = status
+    s.mu.Unlock()
+}
+
+func (s *session) Dialog() *Dialog {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    return s.dialog
+}
+
+// remoteHangup records that S2 ended the call with a BYE.
+func (s *session) remoteHangup() {
+    s.hungUp.Do(func() { close(s.hangup) })
+}
+
+// localSDP builds our session description: an audio stream on the call's RTP
+// port offering our codecs. The origin version is bumped on every call, as
+// each description sent is a new offer or answer (RFC 3264 section 8).
+func (c *Client) localSDP(s *session) *sdp.Session {
+    s.mu.Lock()
+    s.sdpVersion++
+    version := s.sdpVersion
+    s.mu.Unlock()
+
+    connection := sdp.NewConnection(c.localIP)
+    audio := &sdp.Media{Type: "audio", Port: s.rtpPort, Proto: "RTP/AVP"}
+    for _, codec := range s.codecs {
+        audio.AddCodec(sdp.Codec{
+            PayloadType: codec.PayloadType(),
+            Name:        codec.Name(),
+            ClockRate:   codec.ClockRate(),
+            Channels:    codec.Channels(),
+            Fmtp:        codec.Fmtp(),
+        })
+    }
+    for _, events := range telephoneEvents(s.codecs) {
+        audio.AddCodec(events)
+    }
+    audio.Attributes = append(audio.Attributes, sdp.Attribute{Key: string(sdp.SendRecv)})
+
+    return &sdp.Session{
+        Origin:     sdp.Origin{Username: "-", SessionID: uint64(s.sdpID), SessionVersion: uint64(version), Connection: *connection},
+        Name:       "S1 Call Generator",
+        Connection: connection,
+        Media:      []*sdp.Media{audio},
+    }
+}
+
+// telephoneEvents are offered after the audio codecs for RFC 4733 DTMF, one
+// from payload type 101 up for each clock rate of the codecs, as the events
+// must run on the clock of the audio they are sent with: 8000 for G.711, 48000
+// for Opus.
+func telephoneEvents(codecs []media.Codec) []sdp.Codec {
+    var events []sdp.Codec
+    seen := map[int]bool{}
+    for _, codec := range codecs {
+        if seen[codec.ClockRate()] {
+            continue
+        }
+        seen[codec.ClockRate()] = true
+        events = append(events, sdp.Codec{
+            PayloadType: uint8(101 + len(events)),
+            Name:        sdp.TelephoneEvent,
+            ClockRate:   codec.ClockRate(),
+            Channels:    1,
+            Fmtp:        "0-16",
+        })
+    }
+    return events
+}
+
+// setMedia records the outcome of an offer/answer exchange on the call and
+// points its stream at it.
+func (s *session) setMedia(negotiated *sdp.Result) {
+    s.mu.Lock()
+    s.call.Codec = negotiated.Codec.String()
+    s.call.RemoteMedia = ""
+    if negotiated.Addr != nil {
+        s.call.RemoteMedia = negotiated.Addr.String()
+    }
+    s.mu.Unlock()
+
+    s.stream.update(negotiated)
+}
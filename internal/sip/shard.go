@@ -0,0 +1,83 @@
+package sip
+
+import (
+    "net"
+    "sync"
+
+    "github.com/s1-callgen/internal/sip/message"
+)
+
+// shard is one of the client's sockets together with the calls hashed to it.
+// Calls are spread over shards by Call-ID, so sends, receives and table
+// lookups for different calls rarely wait on each other.
+type shard struct {
+    client *Client
+
+    connMu     sync.Mutex
+    localPort  int
+    conn       net.Conn     // TCP and TLS
+    packetConn *net.UDPConn // UDP
+
+    mu           sync.Mutex
+    publicIP     string // our address as seen by S2, learned from Via
+    publicPort   int
+    sessions     map[string]*session
+    transactions map[string]transaction
+    responses    map[string]*message.Response
+}
+
+func newShard(c *Client) *shard {
+    return &shard{
+        client:       c,
+        localPort:    c.localPort,
+        sessions:     make(map[string]*session),
+        transactions: make(map[string]transaction),
+        responses:    make(map[string]*message.Response),
+    }
+}
+
+// SetSockets sets how many sockets the client spreads calls over, each with
+// its own source port and receive goroutine. It must be called before
+// Connect; for UDP the listen port range needs a free port per socket.
+func (c *Client) SetSockets(n int) {
+    c.shards = make([]*shard, max(n, 1))
+    for i := range c.shards {
+        c.shards[i] = newShard(c)
+    }
+}
+
+// shardFor returns the shard a call belongs to, by FNV-1a hash of its
+// Call-ID.
+func (c *Client) shardFor(callID string) *shard {
+    if len(c.shards) == 1 {
+        return c.shards[0]
+    }
+
+    hash := uint32(2166136261)
+    for i := 0; i < len(callID); i++ {
+        hash ^= uint32(callID[i])
+        hash *= 16777619
+    }
+    return c.shards[hash%uint32(len(c.shards))]
+}
+
+func (c *Client) removeTransaction(callID, key string) {
+    sh := c.shardFor(callID)
+    sh.mu.Lock()
+    delete(sh.transactions, key)
+    sh.mu.Unlock()
+}
+
+func (sh *shard) close() {
+    sh.connMu.Lock()
+    defer sh.connMu.Unlock()
+
+    if sh.conn != nil {
+        sh.conn.Close()
+        sh.conn = nil
+    }
+    if sh.packetConn != nil {
+        sh.packetConn.Close()
+        sh.packetConn = nil
+    }
+}
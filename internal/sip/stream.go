@@ -0,0 +1,305 @@
+package sip
+
+import (
+    "encoding/binary"
+    "errors"
+    "log"
+    "math/rand"
+    "net"
+    "os"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "time"
+
+    "github.com/s1-callgen/internal/media"
+    "github.com/s1-callgen/internal/sip/sdp"
+)
+
+// Audio is sent in packets of one media frame each.
+const packetInterval = media.FrameDuration * time.Millisecond
+
+// rtpPortPool hands out the even RTP ports 10000-19998, RTCP taking the odd
+// port above each. It is shared by all clients so that calls to different
+// targets never reserve the same port.
+var rtpPortPool = sync.OnceValue(func() chan int {
+    ports := make(chan int, 5000)
+    for port := 10000; port < 20000; port += 2 {
+        ports <- port
+    }
+    return ports
+})
+
+// rtpStream sends a call's audio, a prompt or silence, from its reserved RTP
+// port, and receives what S2 sends to it. Reports are exchanged over RTCP on
+// the next port up.
+type rtpStream struct {
+    conn  *net.UDPConn
+    rtcp  *net.UDPConn
+    cname string
+    epoch time.Time // origin of arrival times for the jitter
+
+    mu        sync.Mutex
+    remote    *sdp.Result
+    codec     media.Codec   // encodes for remote.Codec, nil when unsupported
+    decoder   media.Codec   // decodes remote.Codec, for the media checks
+    player    *media.Player // audio sent, silence when nil; set before start
+    started   bool
+    tones     []byte    // DTMF events waiting to be sent
+    tone      *dtmfTone // event being sent
+    pause     int       // audio packets before the next event
+    sequence  uint16
+    timestamp uint32
+    ssrc      uint32
+    octets    uint64 // payload sent, for sender reports
+    reception reception
+
+    // Liveness of S2's media, for the media checks
+    startedAt      time.Time
+    closedAt       time.Time
+    firstArrival   time.Time
+    audibleAt      time.Time // of the last audible packet
+    longestSilence time.Duration
+    ssrcChanges    int
+    unexpectedSSRC int  // changes without a new offer or answer
+    newSource      bool // set by a new offer or answer
+    remoteReports  int  // RTCP reports from S2
+    reportsOnUs    int  // report blocks from S2 on our stream
+
+    stop     chan struct{}
+    done     chan struct{}
+    stopOnce sync.Once
+    sent     atomic.Uint64
+    received atomic.Uint64
+    capture  atomic.Pointer[streamCapture] // nil when the call is not captured
+}
+
+// openRTPStream binds the RTP socket and the RTCP one above it, on every
+// interface when ip is empty. Nothing is sent until start.
+func openRTPStream(ip string, port int) (*rtpStream, error) {
+    conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP(ip), Port: port})
+    if err != nil {
+        return nil, err
+    }
+    rtcp, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP(ip), Port: port + 1})
+    if err != nil {
+        conn.Close()
+        return nil, err
+    }
+
+    host := ip
+    if host == "" {
+        host, _ = os.Hostname()
+    }
+    s := &rtpStream{
+        conn:      conn,
+        rtcp:      rtcp,
+        cname:     "s1@" + host,
+        epoch:     time.Now(),
+        sequence:  uint16(rand.Intn(65536)),
+        timestamp: rand.Uint32(),
+        ssrc:      rand.Uint32(),
+        stop:      make(chan struct{}),
+        done:      make(chan struct{}),
+    }
+    go s.receive()
+    go s.receiveRTCP()
+    return s, nil
+}
+
+// start sends packets to S2 every 20 ms, and reports every few seconds,
+// until the stream is closed.
+func (s *rtpStream) start(remote *sdp.Result) {
+    s.mu.Lock()
+    s.answered(remote, time.Now())
+    s.mu.Unlock()
+    go s.send()
+}
+
+// answered takes the media parameters of the answer, from which on S2's
+// media is checked. S2 may send from a new source once answered, as when
+// its early media came from an announcement server. Called with s.mu held.
+func (s *rtpStream) answered(remote *sdp.Result, now time.Time) {
+    s.setRemote(remote)
+    s.started = true
+    s.startedAt = now
+    s.audibleAt = now
+    s.newSource = true
+}
+
+// update points the stream at new media parameters, as negotiated by a
+// re-INVITE or UPDATE from S2.
+func (s *rtpStream) update(remote *sdp.Result) {
+    s.mu.Lock()
+    s.setRemote(remote)
+    s.newSource = true
+    s.mu.Unlock()
+}
+
+// setRemote takes new media parameters, switching encoder when the codec
+// changes. Called with s.mu held.
+func (s *rtpStream) setRemote(remote *sdp.Result) {
+    s.remote = remote
+    if s.codec != nil && strings.EqualFold(s.codec.Name(), remote.Codec.Name) {
+        return
+    }
+    codec, err := media.New(remote.Codec.Name)
+    if err != nil {
+        log.Printf("[SIP] Not sending RTP: %v", err)
+    }
+    s.codec = codec
+    s.decoder, _ = media.New(remote.Codec.Name)
+}
+
+func (s *rtpStream) send() {
+    defer close(s.done)
+    ticker := time.NewTicker(packetInterval)
+    defer ticker.Stop()
+    nextReport := time.Now().Add(nextReportInterval() / 2)
+
+    for {
+        var now time.Time
+        select {
+        case now = <-ticker.C:
+        case <-s.stop:
+            return
+        }
+
+        if now.After(nextReport) {
+            s.sendReport(false)
+            nextReport = now.Add(nextReportInterval())
+        }
+
+        s.mu.Lock()
+        remote := s.remote
+        packet := s.nextPacket()
+        s.mu.Unlock()
+
+        if packet == nil {
+            continue
+        }
+        if _, err := s.conn.WriteToUDP(packet, remote.Addr); err == nil {
+            s.sent.Add(1)
+            s.captureRTP(packet, remote.Addr, true)
+        }
+    }
+}
+
+// nextPacket returns the packet due this tick, a telephone event or a frame
+// of audio, or nil when nothing is sent to S2. The timestamp advances also
+// while on hold, as the media clock keeps running (RFC 3550 section 5.1).
+// Called with s.mu held.
+func (s *rtpStream) nextPacket() []byte {
+    remote, codec := s.remote, s.codec
+    if codec == nil {
+        return nil
+    }
+    var packet []byte
+    if remote.Sends() {
+        if packet = s.eventPacket(remote); packet == nil {
+            packet = createRTPPacket(remote.Codec.PayloadType, s.sequence, s.timestamp, s.ssrc, s.frame(codec))
+        }
+        s.sequence++
+        s.octets += uint64(len(packet) - 12)
+    }
+    s.timestamp += media.FrameTicks(codec)
+    return packet
+}
+
+// frame returns the next frame of audio, encoded by the codec. Called with
+// s.mu held.
+func (s *rtpStream) frame(codec media.Codec) []byte {
+    if s.player == nil {
+        return media.Silence(codec)
+    }
+    return codec.Encode(s.player.Next(codec.SampleRate()))
+}
+
+// receive reads the packets S2 sends until the socket is closed.
+func (s *rtpStream) receive() {
+    buffer := make([]byte, 1500)
+    for {
+        n, from, err := s.conn.ReadFromUDP(buffer)
+        if err != nil {
+            if errors.Is(err, net.ErrClosed) {
+                return
+            }
+            log.Printf("[SIP] Error reading RTP: %v", err)
+            continue
+        }
+        s.captureRTP(buffer[:n], from, false)
+        if n < 12 || buffer[0]>>6 != 2 {
+            continue
+        }
+        s.received.Add(1)
+
+        // Arrival times are in units of the RTP clock of S2's audio
+        s.mu.Lock()
+        clockRate := 8000
+        if s.remote != nil {
+            clockRate = s.remote.Codec.ClockRate
+        }
+        now := time.Now()
+        arrival := int64(now.Sub(s.epoch)) * int64(clockRate) / int64(time.Second)
+        if s.started {
+            s.observe(binary.BigEndian.Uint32(buffer[8:12]), buffer[1]&0x7f, rtpPayload(buffer[:n]), now)
+        }
+        s.reception.update(binary.BigEndian.Uint32(buffer[8:12]), binary.BigEndian.Uint16(buffer[2:4]), binary.BigEndian.Uint32(buffer[4:8]), arrival)
+        s.mu.Unlock()
+    }
+}
+
+// rtpPayload returns the payload of an RTP packet, after any CSRC list and
+// header extension and before any padding.
+func rtpPayload(packet []byte) []byte {
+    offset := 12 + 4*int(packet[0]&0x0f)
+    if packet[0]&0x10 != 0 && len(packet) >= offset+4 {
+        offset += 4 + 4*int(binary.BigEndian.Uint16(packet[offset+2:]))
+    }
+    end := len(packet)
+    if packet[0]&0x20 != 0 {
+        end -= int(packet[end-1])
+    }
+    if offset > end {
+        return nil
+    }
+    return packet[offset:end]
+}
+
+// streamQuality is what a stream measured of the media S2 sent.
+type streamQuality struct {
+    expected uint64
+    received uint64
+    lost     int64
+    jitter   time.Duration
+    rtt      time.Duration // 0 when S2 sent no reports on our stream
+}
+
+func (s *rtpStream) quality() streamQuality {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    r := &s.reception
+    q := streamQuality{expected: r.expected(), received: r.received, lost: max(r.lost(), 0), rtt: r.rtt}
+    if s.remote != nil && s.remote.Codec.ClockRate > 0 {
+        q.jitter = time.Duration(r.jitter * float64(time.Second) / float64(s.remote.Codec.ClockRate))
+    }
+    return q
+}
+
+// close stops sending, says goodbye over RTCP and releases the ports.
+func (s *rtpStream) close() {
+    s.stopOnce.Do(func() {
+        close(s.stop)
+        s.mu.Lock()
+        started := s.started
+        s.closedAt = time.Now()
+        s.mu.Unlock()
+        if started {
+            <-s.done
+            s.sendReport(true)
+        }
+        s.conn.Close()
+        s.rtcp.Close()
+    })
+}
@@ -0,0 +1,209 @@
+package sip
+
+import (
+    "bytes"
+    "encoding/binary"
+    "net"
+    "testing"
+    "time"
+
+    "github.com/s1-callgen/internal/sip/sdp"
+)
+
+// openTestStream opens a stream on the loopback interface, on ports taken
+// from the pool and returned when the test ends.
+func openTestStream(t *testing.T) *rtpStream {
+    t.Helper()
+    pool := rtpPortPool()
+    for i := 0; i < 10; i++ {
+        port := <-pool
+        s, err := openRTPStream("127.0.0.1", port)
+        if err != nil {
+            pool <- port
+            continue
+        }
+        t.Cleanup(func() {
+            s.close()
+            pool <- port
+        })
+        return s
+    }
+    t.Fatal("no free RTP ports")
+    return nil
+}
+
+// listenPeer binds S2's RTP socket and the RTCP one above it on the
+// loopback interface, on ports taken from the pool.
+func listenPeer(t *testing.T) (rtp, rtcp *net.UDPConn) {
+    t.Helper()
+    pool := rtpPortPool()
+    for i := 0; i < 10; i++ {
+        port := <-pool
+        rtp, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port})
+        if err != nil {
+            pool <- port
+            continue
+        }
+        rtcp, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port + 1})
+        if err != nil {
+            rtp.Close()
+            pool <- port
+            continue
+        }
+        t.Cleanup(func() {
+            rtp.Close()
+            rtcp.Close()
+            pool <- port
+        })
+        return rtp, rtcp
+    }
+    t.Fatal("no free RTP ports")
+    return nil, nil
+}
+
+// readPacket reads a packet from conn, failing the test after a second.
+func readPacket(t *testing.T, conn *net.UDPConn) []byte {
+    t.Helper()
+    conn.SetReadDeadline(time.Now().Add(time.Second))
+    buffer := make([]byte, 1500)
+    n, err := conn.Read(buffer)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return buffer[:n]
+}
+
+func TestStreamSends(t *testing.T) {
+    peer, peerRTCP := listenPeer(t)
+
+    s := openTestStream(t)
+    s.start(&sdp.Result{
+        Codec:     sdp.Codec{PayloadType: 8, Name: "PCMA", ClockRate: 8000, Channels: 1},
+        Addr:      peer.LocalAddr().(*net.UDPAddr),
+        Direction: sdp.SendRecv,
+    })
+
+    started := time.Now()
+    var first rtpHeader
+    for i := 0; i < 10; i++ {
+        packet := readPacket(t, peer)
+        h := parseRTPHeader(t, packet)
+        if i == 0 {
+            first = h
+        }
+        if h.payloadType != 8 || h.ssrc != first.ssrc || h.sequence != first.sequence+uint16(i) || h.timestamp != first.timestamp+uint32(160*i) {
+            t.Errorf("packet %d: %+v, want PCMA %d at %d from %#x", i, h, first.sequence+uint16(i), first.timestamp+uint32(160*i), first.ssrc)
+        }
+        if payload := packet[12:]; !bytes.Equal(payload, bytes.Repeat([]byte{0xd5}, 160)) {
+            t.Errorf("packet %d: payload %x, want A-law silence", i, payload)
+        }
+    }
+    // Ten packets 20 ms apart take about 200 ms, leaving room for a slow
+    // machine
+    if elapsed := time.Since(started); elapsed < 150*time.Millisecond || elapsed > 600*time.Millisecond {
+        t.Errorf("10 packets in %v, want about 200 ms", elapsed)
+    }
+
+    // Closing says goodbye over RTCP with a report on what was sent
+    s.close()
+    report := readPacket(t, peerRTCP)
+    if len(report) < 28 || report[1] != rtcpSR || binary.BigEndian.Uint32(report[4:]) != first.ssrc {
+        t.Fatalf("got %x, want a sender report from %#x", report, first.ssrc)
+    }
+    if sent := binary.BigEndian.Uint32(report[20:]); uint64(sent) != s.sent.Load() || sent < 10 {
+        t.Errorf("report of %d packets sent, want %d", sent, s.sent.Load())
+    }
+    if !bytes.Contains(report, []byte(s.cname)) || report[len(report)-7] != rtcpBYE {
+        t.Errorf("got %x, want the CNAME %s and a BYE", report, s.cname)
+    }
+}
+
+func TestStreamReceives(t *testing.T) {
+    s := openTestStream(t)
+    s.start(&sdp.Result{
+        Codec:     sdp.Codec{PayloadType: 0, Name: "PCMU", ClockRate: 8000, Channels: 1},
+        Addr:      &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9}, // discard
+        Direction: sdp.SendRecv,
+    })
+
+    peer, err := net.DialUDP("udp", nil, s.conn.LocalAddr().(*net.UDPAddr))
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer peer.Close()
+
+    // 50 packets from 65520 with 5 lost, one duplicated and one reordered,
+    // and a datagram that is not RTP
+    var sequences []uint16
+    for i := 0; i < 50; i++ {
+        if i%10 == 3 {
+            continue
+        }
+        sequences = append(sequences, uint16(65520+i))
+    }
+    sequences = append(sequences, sequences[len(sequences)-1])
+    sequences[10], sequences[11] = sequences[11], sequences[10]
+    for _, seq := range sequences {
+        peer.Write(createRTPPacket(0, seq, uint32(seq)*160, 0xabcd, bytes.Repeat([]byte{0xff}, 160)))
+    }
+    peer.Write([]byte("not RTP at all"))
+
+    deadline := time.Now().Add(time.Second)
+    for s.received.Load() < uint64(len(sequences)) && time.Now().Before(deadline) {
+        time.Sleep(5 * time.Millisecond)
+    }
+    if got := s.received.Load(); got != uint64(len(sequences)) {
+        t.Fatalf("received %d packets, want %d", got, len(sequences))
+    }
+    q := s.quality()
+    if q.expected != 50 || q.received != 46 || q.lost != 4 {
+        t.Errorf("expected %d, received %d, lost %d; want 50, 46 and 4", q.expected, q.received, q.lost)
+    }
+}
+
+func TestRTPPayload(t *testing.T) {
+    payload := []byte("payload")
+    tests := []struct {
+        name   string
+        packet []byte
+        want   []byte
+    }{
+        {
+            name:   "plain",
+            packet: append([]byte{0x80, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 1}, payload...),
+            want:   payload,
+        },
+        {
+            name:   "two CSRCs",
+            packet: append([]byte{0x82, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 1, 0, 0, 0, 2, 0, 0, 0, 3}, payload...),
+            want:   payload,
+        },
+        {
+            name:   "header extension",
+            packet: append([]byte{0x90, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 1, 0xbe, 0xde, 0, 1, 0x10, 0xff, 0, 0}, payload...),
+            want:   payload,
+        },
+        {
+            name:   "padding",
+            packet: append(append([]byte{0xa0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 1}, payload...), 0, 0, 3),
+            want:   payload,
+        },
+        {
+            name:   "CSRCs past the end",
+            packet: []byte{0x8f, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 1, 0, 0, 0, 2},
+            want:   nil,
+        },
+        {
+            name:   "padding past the payload",
+            packet: append(append([]byte{0xa0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 1}, payload...), 200),
+            want:   nil,
+        },
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            if got := rtpPayload(tt.packet); !bytes.Equal(got, tt.want) {
+                t.Errorf("got %q, want %q", got, tt.want)
+            }
+        })
+    }
+}
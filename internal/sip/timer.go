@@ -0,0 +1,397 @@
+package sip
+
+import (
+    "errors"
+    "fmt"
+    "log"
+    "math/rand"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/s1-callgen/internal/sip/message"
+    "github.com/s1-callgen/internal/sip/sdp"
+)
+
+// Session timers (RFC 4028) keep a call alive through switches that drop
+// sessions not refreshed within the Session-Expires interval. The refresher
+// sends a re-INVITE or UPDATE every half interval; the other side hangs up
+// when no refresh came shortly before the interval ends.
+
+// SessionTimers configures the session timer requested in INVITEs. A zero
+// Expires requests none, though a timer S2 starts is still honored.
+type SessionTimers struct {
+    Expires   int    // seconds, the Session-Expires asked for
+    MinSE     int    // seconds, the smallest interval we accept
+    Refresher string // uac for us, uas for S2, or "" to leave it to S2
+    UseUpdate bool   // refresh with UPDATE, else re-INVITE
+}
+
+// minSessionExpires is the smallest Min-SE allowed (RFC 4028 section 4).
+const minSessionExpires = 90
+
+// maxIntervalRetries bounds how often a request is resent with the longer
+// interval asked for by a 422 (Session Interval Too Small) or a 423
+// (Interval Too Brief).
+const maxIntervalRetries = 2
+
+// refreshRetry is how long a refresh that failed without ending the dialog,
+// as on a 491 or 500, waits before it is tried again.
+const refreshRetry = 5 * time.Second
+
+// ErrSessionExpired is returned when a call's session timer ran out: S2 did
+// not refresh it in time, or rejected our refresh as if the dialog were gone.
+var ErrSessionExpired = errors.New("sip: session expired")
+
+// SetSessionTimers sets the session timer requested for calls.
+func (c *Client) SetSessionTimers(timers SessionTimers) {
+    c.timers = timers
+}
+
+// sessionTimer is the session timer of a call. Guarded by session.mu.
+type sessionTimer struct {
+    interval  int  // seconds, 0 while the call has none
+    refresher bool // whether we refresh, else S2 does
+    minSE     int  // seconds, our Min-SE, raised by 422 responses
+    refreshed time.Time
+    noUpdate  bool // S2 rejected UPDATE, so refreshes are re-INVITEs
+}
+
+// setSessionTimer starts the session timer over with an interval and
+// refresher, as negotiated by a request or response, and wakes the timer
+// loop.
+func (s *session) setSessionTimer(interval int, refresher bool) {
+    s.mu.Lock()
+    s.timer.interval = interval
+    s.timer.refresher = refresher
+    s.timer.refreshed = time.Now()
+    s.mu.Unlock()
+
+    select {
+    case s.timerReset <- struct{}{}:
+    default:
+    }
+}
+
+// addTimerHeaders adds the headers of a request asking for a session
+// timer: Supported, Session-Expires with the refresher if one is wanted,
+// and Min-SE.
+func addTimerHeaders(req *message.Request, interval, minSE int, refresher string) {
+    value := strconv.Itoa(interval)
+    if refresher != "" {
+        value += ";refresher=" + refresher
+    }
+    req.Header.Add("Supported", "timer")
+    req.Header.Add("Session-Expires", value)
+    req.Header.Add("Min-SE", strconv.Itoa(minSE))
+}
+
+// parseSessionExpires parses a Session-Expires value such as
+// "1800;refresher=uac" into the interval in seconds and the refresher.
+func parseSessionExpires(value string) (int, string, bool) {
+    delta, params, _ := strings.Cut(value, ";")
+    interval, err := strconv.Atoi(strings.TrimSpace(delta))
+    if err != nil || interval <= 0 {
+        return 0, "", false
+    }
+    refresher := ""
+    for _, param := range strings.Split(params, ";") {
+        name, v, _ := strings.Cut(param, "=")
+        if strings.EqualFold(strings.TrimSpace(name), "refresher") {
+            refresher = strings.ToLower(strings.TrimSpace(v))
+        }
+    }
+    return interval, refresher, true
+}
+
+// retryTooSmall builds the INVITE to send again after a 422 Session
+// Interval Too Small, asking for at least the Min-SE of the response, with
+// a new branch and CSeq. It returns nil when the response gives no larger
+// interval to ask for.
+func retryTooSmall(sess *session, invite *message.Request, resp *message.Response, branch string) *message.Request {
+    minSE, err := strconv.Atoi(strings.TrimSpace(resp.Header.Get("Min-SE")))
+    interval, refresher, ok := parseSessionExpires(invite.Header.Get("Session-Expires"))
+    if err != nil || !ok || minSE <= interval {
+        return nil
+    }
+
+    via, err := invite.Header.Via()
+    if err != nil {
+        return nil
+    }
+    via.Params.Set("branch", branch)
+    seq, method, err := invite.Header.CSeq()
+    if err != nil {
+        return nil
+    }
+
+    sess.mu.Lock()
+    sess.timer.minSE = minSE
+    sess.mu.Unlock()
+
+    retry := &message.Request{
+        Method: invite.Method,
+        URI:    invite.URI,
+        Header: invite.Header.Clone(),
+        Body:   invite.Body,
+    }
+    retry.Header.Set("Via", via.String())
+    retry.Header.Set("CSeq", fmt.Sprintf("%d %s", seq+1, method))
+    retry.Header.Del("Supported")
+    retry.Header.Del("Session-Expires")
+    retry.Header.Del("Min-SE")
+    addTimerHeaders(retry, minSE, minSE, refresher)
+    return retry
+}
+
+// startSessionTimer starts the session timer a 2xx to our INVITE or refresh
+// negotiated. Without a Session-Expires in it the call has no session timer
+// (RFC 4028 section 7.2).
+func (sess *session) startSessionTimer(resp *message.Response) {
+    interval, refresher, ok := parseSessionExpires(resp.Header.Get("Session-Expires"))
+    if !ok {
+        sess.setSessionTimer(0, false)
+        return
+    }
+    sess.mu.Lock()
+    sess.call.SessionExpires = interval
+    sess.mu.Unlock()
+    sess.setSessionTimer(interval, refresher != "uas")
+}
+
+// sessionIntervalTooSmall returns the 422 response refusing a re-INVITE or
+// UPDATE from S2 whose Session-Expires is below our Min-SE, or nil when the
+// interval is acceptable.
+func (c *Client) sessionIntervalTooSmall(sess *session, req *message.Request) *message.Response {
+    sess.mu.Lock()
+    minSE := sess.timer.minSE
+    sess.mu.Unlock()
+
+    interval, _, ok := parseSessionExpires(req.Header.Get("Session-Expires"))
+    if !ok || interval >= minSE {
+        return nil
+    }
+    resp := c.newResponse(req, 422, "Session Interval Too Small")
+    resp.Header.Add("Min-SE", strconv.Itoa(minSE))
+    return resp
+}
+
+// answerSessionTimer adds the session timer headers to our 2xx to a
+// re-INVITE or UPDATE from S2, which refreshes the session, and starts the
+// timer over. S2 is the UAC of its request, so refresher=uac means S2
+// refreshes (RFC 4028 section 9).
+func (c *Client) answerSessionTimer(sess *session, req *message.Request, resp *message.Response) {
+    sess.mu.Lock()
+    current := sess.timer.interval
+    sess.mu.Unlock()
+
+    interval, refresher, ok := parseSessionExpires(req.Header.Get("Session-Expires"))
+    switch {
+    case ok && refresher == "":
+        refresher = "uas"
+        if supportsTimer(req) {
+            refresher = "uac"
+        }
+    case !ok && current > 0:
+        // S2 left the timer out; we keep the session alive ourselves
+        interval, refresher = current, "uas"
+    case !ok:
+        return
+    }
+
+    resp.Header.Add("Supported", "timer")
+    if supportsTimer(req) {
+        resp.Header.Add("Require", "timer")
+    }
+    resp.Header.Add("Session-Expires", fmt.Sprintf("%d;refresher=%s", interval, refresher))
+    sess.mu.Lock()
+    sess.call.SessionExpires = interval
+    sess.mu.Unlock()
+    sess.setSessionTimer(interval, refresher == "uas")
+}
+
+// supportsTimer reports whether a request lists the timer extension in
+// Supported.
+func supportsTimer(req *message.Request) bool {
+    for _, value := range req.Header.Values("Supported") {
+        for _, option := range message.SplitList(value) {
+            if strings.EqualFold(strings.TrimSpace(option), "timer") {
+                return true
+            }
+        }
+    }
+    return false
+}
+
+// runSessionTimer runs a call's session timer until stop is closed. As the
+// refresher it refreshes the session every half interval; otherwise it waits
+// for S2's refreshes. expired is closed when the session ends for want of a
+// refresh.
+func (c *Client) runSessionTimer(sess *session, dialog *Dialog, stop <-chan struct{}, expired chan<- struct{}) {
+    callID := sess.call.SIPCallID
+    for {
+        sess.mu.Lock()
+        t := sess.timer
+        sess.mu.Unlock()
+
+        // With no timer only a request from S2 can start one
+        var wait <-chan time.Time
+        if t.interval > 0 {
+            interval := time.Duration(t.interval) * time.Second
+            due := t.refreshed.Add(interval / 2)
+            if !t.refresher {
+                // S2's refresh is late from min(32 s, interval/3) before the
+                // interval ends (RFC 4028 section 10)
+                due = t.refreshed.Add(interval - min(32*time.Second, interval/3))
+            }
+            wait = time.After(time.Until(due))
+        }
+
+        select {
+        case <-wait:
+        case <-sess.timerReset:
+            continue
+        case <-stop:
+            return
+        }
+
+        if !t.refresher {
+            log.Printf("[SIP] Call %s: S2 did not refresh the session within %d s", callID, t.interval)
+            close(expired)
+            return
+        }
+
+        err := c.refreshSession(sess, dialog)
+        for err != nil && !errors.Is(err, ErrSessionExpired) {
+            log.Printf("[SIP] Call %s: Session refresh failed: %v", callID, err)
+            deadline := t.refreshed.Add(time.Duration(t.interval) * time.Second)
+            if time.Now().Add(refreshRetry).After(deadline) {
+                err = ErrSessionExpired
+                break
+            }
+            select {
+            case <-time.After(refreshRetry + time.Duration(rand.Int63n(int64(time.Second)))):
+            case <-stop:
+                return
+            }
+            err = c.refreshSession(sess, dialog)
+        }
+        if err != nil {
+            log.Printf("[SIP] Call %s: Session refresh failed: %v", callID, err)
+            close(expired)
+            return
+        }
+    }
+}
+
+// refreshSession sends a session refresh, UPDATE or re-INVITE, and applies
+// the session timer of its 2xx. A 422 raises the interval asked for, and a
+// switch that does not allow UPDATE gets a re-INVITE. A 408 or 481, or no
+// response at all, means the dialog is gone and returns ErrSessionExpired
+// (RFC 4028 section 10).
+func (c *Client) refreshSession(sess *session, dialog *Dialog) error {
+    callID := sess.call.SIPCallID
+    for attempt := 0; ; attempt++ {
+        sess.mu.Lock()
+        t := sess.timer
+        sess.mu.Unlock()
+
+        method := "INVITE"
+        if c.timers.UseUpdate && !t.noUpdate {
+            method = "UPDATE"
+        }
+        req := dialog.NewRequest(method, c.newVia(callID, c.generateBranch()))
+        req.Header.Add("Contact", c.contact(sess.call).String())
+        req.Header.Add("Allow", allowedMethods)
+        req.Header.Add("User-Agent", userAgent)
+        addTimerHeaders(req, t.interval, t.minSE, "uac")
+
+        var resp *message.Response
+        var err error
+        if method == "UPDATE" {
+            resp, err = c.request(callID, req)
+        } else {
+            resp, err = c.reinvite(sess, dialog, req)
+        }
+        if err != nil {
+            return fmt.Errorf("%w: %v", ErrSessionExpired, err)
+        }
+
+        switch {
+        case resp.StatusCode >= 200 && resp.StatusCode < 300:
+            dialog.refreshTarget(resp.Header)
+            sess.startSessionTimer(resp)
+            sess.mu.Lock()
+            sess.call.SessionRefreshes++
+            sess.mu.Unlock()
+            log.Printf("[SIP] Call %s: Session refreshed with %s", callID, method)
+            return nil
+
+        case resp.StatusCode == 422 && attempt < maxIntervalRetries:
+            minSE, err := strconv.Atoi(strings.TrimSpace(resp.Header.Get("Min-SE")))
+            if err != nil || minSE <= t.interval {
+                return fmt.Errorf("sip: %s answered with 422 %s", method, resp.Reason)
+            }
+            sess.mu.Lock()
+            sess.timer.interval = minSE
+            sess.timer.minSE = minSE
+            sess.mu.Unlock()
+
+        case (resp.StatusCode == 405 || resp.StatusCode == 501) && method == "UPDATE":
+            sess.mu.Lock()
+            sess.timer.noUpdate = true
+            sess.mu.Unlock()
+
+        case resp.StatusCode == 408 || resp.StatusCode == 481:
+            return fmt.Errorf("%w: %s answered with %d %s", ErrSessionExpired, method, resp.StatusCode, resp.Reason)
+
+        default:
+            return fmt.Errorf("sip: %s answered with %d %s", method, resp.StatusCode, resp.Reason)
+        }
+    }
+}
+
+// reinvite runs a re-INVITE carrying a new offer of our session, acknowledges
+// its 2xx and applies S2's answer.
+func (c *Client) reinvite(sess *session, dialog *Dialog, req *message.Request) (*message.Response, error) {
+    offer := c.localSDP(sess)
+    sess.mu.Lock()
+    sess.offer = offer
+    sess.mu.Unlock()
+    req.Header.Add("Content-Type", "application/sdp")
+    req.Body = offer.Bytes()
+
+    tx, err := c.startINVITE(sess, req, false)
+    if err != nil {
+        return nil, err
+    }
+    result := <-tx.result
+    if result.err != nil {
+        return nil, result.err
+    }
+    resp := result.response
+    if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+        return resp, nil
+    }
+
+    ack := dialog.NewACK(c.newVia(sess.call.SIPCallID, c.generateBranch()))
+    sess.mu.Lock()
+    sess.ack = ack
+    sess.offer = nil
+    sess.mu.Unlock()
+    if err := c.sendMessage(ack); err != nil {
+        log.Printf("[SIP] Call %s: ACK failed: %v", sess.call.SIPCallID, err)
+    }
+
+    answer, err := sdp.Parse(resp.Body)
+    var negotiated *sdp.Result
+    if err == nil {
+        negotiated, err = sdp.Match(offer, answer)
+    }
+    if err != nil {
+        log.Printf("[SIP] Call %s: Cannot use answer to re-INVITE: %v", sess.call.SIPCallID, err)
+    } else {
+        sess.setMedia(negotiated)
+    }
+    return resp, nil
+}
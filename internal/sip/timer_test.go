@@ -0,0 +1,277 @@
+package sip
+
+import (
+    "context"
+    "errors"
+    "testing"
+    "time"
+
+    "github.com/s1-callgen/internal/models"
+    "github.com/s1-callgen/internal/sip/message"
+)
+
+// reinviteFromS2 is a re-INVITE from S2 with the given headers added.
+func reinviteFromS2(t *testing.T, headers ...string) *message.Request {
+    t.Helper()
+    req := parseRequest(t, `INVITE sip:100@10.0.0.1:5060 SIP/2.0
+Via: SIP/2.0/UDP 10.0.0.2:5060;branch=z9hG4bKs2
+From: <sip:200@s2.example.com>;tag=b
+To: <sip:100@s1.example.com>;tag=a
+Call-ID: timer@s1
+CSeq: 2 INVITE
+Content-Length: 0
+
+`)
+    for i := 0; i+1 < len(headers); i += 2 {
+        req.Header.Add(headers[i], headers[i+1])
+    }
+    return req
+}
+
+func TestStartSessionTimer(t *testing.T) {
+    tests := []struct {
+        name           string
+        sessionExpires string
+        interval       int
+        refresher      bool
+    }{
+        {"we refresh", "1800;refresher=uac", 1800, true},
+        {"S2 refreshes", "1800;refresher=UAS", 1800, false},
+        {"refresher left to us", "600", 600, true},
+        {"no timer", "", 0, false},
+        {"invalid", "soon", 0, false},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            sess := newSession(&models.Call{}, 0)
+            resp := &message.Response{StatusCode: 200}
+            if tt.sessionExpires != "" {
+                resp.Header.Add("Session-Expires", tt.sessionExpires)
+            }
+            sess.startSessionTimer(resp)
+            if sess.timer.interval != tt.interval || sess.timer.refresher != tt.refresher {
+                t.Errorf("interval %d, refresher %v; want %d and %v", sess.timer.interval, sess.timer.refresher, tt.interval, tt.refresher)
+            }
+            select {
+            case <-sess.timerReset:
+            default:
+                t.Error("timer loop not woken")
+            }
+        })
+    }
+}
+
+func TestAnswerSessionTimer(t *testing.T) {
+    c, err := NewClient("10.0.0.1", 5060, "10.0.0.2", 5060)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    // S2 is the UAC of its re-INVITE, so refresher=uac in our 2xx means S2
+    // refreshes
+    tests := []struct {
+        name           string
+        headers        []string
+        current        int
+        sessionExpires string
+        require        bool
+        refresher      bool
+    }{
+        {
+            name:           "S2 refreshes",
+            headers:        []string{"Supported", "timer", "Session-Expires", "1800;refresher=uac"},
+            sessionExpires: "1800;refresher=uac",
+            require:        true,
+        },
+        {
+            name:           "S2 asks us to refresh",
+            headers:        []string{"Supported", "timer", "Session-Expires", "1800;refresher=uas"},
+            sessionExpires: "1800;refresher=uas",
+            require:        true,
+            refresher:      true,
+        },
+        {
+            name:           "refresher left to us, S2 supports timers",
+            headers:        []string{"Supported", "100rel, timer", "Session-Expires", "900"},
+            sessionExpires: "900;refresher=uac",
+            require:        true,
+        },
+        {
+            name:           "refresher left to us, S2 without timer support",
+            headers:        []string{"Session-Expires", "900"},
+            sessionExpires: "900;refresher=uas",
+            refresher:      true,
+        },
+        {
+            name:           "timer dropped by S2",
+            current:        1800,
+            sessionExpires: "1800;refresher=uas",
+            refresher:      true,
+        },
+        {
+            name: "no timer",
+        },
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            sess := newSession(&models.Call{}, 0)
+            sess.timer.interval = tt.current
+            req := reinviteFromS2(t, tt.headers...)
+            resp := c.newResponse(req, 200, "OK")
+            c.answerSessionTimer(sess, req, resp)
+
+            if got := resp.Header.Get("Session-Expires"); got != tt.sessionExpires {
+                t.Errorf("Session-Expires %q, want %q", got, tt.sessionExpires)
+            }
+            if got := resp.Header.Get("Require") == "timer"; got != tt.require {
+                t.Errorf("Require %q, want timer %v", resp.Header.Get("Require"), tt.require)
+            }
+            if tt.sessionExpires != "" && (sess.timer.refresher != tt.refresher || sess.call.SessionExpires != sess.timer.interval) {
+                t.Errorf("refresher %v with %d s on the call, want %v and %d s", sess.timer.refresher, sess.call.SessionExpires, tt.refresher, sess.timer.interval)
+            }
+        })
+    }
+}
+
+func TestSessionIntervalTooSmall(t *testing.T) {
+    c, err := NewClient("10.0.0.1", 5060, "10.0.0.2", 5060)
+    if err != nil {
+        t.Fatal(err)
+    }
+    sess := newSession(&models.Call{}, 0)
+    sess.timer.minSE = 300
+
+    if resp := c.sessionIntervalTooSmall(sess, reinviteFromS2(t, "Session-Expires", "120")); resp == nil || resp.StatusCode != 422 || resp.Header.Get("Min-SE") != "300" {
+        t.Errorf("got %v, want 422 with Min-SE 300", resp)
+    }
+    for _, value := range []string{"300", ""} {
+        if resp := c.sessionIntervalTooSmall(sess, reinviteFromS2(t, "Session-Expires", value)); resp != nil {
+            t.Errorf("Session-Expires %q refused with %d", value, resp.StatusCode)
+        }
+    }
+}
+
+func TestRetryTooSmall(t *testing.T) {
+    invite := parseRequest(t, `INVITE sip:200@s2.example.com SIP/2.0
+Via: SIP/2.0/UDP 10.0.0.1:5060;branch=z9hG4bK1;rport
+From: <sip:100@s1.example.com>;tag=a
+To: <sip:200@s2.example.com>
+Call-ID: timer@s1
+CSeq: 1 INVITE
+Supported: timer
+Session-Expires: 90;refresher=uac
+Min-SE: 90
+Content-Length: 0
+
+`)
+    sess := newSession(&models.Call{}, 0)
+    sess.timer.minSE = 90
+
+    tooSmall := message.NewResponse(invite, 422, "Session Interval Too Small")
+    tooSmall.Header.Add("Min-SE", "1800")
+    retry := retryTooSmall(sess, invite, tooSmall, "z9hG4bK2")
+    if retry == nil {
+        t.Fatal("no retry after 422 with Min-SE 1800")
+    }
+    if got := retry.Header.Get("Session-Expires"); got != "1800;refresher=uac" {
+        t.Errorf("Session-Expires %q, want 1800;refresher=uac", got)
+    }
+    if got := retry.Header.Get("Min-SE"); got != "1800" || sess.timer.minSE != 1800 {
+        t.Errorf("Min-SE %q and %d on the session, want 1800", got, sess.timer.minSE)
+    }
+    if seq, _, _ := retry.Header.CSeq(); seq != 2 {
+        t.Errorf("CSeq %d, want 2", seq)
+    }
+    if via, _ := retry.Header.Via(); via.Branch() != "z9hG4bK2" {
+        t.Errorf("branch %s, want z9hG4bK2", via.Branch())
+    }
+    if len(retry.Header.Values("Session-Expires")) != 1 || len(retry.Header.Values("Supported")) != 1 {
+        t.Errorf("timer headers repeated:\n%s", retry.Bytes())
+    }
+    if got := invite.Header.Get("Session-Expires"); got != "90;refresher=uac" {
+        t.Errorf("original INVITE changed to %q", got)
+    }
+
+    // A 422 asking for no more than was offered cannot be satisfied
+    tooSmall.Header.Set("Min-SE", "90")
+    if retry := retryTooSmall(sess, invite, tooSmall, "z9hG4bK3"); retry != nil {
+        t.Error("retried after 422 with the Min-SE offered")
+    }
+}
+
+// answerCall answers the INVITE of a call with a 2xx carrying the given
+// Session-Expires.
+func answerCall(peer *udpPeer, sessionExpires string) {
+    peer.t.Helper()
+    invite := peer.expect("INVITE", "")
+    resp := message.NewResponse(invite, 200, "OK")
+    resp.Header.Set("To", invite.Header.Get("To")+";tag=s2")
+    resp.Header.Add("Supported", "timer")
+    resp.Header.Add("Require", "timer")
+    resp.Header.Add("Session-Expires", sessionExpires)
+    peer.send(resp)
+}
+
+func TestSessionRefresh(t *testing.T) {
+    c, peer := newUDPPeer(t)
+    c.SetSessionTimers(SessionTimers{Expires: 90, MinSE: 90, UseUpdate: true})
+    done := make(chan callResult, 1)
+    go func() {
+        call, err := c.MakeCall(context.Background(), "100", "200", 2*time.Second, CallOptions{})
+        done <- callResult{call, err}
+    }()
+
+    // We refresh at half the interval S2 chose, and ask again for the
+    // interval a 422 wants
+    answerCall(peer, "2;refresher=uac")
+    answered := time.Now()
+    update := peer.expect("UPDATE", "ACK")
+    if since := time.Since(answered); since < 900*time.Millisecond || since > 1500*time.Millisecond {
+        t.Errorf("refresh after %v, want half of 2 s", since)
+    }
+    if got := update.Header.Get("Session-Expires"); got != "2;refresher=uac" {
+        t.Errorf("Session-Expires %q, want 2;refresher=uac", got)
+    }
+    tooSmall := message.NewResponse(update, 422, "Session Interval Too Small")
+    tooSmall.Header.Add("Min-SE", "120")
+    peer.send(tooSmall)
+
+    update = peer.expect("UPDATE", "")
+    if got, minSE := update.Header.Get("Session-Expires"), update.Header.Get("Min-SE"); got != "120;refresher=uac" || minSE != "120" {
+        t.Errorf("Session-Expires %q and Min-SE %q after 422, want 120;refresher=uac and 120", got, minSE)
+    }
+    ok := message.NewResponse(update, 200, "OK")
+    ok.Header.Add("Session-Expires", "120;refresher=uac")
+    peer.send(ok)
+
+    bye := peer.expect("BYE", "")
+    peer.respond(bye, 200, "OK")
+    result := callEnd(t, done, 2*time.Second)
+    if result.err != nil || result.call.Status != "COMPLETED" || result.call.SessionRefreshes != 1 || result.call.SessionExpires != 120 {
+        t.Errorf("got %v with status %s, %d refreshes of %d s; want COMPLETED after 1 refresh of 120 s", result.err, result.call.Status, result.call.SessionRefreshes, result.call.SessionExpires)
+    }
+}
+
+func TestSessionExpiry(t *testing.T) {
+    c, peer := newUDPPeer(t)
+    done := make(chan callResult, 1)
+    go func() {
+        call, err := c.MakeCall(context.Background(), "100", "200", 10*time.Second, CallOptions{})
+        done <- callResult{call, err}
+    }()
+
+    // S2 is to refresh and never does, so the call is hung up a third of the
+    // interval before it ends
+    answerCall(peer, "3;refresher=uas")
+    answered := time.Now()
+    bye := peer.expect("BYE", "ACK")
+    if since := time.Since(answered); since < 1900*time.Millisecond || since > 2500*time.Millisecond {
+        t.Errorf("BYE after %v, want 2 s", since)
+    }
+    peer.respond(bye, 200, "OK")
+
+    result := callEnd(t, done, time.Second)
+    if !errors.Is(result.err, ErrSessionExpired) || result.call.Status != "FAILED" {
+        t.Errorf("got %v with status %s, want ErrSessionExpired and FAILED", result.err, result.call.Status)
+    }
+}
@@ -0,0 +1,470 @@
+package sip
+
+import (
+    "errors"
+    "fmt"
+    "log"
+    "sync"
+    "time"
+
+    "github.com/s1-callgen/internal/models"
+    "github.com/s1-callgen/internal/sip/message"
+)
+
+// RFC 3261 timer values
+const (
+    T1 = 500 * time.Millisecond
+    T2 = 4 * time.Second
+    T4 = 5 * time.Second
+
+    timerC = 3 * time.Minute
+    timerD = 32 * time.Second
+)
+
+// transactionTimers are the timer values a client's transactions run with:
+// those of RFC 3261, or shorter ones in tests.
+type transactionTimers struct {
+    t1, t2, t4 time.Duration
+    c, d       time.Duration
+}
+
+var defaultTimers = transactionTimers{t1: T1, t2: T2, t4: T4, c: timerC, d: timerD}
+
+// b is 64*T1: Timer B and F, and how long a response is kept to answer
+// retransmissions.
+func (t transactionTimers) b() time.Duration {
+    return 64 * t.t1
+}
+
+// ErrTimeout is returned when S2 never sends a final response to an INVITE.
+var ErrTimeout = errors.New("sip: transaction timed out")
+
+// ErrCanceled is returned when a call was abandoned with CANCEL before it was
+// answered.
+var ErrCanceled = errors.New("sip: call canceled before answer")
+
+// ErrCodecMismatch is returned when S2 and the call share no audio codec.
+var ErrCodecMismatch = errors.New("sip: no common codec with S2")
+
+// ErrNoTransaction is returned by CancelCall when the call has no INVITE
+// still waiting for a final response.
+var ErrNoTransaction = errors.New("sip: no pending INVITE for call")
+
+// transaction is a client transaction that responses are routed to.
+type transaction interface {
+    deliver(resp *message.Response)
+}
+
+// transactionKey identifies a client transaction by the branch of the top Via
+// and the CSeq method (RFC 3261 section 17.1.3). A CANCEL shares its branch
+// with the INVITE it cancels, so the method is needed to tell them apart.
+func transactionKey(branch, method string) string {
+    return branch + " " + method
+}
+
+// ResponseError is returned when an INVITE is rejected with a 3xx-6xx response.
+type ResponseError struct {
+    StatusCode int
+    Reason     string
+}
+
+func (e *ResponseError) Error() string {
+    return fmt.Sprintf("sip: call rejected with %d %s", e.StatusCode, e.Reason)
+}
+
+// Is makes 488 and 606 match ErrCodecMismatch, as S2 rejects an offer without
+// a codec it accepts with them.
+func (e *ResponseError) Is(target error) bool {
+    return target == ErrCodecMismatch && (e.StatusCode == 488 || e.StatusCode == 606)
+}
+
+type transactionState int
+
+const (
+    stateCalling transactionState = iota
+    stateProceeding
+    stateCompleted
+    stateTerminated
+)
+
+func (s transactionState) String() string {
+    switch s {
+    case stateCalling:
+        return "Calling"
+    case stateProceeding:
+        return "Proceeding"
+    case stateCompleted:
+        return "Completed"
+    default:
+        return "Terminated"
+    }
+}
+
+type transactionResult struct {
+    response *message.Response
+    err      error
+}
+
+// inviteTransaction implements the INVITE client transaction of RFC 3261
+// section 17.1.1. Over TCP and TLS the INVITE is not retransmitted and the
+// transaction ends as soon as the ACK for a failure is sent.
+type inviteTransaction struct {
+    client    *Client
+    session   *session
+    call      *models.Call
+    branch    string
+    request   *message.Request
+    ack       *message.Request
+    mu        sync.Mutex
+    state     transactionState
+    responses chan *message.Response
+    result    chan transactionResult
+    cancel    chan struct{}
+    cancelled sync.Once
+    canceling bool
+    done      chan struct{}
+}
+
+func newInviteTransaction(c *Client, sess *session, branch string, request *message.Request) *inviteTransaction {
+    return &inviteTransaction{
+        client:    c,
+        session:   sess,
+        call:      sess.call,
+        branch:    branch,
+        request:   request,
+        state:     stateCalling,
+        responses: make(chan *message.Response, 16),
+        result:    make(chan transactionResult, 1),
+        cancel:    make(chan struct{}),
+        done:      make(chan struct{}),
+    }
+}
+
+func (tx *inviteTransaction) State() transactionState {
+    tx.mu.Lock()
+    defer tx.mu.Unlock()
+    return tx.state
+}
+
+func (tx *inviteTransaction) setState(state transactionState) {
+    tx.mu.Lock()
+    defer tx.mu.Unlock()
+    tx.state = state
+}
+
+// deliver hands a received response to the transaction. It never blocks once
+// the transaction has terminated.
+func (tx *inviteTransaction) deliver(resp *message.Response) {
+    select {
+    case tx.responses <- resp:
+    case <-tx.done:
+    }
+}
+
+// requestCancel asks the transaction to abandon the INVITE. CANCEL may only be
+// sent once a provisional response has arrived (RFC 3261 section 9.1), so in
+// the Calling state it is deferred until then; if none arrives, Timer B ends
+// the INVITE as canceled.
+func (tx *inviteTransaction) requestCancel() {
+    tx.cancelled.Do(func() {
+        tx.mu.Lock()
+        tx.canceling = true
+        tx.mu.Unlock()
+        close(tx.cancel)
+    })
+}
+
+// Canceling reports whether the INVITE has been asked to be canceled.
+func (tx *inviteTransaction) Canceling() bool {
+    tx.mu.Lock()
+    defer tx.mu.Unlock()
+    return tx.canceling
+}
+
+// start sends the INVITE and runs the state machine until it terminates.
+func (tx *inviteTransaction) start() error {
+    if err := tx.client.sendMessage(tx.request); err != nil {
+        tx.setState(stateTerminated)
+        close(tx.done)
+        return err
+    }
+    go tx.run()
+    return nil
+}
+
+func (tx *inviteTransaction) run() {
+    defer func() {
+        tx.setState(stateTerminated)
+        close(tx.done)
+        tx.client.removeTransaction(tx.call.SIPCallID, transactionKey(tx.branch, "INVITE"))
+    }()
+
+    timing := tx.client.timing
+    interval := timing.t1
+    retransmit := time.NewTimer(interval)
+    timeout := time.NewTimer(timing.b())
+    proceeding := time.NewTimer(timing.c)
+    if tx.client.reliable() {
+        retransmit.Stop()
+    }
+    defer retransmit.Stop()
+    defer timeout.Stop()
+    defer proceeding.Stop()
+
+    var completed, abandoned <-chan time.Time
+    cancel := tx.cancel
+    canceled := false
+    timedOut := false
+
+    // sendCANCEL starts the CANCEL transaction. If S2 never answers the
+    // INVITE with a final response the INVITE is treated as canceled after
+    // 64*T1 (RFC 3261 section 9.1).
+    sendCANCEL := func() {
+        canceled = true
+        abandoned = time.After(timing.b())
+        go tx.client.sendCANCEL(tx.call, tx.request)
+    }
+
+    for {
+        select {
+        case <-retransmit.C:
+            if tx.State() != stateCalling {
+                continue
+            }
+            if err := tx.client.sendMessage(tx.request); err != nil {
+                log.Printf("[SIP] Call %s: INVITE retransmission failed: %v", tx.call.SIPCallID, err)
+            }
+            interval *= 2
+            retransmit.Reset(interval)
+
+        case <-timeout.C:
+            if tx.State() != stateCalling {
+                continue
+            }
+            // A CANCEL deferred for a provisional response that never came
+            // still abandons the call (RFC 3261 section 9.1)
+            if tx.Canceling() {
+                log.Printf("[SIP] Call %s: Timer B fired while canceling, no response from S2", tx.call.SIPCallID)
+                tx.result <- transactionResult{err: ErrCanceled}
+                return
+            }
+            log.Printf("[SIP] Call %s: Timer B fired, no response from S2", tx.call.SIPCallID)
+            tx.result <- transactionResult{err: ErrTimeout}
+            return
+
+        case <-proceeding.C:
+            if tx.State() != stateProceeding || canceled {
+                continue
+            }
+            log.Printf("[SIP] Call %s: no final response after %v, canceling", tx.call.SIPCallID, timing.c)
+            timedOut = true
+            sendCANCEL()
+
+        case <-cancel:
+            cancel = nil
+            if tx.State() == stateProceeding && !canceled {
+                sendCANCEL()
+            }
+
+        case <-abandoned:
+            if tx.State() != stateProceeding {
+                continue
+            }
+            log.Printf("[SIP] Call %s: no final response after CANCEL", tx.call.SIPCallID)
+            if timedOut {
+                tx.result <- transactionResult{err: ErrTimeout}
+            } else {
+                tx.result <- transactionResult{err: ErrCanceled}
+            }
+            return
+
+        case resp := <-tx.responses:
+            state := tx.State()
+            switch {
+            case resp.StatusCode < 200:
+                if state != stateCalling && state != stateProceeding {
+                    continue
+                }
+                tx.setState(stateProceeding)
+                // Each provisional response restarts Timer C (RFC 3261
+                // section 16.6 step 11)
+                resetTimer(proceeding, timing.c)
+                if cancel == nil && !canceled {
+                    sendCANCEL()
+                }
+                if to, err := tx.request.Header.To(); err == nil && to.Tag() != "" {
+                    // A re-INVITE's provisional responses leave the
+                    // answered call's status alone
+                    continue
+                }
+                switch resp.StatusCode {
+                case 100:
+                    log.Printf("[SIP] Call %s: Trying", tx.call.SIPCallID)
+                    tx.session.setStatus("TRYING")
+                case 180, 183:
+                    log.Printf("[SIP] Call %s: Ringing", tx.call.SIPCallID)
+                    tx.session.setStatus("RINGING")
+                }
+
+            case resp.StatusCode < 300:
+                if state != stateCalling && state != stateProceeding {
+                    continue
+                }
+                tx.result <- transactionResult{response: resp}
+                return
+
+            default:
+                if state == stateCompleted {
+                    // Retransmitted final response: our ACK was lost, so
+                    // send it again while Timer D runs
+                    tx.sendACK()
+                    continue
+                }
+                tx.setState(stateCompleted)
+                tx.ack = buildACK(tx.request, resp)
+                tx.sendACK()
+                if timedOut && resp.StatusCode == 487 {
+                    tx.result <- transactionResult{err: ErrTimeout}
+                } else {
+                    tx.result <- transactionResult{response: resp}
+                }
+                if tx.client.reliable() {
+                    return
+                }
+                completed = time.After(timing.d)
+                abandoned = nil
+            }
+
+        case <-completed:
+            return
+        }
+    }
+}
+
+// resetTimer restarts a timer that may have fired without its channel being
+// read.
+func resetTimer(t *time.Timer, d time.Duration) {
+    if !t.Stop() {
+        select {
+        case <-t.C:
+        default:
+        }
+    }
+    t.Reset(d)
+}
+
+func (tx *inviteTransaction) sendACK() {
+    if err := tx.client.sendMessage(tx.ack); err != nil {
+        log.Printf("[SIP] Call %s: ACK failed: %v", tx.call.SIPCallID, err)
+    }
+}
+
+// nonInviteTransaction implements the non-INVITE client transaction of RFC
+// 3261 section 17.1.2. Over TCP and TLS the request is not retransmitted and
+// the transaction ends with the final response.
+type nonInviteTransaction struct {
+    client    *Client
+    key       string
+    callID    string
+    request   *message.Request
+    responses chan *message.Response
+    result    chan transactionResult
+    done      chan struct{}
+}
+
+func newNonInviteTransaction(c *Client, key, callID string, request *message.Request) *nonInviteTransaction {
+    return &nonInviteTransaction{
+        client:    c,
+        key:       key,
+        callID:    callID,
+        request:   request,
+        responses: make(chan *message.Response, 16),
+        result:    make(chan transactionResult, 1),
+        done:      make(chan struct{}),
+    }
+}
+
+func (tx *nonInviteTransaction) deliver(resp *message.Response) {
+    select {
+    case tx.responses <- resp:
+    case <-tx.done:
+    }
+}
+
+// start sends the request and runs the state machine until it terminates.
+func (tx *nonInviteTransaction) start() error {
+    if err := tx.client.sendMessage(tx.request); err != nil {
+        close(tx.done)
+        return err
+    }
+    go tx.run()
+    return nil
+}
+
+func (tx *nonInviteTransaction) run() {
+    defer func() {
+        close(tx.done)
+        tx.client.removeTransaction(tx.callID, tx.key)
+    }()
+
+    timing := tx.client.timing
+    interval := timing.t1
+    retransmit := time.NewTimer(interval)
+    timeout := time.NewTimer(timing.b())
+    if tx.client.reliable() {
+        retransmit.Stop()
+    }
+    defer retransmit.Stop()
+    defer timeout.Stop()
+
+    var completed <-chan time.Time
+    proceeding := false
+
+    for {
+        select {
+        case <-retransmit.C:
+            if completed != nil {
+                continue
+            }
+            if err := tx.client.sendMessage(tx.request); err != nil {
+                log.Printf("[SIP] Call %s: retransmission failed: %v", tx.callID, err)
+            }
+            interval = min(interval*2, timing.t2)
+            retransmit.Reset(interval)
+
+        case <-timeout.C:
+            if completed != nil {
+                continue
+            }
+            tx.result <- transactionResult{err: ErrTimeout}
+            return
+
+        case resp := <-tx.responses:
+            if completed != nil {
+                // A retransmitted final response, absorbed by Timer K
+                continue
+            }
+            if resp.StatusCode < 200 {
+                // Proceeding: keep retransmitting, but only every T2,
+                // starting from now
+                if !proceeding && !tx.client.reliable() {
+                    interval = timing.t2
+                    resetTimer(retransmit, interval)
+                }
+                proceeding = true
+                continue
+            }
+            tx.result <- transactionResult{response: resp}
+            // Timer K is zero for reliable transports and T4 for UDP
+            if tx.client.reliable() {
+                return
+            }
+            retransmit.Stop()
+            timeout.Stop()
+            completed = time.After(timing.t4)
+
+        case <-completed:
+            return
+        }
+    }
+}
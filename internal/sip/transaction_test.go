@@ -0,0 +1,433 @@
+package sip
+
+import (
+    "bytes"
+    "context"
+    "errors"
+    "net"
+    "testing"
+    "time"
+
+    "github.com/s1-callgen/internal/models"
+    "github.com/s1-callgen/internal/sip/message"
+)
+
+// testTimers shorten the transaction timers 25 times, so that Timer B fires
+// after 1.28 s.
+var testTimers = transactionTimers{
+    t1: 20 * time.Millisecond,
+    t2: 160 * time.Millisecond,
+    t4: 200 * time.Millisecond,
+    c:  2 * time.Second,
+    d:  400 * time.Millisecond,
+}
+
+// udpPeer is S2 as played by a test, on a UDP socket of its own.
+type udpPeer struct {
+    t      *testing.T
+    conn   *net.UDPConn
+    client *net.UDPAddr // where the last request came from
+}
+
+// newUDPPeer returns a client with the test timers connected over UDP to a
+// peer the test answers its requests from.
+func newUDPPeer(t *testing.T) (*Client, *udpPeer) {
+    t.Helper()
+    conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { conn.Close() })
+
+    c, err := NewClient("127.0.0.1", 0, "127.0.0.1", conn.LocalAddr().(*net.UDPAddr).Port)
+    if err != nil {
+        t.Fatal(err)
+    }
+    c.SetListenAddress("127.0.0.1", 0, 0)
+    c.timing = testTimers
+    if err := c.Connect(); err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(c.Close)
+    return c, &udpPeer{t: t, conn: conn}
+}
+
+// receive returns the next request from the client and when it arrived, or
+// nil if none arrives within wait.
+func (p *udpPeer) receive(wait time.Duration) (*message.Request, time.Time) {
+    p.t.Helper()
+    buffer := make([]byte, message.MaxMessageSize)
+    p.conn.SetReadDeadline(time.Now().Add(wait))
+    for {
+        n, addr, err := p.conn.ReadFromUDP(buffer)
+        if err != nil {
+            return nil, time.Time{}
+        }
+        at := time.Now()
+        msg, err := message.Parse(buffer[:n])
+        if err != nil {
+            p.t.Fatalf("client sent %q: %v", buffer[:n], err)
+        }
+        if req, ok := msg.(*message.Request); ok {
+            p.client = addr
+            return req, at
+        }
+    }
+}
+
+// expect returns the next request from the client other than a
+// retransmission of skip, failing the test unless it is a method request.
+func (p *udpPeer) expect(method, skip string) *message.Request {
+    p.t.Helper()
+    for {
+        req, _ := p.receive(3 * time.Second)
+        if req == nil {
+            p.t.Fatalf("no %s from the client", method)
+        }
+        if req.Method == skip {
+            continue
+        }
+        if req.Method != method {
+            p.t.Fatalf("got %s, want %s", req.Method, method)
+        }
+        return req
+    }
+}
+
+// respond answers req; responses past 100 carry S2's To tag.
+func (p *udpPeer) respond(req *message.Request, code int, reason string) *message.Response {
+    p.t.Helper()
+    resp := message.NewResponse(req, code, reason)
+    if to, err := req.Header.To(); err == nil && to.Tag() == "" && code > 100 {
+        to.Params.Set("tag", "s2")
+        resp.Header.Set("To", to.String())
+    }
+    p.send(resp)
+    return resp
+}
+
+// send sends a message to where the last request came from.
+func (p *udpPeer) send(msg interface{ Bytes() []byte }) {
+    p.t.Helper()
+    if _, err := p.conn.WriteToUDP(msg.Bytes(), p.client); err != nil {
+        p.t.Fatal(err)
+    }
+}
+
+type callResult struct {
+    call *models.Call
+    err  error
+}
+
+// startCall makes a call in the background until ctx is done.
+func startCall(ctx context.Context, c *Client) <-chan callResult {
+    done := make(chan callResult, 1)
+    go func() {
+        call, err := c.MakeCall(ctx, "100", "200", time.Second, CallOptions{})
+        done <- callResult{call, err}
+    }()
+    return done
+}
+
+// callEnd waits for a call started with startCall to end.
+func callEnd(t *testing.T, done <-chan callResult, wait time.Duration) callResult {
+    t.Helper()
+    select {
+    case result := <-done:
+        return result
+    case <-time.After(wait):
+        t.Fatalf("call still up after %v", wait)
+        return callResult{}
+    }
+}
+
+func TestCancelBeforeProvisional(t *testing.T) {
+    c, peer := newUDPPeer(t)
+    ctx, cancel := context.WithCancel(context.Background())
+    defer cancel()
+
+    done := startCall(ctx, c)
+    peer.expect("INVITE", "")
+    cancel()
+
+    // No CANCEL may be sent before a provisional response, and none comes,
+    // so Timer B ends the INVITE
+    started := time.Now()
+    result := callEnd(t, done, 5*time.Second)
+    if !errors.Is(result.err, ErrCanceled) || result.call.Status != "CANCELED" {
+        t.Errorf("got %v with status %s, want ErrCanceled and CANCELED", result.err, result.call.Status)
+    }
+    if elapsed := time.Since(started); elapsed > testTimers.b()+500*time.Millisecond {
+        t.Errorf("call ended after %v, want Timer B of %v", elapsed, testTimers.b())
+    }
+    for {
+        req, _ := peer.receive(50 * time.Millisecond)
+        if req == nil {
+            break
+        }
+        if req.Method != "INVITE" {
+            t.Errorf("client sent %s before any provisional response", req.Method)
+        }
+    }
+}
+
+func TestCancelAfterRinging(t *testing.T) {
+    c, peer := newUDPPeer(t)
+    ctx, cancel := context.WithCancel(context.Background())
+    defer cancel()
+
+    done := startCall(ctx, c)
+    invite := peer.expect("INVITE", "")
+    peer.respond(invite, 180, "Ringing")
+    cancel()
+
+    req := peer.expect("CANCEL", "INVITE")
+    inviteVia, _ := invite.Header.Via()
+    via, _ := req.Header.Via()
+    seq, method, _ := req.Header.CSeq()
+    if via.Branch() != inviteVia.Branch() || seq != 1 || method != "CANCEL" || req.URI.String() != invite.URI.String() {
+        t.Errorf("CANCEL %s %d %s on branch %s, want %s 1 CANCEL on branch %s", req.URI, seq, method, via.Branch(), invite.URI, inviteVia.Branch())
+    }
+    peer.respond(req, 200, "OK")
+    terminated := peer.respond(invite, 487, "Request Terminated")
+
+    ack := peer.expect("ACK", "INVITE")
+    via, _ = ack.Header.Via()
+    seq, method, _ = ack.Header.CSeq()
+    if via.Branch() != inviteVia.Branch() || seq != 1 || method != "ACK" || ack.Header.Get("To") != terminated.Header.Get("To") {
+        t.Errorf("ACK %d %s on branch %s to %s, want 1 ACK on branch %s to %s", seq, method, via.Branch(), ack.Header.Get("To"), inviteVia.Branch(), terminated.Header.Get("To"))
+    }
+
+    result := callEnd(t, done, 2*time.Second)
+    if !errors.Is(result.err, ErrCanceled) || result.call.Status != "CANCELED" {
+        t.Errorf("got %v with status %s, want ErrCanceled and CANCELED", result.err, result.call.Status)
+    }
+}
+
+func TestInviteRetransmission(t *testing.T) {
+    c, peer := newUDPPeer(t)
+    done := startCall(context.Background(), c)
+
+    // Timer A doubles from T1 on every retransmission until Timer B ends
+    // the transaction at 64*T1: the INVITE goes out at 0, 1, 3, 7, 15, 31
+    // and 63 T1
+    var sent []time.Time
+    for {
+        req, at := peer.receive(time.Second)
+        if req == nil {
+            break
+        }
+        if req.Method != "INVITE" {
+            t.Fatalf("got %s, want INVITE", req.Method)
+        }
+        sent = append(sent, at)
+    }
+    if len(sent) < 6 || len(sent) > 7 {
+        t.Fatalf("INVITE sent %d times, want 7", len(sent))
+    }
+    for i := 1; i < len(sent); i++ {
+        want := testTimers.t1 << (i - 1)
+        if gap := sent[i].Sub(sent[i-1]); gap < want-5*time.Millisecond || gap > want+100*time.Millisecond {
+            t.Errorf("retransmission %d after %v, want %v", i, gap, want)
+        }
+    }
+
+    result := callEnd(t, done, time.Second)
+    if !errors.Is(result.err, ErrTimeout) || result.call.Status != "TIMEOUT" {
+        t.Errorf("got %v with status %s, want ErrTimeout and TIMEOUT", result.err, result.call.Status)
+    }
+    if ended := result.call.EndTime.Sub(sent[0]); ended < testTimers.b()-5*time.Millisecond {
+        t.Errorf("call ended %v after the INVITE, want Timer B of %v", ended, testTimers.b())
+    }
+}
+
+func TestInviteFailureACK(t *testing.T) {
+    c, peer := newUDPPeer(t)
+    done := startCall(context.Background(), c)
+
+    invite := peer.expect("INVITE", "")
+    peer.respond(invite, 180, "Ringing")
+    callID := invite.Header.CallID()
+    deadline := time.Now().Add(time.Second)
+    for status := ""; status != "RINGING"; {
+        if time.Now().After(deadline) {
+            t.Fatalf("status %s after 180, want RINGING", status)
+        }
+        time.Sleep(5 * time.Millisecond)
+        sh := c.shardFor(callID)
+        sh.mu.Lock()
+        sess := sh.sessions[callID]
+        sh.mu.Unlock()
+        sess.mu.Lock()
+        status = sess.call.Status
+        sess.mu.Unlock()
+    }
+
+    busy := peer.respond(invite, 486, "Busy Here")
+    ack := peer.expect("ACK", "INVITE")
+    inviteVia, _ := invite.Header.Via()
+    via, _ := ack.Header.Via()
+    seq, method, _ := ack.Header.CSeq()
+    if ack.URI.String() != invite.URI.String() || via.Branch() != inviteVia.Branch() || seq != 1 || method != "ACK" {
+        t.Errorf("ACK %s %d %s on branch %s, want %s 1 ACK on branch %s", ack.URI, seq, method, via.Branch(), invite.URI, inviteVia.Branch())
+    }
+    if ack.Header.Get("To") != busy.Header.Get("To") || ack.Header.Get("From") != invite.Header.Get("From") || ack.Header.CallID() != callID {
+        t.Errorf("ACK from %s to %s in %s, want the INVITE's From and Call-ID and the 486's To", ack.Header.Get("From"), ack.Header.Get("To"), ack.Header.CallID())
+    }
+
+    result := callEnd(t, done, time.Second)
+    var rejected *ResponseError
+    if !errors.As(result.err, &rejected) || rejected.StatusCode != 486 || result.call.Status != "FAILED" {
+        t.Errorf("got %v with status %s, want a 486 and FAILED", result.err, result.call.Status)
+    }
+
+    // Timer D absorbs retransmissions of the 486 with the same ACK, and
+    // once it fires they go unanswered
+    peer.send(busy)
+    if again := peer.expect("ACK", ""); !bytes.Equal(again.Bytes(), ack.Bytes()) {
+        t.Errorf("ACK of the retransmission\n%s\nwant\n%s", again.Bytes(), ack.Bytes())
+    }
+    time.Sleep(testTimers.d)
+    peer.send(busy)
+    if req, _ := peer.receive(200 * time.Millisecond); req != nil {
+        t.Errorf("got %s after Timer D, want nothing", req.Method)
+    }
+}
+
+func TestTimerCRestarts(t *testing.T) {
+    c, peer := newUDPPeer(t)
+    c.timing.c = 300 * time.Millisecond
+    done := startCall(context.Background(), c)
+
+    // Provisional responses every 200 ms keep Timer C from firing; it
+    // cancels the INVITE 300 ms after the last
+    invite := peer.expect("INVITE", "")
+    ringing := peer.respond(invite, 180, "Ringing")
+    var last time.Time
+    for i := 0; i < 3; i++ {
+        if req, _ := peer.receive(200 * time.Millisecond); req != nil {
+            t.Fatalf("got %s after %d provisional responses 200 ms apart, want nothing", req.Method, i+1)
+        }
+        peer.send(ringing)
+        last = time.Now()
+    }
+
+    req := peer.expect("CANCEL", "INVITE")
+    if since := time.Since(last); since < 290*time.Millisecond {
+        t.Errorf("CANCEL %v after the last provisional response, want Timer C of 300 ms", since)
+    }
+    peer.respond(req, 200, "OK")
+    peer.respond(invite, 487, "Request Terminated")
+    peer.expect("ACK", "INVITE")
+
+    result := callEnd(t, done, time.Second)
+    if !errors.Is(result.err, ErrTimeout) || result.call.Status != "TIMEOUT" {
+        t.Errorf("got %v with status %s, want ErrTimeout and TIMEOUT", result.err, result.call.Status)
+    }
+}
+
+// ping sends an OPTIONS in the background.
+func ping(c *Client) <-chan transactionResult {
+    done := make(chan transactionResult, 1)
+    go func() {
+        resp, err := c.Ping()
+        done <- transactionResult{resp, err}
+    }()
+    return done
+}
+
+// retransmissions returns when the requests from the client arrive until
+// none arrives for a second, failing the test on any request but method.
+func (p *udpPeer) retransmissions(method string) []time.Time {
+    p.t.Helper()
+    var sent []time.Time
+    for {
+        req, at := p.receive(time.Second)
+        if req == nil {
+            return sent
+        }
+        if req.Method != method {
+            p.t.Fatalf("got %s, want %s", req.Method, method)
+        }
+        sent = append(sent, at)
+    }
+}
+
+func TestNonInviteTimeout(t *testing.T) {
+    c, peer := newUDPPeer(t)
+    done := ping(c)
+
+    // Timer E doubles from T1 to T2, and Timer F ends the transaction at
+    // 64*T1: the OPTIONS goes out at 0, 1, 3 and 7 T1, then every 8 T1
+    // until 63 T1
+    sent := peer.retransmissions("OPTIONS")
+    if len(sent) < 10 || len(sent) > 11 {
+        t.Fatalf("OPTIONS sent %d times, want 11", len(sent))
+    }
+    for i := 1; i < len(sent); i++ {
+        want := min(testTimers.t1<<(i-1), testTimers.t2)
+        if gap := sent[i].Sub(sent[i-1]); gap < want-5*time.Millisecond || gap > want+100*time.Millisecond {
+            t.Errorf("retransmission %d after %v, want %v", i, gap, want)
+        }
+    }
+
+    select {
+    case result := <-done:
+        if !errors.Is(result.err, ErrTimeout) {
+            t.Errorf("got %v, want ErrTimeout", result.err)
+        }
+    case <-time.After(time.Second):
+        t.Fatal("no result after Timer F")
+    }
+}
+
+func TestNonInviteProceeding(t *testing.T) {
+    c, peer := newUDPPeer(t)
+    done := ping(c)
+
+    // A provisional response puts the next retransmission T2 away, not T1
+    options := peer.expect("OPTIONS", "")
+    peer.respond(options, 100, "Trying")
+    proceeding := time.Now()
+    for i := 0; i < 2; i++ {
+        req, at := peer.receive(time.Second)
+        if req == nil || req.Method != "OPTIONS" {
+            t.Fatalf("got %v, want the OPTIONS again", req)
+        }
+        if gap := at.Sub(proceeding); gap < testTimers.t2-5*time.Millisecond || gap > testTimers.t2+100*time.Millisecond {
+            t.Errorf("retransmission %d after %v, want T2 of %v", i+1, gap, testTimers.t2)
+        }
+        proceeding = at
+    }
+
+    ok := peer.respond(options, 200, "OK")
+    select {
+    case result := <-done:
+        if result.err != nil || result.response.StatusCode != 200 {
+            t.Fatalf("got %v, %v; want 200", result.response, result.err)
+        }
+    case <-time.After(time.Second):
+        t.Fatal("no result after 200")
+    }
+
+    // Timer K keeps the transaction for T4 to absorb retransmissions of the
+    // 200, without sending anything
+    answered := time.Now()
+    transactions := func() int {
+        sh := c.shards[0]
+        sh.mu.Lock()
+        defer sh.mu.Unlock()
+        return len(sh.transactions)
+    }
+    if n := transactions(); n != 1 {
+        t.Errorf("%d transactions after the 200, want it kept", n)
+    }
+    peer.send(ok)
+    if req, _ := peer.receive(testTimers.t4 / 2); req != nil {
+        t.Errorf("got %s after the 200, want nothing", req.Method)
+    }
+    time.Sleep(testTimers.t4 - time.Since(answered) + 50*time.Millisecond)
+    if n := transactions(); n != 0 {
+        t.Errorf("%d transactions after Timer K, want none", n)
+    }
+}
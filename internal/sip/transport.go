@@ -0,0 +1,468 @@
+package sip
+
+import (
+    "bufio"
+    "context"
+    "crypto/tls"
+    "crypto/x509"
+    "errors"
+    "fmt"
+    "log"
+    "net"
+    "os"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/s1-callgen/internal/sip/message"
+)
+
+// Transports S2 can be reached over, as they appear in Via headers
+const (
+    TransportUDP = "UDP"
+    TransportTCP = "TCP"
+    TransportTLS = "TLS"
+)
+
+// dialTimeout bounds connection setup, including the TLS handshake.
+const dialTimeout = 10 * time.Second
+
+// TLSConfig configures the TLS transport. All fields are optional.
+type TLSConfig struct {
+    CertFile           string // client certificate, PEM
+    KeyFile            string // client certificate key, PEM
+    CAFile             string // CA bundle S2 is verified against instead of the system roots
+    ServerName         string // SNI and verified name, defaults to the S2 host
+    InsecureSkipVerify bool
+}
+
+// SetTransport selects the transport used to reach S2: UDP, TCP or TLS. It
+// must be called before Connect. An empty transport is UDP, unless a locator
+// is set and DNS names another. tlsConfig is only used for TLS and may be
+// nil.
+func (c *Client) SetTransport(transport string, tlsConfig *TLSConfig) error {
+    transport = strings.ToUpper(transport)
+    switch transport {
+    case "", TransportUDP, TransportTCP, TransportTLS:
+    default:
+        return fmt.Errorf("sip: unsupported transport %q", transport)
+    }
+
+    // Loaded also when DNS may pick TLS
+    if transport == "" || transport == TransportTLS {
+        config, err := loadTLSConfig(tlsConfig)
+        if err != nil {
+            return err
+        }
+        c.tlsConfig = config
+    }
+
+    c.transportSet = transport != ""
+    if transport == "" {
+        transport = TransportUDP
+    }
+    c.transport = transport
+    return nil
+}
+
+// loadTLSConfig builds the crypto/tls configuration for the TLS transport.
+func loadTLSConfig(config *TLSConfig) (*tls.Config, error) {
+    tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+    if config == nil {
+        return tlsConfig, nil
+    }
+
+    tlsConfig.ServerName = config.ServerName
+    tlsConfig.InsecureSkipVerify = config.InsecureSkipVerify
+
+    if config.CertFile != "" || config.KeyFile != "" {
+        cert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+        if err != nil {
+            return nil, fmt.Errorf("sip: loading client certificate: %v", err)
+        }
+        tlsConfig.Certificates = []tls.Certificate{cert}
+    }
+
+    if config.CAFile != "" {
+        pem, err := os.ReadFile(config.CAFile)
+        if err != nil {
+            return nil, fmt.Errorf("sip: loading CA bundle: %v", err)
+        }
+        pool := x509.NewCertPool()
+        if !pool.AppendCertsFromPEM(pem) {
+            return nil, fmt.Errorf("sip: no certificates in %s", config.CAFile)
+        }
+        tlsConfig.RootCAs = pool
+    }
+
+    return tlsConfig, nil
+}
+
+// SetListenAddress sets where the UDP socket is bound: ip, or every interface
+// when empty, and the first free port of firstPort-lastPort. It must be
+// called before Connect. The bound port is advertised in Via and Contact.
+func (c *Client) SetListenAddress(ip string, firstPort, lastPort int) {
+    c.bindIP = ip
+    c.firstPort = firstPort
+    c.lastPort = max(lastPort, firstPort)
+}
+
+// SetLocator makes the client resolve the S2 host as a SIP domain, with
+// NAPTR, SRV and A/AAAA records (RFC 3263), instead of as a plain host name.
+// It must be called before Connect.
+func (c *Client) SetLocator(locator *Locator) {
+    c.locator = locator
+}
+
+// locate resolves the S2 host to the destinations tried in order, and
+// schedules resolving it again when the DNS answers expire. The first
+// resolution may also pick the transport; later ones keep it.
+func (c *Client) locate() error {
+    host, port := c.target()
+    transport := ""
+    if c.transportSet {
+        transport = c.transport
+    }
+
+    var located []Destination
+    var expires time.Time
+    if c.locator != nil {
+        ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+        defer cancel()
+        var err error
+        located, expires, err = c.locator.Locate(ctx, host, port, transport)
+        if err != nil {
+            return err
+        }
+    } else {
+        addr, err := net.ResolveIPAddr("ip", host)
+        if err != nil {
+            return err
+        }
+        located = []Destination{{Transport: c.transport, IP: addr.IP, Port: defaultPort(port, c.transport)}}
+    }
+    if len(located) == 0 {
+        return fmt.Errorf("sip: no servers found for %s", host)
+    }
+
+    if !c.transportSet {
+        c.transport = located[0].Transport
+        c.transportSet = true
+    }
+    var usable []Destination
+    for _, d := range located {
+        if d.Transport == c.transport {
+            usable = append(usable, d)
+        }
+    }
+
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    c.located = usable
+    if c.relocation != nil {
+        c.relocation.Stop()
+        c.relocation = nil
+    }
+    if !expires.IsZero() && !c.closed {
+        c.relocation = time.AfterFunc(time.Until(expires), c.relocate)
+    }
+    return nil
+}
+
+// relocate resolves the S2 host again once its DNS records expired, and
+// moves to the new first destination if it changed.
+func (c *Client) relocate() {
+    previous := c.destination()
+    if err := c.locate(); err != nil {
+        log.Printf("[SIP] Resolving S2 again failed, retrying in %v: %v", negativeTTL, err)
+        c.mu.Lock()
+        if !c.closed {
+            c.relocation = time.AfterFunc(negativeTTL, c.relocate)
+        }
+        c.mu.Unlock()
+        return
+    }
+
+    current := c.destination()
+    if current.equal(previous) {
+        return
+    }
+    log.Printf("[SIP] S2 moved from %s to %s", previous, current)
+    if !c.reliable() {
+        c.remoteAddr.Store(&net.UDPAddr{IP: current.IP, Port: current.Port})
+        return
+    }
+    for _, sh := range c.shards {
+        if err := sh.connect(); err != nil {
+            log.Printf("[SIP] Reconnecting to %s failed: %v", current, err)
+        }
+    }
+}
+
+// destination returns the first destination S2 was located at.
+func (c *Client) destination() Destination {
+    c.mu.RLock()
+    defer c.mu.RUnlock()
+    return c.located[0]
+}
+
+// connectUDP binds each shard's socket, unless it already is, and points
+// them all at S2's current address.
+func (c *Client) connectUDP() error {
+    d := c.destination()
+    remoteAddr := &net.UDPAddr{IP: d.IP, Port: d.Port}
+    c.remoteAddr.Store(remoteAddr)
+
+    port := c.firstPort
+    for _, sh := range c.shards {
+        sh.connMu.Lock()
+        if sh.packetConn == nil {
+            conn, err := c.bind(port)
+            if err != nil {
+                sh.connMu.Unlock()
+                return err
+            }
+            sh.packetConn = conn
+            sh.localPort = conn.LocalAddr().(*net.UDPAddr).Port
+            go sh.listenUDP(conn)
+            log.Printf("[SIP] Listening on %s", conn.LocalAddr())
+        }
+        if c.firstPort != 0 {
+            port = sh.localPort + 1
+        }
+        sh.connMu.Unlock()
+    }
+
+    log.Printf("[SIP] Connected to %s over %s", remoteAddr, c.transport)
+    return nil
+}
+
+// bind opens a UDP socket on the first free port from first to the end of
+// the configured range. Port 0 binds an ephemeral port.
+func (c *Client) bind(first int) (*net.UDPConn, error) {
+    ip := net.ParseIP(c.bindIP)
+    if c.bindIP != "" && ip == nil {
+        return nil, fmt.Errorf("sip: invalid listen address %q", c.bindIP)
+    }
+
+    err := fmt.Errorf("range exhausted")
+    for port := first; port <= c.lastPort; port++ {
+        var conn *net.UDPConn
+        conn, err = net.ListenUDP("udp", &net.UDPAddr{IP: ip, Port: port})
+        if err == nil {
+            return conn, nil
+        }
+    }
+    return nil, fmt.Errorf("sip: cannot bind a port in %d-%d: %v", first, c.lastPort, err)
+}
+
+// reliable reports whether the transport is a stream, over which requests are
+// not retransmitted (RFC 3261 section 17.1).
+func (c *Client) reliable() bool {
+    return c.transport != TransportUDP
+}
+
+// dial opens a TCP or TLS connection to S2, trying each destination it was
+// located at in turn.
+func (c *Client) dial() (net.Conn, error) {
+    c.mu.RLock()
+    remoteIP, located := c.remoteIP, c.located
+    c.mu.RUnlock()
+
+    err := errors.New("sip: no servers located")
+    for _, d := range located {
+        addr := net.JoinHostPort(d.IP.String(), strconv.Itoa(d.Port))
+
+        var conn net.Conn
+        if c.transport == TransportTLS {
+            // The certificate is verified against the configured host, the
+            // domain when S2 was located by DNS (RFC 3263 section 4.1)
+            config := c.tlsConfig.Clone()
+            if config == nil {
+                config, _ = loadTLSConfig(nil)
+            }
+            if config.ServerName == "" {
+                config.ServerName = remoteIP
+            }
+            conn, err = tls.DialWithDialer(&net.Dialer{Timeout: dialTimeout}, "tcp", addr, config)
+        } else {
+            conn, err = net.DialTimeout("tcp", addr, dialTimeout)
+        }
+        if err == nil {
+            return conn, nil
+        }
+    }
+    return nil, err
+}
+
+// sendMessage writes a message to S2 from the socket of the call it belongs
+// to.
+func (c *Client) sendMessage(msg message.Message) error {
+    sh := c.shardFor(msg.Headers().CallID())
+    b := msg.Bytes()
+    if err := sh.send(b); err != nil {
+        return err
+    }
+    if c.tracing() {
+        local, remote := sh.addrs()
+        c.traceMessage(msg, b, local, remote)
+    }
+    return nil
+}
+
+// send writes to S2. A stream connection is shared by all calls of the shard;
+// one that S2 closed is dialed again on the next message. connMu only guards
+// the connection fields: sockets serialise concurrent writes themselves, so
+// sends of different calls do not wait on each other's writes or dials.
+func (sh *shard) send(b []byte) error {
+    c := sh.client
+    if !c.reliable() {
+        sh.connMu.Lock()
+        conn := sh.packetConn
+        sh.connMu.Unlock()
+        if conn == nil {
+            return errors.New("sip: not connected")
+        }
+        _, err := conn.WriteToUDP(b, c.remoteAddr.Load())
+        return err
+    }
+
+    conn, err := sh.streamConn()
+    if err != nil {
+        return err
+    }
+    if _, err := conn.Write(b); err != nil {
+        sh.connMu.Lock()
+        if sh.conn == conn {
+            sh.conn = nil
+        }
+        sh.connMu.Unlock()
+        conn.Close()
+        return err
+    }
+    return nil
+}
+
+// streamConn returns the shard's TCP or TLS connection, dialing S2 if there
+// is none. Of two sends dialing at once, the first connection made is kept
+// and the other closed.
+func (sh *shard) streamConn() (net.Conn, error) {
+    sh.connMu.Lock()
+    conn := sh.conn
+    sh.connMu.Unlock()
+    if conn != nil {
+        return conn, nil
+    }
+
+    conn, err := sh.client.dial()
+    if err != nil {
+        return nil, err
+    }
+    sh.connMu.Lock()
+    if existing := sh.conn; existing != nil {
+        sh.connMu.Unlock()
+        conn.Close()
+        return existing, nil
+    }
+    sh.conn = conn
+    sh.connMu.Unlock()
+
+    log.Printf("[SIP] Reconnected to %s over %s", conn.RemoteAddr(), sh.client.transport)
+    go sh.listen(conn)
+    return conn, nil
+}
+
+// addrs returns the local and remote address messages are sent between.
+func (sh *shard) addrs() (net.Addr, net.Addr) {
+    sh.connMu.Lock()
+    defer sh.connMu.Unlock()
+    switch {
+    case sh.conn != nil:
+        return sh.conn.LocalAddr(), sh.conn.RemoteAddr()
+    case sh.packetConn != nil:
+        return sh.packetConn.LocalAddr(), sh.client.remoteAddr.Load()
+    }
+    return nil, nil
+}
+
+// connect dials the shard's TCP or TLS connection, replacing any open one.
+func (sh *shard) connect() error {
+    conn, err := sh.client.dial()
+    if err != nil {
+        return err
+    }
+
+    sh.connMu.Lock()
+    old := sh.conn
+    sh.conn = conn
+    sh.connMu.Unlock()
+
+    if old != nil {
+        old.Close()
+    }
+    go sh.listen(conn)
+    return nil
+}
+
+// listen reads messages from a TCP or TLS connection, framed by
+// Content-Length, until it is closed.
+func (sh *shard) listen(conn net.Conn) {
+    reader := bufio.NewReader(conn)
+    for {
+        msg, err := message.ReadMessage(reader)
+        if err != nil {
+            if !errors.Is(err, net.ErrClosed) {
+                // EOF, a reset, or a framing error that leaves the stream
+                // out of sync: the next message sent dials again
+                log.Printf("[SIP] Connection to %s closed: %v", conn.RemoteAddr(), err)
+            }
+            sh.connMu.Lock()
+            if sh.conn == conn {
+                sh.conn = nil
+            }
+            sh.connMu.Unlock()
+            conn.Close()
+            return
+        }
+        if sh.client.tracing() {
+            sh.client.traceMessage(msg, msg.Bytes(), conn.RemoteAddr(), conn.LocalAddr())
+        }
+        sh.client.dispatch(msg)
+    }
+}
+
+// listenUDP reads datagrams, one message each, until the socket is closed.
+// Requests are accepted from any source, as S2 may send them from another
+// port than it receives on.
+func (sh *shard) listenUDP(conn *net.UDPConn) {
+    buffer := make([]byte, message.MaxMessageSize)
+    for {
+        n, from, err := conn.ReadFromUDP(buffer)
+        if err != nil {
+            if errors.Is(err, net.ErrClosed) {
+                return
+            }
+            log.Printf("[SIP] Error reading message: %v", err)
+            continue
+        }
+
+        msg, err := message.Parse(buffer[:n])
+        if err != nil {
+            log.Printf("[SIP] Dropping malformed message: %v", err)
+            continue
+        }
+        if sh.client.tracing() {
+            sh.client.traceMessage(msg, buffer[:n], from, conn.LocalAddr())
+        }
+        sh.client.dispatch(msg)
+    }
+}
+
+func (c *Client) dispatch(msg message.Message) {
+    switch m := msg.(type) {
+    case *message.Response:
+        c.handleResponse(m)
+    case *message.Request:
+        c.handleRequest(m)
+    }
+}
@@ -0,0 +1,278 @@
+package sip
+
+import (
+    "bufio"
+    "crypto/ecdsa"
+    "crypto/elliptic"
+    "crypto/rand"
+    "crypto/tls"
+    "crypto/x509"
+    "crypto/x509/pkix"
+    "math/big"
+    "net"
+    "strconv"
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/s1-callgen/internal/sip/message"
+)
+
+// streamPeer is S2 as played by a test, on the far end of a stream
+// connection.
+type streamPeer struct {
+    t      *testing.T
+    conn   net.Conn
+    reader *bufio.Reader
+}
+
+// newStreamPeer returns a client over TCP or TLS whose shard is connected
+// to a peer by net.Pipe, and listening on it.
+func newStreamPeer(t *testing.T, transport string) (*Client, *streamPeer) {
+    t.Helper()
+    c, err := NewClient("10.0.0.1", 5060, "10.0.0.2", 5060)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err := c.SetTransport(transport, nil); err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(c.Close)
+
+    var ours, theirs net.Conn
+    ours, theirs = net.Pipe()
+    if transport == TransportTLS {
+        ours = tls.Client(ours, &tls.Config{InsecureSkipVerify: true})
+        theirs = tls.Server(theirs, &tls.Config{Certificates: []tls.Certificate{selfSigned(t)}})
+    }
+    sh := c.shards[0]
+    sh.conn = ours
+    go sh.listen(ours)
+    t.Cleanup(func() { theirs.Close() })
+    return c, &streamPeer{t: t, conn: theirs, reader: bufio.NewReader(theirs)}
+}
+
+// selfSigned returns a certificate for S2 to present over TLS.
+func selfSigned(t *testing.T) tls.Certificate {
+    t.Helper()
+    key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    if err != nil {
+        t.Fatal(err)
+    }
+    template := &x509.Certificate{
+        SerialNumber: big.NewInt(1),
+        Subject:      pkix.Name{CommonName: "s2.example.com"},
+        NotBefore:    time.Now().Add(-time.Hour),
+        NotAfter:     time.Now().Add(time.Hour),
+    }
+    der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// write writes raw bytes to the client, with LF line ends made CRLF, in a
+// goroutine as the pipe blocks until the client reads.
+func (p *streamPeer) write(chunks ...string) {
+    go func() {
+        for _, chunk := range chunks {
+            if _, err := p.conn.Write([]byte(strings.ReplaceAll(chunk, "\n", "\r\n"))); err != nil {
+                return
+            }
+        }
+    }()
+}
+
+// read returns the next message from the client, failing the test if none
+// arrives within a second.
+func (p *streamPeer) read() message.Message {
+    p.t.Helper()
+    p.conn.SetReadDeadline(time.Now().Add(time.Second))
+    msg, err := message.ReadMessage(p.reader)
+    if err != nil {
+        p.t.Fatalf("reading from the client: %v", err)
+    }
+    return msg
+}
+
+// options is an OPTIONS request from S2 with sequence number seq and a
+// body, which the client answers with a 200.
+func options(seq int) string {
+    n := strconv.Itoa(seq)
+    return `OPTIONS sip:100@10.0.0.1:5060;transport=tcp SIP/2.0
+Via: SIP/2.0/TCP 10.0.0.2:5060;branch=z9hG4bK` + n + `
+From: <sip:s2@10.0.0.2>;tag=s2
+To: <sip:100@10.0.0.1>
+Call-ID: stream@s2
+CSeq: ` + n + ` OPTIONS
+Content-Type: text/plain
+Content-Length: 6
+
+hello
+`
+}
+
+// split cuts s at the given offsets.
+func split(s string, at ...int) []string {
+    var chunks []string
+    from := 0
+    for _, to := range at {
+        chunks = append(chunks, s[from:to])
+        from = to
+    }
+    return append(chunks, s[from:])
+}
+
+func TestStreamFraming(t *testing.T) {
+    tests := []struct {
+        name   string
+        chunks []string
+        seqs   []int
+    }{
+        {
+            name:   "whole message",
+            chunks: []string{options(1)},
+            seqs:   []int{1},
+        },
+        {
+            // Split in the start line, in the headers, between the headers
+            // and the body and in the body
+            name:   "partial reads",
+            chunks: split(options(1), 5, 120, strings.Index(options(1), "\n\n")+2, len(options(1))-3),
+            seqs:   []int{1},
+        },
+        {
+            name:   "pipelined",
+            chunks: []string{options(1) + options(2) + options(3)},
+            seqs:   []int{1, 2, 3},
+        },
+        {
+            name:   "keep-alives between messages",
+            chunks: []string{"\n\n", options(1) + "\n\n", "\n", options(2)},
+            seqs:   []int{1, 2},
+        },
+        {
+            name:   "second message split",
+            chunks: []string{options(1) + options(2)[:40], options(2)[40:]},
+            seqs:   []int{1, 2},
+        },
+    }
+
+    for _, transport := range []string{TransportTCP, TransportTLS} {
+        for _, tt := range tests {
+            t.Run(transport+"/"+tt.name, func(t *testing.T) {
+                _, peer := newStreamPeer(t, transport)
+                peer.write(tt.chunks...)
+                for _, seq := range tt.seqs {
+                    resp, ok := peer.read().(*message.Response)
+                    if !ok {
+                        t.Fatal("got a request, want a response")
+                    }
+                    if got, _, _ := resp.Header.CSeq(); resp.StatusCode != 200 || got != uint32(seq) {
+                        t.Errorf("got %d to CSeq %d, want 200 to %d", resp.StatusCode, got, seq)
+                    }
+                }
+            })
+        }
+    }
+}
+
+func TestStreamWithoutContentLength(t *testing.T) {
+    c, peer := newStreamPeer(t, TransportTCP)
+    peer.write(strings.Replace(options(1), "Content-Length: 6\n", "", 1))
+
+    // The stream cannot be framed any more, so the client drops the
+    // connection, to dial again on its next message
+    peer.conn.SetReadDeadline(time.Now().Add(time.Second))
+    if msg, err := message.ReadMessage(peer.reader); err == nil {
+        t.Fatalf("client answered with %q", msg.Bytes())
+    } else if ne, ok := err.(net.Error); ok && ne.Timeout() {
+        t.Fatal("connection still open")
+    }
+    sh := c.shards[0]
+    sh.connMu.Lock()
+    defer sh.connMu.Unlock()
+    if sh.conn != nil {
+        t.Error("connection kept by the shard")
+    }
+}
+
+func TestStreamReuse(t *testing.T) {
+    c, peer := newStreamPeer(t, TransportTCP)
+
+    // Requests of one shard share its connection, and their responses come
+    // back on it
+    for i := 0; i < 2; i++ {
+        done := ping(c)
+        req, ok := peer.read().(*message.Request)
+        if !ok || req.Method != "OPTIONS" {
+            t.Fatalf("got %v, want OPTIONS", req)
+        }
+        if via, _ := req.Header.Via(); via.Transport != TransportTCP {
+            t.Errorf("Via over %s, want TCP", via.Transport)
+        }
+        resp := message.NewResponse(req, 200, "OK")
+        go peer.conn.Write(resp.Bytes())
+        select {
+        case result := <-done:
+            if result.err != nil || result.response.StatusCode != 200 {
+                t.Fatalf("ping %d: got %v, %v; want 200", i, result.response, result.err)
+            }
+        case <-time.After(time.Second):
+            t.Fatalf("ping %d not answered", i)
+        }
+    }
+}
+
+func TestStreamReconnect(t *testing.T) {
+    listener, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer listener.Close()
+    addr := listener.Addr().(*net.TCPAddr)
+
+    c, peer := newStreamPeer(t, TransportTCP)
+    c.located = []Destination{{Transport: TransportTCP, IP: addr.IP, Port: addr.Port}}
+    sh := c.shards[0]
+
+    // S2 closes the connection; once the shard notices, the next request
+    // dials it again
+    peer.conn.Close()
+    deadline := time.Now().Add(time.Second)
+    for {
+        sh.connMu.Lock()
+        conn := sh.conn
+        sh.connMu.Unlock()
+        if conn == nil {
+            break
+        }
+        if time.Now().After(deadline) {
+            t.Fatal("closed connection kept by the shard")
+        }
+        time.Sleep(time.Millisecond)
+    }
+
+    done := ping(c)
+    listener.(*net.TCPListener).SetDeadline(time.Now().Add(time.Second))
+    conn, err := listener.Accept()
+    if err != nil {
+        t.Fatalf("client did not dial again: %v", err)
+    }
+    defer conn.Close()
+    redialed := &streamPeer{t: t, conn: conn, reader: bufio.NewReader(conn)}
+    req, ok := redialed.read().(*message.Request)
+    if !ok || req.Method != "OPTIONS" {
+        t.Fatalf("got %v, want OPTIONS", req)
+    }
+    conn.Write(message.NewResponse(req, 200, "OK").Bytes())
+    select {
+    case result := <-done:
+        if result.err != nil || result.response.StatusCode != 200 {
+            t.Errorf("got %v, %v; want 200", result.response, result.err)
+        }
+    case <-time.After(time.Second):
+        t.Error("ping not answered on the new connection")
+    }
+}
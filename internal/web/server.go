@@ -6,8 +6,10 @@ import (
     "html/template"
     "log"
     "net/http"
-    "time"
+    "path/filepath"
+    "strings"
     
+    "github.com/s1-callgen/internal/capture"
     "github.com/s1-callgen/internal/generator"
     "github.com/s1-callgen/internal/models"
 )
@@ -36,6 +38,9 @@ func (w *WebServer) Start() error {
     http.HandleFunc("/api/config", w.authMiddleware(w.handleConfig))
     http.HandleFunc("/api/numbers", w.authMiddleware(w.handleNumbers))
     http.HandleFunc("/api/control", w.authMiddleware(w.handleControl))
+    http.HandleFunc("/api/registration", w.authMiddleware(w.handleRegistration))
+    http.HandleFunc("/api/captures", w.authMiddleware(w.handleCaptures))
+    http.HandleFunc("/api/captures/", w.authMiddleware(w.handleCapture))
     http.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir("static"))))
     
     addr := fmt.Sprintf(":%d", w.config.WebInterface.Port)
@@ -59,7 +64,7 @@ func (w *WebServer) authMiddleware(handler http.HandlerFunc) http.HandlerFunc {
 
 func (w *WebServer) handleDashboard(rw http.ResponseWriter, r *http.Request) {
     // Serve the dashboard HTML
-    fmt.Fprintf(rw, dashboardHTML)
+    fmt.Fprint(rw, dashboardHTML)
 }
 
 func (w *WebServer) handleStats(rw http.ResponseWriter, r *http.Request) {
@@ -101,11 +106,15 @@ func (w *WebServer) handleNumbers(rw http.ResponseWriter, r *http.Request) {
         if err == nil {
             // Process CSV file
             defer file.Close()
-            // Implementation for CSV processing
+            err = w.generator.LoadNumbers(file)
         } else {
             // Process manual entry
             numbers := r.FormValue("numbers")
-            // Implementation for manual number processing
+            err = w.generator.LoadNumbers(strings.NewReader(numbers))
+        }
+        if err != nil {
+            http.Error(rw, err.Error(), http.StatusBadRequest)
+            return
         }
         
         rw.WriteHeader(http.StatusOK)
@@ -134,6 +143,42 @@ func (w *WebServer) handleControl(rw http.ResponseWriter, r *http.Request) {
     rw.WriteHeader(http.StatusOK)
 }
 
+// handleRegistration returns the state of the registration with S2, or null
+// when S1 does not register.
+func (w *WebServer) handleRegistration(rw http.ResponseWriter, r *http.Request) {
+    rw.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(rw).Encode(w.generator.RegistrationStatus())
+}
+
+// handleCaptures lists the finished call captures, newest first.
+func (w *WebServer) handleCaptures(rw http.ResponseWriter, r *http.Request) {
+    files := []capture.File{}
+    if capturer := w.generator.Captures(); capturer != nil {
+        files = capturer.Files()
+    }
+    
+    rw.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(rw).Encode(files)
+}
+
+// handleCapture downloads the capture of the call whose SIP Call-ID ends
+// the path.
+func (w *WebServer) handleCapture(rw http.ResponseWriter, r *http.Request) {
+    capturer := w.generator.Captures()
+    if capturer == nil {
+        http.Error(rw, "capture is disabled", http.StatusNotFound)
+        return
+    }
+    
+    path, ok := capturer.Find(strings.TrimPrefix(r.URL.Path, "/api/captures/"))
+    if !ok {
+        http.NotFound(rw, r)
+        return
+    }
+    rw.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filepath.Base(path)))
+    http.ServeFile(rw, r, path)
+}
+
 const dashboardHTML = `
 <!DOCTYPE html>
 <html>
@@ -157,6 +202,8 @@ const dashboardHTML = `
         .status.active { background: #4CAF50; color: white; }
         .status.inactive { background: #f44336; color: white; }
         #realtimeChart { width: 100%; height: 300px; }
+        table { width: 100%; border-collapse: collapse; }
+        th, td { text-align: left; padding: 6px 10px; border-bottom: 1px solid #eee; }
     </style>
     <script src="https://cdn.jsdelivr.net/npm/chart.js"></script>
 </head>
@@ -172,6 +219,7 @@ const dashboardHTML = `
                 <button class="btn-success" onclick="toggleAutopilot()">Toggle Autopilot</button>
                 <span class="status" id="status">Inactive</span>
                 <span class="status" id="autopilot-status">Autopilot: OFF</span>
+                <span class="status" id="registration-status" style="display: none"></span>
            </div>
        </div>
        
@@ -198,9 +246,34 @@ const dashboardHTML = `
                    <div class="stat-value" id="avg-duration">0s</div>
                    <div class="stat-label">Avg Duration</div>
                </div>
+               <div class="stat-box">
+                   <div class="stat-value" id="mos">-</div>
+                   <div class="stat-label">MOS</div>
+               </div>
+               <div class="stat-box">
+                   <div class="stat-value" id="packet-loss">-</div>
+                   <div class="stat-label">Packet Loss</div>
+               </div>
+               <div class="stat-box">
+                   <div class="stat-value" id="jitter">-</div>
+                   <div class="stat-label">Jitter</div>
+               </div>
            </div>
        </div>
        
+       <div class="card">
+           <h2>S2 Targets</h2>
+           <table>
+               <thead>
+                   <tr>
+                       <th>Target</th><th>Priority</th><th>Weight</th><th>Health</th><th>Active</th>
+                       <th>Total</th><th>Success</th><th>Failed</th><th>Failovers</th><th>Ping RTT</th>
+                   </tr>
+               </thead>
+               <tbody id="targets"></tbody>
+           </table>
+       </div>
+       
        <div class="card">
            <h2>Call Traffic Pattern</h2>
            <canvas id="realtimeChart"></canvas>
@@ -216,6 +289,11 @@ const dashboardHTML = `
            <textarea id="manual-numbers" rows="5" cols="50" placeholder="ANI,DNIS,Country,Carrier"></textarea>
            <button onclick="uploadManual()" class="btn-primary">Add Numbers</button>
        </div>
+       
+       <div class="card">
+           <h2>Call Captures</h2>
+           <ul id="captures"></ul>
+       </div>
    </div>
    
    <script>
@@ -273,6 +351,13 @@ const dashboardHTML = `
                document.getElementById('success-rate').textContent = data.current_asr.toFixed(1) + '%';
                document.getElementById('cps').textContent = data.current_cps.toFixed(2);
                document.getElementById('avg-duration').textContent = data.average_call_duration.toFixed(1) + 's';
+               if (data.media.calls > 0) {
+                   document.getElementById('mos').textContent = data.media.mos.toFixed(2);
+                   document.getElementById('packet-loss').textContent = data.media.packet_loss.toFixed(2) + '%';
+                   document.getElementById('jitter').textContent = data.media.jitter.toFixed(1) + 'ms';
+               }
+               
+               updateTargets(data.targets || []);
                
                // Update chart
                const now = new Date().toLocaleTimeString();
@@ -291,6 +376,66 @@ const dashboardHTML = `
            });
        }
        
+       function updateTargets(targets) {
+           const rows = document.getElementById('targets');
+           rows.replaceChildren();
+           targets.forEach(t => {
+               const health = document.createElement('span');
+               health.className = 'status ' + (t.healthy ? 'active' : 'inactive');
+               health.textContent = t.healthy ? 'Up' : 'Down';
+               const rtt = t.last_ping && !t.last_ping.startsWith('0001') ? t.ping_rtt.toFixed(1) + 'ms' : '-';
+               const row = document.createElement('tr');
+               [t.name, t.priority, t.weight, health, t.active_calls, t.total_calls,
+                t.successful_calls, t.failed_calls, t.failovers, rtt].forEach(value => {
+                   const cell = document.createElement('td');
+                   cell.append(value);
+                   row.appendChild(cell);
+               });
+               rows.appendChild(row);
+           });
+       }
+       
+       function updateRegistration() {
+           fetch('/api/registration', {
+               headers: {
+                   'Authorization': 'Basic ' + btoa('admin:admin')
+               }
+           })
+           .then(response => response.json())
+           .then(status => {
+               const badge = document.getElementById('registration-status');
+               if (!status) {
+                   badge.style.display = 'none';
+                   return;
+               }
+               badge.style.display = '';
+               badge.className = 'status ' + (status.state === 'REGISTERED' ? 'active' : 'inactive');
+               badge.textContent = 'Registration: ' + status.state + (status.registrar ? ' with ' + status.registrar : '');
+               badge.title = status.last_error || '';
+           });
+       }
+       
+       function updateCaptures() {
+           fetch('/api/captures', {
+               headers: {
+                   'Authorization': 'Basic ' + btoa('admin:admin')
+               }
+           })
+           .then(response => response.json())
+           .then(files => {
+               const list = document.getElementById('captures');
+               list.replaceChildren();
+               files.slice(0, 20).forEach(f => {
+                   const link = document.createElement('a');
+                   link.href = '/api/captures/' + encodeURIComponent(f.call_id);
+                   link.textContent = f.call_id;
+                   const item = document.createElement('li');
+                   item.append(link, ' (' + (f.size / 1024).toFixed(1) + ' KB, ' + new Date(f.mod_time).toLocaleTimeString() + ')');
+                   list.appendChild(item);
+               });
+           });
+       }
+       
        function startGenerator() {
            fetch('/api/control', {
                method: 'POST',
@@ -347,6 +492,10 @@ const dashboardHTML = `
        // Initialize
        initChart();
        setInterval(updateStats, 2000);
+       updateRegistration();
+       setInterval(updateRegistration, 5000);
+       updateCaptures();
+       setInterval(updateCaptures, 10000);
        
        // Handle file upload
        document.getElementById('upload-form').addEventListener('submit', function(e) {